@@ -35,7 +35,9 @@ import (
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	validation "k8s.io/apimachinery/pkg/util/validation"
@@ -45,6 +47,7 @@ import (
 	listersv1 "k8s.io/client-go/listers/core/v1"
 	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/workqueue"
 	utilflag "k8s.io/component-base/cli/flag"
@@ -58,11 +61,13 @@ import (
 
 	"github.com/kubernetes-csi/csi-lib-utils/leaderelection"
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"github.com/kubernetes-csi/external-provisioner/pkg/audit"
 	"github.com/kubernetes-csi/external-provisioner/pkg/capacity"
 	"github.com/kubernetes-csi/external-provisioner/pkg/capacity/topology"
 	ctrl "github.com/kubernetes-csi/external-provisioner/pkg/controller"
 	"github.com/kubernetes-csi/external-provisioner/pkg/features"
 	"github.com/kubernetes-csi/external-provisioner/pkg/owner"
+	"github.com/kubernetes-csi/external-provisioner/pkg/tracing"
 	snapclientset "github.com/kubernetes-csi/external-snapshotter/client/v6/clientset/versioned"
 	gatewayclientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
 	gatewayInformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
@@ -75,6 +80,8 @@ var (
 	csiEndpoint          = flag.String("csi-address", "/run/csi/socket", "The gRPC endpoint for Target CSI Volume.")
 	volumeNamePrefix     = flag.String("volume-name-prefix", "pvc", "Prefix to apply to the name of a created volume.")
 	volumeNameUUIDLength = flag.Int("volume-name-uuid-length", -1, "Truncates generated UUID of a created volume to this length. Defaults behavior is to NOT truncate.")
+	volumeNameTemplate   = flag.String("volume-name-template", "", "Template for the name of a created volume in CreateVolume, for example ${pvc.namespace}-${pvc.name}-${pvc.uidhash}. The PV name is not affected. Can be overridden by the csi.storage.k8s.io/volume-name-template storage class parameter. Default is to use the PV name.")
+	volumeNameMaxLength  = flag.Int("volume-name-max-length", 128, "Maximum length of volume names generated from --volume-name-template. Longer names get truncated and a hash of the full name gets appended. 0 disables truncation.")
 	showVersion          = flag.Bool("version", false, "Show version.")
 	retryIntervalStart   = flag.Duration("retry-interval-start", time.Second, "Initial retry interval of failed provisioning or deletion. It doubles with each failure, up to retry-interval-max.")
 	retryIntervalMax     = flag.Duration("retry-interval-max", 5*time.Minute, "Maximum retry interval of failed provisioning or deletion.")
@@ -88,7 +95,10 @@ var (
 	leaderElectionNamespace = flag.String("leader-election-namespace", "", "Namespace where the leader election resource lives. Defaults to the pod namespace if not set.")
 	strictTopology          = flag.Bool("strict-topology", false, "Late binding: pass only selected node topology to CreateVolume Request, unlike default behavior of passing aggregated cluster topologies that match with topology keys of the selected node.")
 	immediateTopology       = flag.Bool("immediate-topology", true, "Immediate binding: pass aggregated cluster topologies for all nodes where the CSI driver is available (enabled, the default) or no topology requirements (if disabled).")
+	topologySpreadKey       = flag.String("topology-spread-key", "", "Immediate binding: prefer the topology segment with the fewest existing volumes of PVCs in the same group. Groups are defined by \"label:<key>\", \"annotation:<key>\" or \"statefulset\" for the owning StatefulSet. Disabled if empty.")
 	extraCreateMetadata     = flag.Bool("extra-create-metadata", false, "If set, add pv/pvc metadata to plugin create requests as parameters.")
+	pvcLabelAllowlist       = flag.String("pvc-label-allowlist", "", "Comma-separated list of PVC label keys which get added to plugin create requests as csi.storage.k8s.io/pvc/label/<key> parameters. A key ending in * matches all keys with that prefix. Can be overridden by the csi.storage.k8s.io/pvc-label-allowlist storage class parameter.")
+	pvcAnnotationAllowlist  = flag.String("pvc-annotation-allowlist", "", "Comma-separated list of PVC annotation keys which get added to plugin create requests as csi.storage.k8s.io/pvc/annotation/<key> parameters. A key ending in * matches all keys with that prefix. Can be overridden by the csi.storage.k8s.io/pvc-annotation-allowlist storage class parameter.")
 	metricsAddress          = flag.String("metrics-address", "", "(deprecated) The TCP network address where the prometheus metrics endpoint will listen (example: `:8080`). The default is empty string, which means metrics endpoint is disabled. Only one of `--metrics-address` and `--http-endpoint` can be set.")
 	httpEndpoint            = flag.String("http-endpoint", "", "The TCP network address where the HTTP server for diagnostics, including pprof, metrics and leader election health check, will listen (example: `:8080`). The default is empty string, which means the server is disabled. Only one of `--metrics-address` and `--http-endpoint` can be set.")
 	metricsPath             = flag.String("metrics-path", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
@@ -109,6 +119,8 @@ var (
 	enableCapacity           = flag.Bool("enable-capacity", false, "This enables producing CSIStorageCapacity objects with capacity information from the driver's GetCapacity call.")
 	capacityImmediateBinding = flag.Bool("capacity-for-immediate-binding", false, "Enables producing capacity information for storage classes with immediate binding. Not needed for the Kubernetes scheduler, maybe useful for other consumers or for debugging.")
 	capacityPollInterval     = flag.Duration("capacity-poll-interval", time.Minute, "How long the external-provisioner waits before checking for storage capacity changes.")
+	capacityRankedTopology   = flag.Bool("capacity-ranked-topology", false, "Immediate binding: order the preferred topology segments by the capacity published in CSIStorageCapacity objects for the storage class, with the StatefulSet spreading as tie-breaker. Requires --enable-capacity and --capacity-for-immediate-binding.")
+	capacityRankingTolerance = flag.Int("capacity-ranking-tolerance", 10, "Percentage of the largest capacity by which the capacities of topology segments may differ and still rank the same with --capacity-ranked-topology, so that the StatefulSet spreading decides between them. 0 ranks by exact capacity.")
 	capacityOwnerrefLevel    = flag.Int("capacity-ownerref-level", 1, "The level indicates the number of objects that need to be traversed starting from the pod identified by the POD_NAME and NAMESPACE environment variables to reach the owning object for CSIStorageCapacity objects: -1 for no owner, 0 for the pod itself, 1 for a StatefulSet or DaemonSet, 2 for a Deployment, etc.")
 
 	enableNodeDeployment           = flag.Bool("node-deployment", false, "Enables deploying the external-provisioner together with a CSI driver on nodes to manage node-local volumes.")
@@ -119,6 +131,54 @@ var (
 
 	preventVolumeModeConversion = flag.Bool("prevent-volume-mode-conversion", false, "Prevents an unauthorised user from modifying the volume mode when creating a PVC from an existing VolumeSnapshot.")
 
+	enableOrphanedVolumeDetection     = flag.Bool("enable-orphaned-volume-detection", false, "Periodically compares the volumes reported by the driver's ListVolumes call with the PersistentVolumes of the driver and reports volumes without a PersistentVolume. Requires the LIST_VOLUMES controller capability.")
+	orphanedVolumeCheckInterval       = flag.Duration("orphaned-volume-check-interval", time.Hour, "How long the external-provisioner waits between checks for orphaned volumes.")
+	orphanedVolumeDeletionGracePeriod = flag.Duration("orphaned-volume-deletion-grace-period", 0, "Orphaned volumes which are recorded in --orphaned-volume-configmap get deleted once they have been orphaned for longer than this. The default of zero only reports orphaned volumes without deleting them.")
+	orphanedVolumeConfigMap           = flag.String("orphaned-volume-configmap", "", "<namespace>/<name> of a ConfigMap in which volumes get recorded that were created by the external-provisioner but could not be deleted again after provisioning failed. Only those orphaned volumes get deleted after --orphaned-volume-deletion-grace-period.")
+
+	enablePodPriority   = flag.Bool("enable-pod-priority", false, "Provisions volumes for PVCs of pods with a higher priority first. Requires watching all pods.")
+	podPriorityMaxDelay = flag.Duration("pod-priority-max-delay", 5*time.Minute, "How long provisioning of a PVC gets deferred at most in favor of PVCs of pods with a higher priority.")
+
+	enableFairQueuing = flag.Bool("enable-fair-queuing", false, "Shares the worker threads between namespaces which have PVCs waiting for provisioning or PVs waiting for deletion.")
+	namespaceWeights  = flag.String("namespace-weights", "", "Comma-separated list of <namespace>=<weight> pairs for --enable-fair-queuing. Namespaces get a share of the worker threads that is proportional to their weight. The default weight is 1.")
+
+	tracingExporter      = flag.String("tracing-exporter", "", "Exports OpenTelemetry traces of provisioning, deletion and capacity operations. Must be \"otlp\" for an OTLP collector or \"stdout\" for JSON output. Tracing is disabled if empty.")
+	tracingEndpoint      = flag.String("tracing-endpoint", "", "host:port of the OTLP collector for --tracing-exporter=otlp. The default is taken from the OTEL_EXPORTER_OTLP_ENDPOINT env variable or is localhost:4317.")
+	tracingFile          = flag.String("tracing-file", "", "File that --tracing-exporter=stdout appends to instead of stdout.")
+	tracingSamplingRatio = flag.Float64("tracing-sampling-ratio", 1.0, "Fraction of the provisioning, deletion and capacity operations which get traced, between 0 and 1.")
+
+	enableSecretCache     = flag.Bool("enable-secret-cache", false, "Watches the provisioner secrets that are referenced by storage classes of the driver and by PVs instead of reading them from the API server for each provisioning and deletion. Requires list and watch permissions for secrets in the namespaces of these secrets.")
+	secretCacheMaxWatches = flag.Int("secret-cache-max-watches", 100, "Maximum number of secrets and namespaces that --enable-secret-cache watches. Each one needs a separate watch. The secrets which are referenced the least are read from the API server once the limit is reached.")
+
+	credentialDir           = flag.String("credential-dir", "", "Directory with credentials for storage classes with csi.storage.k8s.io/provisioner-secret-provider: file. The credentials for a secret reference are read from <dir>/<namespace>/<name>, one file per key.")
+	credentialBrokerURL     = flag.String("credential-broker-url", "", "URL of a credential broker for storage classes with csi.storage.k8s.io/provisioner-secret-provider: http. The namespace and name of the secret reference are passed as query parameters.")
+	credentialBrokerTimeout = flag.Duration("credential-broker-timeout", 10*time.Second, "Timeout for requests to --credential-broker-url.")
+
+	hostAssistedCloneImage          = flag.String("host-assisted-clone-image", "", "Container image with sh, cp and dd. If set, PVC data sources which the driver cannot clone get copied into a new, empty volume by a Job with this image.")
+	hostAssistedCloneCrossNamespace = flag.Bool("host-assisted-clone-cross-namespace", false, "Allows --host-assisted-clone-image to copy PVC data sources from other namespaces than the new PVC. The copy Job then runs in the namespace of the source PVC.")
+
+	cloneTimeout       = flag.Duration("clone-timeout", 0, "Time after which a PVC that clones another PVC and is still pending counts as stuck. Stuck clones get reported with events on both PVCs. Zero disables the detection.")
+	cloneTimeoutPolicy = flag.String("clone-timeout-policy", "wait", "What to do with the cloning protection finalizer of a PVC which is being deleted when all of its clones are stuck: 'wait' keeps it until the clones are bound or the PVC gets annotated with provisioner.storage.kubernetes.io/release-cloning-protection=true, 'release' removes it.")
+
+	trashConfigMap = flag.String("trash-configmap", "", "<namespace>/<name> of a ConfigMap in which deleted volumes of storage classes with the csi.storage.k8s.io/trash-retention parameter are kept until their retention expires. The trash is disabled if empty.")
+	trashInterval  = flag.Duration("trash-interval", time.Minute, "How often the trash gets checked for volumes whose retention has expired.")
+
+	deletionCircuitBreakerMaxDeletes  = flag.Int("deletion-circuit-breaker-max-deletes", 0, "Pauses all deletions of volumes when more volumes would get deleted within --deletion-circuit-breaker-window. Zero disables the limit.")
+	deletionCircuitBreakerMaxCapacity = flag.String("deletion-circuit-breaker-max-capacity", "", "Pauses all deletions of volumes when more capacity, for example 10Ti, would get deleted within --deletion-circuit-breaker-window. Empty disables the limit.")
+	deletionCircuitBreakerWindow      = flag.Duration("deletion-circuit-breaker-window", time.Hour, "Sliding window for --deletion-circuit-breaker-max-deletes and --deletion-circuit-breaker-max-capacity.")
+
+	auditLogPath        = flag.String("audit-log-path", "", "File to which CreateVolume and DeleteVolume calls get recorded as JSON lines. The file gets rotated when it reaches --audit-log-max-size.")
+	auditLogMaxSize     = flag.Int64("audit-log-max-size", 100, "Maximum size in megabytes of --audit-log-path before it gets rotated. Zero disables rotation.")
+	auditLogMaxBackups  = flag.Int("audit-log-max-backups", 5, "Number of rotated --audit-log-path files to keep.")
+	auditWebhookURL     = flag.String("audit-webhook-url", "", "URL to which each record of a CreateVolume and DeleteVolume call gets posted as JSON.")
+	auditWebhookTimeout = flag.Duration("audit-webhook-timeout", 5*time.Second, "Timeout for posting a record to --audit-webhook-url.")
+	auditLogLevel       = flag.String("audit-log-level", audit.LevelMetadata, "Amount of detail in audit records. Must be \"metadata\" or \"request\", which additionally records parameters, secret keys and topology.")
+
+	quotaConfigMap = flag.String("quota-configmap", "", "<namespace>/<name> of a ConfigMap with quota policies for storage classes. Quotas are not enforced if empty.")
+
+	volumeHandleClusterID = flag.String("volume-handle-cluster-id", "", "If set, the ID gets embedded in the volume handles of new PVs and volumes whose handle contains some other cluster ID do not get deleted. Must be a DNS label. Intended for clusters which share a storage backend.")
+	provisionerIdentity   = flag.String("provisioner-identity", "", "Stable identity of the provisioner which gets stored in the volume attributes of new PVs. Default is an identity generated from the start time.")
+
 	featureGates        map[string]bool
 	provisionController *controller.ProvisionController
 	version             = "unknown"
@@ -136,6 +196,11 @@ func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	explainNamespace, explainName, err := parseExplainArgs(flag.Args())
+	if err != nil {
+		klog.Fatal(err)
+	}
+
 	ctx := context.Background()
 
 	if err := utilfeature.DefaultMutableFeatureGate.SetFromMap(featureGates); err != nil {
@@ -153,6 +218,90 @@ func main() {
 	}
 	klog.Infof("Version: %s", version)
 
+	if err := ctrl.ValidateVolumeNameTemplate(*volumeNameTemplate); err != nil {
+		klog.Fatalf("Invalid --volume-name-template: %v", err)
+	}
+	if err := ctrl.ValidateClusterID(*volumeHandleClusterID); err != nil {
+		klog.Fatalf("Invalid --volume-handle-cluster-id: %v", err)
+	}
+	var quotaNamespace, quotaName string
+	if *quotaConfigMap != "" {
+		parts := strings.Split(*quotaConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			klog.Fatalf("Invalid --quota-configmap: expected <namespace>/<name>, got %q", *quotaConfigMap)
+		}
+		quotaNamespace, quotaName = parts[0], parts[1]
+	}
+	var trashNamespace, trashName string
+	if *trashConfigMap != "" {
+		parts := strings.Split(*trashConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			klog.Fatalf("Invalid --trash-configmap: expected <namespace>/<name>, got %q", *trashConfigMap)
+		}
+		if *enableNodeDeployment {
+			klog.Fatal("--trash-configmap is not supported together with --node-deployment")
+		}
+		trashNamespace, trashName = parts[0], parts[1]
+	}
+	var orphanRecordNamespace, orphanRecordName string
+	if *orphanedVolumeConfigMap != "" {
+		parts := strings.Split(*orphanedVolumeConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			klog.Fatalf("Invalid --orphaned-volume-configmap: expected <namespace>/<name>, got %q", *orphanedVolumeConfigMap)
+		}
+		orphanRecordNamespace, orphanRecordName = parts[0], parts[1]
+	}
+	var deletionCircuitBreakerMaxBytes int64
+	if *deletionCircuitBreakerMaxCapacity != "" {
+		quantity, err := resource.ParseQuantity(*deletionCircuitBreakerMaxCapacity)
+		if err != nil || quantity.Sign() <= 0 {
+			klog.Fatalf("Invalid --deletion-circuit-breaker-max-capacity: expected a positive quantity, got %q", *deletionCircuitBreakerMaxCapacity)
+		}
+		deletionCircuitBreakerMaxBytes = quantity.Value()
+	}
+	if *cloneTimeoutPolicy != "wait" && *cloneTimeoutPolicy != "release" {
+		klog.Fatalf("Invalid --clone-timeout-policy: expected 'wait' or 'release', got %q", *cloneTimeoutPolicy)
+	}
+	if *tracingExporter != "" {
+		if *tracingSamplingRatio < 0 || *tracingSamplingRatio > 1 {
+			klog.Fatalf("Invalid --tracing-sampling-ratio: must be between 0 and 1, got %v", *tracingSamplingRatio)
+		}
+		shutdownTracing, err := tracing.Setup(ctx, tracing.Options{
+			Exporter:      *tracingExporter,
+			Endpoint:      *tracingEndpoint,
+			File:          *tracingFile,
+			SamplingRatio: *tracingSamplingRatio,
+			ServiceName:   "csi-provisioner",
+		})
+		if err != nil {
+			klog.Fatalf("Failed to set up tracing: %v", err)
+		}
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				klog.Warningf("Failed to flush traces: %v", err)
+			}
+		}()
+	}
+	var auditLogger *audit.Logger
+	if *auditLogPath != "" || *auditWebhookURL != "" {
+		var sinks []audit.Sink
+		if *auditLogPath != "" {
+			sink, err := audit.NewFileSink(*auditLogPath, *auditLogMaxSize*1024*1024, *auditLogMaxBackups)
+			if err != nil {
+				klog.Fatalf("Failed to open --audit-log-path: %v", err)
+			}
+			sinks = append(sinks, sink)
+		}
+		if *auditWebhookURL != "" {
+			sinks = append(sinks, audit.NewHTTPSink(*auditWebhookURL, *auditWebhookTimeout))
+		}
+		auditLogger, err = audit.NewLogger(*auditLogLevel, sinks...)
+		if err != nil {
+			klog.Fatalf("Invalid --audit-log-level: %v", err)
+		}
+		defer auditLogger.Close()
+	}
+
 	if *metricsAddress != "" && *httpEndpoint != "" {
 		klog.Error("only one of `--metrics-address` and `--http-endpoint` can be set.")
 		os.Exit(1)
@@ -277,6 +426,10 @@ func main() {
 	if err != nil {
 		klog.Fatalf("Error getting CSI driver capabilities: %s", err)
 	}
+	groupControllerCapabilities, err := ctrl.GetGroupControllerCapabilities(grpcClient, *operationTimeout, pluginCapabilities)
+	if err != nil {
+		klog.Fatalf("Error getting CSI driver group controller capabilities: %s", err)
+	}
 
 	// Generate a unique ID for this provisioner
 	timeStamp := time.Now().UnixNano() / int64(time.Millisecond)
@@ -284,6 +437,14 @@ func main() {
 	if *enableNodeDeployment {
 		identity = identity + "-" + node
 	}
+	// The leader election identity must remain unique for each instance.
+	leaderElectionIdentity := identity
+	if *provisionerIdentity != "" {
+		identity = *provisionerIdentity
+		if *enableNodeDeployment {
+			identity = identity + "-" + node
+		}
+	}
 
 	factory := informers.NewSharedInformerFactory(clientset, ctrl.ResyncPeriodOfCsiNodeInformer)
 	var factoryForNamespace informers.SharedInformerFactory // usually nil, only used for CSIStorageCapacity
@@ -293,15 +454,137 @@ func main() {
 	// Create informer to prevent hit the API server for all resource request
 	scLister := factory.Storage().V1().StorageClasses().Lister()
 	claimLister := factory.Core().V1().PersistentVolumeClaims().Lister()
+	// The PV informer is shared with the provision controller.
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	pvLister := pvInformer.Lister()
+	if err := pvInformer.Informer().AddIndexers(cache.Indexers{ctrl.PVVolumeNameIndex: ctrl.PVVolumeNameIndexFunc(provisionerName)}); err != nil {
+		klog.Fatalf("Failed to add PersistentVolume index: %v", err)
+	}
+	// The provision controller gets the PVC and PV informers through
+	// wrappers, which allow putting skipped PVCs and PVs into its work
+	// queues again.
+	claimRequeueInformer := ctrl.NewRequeueInformer(factory.Core().V1().PersistentVolumeClaims().Informer())
+	pvRequeueInformer := ctrl.NewRequeueInformer(pvInformer.Informer())
 
-	var vaLister storagelistersv1.VolumeAttachmentLister
+	var vaIndexer cache.Indexer
 	if controllerCapabilities[csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME] {
 		klog.Info("CSI driver supports PUBLISH_UNPUBLISH_VOLUME, watching VolumeAttachments")
-		vaLister = factory.Storage().V1().VolumeAttachments().Lister()
+		vaInformer := factory.Storage().V1().VolumeAttachments().Informer()
+		if err := vaInformer.SetTransform(ctrl.VolumeAttachmentTransform(provisionerName)); err != nil {
+			klog.Fatalf("Failed to set VolumeAttachment transform: %v", err)
+		}
+		if err := vaInformer.AddIndexers(cache.Indexers{ctrl.VolumeAttachmentPVIndex: ctrl.VolumeAttachmentPVIndexFunc(provisionerName)}); err != nil {
+			klog.Fatalf("Failed to add VolumeAttachment index: %v", err)
+		}
+		vaIndexer = vaInformer.GetIndexer()
 	} else {
 		klog.Info("CSI driver does not support PUBLISH_UNPUBLISH_VOLUME, not watching VolumeAttachments")
 	}
 
+	// The quota ConfigMap gets watched with its own informer because
+	// only that single object is needed.
+	var quotaFactory informers.SharedInformerFactory
+	var quotaChecker *ctrl.QuotaChecker
+	if quotaName != "" {
+		quotaFactory = informers.NewSharedInformerFactoryWithOptions(clientset,
+			ctrl.ResyncPeriodOfCsiNodeInformer,
+			informers.WithNamespace(quotaNamespace),
+			informers.WithTweakListOptions(func(lo *metav1.ListOptions) {
+				lo.FieldSelector = fields.OneTermEqualSelector("metadata.name", quotaName).String()
+			}),
+		)
+		quotaChecker = ctrl.NewQuotaChecker(quotaFactory.Core().V1().ConfigMaps().Lister(), quotaNamespace, quotaName, pvInformer)
+	}
+
+	// The capacity controller gets created after the provisioner, so
+	// ranking by capacity uses its own informer for the CSIStorageCapacity
+	// objects of the driver. Those may get published by several instances
+	// in distributed provisioning, so only the driver name gets checked.
+	var capacityRankingFactory informers.SharedInformerFactory
+	var capacityRanking *ctrl.CapacityRanking
+	if *capacityRankedTopology {
+		if !*enableCapacity || !*capacityImmediateBinding {
+			klog.Fatal("--capacity-ranked-topology requires --enable-capacity and --capacity-for-immediate-binding")
+		}
+		namespace := os.Getenv("NAMESPACE")
+		if namespace == "" {
+			klog.Fatal("need NAMESPACE env variable for CSIStorageCapacity objects")
+		}
+		capacityRankingFactory = informers.NewSharedInformerFactoryWithOptions(clientset,
+			ctrl.ResyncPeriodOfCsiNodeInformer,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(lo *metav1.ListOptions) {
+				lo.LabelSelector = labels.Set{capacity.DriverNameLabel: provisionerName}.AsSelector().String()
+			}),
+		)
+		capacityRanking = ctrl.NewCapacityRanking(capacityRankingFactory.Storage().V1().CSIStorageCapacities().Lister(), *capacityRankingTolerance)
+	}
+
+	var topologySpreading *ctrl.TopologySpreading
+	if *topologySpreadKey != "" {
+		topologySpreading, err = ctrl.NewTopologySpreading(provisionerName, *topologySpreadKey, claimLister, pvLister)
+		if err != nil {
+			klog.Fatalf("Invalid --topology-spread-key: %v", err)
+		}
+	}
+
+	var provisioningPriority *ctrl.ProvisioningPriority
+	if *enablePodPriority {
+		podInformer := factory.Core().V1().Pods().Informer()
+		if err := podInformer.AddIndexers(cache.Indexers{ctrl.PodClaimIndex: ctrl.PodClaimIndexFunc}); err != nil {
+			klog.Fatalf("Failed to add pod index: %v", err)
+		}
+		provisioningPriority = ctrl.NewProvisioningPriority(provisionerName, claimRequeueInformer, scLister, podInformer, *podPriorityMaxDelay)
+	}
+
+	var namespaceFairness *ctrl.NamespaceFairness
+	if *enableFairQueuing {
+		weights, err := ctrl.ParseNamespaceWeights(*namespaceWeights)
+		if err != nil {
+			klog.Fatalf("Invalid --namespace-weights: %v", err)
+		}
+		namespaceFairness = ctrl.NewNamespaceFairness(provisionerName, claimRequeueInformer, pvRequeueInformer, scLister, int(*workerThreads), weights)
+	}
+
+	var secretCache *ctrl.SecretCache
+	if *enableSecretCache {
+		secretCache = ctrl.NewSecretCache(clientset, provisionerName, factory.Storage().V1().StorageClasses(), pvInformer, ctrl.ResyncPeriodOfCsiNodeInformer, *secretCacheMaxWatches)
+	}
+
+	credentialProviders := map[string]ctrl.CredentialProvider{}
+	if *credentialDir != "" {
+		credentialProviders[ctrl.CredentialProviderFile] = ctrl.NewFileCredentialProvider(*credentialDir)
+	}
+	if *credentialBrokerURL != "" {
+		credentialProviders[ctrl.CredentialProviderHTTP] = ctrl.NewHTTPCredentialProvider(*credentialBrokerURL, *credentialBrokerTimeout)
+	}
+
+	var hostAssistedClone *ctrl.HostAssistedClone
+	if *hostAssistedCloneImage != "" {
+		hostAssistedClone = &ctrl.HostAssistedClone{Image: *hostAssistedCloneImage, AllowCrossNamespace: *hostAssistedCloneCrossNamespace}
+	}
+
+	var trash *ctrl.Trash
+	if trashName != "" {
+		trash = ctrl.NewTrash(clientset, trashNamespace, trashName, pvInformer, *trashInterval)
+	}
+
+	var deletionCircuitBreaker *ctrl.DeletionCircuitBreaker
+	if *deletionCircuitBreakerMaxDeletes > 0 || deletionCircuitBreakerMaxBytes > 0 {
+		deletionCircuitBreaker = ctrl.NewDeletionCircuitBreaker(clientset, provisionerName,
+			*deletionCircuitBreakerMaxDeletes, deletionCircuitBreakerMaxBytes, *deletionCircuitBreakerWindow)
+	}
+
+	var orphanRecord *ctrl.OrphanRecord
+	if orphanRecordName != "" {
+		orphanRecord = ctrl.NewOrphanRecord(clientset, orphanRecordNamespace, orphanRecordName)
+	}
+
+	var cloneTimeoutConfig *ctrl.CloneTimeout
+	if *cloneTimeout > 0 {
+		cloneTimeoutConfig = &ctrl.CloneTimeout{Timeout: *cloneTimeout, Release: *cloneTimeoutPolicy == "release", Attempts: ctrl.NewCloneAttempts()}
+	}
+
 	var nodeDeployment *ctrl.NodeDeployment
 	if *enableNodeDeployment {
 		nodeDeployment = &ctrl.NodeDeployment{
@@ -379,6 +662,9 @@ func main() {
 	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax)
 	claimQueue := workqueue.NewNamedRateLimitingQueue(rateLimiter, "claims")
 	claimInformer := factory.Core().V1().PersistentVolumeClaims().Informer()
+	if err := claimInformer.AddIndexers(cache.Indexers{ctrl.ClaimDataSourceIndex: ctrl.ClaimDataSourceIndexFunc}); err != nil {
+		klog.Fatalf("Failed to add claim data source index: %v", err)
+	}
 
 	// Setup options
 	provisionerOptions := []func(*controller.ProvisionController) error{
@@ -388,7 +674,8 @@ func main() {
 		controller.RateLimiter(rateLimiter),
 		controller.Threadiness(int(*workerThreads)),
 		controller.CreateProvisionedPVLimiter(workqueue.DefaultControllerRateLimiter()),
-		controller.ClaimsInformer(claimInformer),
+		controller.ClaimsInformer(claimRequeueInformer),
+		controller.VolumesInformer(pvRequeueInformer),
 		controller.NodesLister(nodeLister),
 	}
 
@@ -400,6 +687,57 @@ func main() {
 		provisionerOptions = append(provisionerOptions, controller.AdditionalProvisionerNames([]string{supportsMigrationFromInTreePluginName}))
 	}
 
+	var orphanedVolumeController *ctrl.OrphanedVolumeController
+	if *enableOrphanedVolumeDetection {
+		orphanedVolumeController = ctrl.NewOrphanedVolumeController(
+			csi.NewControllerClient(grpcClient),
+			provisionerName,
+			pvInformer,
+			translator,
+			controllerCapabilities,
+			*orphanedVolumeCheckInterval,
+			*orphanedVolumeDeletionGracePeriod,
+			*operationTimeout,
+			auditLogger,
+			trash,
+			orphanRecord,
+			deletionCircuitBreaker,
+		)
+		if orphanedVolumeController == nil {
+			klog.Warning("CSI driver does not support LIST_VOLUMES, orphaned volume detection is disabled")
+		} else {
+			legacyregistry.CustomMustRegister(orphanedVolumeController)
+		}
+	}
+
+	csiProvisionerOptions := []ctrl.ProvisionerOption{
+		ctrl.WithVolumeHandleClusterID(*volumeHandleClusterID),
+		ctrl.WithVolumeNameTemplate(*volumeNameTemplate, *volumeNameMaxLength),
+		ctrl.WithGroupControllerCapabilities(groupControllerCapabilities),
+		ctrl.WithPVLister(pvLister),
+		ctrl.WithPVIndexer(pvInformer.Informer().GetIndexer()),
+		ctrl.WithPVCMetadataAllowlist(&ctrl.PVCMetadataAllowlist{
+			Labels:      ctrl.ParseAllowlist(*pvcLabelAllowlist),
+			Annotations: ctrl.ParseAllowlist(*pvcAnnotationAllowlist),
+		}),
+		ctrl.WithQuotaChecker(quotaChecker),
+		ctrl.WithProvisioningPriority(provisioningPriority),
+		ctrl.WithNamespaceFairness(namespaceFairness),
+		ctrl.WithAuditLogger(auditLogger),
+		ctrl.WithSecretCache(secretCache),
+		ctrl.WithCredentialProviders(credentialProviders),
+		ctrl.WithHostAssistedClone(hostAssistedClone),
+		ctrl.WithTrash(trash),
+		ctrl.WithDeletionCircuitBreaker(deletionCircuitBreaker),
+		ctrl.WithCapacityRanking(capacityRanking),
+		ctrl.WithTopologySpreading(topologySpreading),
+		ctrl.WithOrphanRecord(orphanRecord),
+		ctrl.WithOrphanedVolumeController(orphanedVolumeController),
+	}
+	if cloneTimeoutConfig != nil {
+		csiProvisionerOptions = append(csiProvisionerOptions, ctrl.WithCloneAttempts(cloneTimeoutConfig.Attempts))
+	}
+
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
 	csiProvisioner := ctrl.NewCSIProvisioner(
@@ -421,15 +759,27 @@ func main() {
 		csiNodeLister,
 		nodeLister,
 		claimLister,
-		vaLister,
+		vaIndexer,
 		referenceGrantLister,
 		*extraCreateMetadata,
 		*defaultFSType,
 		nodeDeployment,
 		*controllerPublishReadOnly,
 		*preventVolumeModeConversion,
+		csiProvisionerOptions...,
 	)
 
+	if explainName != "" {
+		factories := []informers.SharedInformerFactory{factory}
+		if quotaFactory != nil {
+			factories = append(factories, quotaFactory)
+		}
+		if capacityRankingFactory != nil {
+			factories = append(factories, capacityRankingFactory)
+		}
+		os.Exit(explain(ctx, factories, gatewayFactory, csiProvisioner, explainNamespace, explainName))
+	}
+
 	var capacityController *capacity.Controller
 	if *enableCapacity {
 		// Publishing storage capacity information uses its own client
@@ -566,6 +916,8 @@ func main() {
 		claimInformer,
 		claimQueue,
 		controllerCapabilities,
+		hostAssistedClone != nil,
+		cloneTimeoutConfig,
 	)
 
 	// Start HTTP server, regardless whether we are the leader or not.
@@ -580,6 +932,15 @@ func main() {
 			libmetrics.PersistentVolumeDeleteTotal,
 			libmetrics.PersistentVolumeDeleteFailedTotal,
 			libmetrics.PersistentVolumeDeleteDurationSeconds,
+			ctrl.OperationWaitDurationSeconds,
+			ctrl.NamespacePendingOperations,
+			ctrl.NamespaceWaitDurationSeconds,
+			ctrl.SecretCacheRequestsTotal,
+			ctrl.PendingCloneAgeSeconds,
+			ctrl.TrashVolumes,
+			ctrl.TrashOperationsTotal,
+			ctrl.DeletionCircuitBreakerOpen,
+			ctrl.DeletionsPausedTotal,
 		}...)
 		gatherers = append(gatherers, reg)
 
@@ -593,6 +954,10 @@ func main() {
 				reg,
 				promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})))
 
+		if deletionCircuitBreaker != nil {
+			mux.Handle("/deletion-circuit-breaker", deletionCircuitBreaker)
+		}
+
 		if *enableProfile {
 			klog.InfoS("Starting profiling", "endpoint", httpEndpoint)
 
@@ -624,6 +989,23 @@ func main() {
 				klog.Fatalf("Failed to sync Informers!")
 			}
 		}
+		if quotaFactory != nil {
+			// Quotas must be known before provisioning starts.
+			quotaFactory.Start(ctx.Done())
+			for _, v := range quotaFactory.WaitForCacheSync(ctx.Done()) {
+				if !v {
+					klog.Fatalf("Failed to sync quota ConfigMap informer!")
+				}
+			}
+		}
+		if capacityRankingFactory != nil {
+			capacityRankingFactory.Start(ctx.Done())
+			for _, v := range capacityRankingFactory.WaitForCacheSync(ctx.Done()) {
+				if !v {
+					klog.Fatalf("Failed to sync CSIStorageCapacity informer!")
+				}
+			}
+		}
 
 		if utilfeature.DefaultFeatureGate.Enabled(features.CrossNamespaceVolumeDataSource) {
 			if gatewayFactory != nil {
@@ -643,6 +1025,18 @@ func main() {
 		if csiClaimController != nil {
 			go csiClaimController.Run(ctx, int(*finalizerThreads))
 		}
+		if secretCache != nil {
+			go secretCache.Run(ctx)
+		}
+		if orphanedVolumeController != nil {
+			go orphanedVolumeController.Run(ctx)
+		}
+		if trash != nil {
+			go trash.Run(ctx)
+		}
+		if hostAssistedClone != nil {
+			go hostAssistedClone.Run(ctx)
+		}
 		provisionController.Run(ctx)
 	}
 
@@ -671,7 +1065,7 @@ func main() {
 		le.WithLeaseDuration(*leaderElectionLeaseDuration)
 		le.WithRenewDeadline(*leaderElectionRenewDeadline)
 		le.WithRetryPeriod(*leaderElectionRetryPeriod)
-		le.WithIdentity(identity)
+		le.WithIdentity(leaderElectionIdentity)
 
 		if err := le.Run(); err != nil {
 			klog.Fatalf("failed to initialize leader election: %v", err)
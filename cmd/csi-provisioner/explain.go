@@ -0,0 +1,88 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+
+	ctrl "github.com/kubernetes-csi/external-provisioner/pkg/controller"
+	gatewayInformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
+)
+
+const explainCommand = "explain"
+
+// parseExplainArgs checks the non-flag arguments. It returns the
+// namespace and name of the PVC for the explain command, or empty
+// strings when running normally.
+func parseExplainArgs(args []string) (namespace, name string, err error) {
+	if len(args) == 0 {
+		return "", "", nil
+	}
+	if args[0] != explainCommand {
+		return "", "", fmt.Errorf("unknown command %q", args[0])
+	}
+	if len(args) != 2 {
+		return "", "", fmt.Errorf("usage: %s [flags] %s <namespace>/<pvc name>", os.Args[0], explainCommand)
+	}
+	parts := strings.Split(args[1], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected <namespace>/<pvc name>, got %q", args[1])
+	}
+	return parts[0], parts[1], nil
+}
+
+// explain prints what provisioning the PVC would do and returns the
+// exit code: 0 if provisioning would proceed, 1 otherwise.
+func explain(ctx context.Context, factories []informers.SharedInformerFactory, gatewayFactory gatewayInformers.SharedInformerFactory, provisioner controller.Provisioner, namespace, name string) int {
+	for _, factory := range factories {
+		factory.Start(ctx.Done())
+		for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				klog.Errorf("Failed to sync informer for %v", informer)
+				return 1
+			}
+		}
+	}
+	if gatewayFactory != nil {
+		gatewayFactory.Start(ctx.Done())
+		for informer, synced := range gatewayFactory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				klog.Errorf("Failed to sync informer for %v", informer)
+				return 1
+			}
+		}
+	}
+
+	explanation, err := ctrl.Explain(ctx, provisioner, namespace, name)
+	if err != nil {
+		klog.Error(err.Error())
+		return 1
+	}
+	fmt.Printf("PVC %s/%s:\n\n", namespace, name)
+	explanation.Print(os.Stdout)
+	if explanation.Err != nil {
+		return 1
+	}
+	return 0
+}
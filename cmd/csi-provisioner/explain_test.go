@@ -0,0 +1,71 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseExplainArgs(t *testing.T) {
+	testcases := map[string]struct {
+		args              []string
+		expectedNamespace string
+		expectedName      string
+		expectErr         bool
+	}{
+		"no arguments": {},
+		"explain": {
+			args:              []string{"explain", "default/my-pvc"},
+			expectedNamespace: "default",
+			expectedName:      "my-pvc",
+		},
+		"unknown command": {
+			args:      []string{"provision", "default/my-pvc"},
+			expectErr: true,
+		},
+		"missing PVC": {
+			args:      []string{"explain"},
+			expectErr: true,
+		},
+		"missing namespace": {
+			args:      []string{"explain", "my-pvc"},
+			expectErr: true,
+		},
+		"too many arguments": {
+			args:      []string{"explain", "default/my-pvc", "default/other-pvc"},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			namespace, name, err := parseExplainArgs(tc.args)
+			if tc.expectErr {
+				if err == nil {
+					t.Error("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if namespace != tc.expectedNamespace || name != tc.expectedName {
+				t.Errorf("expected %s/%s, got %s/%s", tc.expectedNamespace, tc.expectedName, namespace, name)
+			}
+		})
+	}
+}
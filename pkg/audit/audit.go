@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records the CSI calls of the external-provisioner which
+// create or delete volumes. Each call becomes one JSON object in the
+// configured sinks.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LevelMetadata records who issued a call, for which volume, and
+	// the result, but not the parameters of the call.
+	LevelMetadata = "metadata"
+	// LevelRequest additionally records the parameters, the secret keys
+	// and the topology of the call.
+	LevelRequest = "request"
+
+	// Redacted replaces the values of secrets.
+	Redacted = "***redacted***"
+)
+
+// Record describes one CSI call.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Method is the CSI method, for example "CreateVolume".
+	Method string `json:"method"`
+	// Reason explains why the call was issued: "provision",
+	// "cleanup" after a failed provisioning attempt, "delete" or
+	// "orphan" for orphaned volumes.
+	Reason string `json:"reason"`
+	// PVC is the <namespace>/<name> of the PVC for which the call was
+	// issued, if there is one.
+	PVC string `json:"pvc,omitempty"`
+	// PV is the name of the PV for which the call was issued, if
+	// there is one.
+	PV            string `json:"pv,omitempty"`
+	VolumeName    string `json:"volumeName,omitempty"`
+	VolumeID      string `json:"volumeID,omitempty"`
+	CapacityBytes int64  `json:"capacityBytes,omitempty"`
+
+	// The following fields are only recorded with LevelRequest.
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Secrets contains the keys of the secrets, with Redacted as value.
+	Secrets            map[string]string   `json:"secrets,omitempty"`
+	RequisiteTopology  []map[string]string `json:"requisiteTopology,omitempty"`
+	PreferredTopology  []map[string]string `json:"preferredTopology,omitempty"`
+	AccessibleTopology []map[string]string `json:"accessibleTopology,omitempty"`
+
+	// Code is the gRPC status code of the call, "OK" on success.
+	Code            string  `json:"code"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// Sink stores records, each of them encoded as one line of JSON.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Logger writes records to sinks. A nil Logger records nothing.
+type Logger struct {
+	level string
+	sinks []Sink
+	mutex sync.Mutex
+}
+
+// NewLogger creates a logger for the given level.
+func NewLogger(level string, sinks ...Sink) (*Logger, error) {
+	if level != LevelMetadata && level != LevelRequest {
+		return nil, fmt.Errorf("unknown audit level %q, must be %q or %q", level, LevelMetadata, LevelRequest)
+	}
+	return &Logger{level: level, sinks: sinks}, nil
+}
+
+// Log writes the record to all sinks. Failures are logged, but do not
+// affect the operation that gets recorded.
+func (l *Logger) Log(record *Record) {
+	if l == nil {
+		return
+	}
+	if l.level == LevelMetadata {
+		record.Parameters = nil
+		record.Secrets = nil
+		record.RequisiteTopology = nil
+		record.PreferredTopology = nil
+		record.AccessibleTopology = nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		klog.Errorf("Failed to encode audit record for %s: %v", record.Method, err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, sink := range l.sinks {
+		if err := sink.Write(line); err != nil {
+			klog.Errorf("Failed to write audit record: %v", err)
+		}
+	}
+}
+
+// Close closes all sinks.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var firstErr error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// RedactSecrets returns the keys of the secrets with Redacted as value.
+func RedactSecrets(secrets map[string]string) map[string]string {
+	if len(secrets) == 0 {
+		return nil
+	}
+	redacted := make(map[string]string, len(secrets))
+	for key := range secrets {
+		redacted[key] = Redacted
+	}
+	return redacted
+}
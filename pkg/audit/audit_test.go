@@ -0,0 +1,194 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	lines []string
+}
+
+func (s *memorySink) Write(line []byte) error {
+	s.lines = append(s.lines, string(line))
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func testRecord() *Record {
+	return &Record{
+		Time:              time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		Method:            "CreateVolume",
+		Reason:            "provision",
+		PVC:               "default/data",
+		VolumeName:        "pvc-1",
+		CapacityBytes:     1024,
+		Parameters:        map[string]string{"type": "ssd"},
+		Secrets:           RedactSecrets(map[string]string{"password": "secret"}),
+		PreferredTopology: []map[string]string{{"zone": "a"}},
+		Code:              "OK",
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	testcases := map[string]struct {
+		level          string
+		expectedRecord *Record
+	}{
+		"metadata": {
+			level: LevelMetadata,
+			expectedRecord: &Record{
+				Time:          time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+				Method:        "CreateVolume",
+				Reason:        "provision",
+				PVC:           "default/data",
+				VolumeName:    "pvc-1",
+				CapacityBytes: 1024,
+				Code:          "OK",
+			},
+		},
+		"request": {
+			level:          LevelRequest,
+			expectedRecord: testRecord(),
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			sink := &memorySink{}
+			logger, err := NewLogger(tc.level, sink)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			logger.Log(testRecord())
+			if len(sink.lines) != 1 || !strings.HasSuffix(sink.lines[0], "}\n") {
+				t.Fatalf("expected one JSON line, got %q", sink.lines)
+			}
+			if strings.Contains(sink.lines[0], "secret\"") {
+				t.Errorf("expected secret to be redacted, got %s", sink.lines[0])
+			}
+			var record Record
+			if err := json.Unmarshal([]byte(sink.lines[0]), &record); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(&record, tc.expectedRecord) {
+				t.Errorf("expected record %+v, got %+v", tc.expectedRecord, record)
+			}
+		})
+	}
+}
+
+func TestLoggerInvalidLevel(t *testing.T) {
+	if _, err := NewLogger("everything"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	logger.Log(testRecord())
+	if err := logger.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 10, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if err := sink.Write([]byte(line)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range expected {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(data) != content {
+			t.Errorf("expected %q in %s, got %q", content, file, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only two backups, got error %v", err)
+	}
+
+	// Reopening appends to the existing file.
+	sink, err = NewFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Write([]byte("fifth\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "fourth\nfifth\n" {
+		t.Errorf("expected appended record, got %q", data)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var received []string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, time.Second)
+	if err := sink.Write([]byte("{}\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(received, []string{"{}\n"}) {
+		t.Errorf("expected record to be posted, got %q", received)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.Write([]byte("{}\n")); err == nil {
+		t.Error("expected error for failed request")
+	}
+}
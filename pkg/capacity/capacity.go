@@ -28,6 +28,8 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/external-provisioner/pkg/capacity/topology"
+	"github.com/kubernetes-csi/external-provisioner/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
@@ -99,6 +101,11 @@ type Controller struct {
 	capacitiesLock sync.Mutex
 }
 
+// getCapacityTimeoutKey is the storage class parameter which overrides the
+// timeout for GetCapacity calls. It gets stripped by the external-provisioner
+// before CreateVolume.
+const getCapacityTimeoutKey = "csi.storage.k8s.io/get-capacity-timeout"
+
 type workItem struct {
 	segment          *topology.Segment
 	storageClassName string
@@ -559,7 +566,16 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 }
 
 // syncCapacity gets the capacity and then updates or creates the object.
-func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
+func (c *Controller) syncCapacity(ctx context.Context, item workItem) (err error) {
+	attrs := []attribute.KeyValue{attribute.String("storageclass", item.storageClassName)}
+	if item.segment != nil {
+		attrs = append(attrs, attribute.String("segment", item.segment.SimpleString()))
+	}
+	ctx, span := tracing.Start(ctx, "syncCapacity", attrs...)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	// We lock only while accessing c.capacities, but not during
 	// the potentially long-running operations. That is okay
 	// because there is only a single worker per item. In the
@@ -608,9 +624,19 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 			Segments: item.segment.GetLabelMap(),
 		}
 	}
-	syncCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	timeout := c.timeout
+	if value, ok := sc.Parameters[getCapacityTimeoutKey]; ok {
+		scTimeout, err := time.ParseDuration(value)
+		if err != nil || scTimeout <= 0 {
+			return fmt.Errorf("invalid value %q for parameter %s of storage class %s", value, getCapacityTimeoutKey, sc.Name)
+		}
+		timeout = scTimeout
+	}
+	syncCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
+	syncCtx, getSpan := tracing.StartGRPC(syncCtx, "GetCapacity")
 	resp, err := c.csiController.GetCapacity(syncCtx, req)
+	tracing.End(getSpan, err)
 	if err != nil {
 		return fmt.Errorf("CSI GetCapacity for %+v: %v", item, err)
 	}
@@ -641,7 +667,9 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 		}
 		var err error
 		klog.V(5).Infof("Capacity Controller: creating new object for %+v, new capacity %v", item, quantity)
-		capacity, err = c.clientFactory(c.ownerNamespace).Create(ctx, capacity, metav1.CreateOptions{})
+		createCtx, createSpan := tracing.Start(ctx, "createCSIStorageCapacity")
+		capacity, err = c.clientFactory(c.ownerNamespace).Create(createCtx, capacity, metav1.CreateOptions{})
+		tracing.End(createSpan, err)
 		if err != nil {
 			return fmt.Errorf("create CSIStorageCapacity for %+v: %v", item, err)
 		}
@@ -665,7 +693,9 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 		}
 		var err error
 		klog.V(5).Infof("Capacity Controller: updating %s for %+v, new capacity %v, new maximumVolumeSize %v", capacity.Name, item, quantity, maximumVolumeSize)
-		capacity, err = c.clientFactory(capacity.Namespace).Update(ctx, capacity, metav1.UpdateOptions{})
+		updateCtx, updateSpan := tracing.Start(ctx, "updateCSIStorageCapacity", attribute.String("csistoragecapacity", capacity.Name))
+		capacity, err = c.clientFactory(capacity.Namespace).Update(updateCtx, capacity, metav1.UpdateOptions{})
+		tracing.End(updateSpan, err)
 		if err != nil {
 			return fmt.Errorf("update CSIStorageCapacity for %+v: %v", item, err)
 		}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/external-provisioner/pkg/audit"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	auditReasonProvision = "provision"
+	auditReasonCleanup   = "cleanup"
+	auditReasonDelete    = "delete"
+	auditReasonOrphan    = "orphan"
+)
+
+// auditCreateVolume records a CreateVolume call for the PVC.
+func (p *csiProvisioner) auditCreateVolume(claim *v1.PersistentVolumeClaim, pvName string, req *csi.CreateVolumeRequest, rep *csi.CreateVolumeResponse, start time.Time, err error) {
+	if p.auditLogger == nil {
+		return
+	}
+	record := &audit.Record{
+		Method:             "CreateVolume",
+		Reason:             auditReasonProvision,
+		PVC:                claim.Namespace + "/" + claim.Name,
+		PV:                 pvName,
+		VolumeName:         req.Name,
+		VolumeID:           rep.GetVolume().GetVolumeId(),
+		CapacityBytes:      req.GetCapacityRange().GetRequiredBytes(),
+		Parameters:         req.Parameters,
+		Secrets:            audit.RedactSecrets(req.Secrets),
+		RequisiteTopology:  topologySegments(req.GetAccessibilityRequirements().GetRequisite()),
+		PreferredTopology:  topologySegments(req.GetAccessibilityRequirements().GetPreferred()),
+		AccessibleTopology: topologySegments(rep.GetVolume().GetAccessibleTopology()),
+	}
+	if capacity := rep.GetVolume().GetCapacityBytes(); capacity != 0 {
+		record.CapacityBytes = capacity
+	}
+	logAuditRecord(p.auditLogger, record, start, err)
+}
+
+// auditDeleteVolume records a DeleteVolume call. The PVC and PV are
+// empty if unknown.
+func auditDeleteVolume(logger *audit.Logger, reason, pvc, pv string, req *csi.DeleteVolumeRequest, start time.Time, err error) {
+	if logger == nil {
+		return
+	}
+	record := &audit.Record{
+		Method:   "DeleteVolume",
+		Reason:   reason,
+		PVC:      pvc,
+		PV:       pv,
+		VolumeID: req.VolumeId,
+		Secrets:  audit.RedactSecrets(req.Secrets),
+	}
+	logAuditRecord(logger, record, start, err)
+}
+
+func logAuditRecord(logger *audit.Logger, record *audit.Record, start time.Time, err error) {
+	record.Time = start
+	record.DurationSeconds = time.Since(start).Seconds()
+	record.Code = status.Code(err).String()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	logger.Log(record)
+}
+
+// topologySegments returns the segments of the topologies.
+func topologySegments(topologies []*csi.Topology) []map[string]string {
+	var segments []map[string]string
+	for _, topology := range topologies {
+		segments = append(segments, topology.GetSegments())
+	}
+	return segments
+}
+
+// claimRefKey returns the <namespace>/<name> of the PVC that the PV is or
+// was bound to, an empty string if there is none.
+func claimRefKey(pv *v1.PersistentVolume) string {
+	if pv.Spec.ClaimRef == nil {
+		return ""
+	}
+	return pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+}
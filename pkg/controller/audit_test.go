@@ -0,0 +1,125 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-provisioner/pkg/audit"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+type auditSink struct {
+	records []audit.Record
+}
+
+func (s *auditSink) Write(line []byte) error {
+	var record audit.Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return err
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *auditSink) Close() error {
+	return nil
+}
+
+func TestAuditLog(t *testing.T) {
+	const requestBytes = 100
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	sink := &auditSink{}
+	auditLogger, err := audit.NewLogger(audit.LevelRequest, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithAuditLogger(auditLogger))
+
+	// The volume is too small and gets deleted again.
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{VolumeId: "small-volume", CapacityBytes: requestBytes / 2},
+	}, nil).Times(1)
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+	claim := createFakePVC(requestBytes)
+	if _, _, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{Name: "gold"},
+			Parameters: map[string]string{"type": "ssd"},
+		},
+		PVC: claim,
+	}); err == nil {
+		t.Fatal("expected error for too small volume")
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: "volume-1"},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: "fake-ns", Name: "data"},
+		},
+	}
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Internal, "fake error")).Times(1)
+	if err := provisioner.Delete(context.Background(), pv); err == nil {
+		t.Fatal("expected DeleteVolume error")
+	}
+
+	if len(sink.records) != 3 {
+		t.Fatalf("expected 3 audit records, got %+v", sink.records)
+	}
+	create, cleanup, deletion := sink.records[0], sink.records[1], sink.records[2]
+	pvName, _ := makeVolumeName("test", string(claim.UID), 5)
+	if create.Method != "CreateVolume" || create.Reason != auditReasonProvision || create.PVC != "fake-ns/"+claim.Name ||
+		create.PV != pvName || create.VolumeID != "small-volume" || create.CapacityBytes != requestBytes/2 ||
+		create.Parameters["type"] != "ssd" || create.Code != "OK" {
+		t.Errorf("unexpected CreateVolume record %+v", create)
+	}
+	if cleanup.Method != "DeleteVolume" || cleanup.Reason != auditReasonCleanup || cleanup.PV != pvName ||
+		cleanup.VolumeID != "small-volume" || cleanup.Code != "OK" {
+		t.Errorf("unexpected cleanup record %+v", cleanup)
+	}
+	if deletion.Method != "DeleteVolume" || deletion.Reason != auditReasonDelete || deletion.PVC != "fake-ns/data" ||
+		deletion.PV != "pv-1" || deletion.VolumeID != "volume-1" || deletion.Code != "Internal" || deletion.Error == "" {
+		t.Errorf("unexpected deletion record %+v", deletion)
+	}
+}
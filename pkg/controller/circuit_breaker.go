@@ -0,0 +1,330 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Annotation on the CSIDriver object with the time at which the
+	// deletion circuit breaker opened. It persists the open breaker
+	// across restarts of the external-provisioner.
+	annDeletionsPausedSince = "provisioner.storage.kubernetes.io/deletions-paused-since"
+
+	// Annotation on the CSIDriver object which resumes deletions after
+	// the deletion circuit breaker opened. The value must be the time at
+	// which the breaker opened, as reported by the event and by
+	// annDeletionsPausedSince.
+	annResumeDeletions = "provisioner.storage.kubernetes.io/resume-deletions"
+
+	// circuitBreakerSyncInterval limits how often the CSIDriver object is
+	// checked for the annotations.
+	circuitBreakerSyncInterval = 10 * time.Second
+)
+
+var (
+	// DeletionCircuitBreakerOpen is 1 while deletions are paused.
+	DeletionCircuitBreakerOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "controller",
+			Name:      "deletion_circuit_breaker_open",
+			Help:      "1 if the deletion circuit breaker paused all deletions of volumes, 0 otherwise.",
+		},
+	)
+	// DeletionsPausedTotal counts the deletions that were refused by the
+	// open circuit breaker.
+	DeletionsPausedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "controller",
+			Name:      "deletions_paused_total",
+			Help:      "Number of attempts to delete a volume which were refused because the deletion circuit breaker is open.",
+		},
+	)
+)
+
+// deletionRecord is a volume deletion within the window of the circuit
+// breaker.
+type deletionRecord struct {
+	time  time.Time
+	bytes int64
+}
+
+// DeletionCircuitBreaker pauses all deletions of volumes once more volumes
+// or more capacity than allowed got deleted within a sliding window. The
+// open state is stored in the annDeletionsPausedSince annotation of the
+// CSIDriver object, so it survives restarts. The breaker stays open until
+// an operator resumes deletions with the annResumeDeletions annotation.
+type DeletionCircuitBreaker struct {
+	client     kubernetes.Interface
+	driverName string
+	maxDeletes int
+	maxBytes   int64
+	window     time.Duration
+	now        func() time.Time
+	// eventRecorder gets set by NewCSIProvisioner.
+	eventRecorder record.EventRecorder
+
+	mutex     sync.Mutex
+	deletions map[string]deletionRecord // by PV name or orphan/<volume ID>
+	openSince time.Time                 // zero while closed
+	// synced is true once the state was read from the CSIDriver object.
+	synced   bool
+	lastSync time.Time
+}
+
+// NewDeletionCircuitBreaker creates a circuit breaker which opens when
+// more than maxDeletes volumes or more than maxBytes get deleted within
+// the window. Zero disables the respective limit. The breaker must be passed
+// to NewCSIProvisioner with WithDeletionCircuitBreaker.
+func NewDeletionCircuitBreaker(client kubernetes.Interface, driverName string, maxDeletes int, maxBytes int64, window time.Duration) *DeletionCircuitBreaker {
+	return &DeletionCircuitBreaker{
+		client:     client,
+		driverName: driverName,
+		maxDeletes: maxDeletes,
+		maxBytes:   maxBytes,
+		window:     window,
+		now:        time.Now,
+		deletions:  map[string]deletionRecord{},
+	}
+}
+
+// admit returns an error if the volume must not be deleted now. Retrying
+// the deletion of the same PV within the window does not count again.
+func (b *DeletionCircuitBreaker) admit(ctx context.Context, volume *v1.PersistentVolume) error {
+	var bytes int64
+	if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok {
+		bytes = capacity.Value()
+	}
+	return b.admitDeletion(ctx, volume.Name, bytes, volume)
+}
+
+// admitOrphan is like admit for a volume without PV.
+func (b *DeletionCircuitBreaker) admitOrphan(ctx context.Context, volumeID string, bytes int64) error {
+	return b.admitDeletion(ctx, "orphan/"+volumeID, bytes, b.driverRef())
+}
+
+// admitDeletion implements admit. Deletions are identified by name, events
+// get recorded for the object.
+func (b *DeletionCircuitBreaker) admitDeletion(ctx context.Context, name string, bytes int64, object runtime.Object) error {
+	unstored, err := b.sync(ctx)
+	if err != nil {
+		return err
+	}
+	opened, err := b.count(name, bytes, object)
+	if opened || unstored {
+		b.persist(ctx)
+	}
+	return err
+}
+
+// count records the deletion if it is allowed. It returns true if the
+// deletion opened the breaker.
+func (b *DeletionCircuitBreaker) count(name string, bytes int64, object runtime.Object) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.openSince.IsZero() {
+		DeletionsPausedTotal.Inc()
+		b.eventRecorder.Eventf(object, v1.EventTypeWarning, "DeletionPaused", "Deletion is paused by the deletion circuit breaker since %s", b.openSince.Format(time.RFC3339))
+		return false, fmt.Errorf("deletion of volumes is paused by the deletion circuit breaker since %s", b.openSince.Format(time.RFC3339))
+	}
+
+	now := b.now()
+	for name, deletion := range b.deletions {
+		if now.Sub(deletion.time) >= b.window {
+			delete(b.deletions, name)
+		}
+	}
+	if _, ok := b.deletions[name]; ok {
+		return false, nil
+	}
+
+	deletion := deletionRecord{time: now, bytes: bytes}
+	deletes := len(b.deletions) + 1
+	for _, d := range b.deletions {
+		bytes += d.bytes
+	}
+	if (b.maxDeletes > 0 && deletes > b.maxDeletes) || (b.maxBytes > 0 && bytes > b.maxBytes) {
+		b.openSince = now.Truncate(time.Second)
+		DeletionCircuitBreakerOpen.Set(1)
+		DeletionsPausedTotal.Inc()
+		klog.Warningf("Deletion circuit breaker opened: deleting %s would delete %d volumes with %d bytes within %v", name, deletes, bytes, b.window)
+		b.eventRecorder.Eventf(b.driverRef(), v1.EventTypeWarning, "DeletionCircuitBreakerOpen",
+			"Paused all deletions of volumes, %d volumes with %d bytes would have been deleted within %v. Annotate this CSIDriver with %s=%s to resume.",
+			deletes, bytes, b.window, annResumeDeletions, b.openSince.Format(time.RFC3339))
+		b.eventRecorder.Eventf(object, v1.EventTypeWarning, "DeletionPaused", "Deletion is paused by the deletion circuit breaker since %s", b.openSince.Format(time.RFC3339))
+		return true, fmt.Errorf("deletion of volumes is paused by the deletion circuit breaker since %s", b.openSince.Format(time.RFC3339))
+	}
+	b.deletions[name] = deletion
+	return false, nil
+}
+
+// sync reads the state of the breaker from the annotations of the CSIDriver
+// object, at most once per circuitBreakerSyncInterval. Deletions are refused
+// until the state could be read once. A missing CSIDriver object counts as
+// closed breaker. It returns true if the breaker is open without that being
+// stored in the CSIDriver object yet.
+func (b *DeletionCircuitBreaker) sync(ctx context.Context) (bool, error) {
+	b.mutex.Lock()
+	now := b.now()
+	if b.synced && now.Sub(b.lastSync) < circuitBreakerSyncInterval {
+		b.mutex.Unlock()
+		return false, nil
+	}
+	b.lastSync = now
+	b.mutex.Unlock()
+
+	// The GET is done without holding the mutex, other deletions
+	// continue with the previous state meanwhile.
+	driver, err := b.client.StorageV1().CSIDrivers().Get(ctx, b.driverName, metav1.GetOptions{})
+	notFound := apierrors.IsNotFound(err)
+	if notFound {
+		driver, err = &storagev1.CSIDriver{}, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err != nil {
+		klog.V(3).Infof("Deletion circuit breaker: failed to get CSIDriver %s: %v", b.driverName, err)
+		if !b.synced {
+			return false, fmt.Errorf("state of the deletion circuit breaker is unknown: %v", err)
+		}
+		return false, nil
+	}
+	b.synced = true
+
+	var pausedSince time.Time
+	if value := driver.Annotations[annDeletionsPausedSince]; value != "" {
+		pausedSince, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			klog.Warningf("Deletion circuit breaker: ignoring invalid annotation %s=%q of CSIDriver %s: %v", annDeletionsPausedSince, value, b.driverName, err)
+		}
+	}
+	switch {
+	case pausedSince.Before(b.openSince):
+		// Opened in memory, but storing it failed before.
+		return !notFound, nil
+	case pausedSince.IsZero():
+		// Never opened.
+	case driver.Annotations[annResumeDeletions] == pausedSince.Format(time.RFC3339):
+		b.reset("annotation " + annResumeDeletions)
+	case !pausedSince.Equal(b.openSince):
+		klog.Warningf("Deletion circuit breaker: deletions are paused since %s according to CSIDriver %s", pausedSince.Format(time.RFC3339), b.driverName)
+		b.openSince = pausedSince
+		DeletionCircuitBreakerOpen.Set(1)
+	}
+	return false, nil
+}
+
+// persist stores the open state in the CSIDriver object. Failures only get
+// logged: the breaker stays open in memory and storing gets retried by the
+// next sync.
+func (b *DeletionCircuitBreaker) persist(ctx context.Context) {
+	b.mutex.Lock()
+	openSince := b.openSince
+	b.mutex.Unlock()
+	if openSince.IsZero() {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annDeletionsPausedSince: openSince.Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		klog.Warningf("Deletion circuit breaker: %v", err)
+		return
+	}
+	if _, err := b.client.StorageV1().CSIDrivers().Patch(ctx, b.driverName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		klog.Warningf("Deletion circuit breaker: failed to store open state in CSIDriver %s, it gets lost when the external-provisioner restarts: %v", b.driverName, err)
+	}
+}
+
+// reset closes the breaker and forgets the previous deletions. The caller
+// must hold the mutex.
+func (b *DeletionCircuitBreaker) reset(reason string) {
+	if b.openSince.IsZero() {
+		return
+	}
+	klog.Infof("Deletion circuit breaker closed by %s", reason)
+	b.eventRecorder.Eventf(b.driverRef(), v1.EventTypeNormal, "DeletionCircuitBreakerClosed", "Resumed deletions of volumes, acknowledged by %s", reason)
+	b.openSince = time.Time{}
+	b.deletions = map[string]deletionRecord{}
+	DeletionCircuitBreakerOpen.Set(0)
+}
+
+// driverRef returns the object that events about the breaker are recorded for.
+func (b *DeletionCircuitBreaker) driverRef() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "CSIDriver",
+		APIVersion: "storage.k8s.io/v1",
+		Name:       b.driverName,
+	}
+}
+
+// deletionCircuitBreakerStatus is the response of the HTTP handler.
+type deletionCircuitBreakerStatus struct {
+	Open      bool         `json:"open"`
+	OpenSince *metav1.Time `json:"openSince,omitempty"`
+	Deletions int          `json:"deletions"`
+	Bytes     int64        `json:"bytes"`
+}
+
+// ServeHTTP reports the state of the breaker for GET requests. Deletions
+// can only be resumed through the CSIDriver object.
+func (b *DeletionCircuitBreaker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	status := deletionCircuitBreakerStatus{
+		Open:      !b.openSince.IsZero(),
+		Deletions: len(b.deletions),
+	}
+	if status.Open {
+		status.OpenSince = &metav1.Time{Time: b.openSince}
+	}
+	for _, deletion := range b.deletions {
+		status.Bytes += deletion.bytes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
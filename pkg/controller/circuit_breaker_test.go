@@ -0,0 +1,219 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+func TestDeletionCircuitBreaker(t *testing.T) {
+	type deletion struct {
+		pv          string
+		capacity    string
+		elapsed     time.Duration
+		expectError bool
+	}
+	testcases := map[string]struct {
+		maxDeletes int
+		maxBytes   int64
+		deletions  []deletion
+	}{
+		"below limits": {
+			maxDeletes: 2,
+			maxBytes:   3 << 30,
+			deletions: []deletion{
+				{pv: "pv-1", capacity: "1Gi"},
+				{pv: "pv-2", capacity: "1Gi"},
+			},
+		},
+		"too many deletions": {
+			maxDeletes: 2,
+			deletions: []deletion{
+				{pv: "pv-1", capacity: "1Gi"},
+				{pv: "pv-2", capacity: "1Gi"},
+				{pv: "pv-3", capacity: "1Gi", expectError: true},
+				{pv: "pv-1", capacity: "1Gi", expectError: true},
+			},
+		},
+		"retries do not count": {
+			maxDeletes: 2,
+			deletions: []deletion{
+				{pv: "pv-1", capacity: "1Gi"},
+				{pv: "pv-1", capacity: "1Gi"},
+				{pv: "pv-2", capacity: "1Gi"},
+			},
+		},
+		"too much capacity": {
+			maxBytes: 3 << 30,
+			deletions: []deletion{
+				{pv: "pv-1", capacity: "2Gi"},
+				{pv: "pv-2", capacity: "2Gi", expectError: true},
+			},
+		},
+		"deletions outside of window": {
+			maxDeletes: 1,
+			deletions: []deletion{
+				{pv: "pv-1", capacity: "1Gi"},
+				{pv: "pv-2", capacity: "1Gi", elapsed: time.Hour},
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			b := NewDeletionCircuitBreaker(fakeclientset.NewSimpleClientset(), driverName, tc.maxDeletes, tc.maxBytes, time.Hour)
+			b.eventRecorder = &record.FakeRecorder{}
+			now := time.Now()
+			b.now = func() time.Time { return now }
+			for i, d := range tc.deletions {
+				now = now.Add(d.elapsed)
+				err := b.admit(context.Background(), newTestPV(d.pv, "fake-ns", "", d.capacity))
+				if d.expectError && err == nil {
+					t.Errorf("deletion #%d of %s: expected error", i, d.pv)
+				} else if !d.expectError && err != nil {
+					t.Errorf("deletion #%d of %s: unexpected error: %v", i, d.pv, err)
+				}
+			}
+		})
+	}
+	DeletionCircuitBreakerOpen.Set(0)
+}
+
+func TestDeletionCircuitBreakerResume(t *testing.T) {
+	driver := &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: driverName}}
+	clientSet := fakeclientset.NewSimpleClientset(driver)
+	b := NewDeletionCircuitBreaker(clientSet, driverName, 1, 0, time.Hour)
+	b.eventRecorder = &record.FakeRecorder{}
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if err := b.admit(ctx, newTestPV("pv-1", "fake-ns", "", "1Gi")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.admit(ctx, newTestPV("pv-2", "fake-ns", "", "1Gi")); err == nil {
+		t.Fatal("expected circuit breaker to open")
+	}
+	if open := testutil.ToFloat64(DeletionCircuitBreakerOpen); open != 1 {
+		t.Errorf("expected open circuit breaker metric, got %v", open)
+	}
+	driver, err := clientSet.StorageV1().CSIDrivers().Get(ctx, driverName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pausedSince := driver.Annotations[annDeletionsPausedSince]; pausedSince != b.openSince.Format(time.RFC3339) {
+		t.Fatalf("expected open state to be stored in CSIDriver, got %q", pausedSince)
+	}
+
+	// A restarted breaker is still open.
+	restarted := NewDeletionCircuitBreaker(clientSet, driverName, 1, 0, time.Hour)
+	restarted.eventRecorder = &record.FakeRecorder{}
+	restarted.now = func() time.Time { return now }
+	if err := restarted.admit(ctx, newTestPV("pv-3", "fake-ns", "", "1Gi")); err == nil {
+		t.Fatal("expected restarted circuit breaker to be open")
+	}
+
+	// An annotation for some earlier opening is ignored.
+	driver.Annotations[annResumeDeletions] = now.Add(-time.Hour).Format(time.RFC3339)
+	if _, err := clientSet.StorageV1().CSIDrivers().Update(ctx, driver, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if err := b.admit(ctx, newTestPV("pv-2", "fake-ns", "", "1Gi")); err == nil {
+		t.Fatal("expected circuit breaker to stay open")
+	}
+
+	// HTTP only reports the state.
+	for method, expectCode := range map[string]int{http.MethodGet: http.StatusOK, http.MethodPost: http.StatusMethodNotAllowed} {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest(method, "/deletion-circuit-breaker", nil))
+		if w.Code != expectCode {
+			t.Fatalf("%s: expected status %d, got %d", method, expectCode, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deletion-circuit-breaker", nil))
+	status := deletionCircuitBreakerStatus{}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Open {
+		t.Errorf("expected open circuit breaker, got %+v", status)
+	}
+
+	driver.Annotations[annResumeDeletions] = driver.Annotations[annDeletionsPausedSince]
+	if _, err := clientSet.StorageV1().CSIDrivers().Update(ctx, driver, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if err := b.admit(ctx, newTestPV("pv-2", "fake-ns", "", "1Gi")); err != nil {
+		t.Fatalf("expected circuit breaker to close, got error: %v", err)
+	}
+	if open := testutil.ToFloat64(DeletionCircuitBreakerOpen); open != 0 {
+		t.Errorf("expected closed circuit breaker metric, got %v", open)
+	}
+
+	// The limit applies again after resuming.
+	if err := b.admit(ctx, newTestPV("pv-3", "fake-ns", "", "1Gi")); err == nil {
+		t.Fatal("expected circuit breaker to open again")
+	}
+	DeletionCircuitBreakerOpen.Set(0)
+}
+
+func TestDeleteWithDeletionCircuitBreaker(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	scLister, _, _, _, _, stopChan := listers(clientSet)
+	defer close(stopChan)
+	breaker := NewDeletionCircuitBreaker(clientSet, driverName, 1, 0, time.Hour)
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithDeletionCircuitBreaker(breaker))
+
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), &csi.DeleteVolumeRequest{VolumeId: "pv-1"}).
+		Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+	if err := provisioner.Delete(context.Background(), newTestPV("pv-1", "fake-ns", "", "1Gi")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := provisioner.Delete(context.Background(), newTestPV("pv-2", "fake-ns", "", "1Gi")); err == nil {
+		t.Fatal("expected deletion to be paused")
+	}
+	DeletionCircuitBreakerOpen.Set(0)
+}
@@ -3,19 +3,27 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
@@ -31,32 +39,213 @@ import (
 // 2) When cloning is finished for each PVC referencing the one as a data source,
 // this PVC will go from `Pending` to `Bound` state. That allows remove the finalizer.
 //
+// PVCs reference their source through `spec.DataSource` or `spec.DataSourceRef`, the latter
+// also in other namespaces with the CrossNamespaceVolumeDataSource feature. The claim informer
+// indexes PVCs by their source with ClaimDataSourceIndexFunc.
+//
+// A clone which stays `Pending` for longer than the optional CloneTimeout after its first
+// provisioning attempt is considered stuck. Events on both PVCs, emitted once when the clone
+// becomes stuck, and the pending clone age metric report it. The finalizer then gets removed when
+// the policy allows it and no provisioning attempt is running for any of the clones, or when the
+// source PVC has the annReleaseCloningProtection annotation.
+//
+
+const (
+	// ClaimDataSourceIndex is the name of the claim informer index which
+	// is created by ClaimDataSourceIndexFunc.
+	ClaimDataSourceIndex = "dataSource"
+
+	// Annotation on a source PVC with value "true" which allows removing
+	// the cloning protection finalizer while clones are still pending.
+	annReleaseCloningProtection = "provisioner.storage.kubernetes.io/release-cloning-protection"
+)
+
+// PendingCloneAgeSeconds reports, for each source PVC whose deletion is
+// blocked, the age of the oldest clone that is still pending.
+var PendingCloneAgeSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "controller",
+		Name:      "pending_clone_age_seconds",
+		Help:      "Age of the oldest pending clone of a PVC which is being deleted, by namespace and name of that source PVC.",
+	},
+	[]string{"namespace", "pvc"},
+)
+
+// CloneTimeout configures how the CloningProtectionController handles
+// clones that are stuck.
+type CloneTimeout struct {
+	// Timeout is the time after the first provisioning attempt of a
+	// clone PVC after which it counts as stuck while it is still pending.
+	Timeout time.Duration
+	// Release enables removing the finalizer of a source PVC once all of
+	// its pending clones are stuck.
+	Release bool
+	// Attempts must also be passed to the provisioner with
+	// WithCloneAttempts. Clones without a recorded attempt, for example
+	// those waiting for their first consumer, never count as stuck.
+	Attempts *CloneAttempts
+}
+
+// CloneAttempts tracks the provisioning attempts of clone PVCs in memory.
+// After a restart, the age of a clone gets measured from its next attempt.
+type CloneAttempts struct {
+	now func() time.Time
+
+	mutex    sync.Mutex
+	started  map[types.UID]time.Time // first attempt
+	inFlight map[types.UID]int       // number of running attempts
+}
+
+// NewCloneAttempts creates an empty tracker.
+func NewCloneAttempts() *CloneAttempts {
+	return &CloneAttempts{
+		now:      time.Now,
+		started:  map[types.UID]time.Time{},
+		inFlight: map[types.UID]int{},
+	}
+}
+
+// start records a provisioning attempt for the clone. The returned
+// function must be called when the attempt is done, with true if the clone
+// got provisioned.
+func (a *CloneAttempts) start(uid types.UID) func(provisioned bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.started[uid]; !ok {
+		a.started[uid] = a.now()
+	}
+	a.inFlight[uid]++
+
+	return func(provisioned bool) {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.inFlight[uid]--
+		if a.inFlight[uid] <= 0 {
+			delete(a.inFlight, uid)
+		}
+		if provisioned {
+			delete(a.started, uid)
+		}
+	}
+}
+
+// state returns the time of the first provisioning attempt of the clone,
+// zero if there was none, and whether an attempt is running.
+func (a *CloneAttempts) state(uid types.UID) (time.Time, bool) {
+	if a == nil {
+		return time.Time{}, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.started[uid], a.inFlight[uid] > 0
+}
+
+// forget removes a clone after it got deleted.
+func (a *CloneAttempts) forget(uid types.UID) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.started, uid)
+}
+
+// ClaimDataSourceIndexFunc indexes PVCs by the <namespace>/<name> of the
+// PVC that they clone, if any.
+func ClaimDataSourceIndexFunc(obj interface{}) ([]string, error) {
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return nil, fmt.Errorf("expected claim, got %T", obj)
+	}
+	if source := claimDataSourceKey(claim); source != "" {
+		return []string{source}, nil
+	}
+	return nil, nil
+}
+
+// claimDataSourceKey returns the <namespace>/<name> of the PVC that the
+// claim clones, the same way as csiProvisioner.dataSource determines the
+// source, or an empty string.
+func claimDataSourceKey(claim *v1.PersistentVolumeClaim) string {
+	isPVC := func(apiGroup *string, kind string) bool {
+		return kind == pvcKind && (apiGroup == nil || *apiGroup == "")
+	}
+	switch {
+	case claim.Spec.DataSource != nil:
+		if isPVC(claim.Spec.DataSource.APIGroup, claim.Spec.DataSource.Kind) {
+			return claim.Namespace + "/" + claim.Spec.DataSource.Name
+		}
+	case claim.Spec.DataSourceRef != nil:
+		ref := claim.Spec.DataSourceRef
+		if !isPVC(ref.APIGroup, ref.Kind) {
+			return ""
+		}
+		if ref.Namespace == nil || *ref.Namespace == "" {
+			return claim.Namespace + "/" + ref.Name
+		}
+		if utilfeature.DefaultFeatureGate.Enabled(features.CrossNamespaceVolumeDataSource) {
+			return *ref.Namespace + "/" + ref.Name
+		}
+	}
+	return ""
+}
 
 // CloningProtectionController is storing all related interfaces
 // to handle cloning protection finalizer removal after CSI cloning is finished
 type CloningProtectionController struct {
 	client        kubernetes.Interface
 	claimLister   corelisters.PersistentVolumeClaimLister
-	claimInformer cache.SharedInformer
+	claimInformer cache.SharedIndexInformer
 	claimQueue    workqueue.RateLimitingInterface
+	eventRecorder record.EventRecorder
+	cloneTimeout  *CloneTimeout
+
+	// reportsMutex protects reports.
+	reportsMutex sync.Mutex
+	// reports remembers which stuck clones were already reported, by
+	// <namespace>/<name> of the source PVC.
+	reports map[string]*stuckCloneReport
+}
+
+// stuckCloneReport is what was reported about the clones of a source PVC.
+type stuckCloneReport struct {
+	// stuck contains the UIDs of the clones that were reported as stuck.
+	stuck sets.String
+	// released contains the UIDs of the clones that were told about the
+	// release by annotation.
+	released sets.String
+	// source is the reason of the last event for the source PVC.
+	source string
 }
 
-// NewCloningProtectionController creates new controller for additional CSI claim protection capabilities
+// NewCloningProtectionController creates new controller for additional CSI claim protection capabilities.
+// It returns nil if the driver cannot clone and host-assisted cloning is disabled. The claim informer
+// must have the ClaimDataSourceIndex. Stuck clones are not detected if cloneTimeout is nil.
 func NewCloningProtectionController(
 	client kubernetes.Interface,
 	claimLister corelisters.PersistentVolumeClaimLister,
-	claimInformer cache.SharedInformer,
+	claimInformer cache.SharedIndexInformer,
 	claimQueue workqueue.RateLimitingInterface,
 	controllerCapabilities rpc.ControllerCapabilitySet,
+	hostAssistedClone bool,
+	cloneTimeout *CloneTimeout,
 ) *CloningProtectionController {
-	if !controllerCapabilities[csi.ControllerServiceCapability_RPC_CLONE_VOLUME] {
+	if !controllerCapabilities[csi.ControllerServiceCapability_RPC_CLONE_VOLUME] && !hostAssistedClone {
 		return nil
 	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+	eventRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "external-provisioner"})
+
 	controller := &CloningProtectionController{
 		client:        client,
 		claimLister:   claimLister,
 		claimInformer: claimInformer,
 		claimQueue:    claimQueue,
+		eventRecorder: eventRecorder,
+		cloneTimeout:  cloneTimeout,
+		reports:       map[string]*stuckCloneReport{},
 	}
 	return controller
 }
@@ -70,6 +259,7 @@ func (p *CloningProtectionController) Run(ctx context.Context, threadiness int)
 	claimHandler := cache.ResourceEventHandlerFuncs{
 		AddFunc:    func(obj interface{}) { p.enqueueClaimUpdate(ctx, obj) },
 		UpdateFunc: func(_ interface{}, newObj interface{}) { p.enqueueClaimUpdate(ctx, newObj) },
+		DeleteFunc: p.forgetClaim,
 	}
 	p.claimInformer.AddEventHandlerWithResyncPeriod(claimHandler, controller.DefaultResyncPeriod)
 
@@ -131,6 +321,17 @@ func (p *CloningProtectionController) enqueueClaimUpdate(ctx context.Context, ob
 		return
 	}
 
+	// A finished clone may allow removing the finalizer of its source.
+	if new.Status.Phase != v1.ClaimPending {
+		if source := claimDataSourceKey(new); source != "" {
+			namespace, name, _ := cache.SplitMetaNamespaceKey(source)
+			if claim, err := p.claimLister.PersistentVolumeClaims(namespace).Get(name); err == nil &&
+				claim.DeletionTimestamp != nil && checkFinalizer(claim, pvcCloneFinalizer) {
+				p.claimQueue.Add(source)
+			}
+		}
+	}
+
 	// Timestamp didn't appear
 	if new.DeletionTimestamp == nil {
 		return
@@ -156,6 +357,8 @@ func (p *CloningProtectionController) syncClaimHandler(ctx context.Context, key
 	claim, err := p.claimLister.PersistentVolumeClaims(namespace).Get(name)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
+			PendingCloneAgeSeconds.DeleteLabelValues(namespace, name)
+			p.forgetReport(key)
 			utilruntime.HandleError(fmt.Errorf("Item '%s' in work queue no longer exists", key))
 			return nil
 		}
@@ -169,27 +372,31 @@ func (p *CloningProtectionController) syncClaimHandler(ctx context.Context, key
 // syncClaim removes finalizers from a PVC, when cloning is finished
 func (p *CloningProtectionController) syncClaim(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
 	if !checkFinalizer(claim, pvcCloneFinalizer) {
+		PendingCloneAgeSeconds.DeleteLabelValues(claim.Namespace, claim.Name)
+		p.forgetReport(claim.Namespace + "/" + claim.Name)
 		return nil
 	}
 
-	// Checking for PVCs in the same namespace to have other states aside from Pending, which means that cloning is still in progress
-	pvcList, err := p.claimLister.PersistentVolumeClaims(claim.Namespace).List(labels.Everything())
+	// Checking for PVCs with DataSource or DataSourceRef pointing to claim, in any namespace,
+	// to have other states aside from Pending, which means that cloning is still in progress
+	objs, err := p.claimInformer.GetIndexer().ByIndex(ClaimDataSourceIndex, claim.Namespace+"/"+claim.Name)
 	if err != nil {
 		return err
 	}
-
-	// Check for pvc state with DataSource pointing to claim
-	for _, pvc := range pvcList {
-		if pvc.Spec.DataSource == nil {
-			continue
+	var pending []*v1.PersistentVolumeClaim
+	for _, obj := range objs {
+		if pvc, ok := obj.(*v1.PersistentVolumeClaim); ok && pvc.Status.Phase == v1.ClaimPending {
+			pending = append(pending, pvc)
 		}
+	}
 
-		// Requeue when at least one PVC is still works on cloning
-		if pvc.Spec.DataSource.Kind == pvcKind &&
-			pvc.Spec.DataSource.Name == claim.Name &&
-			pvc.Status.Phase == v1.ClaimPending {
-			return fmt.Errorf("PVC '%s' is in 'Pending' state, cloning in progress", pvc.Name)
+	// Requeue when at least one PVC is still works on cloning
+	if len(pending) > 0 && !p.releaseStuckClones(claim, pending) {
+		pvc := pending[0]
+		if pvc.Namespace != claim.Namespace {
+			return fmt.Errorf("PVC '%s/%s' is in 'Pending' state, cloning in progress", pvc.Namespace, pvc.Name)
 		}
+		return fmt.Errorf("PVC '%s' is in 'Pending' state, cloning in progress", pvc.Name)
 	}
 
 	// Remove clone finalizer
@@ -209,6 +416,93 @@ func (p *CloningProtectionController) syncClaim(ctx context.Context, claim *v1.P
 			return err
 		}
 	}
+	PendingCloneAgeSeconds.DeleteLabelValues(claim.Namespace, claim.Name)
+	p.forgetReport(claim.Namespace + "/" + claim.Name)
 
 	return nil
 }
+
+// releaseStuckClones reports the age of the pending clones of a claim and
+// emits events once for those which become stuck. It returns true if the
+// cloning protection finalizer may be removed nonetheless.
+func (p *CloningProtectionController) releaseStuckClones(claim *v1.PersistentVolumeClaim, pending []*v1.PersistentVolumeClaim) bool {
+	p.reportsMutex.Lock()
+	defer p.reportsMutex.Unlock()
+	report := p.reports[claim.Namespace+"/"+claim.Name]
+	if report == nil {
+		report = &stuckCloneReport{stuck: sets.NewString(), released: sets.NewString()}
+		p.reports[claim.Namespace+"/"+claim.Name] = report
+	}
+
+	if claim.Annotations[annReleaseCloningProtection] == "true" {
+		klog.Infof("Releasing cloning protection of PVC %s/%s with %d pending clones because of annotation %s", claim.Namespace, claim.Name, len(pending), annReleaseCloningProtection)
+		for _, pvc := range pending {
+			if report.released.Has(string(pvc.UID)) {
+				continue
+			}
+			report.released.Insert(string(pvc.UID))
+			p.eventRecorder.Eventf(pvc, v1.EventTypeWarning, "CloneSourceReleased", "Source PVC %s/%s may get deleted while the clone is pending, its cloning protection was released by annotation %s", claim.Namespace, claim.Name, annReleaseCloningProtection)
+		}
+		return true
+	}
+
+	var attempts *CloneAttempts
+	if p.cloneTimeout != nil {
+		attempts = p.cloneTimeout.Attempts
+	}
+	var oldest time.Duration
+	stuck := sets.NewString()
+	inFlight := false
+	for _, pvc := range pending {
+		started, running := attempts.state(pvc.UID)
+		inFlight = inFlight || running
+		if started.IsZero() {
+			// Provisioning has not started yet.
+			continue
+		}
+		age := attempts.now().Sub(started)
+		if age > oldest {
+			oldest = age
+		}
+		if p.cloneTimeout != nil && age >= p.cloneTimeout.Timeout {
+			stuck.Insert(string(pvc.UID))
+			if !report.stuck.Has(string(pvc.UID)) {
+				p.eventRecorder.Eventf(pvc, v1.EventTypeWarning, "CloneStuck", "Clone of PVC %s/%s is pending for longer than %v and blocks the deletion of the source PVC", claim.Namespace, claim.Name, p.cloneTimeout.Timeout)
+			}
+		}
+	}
+	report.stuck = stuck
+	PendingCloneAgeSeconds.WithLabelValues(claim.Namespace, claim.Name).Set(oldest.Seconds())
+	if stuck.Len() == 0 {
+		report.source = ""
+		return false
+	}
+
+	if p.cloneTimeout.Release && stuck.Len() == len(pending) && !inFlight {
+		klog.Infof("Releasing cloning protection of PVC %s/%s because all %d pending clones are stuck", claim.Namespace, claim.Name, stuck.Len())
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "CloneStuck", "Releasing cloning protection because all clones are pending for longer than %v", p.cloneTimeout.Timeout)
+		return true
+	}
+	if report.source != "blocked" {
+		report.source = "blocked"
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "CloneStuck", "Deletion is blocked by clones which are pending for longer than %v, set annotation %s to \"true\" to release the cloning protection", p.cloneTimeout.Timeout, annReleaseCloningProtection)
+	}
+	return false
+}
+
+// forgetClaim removes the provisioning attempts of a deleted clone.
+func (p *CloningProtectionController) forgetClaim(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if claim, ok := obj.(*v1.PersistentVolumeClaim); ok && p.cloneTimeout != nil {
+		p.cloneTimeout.Attempts.forget(claim.UID)
+	}
+}
+
+// forgetReport removes what was reported about the clones of a source PVC.
+func (p *CloningProtectionController) forgetReport(source string) {
+	p.reportsMutex.Lock()
+	defer p.reportsMutex.Unlock()
+	delete(p.reports, source)
+}
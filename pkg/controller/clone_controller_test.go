@@ -3,18 +3,26 @@ package controller
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/informers"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
 )
 
 var requestedBytes int64 = 1000
@@ -42,6 +50,17 @@ func pvcDataSourceClone(srcName string, pvc *v1.PersistentVolumeClaim) *v1.Persi
 	return pvc
 }
 
+func pvcDataSourceRefClone(srcNamespace, srcName string, pvc *v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
+	pvc.Spec.DataSourceRef = &v1.TypedObjectReference{
+		Kind: pvcKind,
+		Name: srcName,
+	}
+	if srcNamespace != "" {
+		pvc.Spec.DataSourceRef.Namespace = &srcNamespace
+	}
+	return pvc
+}
+
 func pvcNamed(name string, pvc *v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
 	pvc.Name = name
 	return pvc
@@ -98,6 +117,16 @@ func TestCloneFinalizerRemoval(t *testing.T) {
 			cloneSource:   pvcNamespaced(srcNamespace+"1", pvcFinalizers(baseClaim(), pvcCloneFinalizer)),
 			initialClaims: []runtime.Object{pvcPhase(v1.ClaimPending, pvcDataSourceClone(srcName, pvcNamed(dstName+"1", baseClaim())))},
 		},
+		"delete source pvc when destination pvc with data source ref is claim pending": {
+			cloneSource:     pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims:   []runtime.Object{pvcPhase(v1.ClaimPending, pvcDataSourceRefClone("", srcName, pvcNamed(dstName, baseClaim())))},
+			expectFinalizer: true,
+			expectError:     fmt.Errorf("PVC '%s' is in 'Pending' state, cloning in progress", dstName),
+		},
+		"delete source pvc cloned from another namespace without cross-namespace data sources": {
+			cloneSource:   pvcNamespaced(srcNamespace+"1", pvcFinalizers(baseClaim(), pvcCloneFinalizer)),
+			initialClaims: []runtime.Object{pvcPhase(v1.ClaimPending, pvcDataSourceRefClone(srcNamespace+"1", srcName, pvcNamed(dstName, baseClaim())))},
+		},
 		"delete source pvc which is not cloned by any other pvc": {
 			cloneSource: pvcFinalizers(baseClaim(), pvcCloneFinalizer),
 		},
@@ -142,11 +171,188 @@ func TestCloneFinalizerRemoval(t *testing.T) {
 
 }
 
+// TestCrossNamespaceCloneFinalizerRemoval tests that clones in other namespaces block the removal of the finalizer
+func TestCrossNamespaceCloneFinalizerRemoval(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.CrossNamespaceVolumeDataSource, true)()
+	ctx := context.Background()
+
+	cloneSource := pvcNamespaced(srcNamespace+"1", pvcFinalizers(baseClaim(), pvcCloneFinalizer))
+	clone := pvcPhase(v1.ClaimPending, pvcDataSourceRefClone(srcNamespace+"1", srcName, pvcNamed(dstName, baseClaim())))
+	clientSet := fakeclientset.NewSimpleClientset(cloneSource, clone)
+	cloningProtector := fakeCloningProtector(clientSet, cloneSource, clone)
+
+	expectError := fmt.Sprintf("PVC '%s/%s' is in 'Pending' state, cloning in progress", srcNamespace, dstName)
+	if err := cloningProtector.syncClaim(ctx, pvcDeletionMarked(cloneSource)); err == nil || err.Error() != expectError {
+		t.Errorf("Expected error %q during 'syncClaim' run, got: %v", expectError, err)
+	}
+	claim, _ := clientSet.CoreV1().PersistentVolumeClaims(cloneSource.Namespace).Get(ctx, cloneSource.Name, metav1.GetOptions{})
+	if !checkFinalizer(claim, pvcCloneFinalizer) {
+		t.Errorf("Claim finalizer was expected to be found on: %s", claim.Name)
+	}
+}
+
+// TestStuckCloneFinalizerRemoval tests the handling of clones which are pending for too long
+func TestStuckCloneFinalizerRemoval(t *testing.T) {
+	// Clones are created a long time ago, their age counts from the first
+	// provisioning attempt.
+	pendingClone := func(name string) runtime.Object {
+		pvc := pvcPhase(v1.ClaimPending, pvcDataSourceClone(srcName, pvcNamed(name, baseClaim())))
+		pvc.UID = types.UID(name)
+		pvc.CreationTimestamp = metav1.NewTime(time.Now().Add(-24 * time.Hour))
+		return pvc
+	}
+	testcases := map[string]struct {
+		initialClaims   []runtime.Object
+		cloneSource     *v1.PersistentVolumeClaim
+		cloneTimeout    *CloneTimeout
+		attempts        map[string]time.Duration
+		inFlight        []string
+		expectFinalizer bool
+		expectEvents    []string
+	}{
+		"clone within timeout": {
+			cloneSource:     pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims:   []runtime.Object{pendingClone(dstName)},
+			cloneTimeout:    &CloneTimeout{Timeout: time.Hour, Release: true},
+			attempts:        map[string]time.Duration{dstName: time.Minute},
+			expectFinalizer: true,
+		},
+		"clone without provisioning attempt": {
+			cloneSource:     pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims:   []runtime.Object{pendingClone(dstName)},
+			cloneTimeout:    &CloneTimeout{Timeout: time.Hour, Release: true},
+			expectFinalizer: true,
+		},
+		"stuck clone with wait policy": {
+			cloneSource:     pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims:   []runtime.Object{pendingClone(dstName)},
+			cloneTimeout:    &CloneTimeout{Timeout: time.Hour},
+			attempts:        map[string]time.Duration{dstName: 2 * time.Hour},
+			expectFinalizer: true,
+			expectEvents:    []string{"Warning CloneStuck", "Warning CloneStuck"},
+		},
+		"stuck clone with release policy": {
+			cloneSource:   pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims: []runtime.Object{pendingClone(dstName)},
+			cloneTimeout:  &CloneTimeout{Timeout: time.Hour, Release: true},
+			attempts:      map[string]time.Duration{dstName: 2 * time.Hour},
+			expectEvents:  []string{"Warning CloneStuck", "Warning CloneStuck"},
+		},
+		"stuck clone in flight with release policy": {
+			cloneSource:     pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims:   []runtime.Object{pendingClone(dstName)},
+			cloneTimeout:    &CloneTimeout{Timeout: time.Hour, Release: true},
+			attempts:        map[string]time.Duration{dstName: 2 * time.Hour},
+			inFlight:        []string{dstName},
+			expectFinalizer: true,
+			expectEvents:    []string{"Warning CloneStuck", "Warning CloneStuck"},
+		},
+		"one of two clones stuck with release policy": {
+			cloneSource:     pvcFinalizers(baseClaim(), pvcCloneFinalizer),
+			initialClaims:   []runtime.Object{pendingClone(dstName), pendingClone(dstName + "1")},
+			cloneTimeout:    &CloneTimeout{Timeout: time.Hour, Release: true},
+			attempts:        map[string]time.Duration{dstName: 2 * time.Hour, dstName + "1": time.Minute},
+			expectFinalizer: true,
+			expectEvents:    []string{"Warning CloneStuck", "Warning CloneStuck"},
+		},
+		"release annotation without timeout": {
+			cloneSource: func() *v1.PersistentVolumeClaim {
+				pvc := pvcFinalizers(baseClaim(), pvcCloneFinalizer)
+				pvc.Annotations = map[string]string{annReleaseCloningProtection: "true"}
+				return pvc
+			}(),
+			initialClaims: []runtime.Object{pendingClone(dstName)},
+			expectEvents:  []string{"Warning CloneSourceReleased"},
+		},
+	}
+
+	for k, tc := range testcases {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.Background()
+
+			objects := append(tc.initialClaims, tc.cloneSource)
+			clientSet := fakeclientset.NewSimpleClientset(objects...)
+			cloningProtector := fakeCloningProtector(clientSet, objects...)
+			eventRecorder := record.NewFakeRecorder(10)
+			cloningProtector.eventRecorder = eventRecorder
+			cloningProtector.cloneTimeout = tc.cloneTimeout
+			if tc.cloneTimeout != nil {
+				attempts := NewCloneAttempts()
+				for name, age := range tc.attempts {
+					attempts.started[types.UID(name)] = time.Now().Add(-age)
+				}
+				for _, name := range tc.inFlight {
+					attempts.inFlight[types.UID(name)] = 1
+				}
+				tc.cloneTimeout.Attempts = attempts
+			}
+
+			// Syncing again does not repeat the events.
+			for i := 0; i < 2; i++ {
+				err := cloningProtector.syncClaim(ctx, pvcDeletionMarked(tc.cloneSource))
+				if tc.expectFinalizer && err == nil {
+					t.Error("Expected error during 'syncClaim' run, got nil")
+				} else if !tc.expectFinalizer && err != nil {
+					t.Errorf("Caught an unexpected error during 'syncClaim' run: %s", err)
+				}
+				if !tc.expectFinalizer {
+					break
+				}
+			}
+
+			claim, _ := clientSet.CoreV1().PersistentVolumeClaims(tc.cloneSource.Namespace).Get(ctx, tc.cloneSource.Name, metav1.GetOptions{})
+			if tc.expectFinalizer != checkFinalizer(claim, pvcCloneFinalizer) {
+				t.Errorf("Expected finalizer %v on: %s", tc.expectFinalizer, claim.Name)
+			}
+
+			age := testutil.ToFloat64(PendingCloneAgeSeconds.WithLabelValues(claim.Namespace, claim.Name))
+			if tc.expectFinalizer && len(tc.attempts) > 0 && age < time.Minute.Seconds() {
+				t.Errorf("Expected pending clone age of at least one minute, got %vs", age)
+			} else if !tc.expectFinalizer && age != 0 {
+				t.Errorf("Expected no pending clone age after finalizer removal, got %vs", age)
+			}
+			PendingCloneAgeSeconds.Reset()
+
+			close(eventRecorder.Events)
+			var events []string
+			for event := range eventRecorder.Events {
+				events = append(events, strings.Join(strings.Fields(event)[:2], " "))
+			}
+			if strings.Join(events, ", ") != strings.Join(tc.expectEvents, ", ") {
+				t.Errorf("Expected events %v, got %v", tc.expectEvents, events)
+			}
+		})
+	}
+}
+
+func TestCloneAttempts(t *testing.T) {
+	attempts := NewCloneAttempts()
+	now := time.Now()
+	attempts.now = func() time.Time { return now }
+
+	finish := attempts.start("clone")
+	now = now.Add(time.Minute)
+	finishRetry := attempts.start("clone")
+	if started, inFlight := attempts.state("clone"); !started.Equal(now.Add(-time.Minute)) || !inFlight {
+		t.Errorf("expected first attempt one minute ago in flight, got %v, %v", started, inFlight)
+	}
+	finish(false)
+	finishRetry(false)
+	if started, inFlight := attempts.state("clone"); started.IsZero() || inFlight {
+		t.Errorf("expected finished attempt to be remembered, got %v, %v", started, inFlight)
+	}
+	attempts.start("clone")(true)
+	if started, _ := attempts.state("clone"); !started.IsZero() {
+		t.Errorf("expected provisioned clone to be forgotten, got %v", started)
+	}
+}
+
 // TestEnqueueClaimUpadate ensure that PVCs will be processed for finalizer removal only on deletionTimestamp being set on the resource
 func TestEnqueueClaimUpadate(t *testing.T) {
 	testcases := map[string]struct {
-		claim    *v1.PersistentVolumeClaim
-		queueLen int
+		initialClaims []runtime.Object
+		claim         *v1.PersistentVolumeClaim
+		queueLen      int
 	}{
 		"enqueue claim with deletionTimestamp": {
 			claim:    pvcDeletionMarked(baseClaim()),
@@ -156,6 +362,21 @@ func TestEnqueueClaimUpadate(t *testing.T) {
 			claim:    baseClaim(),
 			queueLen: 0,
 		},
+		"enqueue deleted source when clone is bound": {
+			initialClaims: []runtime.Object{pvcDeletionMarked(pvcFinalizers(baseClaim(), pvcCloneFinalizer))},
+			claim:         pvcDataSourceClone(srcName, pvcNamed(dstName, baseClaim())),
+			queueLen:      1,
+		},
+		"enqueue source without deletionTimestamp when clone is bound": {
+			initialClaims: []runtime.Object{pvcFinalizers(baseClaim(), pvcCloneFinalizer)},
+			claim:         pvcDataSourceClone(srcName, pvcNamed(dstName, baseClaim())),
+			queueLen:      0,
+		},
+		"enqueue deleted source when clone is pending": {
+			initialClaims: []runtime.Object{pvcDeletionMarked(pvcFinalizers(baseClaim(), pvcCloneFinalizer))},
+			claim:         pvcPhase(v1.ClaimPending, pvcDataSourceClone(srcName, pvcNamed(dstName, baseClaim()))),
+			queueLen:      0,
+		},
 	}
 
 	for k, tc := range testcases {
@@ -164,7 +385,7 @@ func TestEnqueueClaimUpadate(t *testing.T) {
 			t.Parallel()
 			ctx := context.Background()
 
-			objects := []runtime.Object{}
+			objects := tc.initialClaims
 			clientSet := fakeclientset.NewSimpleClientset(objects...)
 			cloningProtector := fakeCloningProtector(clientSet, objects...)
 
@@ -190,6 +411,7 @@ func fakeCloningProtector(client *fakeclientset.Clientset, objects ...runtime.Ob
 	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(time.Second, 2*time.Second)
 	claimQueue := workqueue.NewNamedRateLimitingQueue(rateLimiter, "claims")
 
+	claimInformer.AddIndexers(cache.Indexers{ClaimDataSourceIndex: ClaimDataSourceIndexFunc})
 	for _, claim := range objects {
 		claimInformer.GetStore().Add(claim)
 	}
@@ -203,5 +425,7 @@ func fakeCloningProtector(client *fakeclientset.Clientset, objects ...runtime.Ob
 		claimInformer,
 		claimQueue,
 		controllerCapabilities,
+		false,
+		nil,
 	)
 }
@@ -21,13 +21,17 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/accessmodes"
+	"github.com/kubernetes-csi/external-provisioner/pkg/audit"
 	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	"github.com/kubernetes-csi/external-provisioner/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -72,6 +76,10 @@ type secretParamsMap struct {
 }
 
 const (
+	// VolumeAttachmentPVIndex is the name of the VolumeAttachment informer
+	// index which is created by VolumeAttachmentPVIndexFunc.
+	VolumeAttachmentPVIndex = "pv"
+
 	// CSI Parameters prefixed with csiParameterPrefix are not passed through
 	// to the driver on CreateVolumeRequest calls. Instead they are intended
 	// to used by the CSI external-provisioner and maybe used to populate
@@ -101,6 +109,12 @@ const (
 	prefixedNodeExpandSecretNameKey      = csiParameterPrefix + "node-expand-secret-name"
 	prefixedNodeExpandSecretNamespaceKey = csiParameterPrefix + "node-expand-secret-namespace"
 
+	prefixedAllowVolumeImportKey = csiParameterPrefix + "allow-volume-import"
+
+	prefixedResolveParameterTemplatesKey = csiParameterPrefix + "resolve-parameter-templates"
+
+	prefixedAutoEnlargeRestoreSizeKey = csiParameterPrefix + "auto-enlarge-restore-size"
+
 	// [Deprecated] CSI Parameters that are put into fields but
 	// NOT stripped from the parameters passed to CreateVolume
 	provisionerSecretNameKey      = "csiProvisionerSecretName"
@@ -148,6 +162,16 @@ const (
 
 	pvcCloneFinalizer = "provisioner.storage.kubernetes.io/cloning-protection"
 
+	// Annotation on a PVC which names an existing volume in the storage
+	// backend. Instead of creating a new volume, that volume gets bound
+	// to the PVC. Only honored for storage classes which allow it.
+	annImportVolumeID = "provisioner.storage.kubernetes.io/import-volume-id"
+
+	// Annotation of a PV which was provisioned while tracing was
+	// enabled. It contains the OpenTelemetry trace ID of the successful
+	// provisioning attempt.
+	annTraceID = "provisioner.storage.kubernetes.io/trace-id"
+
 	annAllowVolumeModeChange = "snapshot.storage.kubernetes.io/allow-volume-mode-change"
 )
 
@@ -219,6 +243,8 @@ type ProvisionerCSITranslator interface {
 type requiredCapabilities struct {
 	snapshot bool
 	clone    bool
+	// hostAssistedClone replaces clone when the data gets copied by a Job.
+	hostAssistedClone bool
 }
 
 // NodeDeployment contains additional parameters for running external-provisioner alongside a
@@ -254,12 +280,18 @@ type csiProvisioner struct {
 	snapshotClient                        snapclientset.Interface
 	timeout                               time.Duration
 	identity                              string
+	volumeHandleClusterID                 string
 	volumeNamePrefix                      string
 	defaultFSType                         string
 	volumeNameUUIDLength                  int
+	volumeNameTemplate                    string
+	volumeNameMaxLength                   int
 	driverName                            string
 	pluginCapabilities                    rpc.PluginCapabilitySet
 	controllerCapabilities                rpc.ControllerCapabilitySet
+	groupControllerCapabilities           rpc.GroupControllerCapabilitySet
+	groupControllerClient                 csi.GroupControllerClient
+	groupRestoreChecks                    groupRestoreChecks
 	supportsMigrationFromInTreePluginName string
 	strictTopology                        bool
 	immediateTopology                     bool
@@ -268,13 +300,32 @@ type csiProvisioner struct {
 	csiNodeLister                         storagelistersv1.CSINodeLister
 	nodeLister                            corelisters.NodeLister
 	claimLister                           corelisters.PersistentVolumeClaimLister
-	vaLister                              storagelistersv1.VolumeAttachmentLister
+	vaIndexer                             cache.Indexer
+	pvLister                              corelisters.PersistentVolumeLister
 	referenceGrantLister                  referenceGrantv1beta1.ReferenceGrantLister
 	extraCreateMetadata                   bool
 	eventRecorder                         record.EventRecorder
 	nodeDeployment                        *internalNodeDeployment
 	controllerPublishReadOnly             bool
 	preventVolumeModeConversion           bool
+	pvcMetadataAllowlist                  PVCMetadataAllowlist
+	quotaChecker                          *QuotaChecker
+	provisioningPriority                  *ProvisioningPriority
+	namespaceFairness                     *NamespaceFairness
+	auditLogger                           *audit.Logger
+	secretCache                           *SecretCache
+	credentialProviders                   map[string]CredentialProvider
+	hostAssistedClone                     *HostAssistedClone
+	trash                                 *Trash
+	deletionCircuitBreaker                *DeletionCircuitBreaker
+	capacityRanking                       *CapacityRanking
+	topologySpreading                     *TopologySpreading
+	operationLimiter                      *operationLimiter
+	orphanRecord                          *OrphanRecord
+	orphanedVolumeController              *OrphanedVolumeController
+	pvIndexer                             cache.Indexer
+	volumeNames                           *volumeNameReservations
+	cloneAttempts                         *CloneAttempts
 }
 
 var (
@@ -320,6 +371,18 @@ func GetDriverCapabilities(conn *grpc.ClientConn, timeout time.Duration) (rpc.Pl
 	return pluginCapabilities, controllerCapabilities, nil
 }
 
+// GetGroupControllerCapabilities returns the group controller capabilities
+// of the driver. The set is empty if the driver does not implement the
+// group controller service.
+func GetGroupControllerCapabilities(conn *grpc.ClientConn, timeout time.Duration, pluginCapabilities rpc.PluginCapabilitySet) (rpc.GroupControllerCapabilitySet, error) {
+	if !pluginCapabilities[csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE] {
+		return rpc.GroupControllerCapabilitySet{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return rpc.GetGroupControllerCapabilities(ctx, conn)
+}
+
 func GetNodeInfo(conn *grpc.ClientConn, timeout time.Duration) (*csi.NodeGetInfoResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -329,8 +392,10 @@ func GetNodeInfo(conn *grpc.ClientConn, timeout time.Duration) (*csi.NodeGetInfo
 
 // NewCSIProvisioner creates new CSI provisioner.
 //
-// vaLister is optional and only needed when VolumeAttachments are
-// meant to be checked before deleting a volume.
+// vaIndexer is optional and only needed when VolumeAttachments are
+// meant to be checked before deleting a volume. It must have the
+// VolumeAttachmentPVIndex. Further optional components get enabled
+// through opts.
 func NewCSIProvisioner(client kubernetes.Interface,
 	connectionTimeout time.Duration,
 	identity string,
@@ -349,13 +414,14 @@ func NewCSIProvisioner(client kubernetes.Interface,
 	csiNodeLister storagelistersv1.CSINodeLister,
 	nodeLister corelisters.NodeLister,
 	claimLister corelisters.PersistentVolumeClaimLister,
-	vaLister storagelistersv1.VolumeAttachmentLister,
+	vaIndexer cache.Indexer,
 	referenceGrantLister referenceGrantv1beta1.ReferenceGrantLister,
 	extraCreateMetadata bool,
 	defaultFSType string,
 	nodeDeployment *NodeDeployment,
 	controllerPublishReadOnly bool,
 	preventVolumeModeConversion bool,
+	opts ...ProvisionerOption,
 ) controller.Provisioner {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartLogging(klog.Infof)
@@ -377,6 +443,7 @@ func NewCSIProvisioner(client kubernetes.Interface,
 		driverName:                            driverName,
 		pluginCapabilities:                    pluginCapabilities,
 		controllerCapabilities:                controllerCapabilities,
+		groupControllerClient:                 csi.NewGroupControllerClient(grpcClient),
 		supportsMigrationFromInTreePluginName: supportsMigrationFromInTreePluginName,
 		strictTopology:                        strictTopology,
 		immediateTopology:                     immediateTopology,
@@ -385,12 +452,33 @@ func NewCSIProvisioner(client kubernetes.Interface,
 		csiNodeLister:                         csiNodeLister,
 		nodeLister:                            nodeLister,
 		claimLister:                           claimLister,
-		vaLister:                              vaLister,
+		vaIndexer:                             vaIndexer,
 		referenceGrantLister:                  referenceGrantLister,
 		extraCreateMetadata:                   extraCreateMetadata,
 		eventRecorder:                         eventRecorder,
 		controllerPublishReadOnly:             controllerPublishReadOnly,
 		preventVolumeModeConversion:           preventVolumeModeConversion,
+		credentialProviders:                   map[string]CredentialProvider{},
+		operationLimiter:                      newOperationLimiter(),
+		volumeNames:                           &volumeNameReservations{names: map[string]*volumeNameReservation{}},
+	}
+	for _, opt := range opts {
+		opt(provisioner)
+	}
+	provisioner.credentialProviders[CredentialProviderSecret] = &secretCredentialProvider{client: client, secretCache: provisioner.secretCache}
+	if provisioner.trash != nil {
+		provisioner.trash.deleteVolume = provisioner.deleteVolume
+		provisioner.trash.eventRecorder = eventRecorder
+	}
+	if provisioner.deletionCircuitBreaker != nil {
+		provisioner.deletionCircuitBreaker.eventRecorder = eventRecorder
+	}
+	if provisioner.orphanedVolumeController != nil {
+		provisioner.orphanedVolumeController.deletionSecrets = provisioner.orphanDeletionSecrets
+		provisioner.orphanedVolumeController.eventRecorder = eventRecorder
+	}
+	if provisioner.hostAssistedClone != nil {
+		provisioner.hostAssistedClone.sweep = provisioner.sweepHostAssistedClones
 	}
 	if nodeDeployment != nil {
 		provisioner.nodeDeployment = &internalNodeDeployment{
@@ -528,6 +616,7 @@ func (p *csiProvisioner) getVolumeCapabilities(
 type deletionSecretParams struct {
 	name      string
 	namespace string
+	provider  string
 }
 
 type prepareProvisionResult struct {
@@ -536,6 +625,17 @@ type prepareProvisionResult struct {
 	req                 *csi.CreateVolumeRequest
 	csiPVSource         *v1.CSIPersistentVolumeSource
 	provDeletionSecrets *deletionSecretParams
+	// importVolumeID is set when an existing volume gets imported
+	// instead of creating a new one.
+	importVolumeID string
+	// pvName is the name of the new PV. It differs from the name in
+	// the request when a volume name template is used.
+	pvName string
+	// limits are the concurrency limits and timeouts of the storage class.
+	limits *storageClassLimits
+	// hostAssistedCloneSource is the PVC data source if its data gets
+	// copied by a Job after creating an empty volume.
+	hostAssistedCloneSource *v1.ObjectReference
 }
 
 // prepareProvision does non-destructive parameter checking and preparations for provisioning a volume.
@@ -545,6 +645,7 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	}
 
 	// normalize dataSource and dataSourceRef.
+	explainStep(ctx, "normalize data source")
 	dataSource, err := p.dataSource(ctx, claim)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
@@ -557,6 +658,7 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		// set to the CSI provisioner name by PV controller for migration scenarios
 		// so that external provisioner can correctly pick up the PVC pointing to an in-tree plugin
 		if sc.Provisioner == p.supportsMigrationFromInTreePluginName {
+			explainStep(ctx, "translate storage class")
 			klog.V(2).Infof("translating storage class for in-tree plugin %s to CSI", sc.Provisioner)
 			storageClass, err := p.translator.TranslateInTreeStorageClassToCSI(p.supportsMigrationFromInTreePluginName, sc)
 			if err != nil {
@@ -569,9 +671,18 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		}
 	}
 
+	importVolumeID := claim.Annotations[annImportVolumeID]
+	if importVolumeID != "" {
+		explainStep(ctx, "check volume import")
+		if err := checkVolumeImport(sc, dataSource, migratedVolume); err != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("cannot import volume %s: %v", importVolumeID, err)
+		}
+	}
+
 	// Make sure the plugin is capable of fulfilling the requested options
 	rc := &requiredCapabilities{}
 	if dataSource != nil {
+		explainStep(ctx, "check data source kind")
 		// PVC.Spec.DataSource.Name is the name of the VolumeSnapshot API object
 		if dataSource.Name == "" {
 			return nil, controller.ProvisioningFinished, fmt.Errorf("the PVC source not found for PVC %s", claim.Name)
@@ -588,7 +699,9 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		default:
 			// DataSource is not VolumeSnapshot and PVC
 			// Assume external data populator to create the volume, and there is no more work for us to do
-			p.eventRecorder.Event(claim, v1.EventTypeNormal, "Provisioning", fmt.Sprintf("Assuming an external populator will provision the volume"))
+			if !isDryRun(ctx) {
+				p.eventRecorder.Event(claim, v1.EventTypeNormal, "Provisioning", fmt.Sprintf("Assuming an external populator will provision the volume"))
+			}
 			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
 				Reason: fmt.Sprintf("data source (%s) is not handled by the provisioner, assuming an external populator will provision it",
 					dataSource.Kind),
@@ -596,19 +709,40 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		}
 	}
 
+	if rc.clone && p.hostAssistedClone != nil {
+		explainStep(ctx, "check host-assisted clone")
+		if p.needsHostAssistedClone(ctx, sc.Provisioner, dataSource) {
+			rc.clone = false
+			rc.hostAssistedClone = true
+		}
+	}
+
+	explainStep(ctx, "check driver capabilities")
 	if err := p.checkDriverCapabilities(rc); err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
 
+	explainStep(ctx, "check claim selector")
 	if claim.Spec.Selector != nil {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("claim Selector is not supported")
 	}
 
+	explainStep(ctx, "generate volume name")
 	pvName, err := makeVolumeName(p.volumeNamePrefix, fmt.Sprintf("%s", claim.ObjectMeta.UID), p.volumeNameUUIDLength)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
+	volumeName := pvName
+	// Imported volumes already have a name and in-tree plugins
+	// expect the PV name.
+	if importVolumeID == "" && !migratedVolume {
+		volumeName, err = p.volumeName(claim, sc, pvName)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
 
+	explainStep(ctx, "resolve fstype")
 	fsTypesFound := 0
 	fsType := ""
 	for k, v := range sc.Parameters {
@@ -630,6 +764,7 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	capacity := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	volSizeBytes := capacity.Value()
 
+	explainStep(ctx, "resolve volume capabilities")
 	volumeCaps, err := p.getVolumeCapabilities(claim, sc, fsType)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
@@ -637,7 +772,7 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 
 	// Create a CSI CreateVolumeRequest and Response
 	req := csi.CreateVolumeRequest{
-		Name:               pvName,
+		Name:               volumeName,
 		Parameters:         sc.Parameters,
 		VolumeCapabilities: volumeCaps,
 		CapacityRange: &csi.CapacityRange{
@@ -645,15 +780,48 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		},
 	}
 
-	if dataSource != nil && (rc.clone || rc.snapshot) {
-		volumeContentSource, err := p.getVolumeContentSource(ctx, claim, sc, dataSource)
+	if dataSource != nil && (rc.clone || rc.snapshot || rc.hostAssistedClone) {
+		explainStep(ctx, fmt.Sprintf("validate %s data source", dataSource.Kind))
+		autoEnlarge := false
+		if value, ok := sc.Parameters[prefixedAutoEnlargeRestoreSizeKey]; ok {
+			autoEnlarge, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, controller.ProvisioningFinished, fmt.Errorf("failed to parse %s parameter: %v", prefixedAutoEnlargeRestoreSizeKey, err)
+			}
+		}
+		var volumeContentSource *csi.VolumeContentSource
+		var sourceSize int64
+		if rc.hostAssistedClone {
+			// The volume gets created empty.
+			sourceSize, err = p.checkHostAssistedCloneSource(claim, dataSource, autoEnlarge)
+		} else {
+			volumeContentSource, sourceSize, err = p.getVolumeContentSource(ctx, claim, sc, dataSource, autoEnlarge)
+		}
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, fmt.Errorf("error getting handle for DataSource Type %s by Name %s: %v", dataSource.Kind, dataSource.Name, err)
 		}
 		req.VolumeContentSource = volumeContentSource
+		if sourceSize > req.CapacityRange.RequiredBytes {
+			// Only possible with autoEnlarge, the size of the PV
+			// is the capacity that the driver reports.
+			klog.V(2).Infof("Enlarging requested capacity %d of PVC %s to size %d of %s %s", req.CapacityRange.RequiredBytes, klog.KObj(claim), sourceSize, dataSource.Kind, dataSource.Name)
+			if !isDryRun(ctx) {
+				requested, enlarged := bytesToQuantity(req.CapacityRange.RequiredBytes), bytesToQuantity(sourceSize)
+				p.eventRecorder.Eventf(claim, v1.EventTypeNormal, "CapacityEnlarged", "Requested capacity %s is smaller than the size of %s %s, provisioning with %s",
+					requested.String(), dataSource.Kind, dataSource.Name, enlarged.String())
+			}
+			req.CapacityRange.RequiredBytes = sourceSize
+		}
+	}
+
+	if claim.Annotations[annGroupRestore] != "" {
+		explainStep(ctx, "check group restore")
+		if err := p.checkGroupRestore(ctx, claim, sc); err != nil {
+			return nil, controller.ProvisioningNoChange, err
+		}
 	}
 
-	if dataSource != nil && rc.clone {
+	if dataSource != nil && (rc.clone || rc.hostAssistedClone) && !isDryRun(ctx) {
 		err = p.setCloneFinalizer(ctx, claim, dataSource)
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, err
@@ -661,6 +829,7 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	}
 
 	if p.supportsTopology() {
+		explainStep(ctx, "generate accessibility requirements")
 		requirements, err := GenerateAccessibilityRequirements(
 			p.client,
 			p.driverName,
@@ -674,10 +843,26 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, fmt.Errorf("error generating accessibility requirements: %v", err)
 		}
+		if requirements != nil && selectedNode == nil {
+			// Spreading gets applied last because it takes precedence.
+			if p.capacityRanking != nil {
+				explainStep(ctx, "rank preferred topology by capacity")
+				if err := p.capacityRanking.rank(sc.Name, requirements.Preferred); err != nil {
+					return nil, controller.ProvisioningNoChange, err
+				}
+			}
+			if p.topologySpreading != nil {
+				explainStep(ctx, "spread preferred topology")
+				if err := p.topologySpreading.rank(ctx, claim, requirements.Preferred); err != nil {
+					return nil, controller.ProvisioningNoChange, err
+				}
+			}
+		}
 		req.AccessibilityRequirements = requirements
 	}
 
 	// Resolve provision secret credentials.
+	explainStep(ctx, "resolve provisioner secret")
 	provisionerSecretRef, err := getSecretReference(provisionerSecretParams, sc.Parameters, pvName, &v1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      claim.Name,
@@ -687,13 +872,18 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, err
 	}
-	provisionerCredentials, err := getCredentials(ctx, p.client, provisionerSecretRef)
+	credentialProvider := sc.Parameters[prefixedProvisionerSecretProviderKey]
+	if _, err := p.credentialProvider(credentialProvider); err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	provisionerCredentials, err := p.getCredentials(ctx, credentialProvider, provisionerSecretRef)
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, err
 	}
 	req.Secrets = provisionerCredentials
 
 	// Resolve controller publish, node stage, node publish secret references
+	explainStep(ctx, "resolve secret references")
 	controllerPublishSecretRef, err := getSecretReference(controllerPublishSecretParams, sc.Parameters, pvName, claim)
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, err
@@ -724,36 +914,67 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		NodeExpandSecretRef:        nodeExpandSecretRef,
 	}
 
-	req.Parameters, err = removePrefixedParameters(sc.Parameters)
+	explainStep(ctx, "resolve parameter templates")
+	parameters, err := resolveParameterTemplates(sc.Parameters, pvName, claim)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	explainStep(ctx, "strip prefixed parameters")
+	req.Parameters, err = removePrefixedParameters(parameters)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("failed to strip CSI Parameters of prefixed keys: %v", err)
 	}
 
+	explainStep(ctx, "parse storage class limits")
+	limits, err := parseStorageClassLimits(sc.Parameters)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
 	if p.extraCreateMetadata {
 		// add pvc and pv metadata to request for use by the plugin
 		req.Parameters[pvcNameKey] = claim.GetName()
 		req.Parameters[pvcNamespaceKey] = claim.GetNamespace()
 		req.Parameters[pvNameKey] = pvName
 	}
+	explainStep(ctx, "add PVC labels and annotations")
+	p.addPVCMetadata(ctx, claim, sc, req.Parameters)
 	deletionAnnSecrets := new(deletionSecretParams)
 
 	if provisionerSecretRef != nil {
 		deletionAnnSecrets.name = provisionerSecretRef.Name
 		deletionAnnSecrets.namespace = provisionerSecretRef.Namespace
+		deletionAnnSecrets.provider = credentialProvider
 	}
 
-	return &prepareProvisionResult{
+	result := &prepareProvisionResult{
 		fsType:              fsType,
 		migratedVolume:      migratedVolume,
 		req:                 &req,
 		csiPVSource:         csiPVSource,
 		provDeletionSecrets: deletionAnnSecrets,
-	}, controller.ProvisioningNoChange, nil
+		importVolumeID:      importVolumeID,
+		pvName:              pvName,
+		limits:              limits,
+	}
+	if rc.hostAssistedClone {
+		result.hostAssistedCloneSource = dataSource
+	}
+	return result, controller.ProvisioningNoChange, nil
 
 }
 
-func (p *csiProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+func (p *csiProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (pv *v1.PersistentVolume, state controller.ProvisioningState, err error) {
 	claim := options.PVC
+	ctx, span := tracing.Start(ctx, "Provision",
+		attribute.String("pvc.namespace", claim.Namespace),
+		attribute.String("pvc.name", claim.Name),
+		attribute.String("storageclass", util.GetPersistentVolumeClaimClass(claim)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	provisioner, ok := claim.Annotations[annStorageProvisioner]
 	if !ok {
 		provisioner = claim.Annotations[annBetaStorageProvisioner]
@@ -782,19 +1003,83 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		}
 	}
 
-	result, state, err := p.prepareProvision(ctx, claim, options.StorageClass, options.SelectedNode)
+	if p.provisioningPriority != nil {
+		finish := p.provisioningPriority.admit(claim)
+		defer func() {
+			finish(err != nil)
+		}()
+	}
+	if p.namespaceFairness != nil {
+		defer p.namespaceFairness.admit(provisionOperation, claim.Namespace, string(claim.UID))()
+	}
+
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		klog.V(3).Infof("Provisioning of PVC %s/%s is traced with trace ID %s", claim.Namespace, claim.Name, traceID)
+	}
+
+	if p.cloneAttempts != nil && claimDataSourceKey(claim) != "" {
+		finish := p.cloneAttempts.start(claim.UID)
+		defer func() {
+			finish(pv != nil)
+		}()
+	}
+
+	prepareCtx, prepareSpan := tracing.Start(ctx, "prepareProvision")
+	result, state, err := p.prepareProvision(prepareCtx, claim, options.StorageClass, options.SelectedNode)
+	tracing.End(prepareSpan, err)
 	if result == nil {
 		return nil, state, err
 	}
+	span.SetAttributes(attribute.String("pv.name", result.pvName))
 	req := result.req
 	volSizeBytes := req.CapacityRange.RequiredBytes
-	pvName := req.Name
 	provisionerCredentials := req.Secrets
 
+	if p.quotaChecker != nil {
+		if err := p.quotaChecker.reserve(result.pvName, options.StorageClass.Name, claim.Namespace, volSizeBytes); err != nil {
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "QuotaExceeded", err.Error())
+			return nil, controller.ProvisioningFinished, err
+		}
+		defer func() {
+			p.quotaChecker.finish(result.pvName, pv != nil, state)
+		}()
+	}
+
+	if req.Name != result.pvName {
+		if err := p.reserveVolumeName(claim, req.Name, result.pvName); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		defer func() {
+			p.finishVolumeName(req.Name, result.pvName, pv != nil, state)
+		}()
+	}
+
+	// Nothing has been started yet when the limit is reached, so
+	// provisioning can simply be retried.
+	release, err := p.operationLimiter.tryAcquire(createOperation, options.StorageClass.Name, result.pvName, result.limits.maxConcurrentCreates)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	defer release()
+
 	createCtx := markAsMigrated(ctx, result.migratedVolume)
-	createCtx, cancel := context.WithTimeout(createCtx, p.timeout)
+	createCtx, cancel := context.WithTimeout(createCtx, limitOrDefault(result.limits.createTimeout, p.timeout))
 	defer cancel()
+	if result.importVolumeID != "" {
+		importCtx, importSpan := tracing.Start(createCtx, "importVolume", attribute.String("volume.id", result.importVolumeID))
+		rep, err := p.importVolume(importCtx, req, result.pvName, result.importVolumeID)
+		tracing.End(importSpan, err)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		klog.V(2).Infof("importing existing volume %s for PVC %s/%s", result.importVolumeID, claim.Namespace, claim.Name)
+		return p.newPersistentVolume(ctx, options, result, rep)
+	}
+	createCtx, createSpan := tracing.StartGRPC(createCtx, "CreateVolume", attribute.String("volume.name", req.Name))
+	start := time.Now()
 	rep, err := p.csiClient.CreateVolume(createCtx, req)
+	p.auditCreateVolume(claim, result.pvName, req, rep, start, err)
+	tracing.End(createSpan, err)
 	if err != nil {
 		// Giving up after an error and telling the pod scheduler to retry with a different node
 		// only makes sense if:
@@ -825,29 +1110,28 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 	if rep.Volume != nil {
 		klog.V(3).Infof("create volume rep: %+v", *rep.Volume)
 	}
-	volumeAttributes := map[string]string{provisionerIDKey: p.identity}
-	for k, v := range rep.Volume.VolumeContext {
-		volumeAttributes[k] = v
-	}
 	respCap := rep.GetVolume().GetCapacityBytes()
-
-	// According to CSI spec CreateVolume should be able to return capacity = 0, which means it is unknown. for example NFS/FTP
-	if respCap == 0 {
-		respCap = volSizeBytes
-		klog.V(3).Infof("csiClient response volume with size 0, which is not supported by apiServer, will use claim size:%d", respCap)
-	} else if respCap < volSizeBytes {
+	if respCap != 0 && respCap < volSizeBytes {
 		capErr := fmt.Errorf("created volume capacity %v less than requested capacity %v", respCap, volSizeBytes)
 		delReq := &csi.DeleteVolumeRequest{
 			VolumeId: rep.GetVolume().GetVolumeId(),
 		}
-		err = cleanupVolume(ctx, p, delReq, provisionerCredentials)
+		err = cleanupVolume(ctx, p, claim, options.StorageClass.Name, result.pvName, delReq, provisionerCredentials)
 		if err != nil {
-			capErr = fmt.Errorf("%v. Cleanup of volume %s failed, volume is orphaned: %v", capErr, pvName, err)
+			capErr = fmt.Errorf("%v. Cleanup of volume %s failed, volume is orphaned: %v", capErr, req.Name, err)
 		}
 		// use InBackground to retry the call, hoping the volume is deleted correctly next time.
 		return nil, controller.ProvisioningInBackground, capErr
 	}
 
+	if result.hostAssistedCloneSource != nil {
+		pv, state, err := p.newPersistentVolume(ctx, options, result, rep)
+		if err != nil {
+			return nil, state, err
+		}
+		return p.copyHostAssistedClone(ctx, claim, pv, result.hostAssistedCloneSource)
+	}
+
 	if options.PVC.Spec.DataSource != nil ||
 		(utilfeature.DefaultFeatureGate.Enabled(features.CrossNamespaceVolumeDataSource) &&
 			options.PVC.Spec.DataSourceRef != nil && options.PVC.Spec.DataSourceRef.Namespace != nil &&
@@ -858,13 +1142,37 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 			delReq := &csi.DeleteVolumeRequest{
 				VolumeId: rep.GetVolume().GetVolumeId(),
 			}
-			err = cleanupVolume(ctx, p, delReq, provisionerCredentials)
+			err = cleanupVolume(ctx, p, claim, options.StorageClass.Name, result.pvName, delReq, provisionerCredentials)
 			if err != nil {
-				sourceErr = fmt.Errorf("%v. cleanup of volume %s failed, volume is orphaned: %v", sourceErr, pvName, err)
+				sourceErr = fmt.Errorf("%v. cleanup of volume %s failed, volume is orphaned: %v", sourceErr, req.Name, err)
 			}
 			return nil, controller.ProvisioningInBackground, sourceErr
 		}
 	}
+	return p.newPersistentVolume(ctx, options, result, rep)
+}
+
+// newPersistentVolume creates the PV object for a volume which was
+// created or imported for the PVC.
+func (p *csiProvisioner) newPersistentVolume(ctx context.Context, options controller.ProvisionOptions, result *prepareProvisionResult, rep *csi.CreateVolumeResponse) (_ *v1.PersistentVolume, _ controller.ProvisioningState, err error) {
+	ctx, span := tracing.Start(ctx, "newPersistentVolume", attribute.String("volume.id", rep.GetVolume().GetVolumeId()))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	req := result.req
+	volumeAttributes := map[string]string{provisionerIDKey: p.identity}
+	for k, v := range rep.Volume.VolumeContext {
+		volumeAttributes[k] = v
+	}
+	respCap := rep.GetVolume().GetCapacityBytes()
+
+	// According to CSI spec CreateVolume should be able to return capacity = 0, which means it is unknown. for example NFS/FTP
+	if respCap == 0 {
+		respCap = req.CapacityRange.RequiredBytes
+		klog.V(3).Infof("csiClient response volume with size 0, which is not supported by apiServer, will use claim size:%d", respCap)
+	}
+
 	pvReadOnly := false
 	volCaps := req.GetVolumeCapabilities()
 	// if the request only has one accessmode and if its ROX, set readonly to true
@@ -873,12 +1181,17 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		pvReadOnly = true
 	}
 
-	result.csiPVSource.VolumeHandle = p.volumeIdToHandle(rep.Volume.VolumeId)
+	if result.migratedVolume {
+		// The handle gets translated back to an in-tree volume source.
+		result.csiPVSource.VolumeHandle = rep.Volume.VolumeId
+	} else {
+		result.csiPVSource.VolumeHandle = p.volumeIdToHandle(rep.Volume.VolumeId)
+	}
 	result.csiPVSource.VolumeAttributes = volumeAttributes
 	result.csiPVSource.ReadOnly = pvReadOnly
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: pvName,
+			Name: result.pvName,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			AccessModes:  options.PVC.Spec.AccessModes,
@@ -898,11 +1211,22 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		klog.V(5).Infof("createVolumeOperation: set annotation [%s/%s] on pv [%s].", annDeletionProvisionerSecretRefNamespace, annDeletionProvisionerSecretRefName, pv.Name)
 		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefName, result.provDeletionSecrets.name)
 		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefNamespace, result.provDeletionSecrets.namespace)
+		if provider := result.provDeletionSecrets.provider; provider != "" && provider != CredentialProviderSecret {
+			metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretProvider, provider)
+		}
 	} else {
 		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefName, "")
 		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefNamespace, "")
 	}
 
+	if req.Name != result.pvName {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annVolumeName, req.Name)
+	}
+
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annTraceID, traceID)
+	}
+
 	if options.StorageClass.ReclaimPolicy != nil {
 		pv.Spec.PersistentVolumeReclaimPolicy = *options.StorageClass.ReclaimPolicy
 	}
@@ -955,6 +1279,106 @@ func (p *csiProvisioner) setCloneFinalizer(ctx context.Context, pvc *v1.Persiste
 	return nil
 }
 
+// checkVolumeImport verifies that importing an existing volume is possible
+// for a PVC. Importing must be enabled explicitly in the storage class
+// because the PVC user gets to choose the volume.
+func checkVolumeImport(sc *storagev1.StorageClass, dataSource *v1.ObjectReference, migratedVolume bool) error {
+	allow, ok := sc.Parameters[prefixedAllowVolumeImportKey]
+	if !ok {
+		return fmt.Errorf("storage class %s does not allow importing volumes", sc.Name)
+	}
+	allowed, err := strconv.ParseBool(allow)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s parameter of storage class %s: %v", prefixedAllowVolumeImportKey, sc.Name, err)
+	}
+	if !allowed {
+		return fmt.Errorf("storage class %s does not allow importing volumes", sc.Name)
+	}
+	if dataSource != nil {
+		return errors.New("a volume cannot be imported for a PVC with a data source")
+	}
+	if migratedVolume {
+		return errors.New("importing volumes is not supported for migrated storage classes")
+	}
+	return nil
+}
+
+// importVolume returns the existing volume with the given ID in the same
+// form as CreateVolume would have returned a new volume. When the driver
+// supports GET_VOLUME, the volume is checked against the request.
+func (p *csiProvisioner) importVolume(ctx context.Context, req *csi.CreateVolumeRequest, pvName, volumeID string) (*csi.CreateVolumeResponse, error) {
+	if p.pvLister == nil {
+		return nil, fmt.Errorf("cannot import volume %s: importing volumes is not enabled", volumeID)
+	}
+	pvs, err := p.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("cannot import volume %s: failed to list persistentvolumes: %v", volumeID, err)
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != p.driverName {
+			continue
+		}
+		// A PV with the name of the new PV is left over from an
+		// earlier attempt for the same PVC.
+		if _, id := decodeVolumeHandle(pv.Spec.CSI.VolumeHandle); pv.Name != pvName && id == volumeID {
+			return nil, fmt.Errorf("cannot import volume %s: already in use by persistentvolume %s", volumeID, pv.Name)
+		}
+	}
+
+	if !p.controllerCapabilities[csi.ControllerServiceCapability_RPC_GET_VOLUME] {
+		klog.Warningf("CSI driver does not support GET_VOLUME, importing volume %s without checking it", volumeID)
+		return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: volumeID}}, nil
+	}
+
+	rsp, err := p.csiClient.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		return nil, fmt.Errorf("cannot import volume %s: ControllerGetVolume failed: %v", volumeID, err)
+	}
+	volume := rsp.GetVolume()
+	if volume.GetVolumeId() != volumeID {
+		return nil, fmt.Errorf("cannot import volume %s: ControllerGetVolume returned volume %q", volumeID, volume.GetVolumeId())
+	}
+	if condition := rsp.GetStatus().GetVolumeCondition(); condition.GetAbnormal() {
+		return nil, fmt.Errorf("cannot import volume %s: volume is abnormal: %s", volumeID, condition.GetMessage())
+	}
+	if capacity := volume.GetCapacityBytes(); capacity != 0 && capacity < req.GetCapacityRange().GetRequiredBytes() {
+		return nil, fmt.Errorf("cannot import volume %s: volume capacity %d is less than requested capacity %d", volumeID, capacity, req.GetCapacityRange().GetRequiredBytes())
+	}
+	if !volumeAccessibleFrom(volume.GetAccessibleTopology(), req.GetAccessibilityRequirements()) {
+		return nil, fmt.Errorf("cannot import volume %s: volume topology %v does not match the accessibility requirements", volumeID, volume.GetAccessibleTopology())
+	}
+	return &csi.CreateVolumeResponse{Volume: volume}, nil
+}
+
+// volumeAccessibleFrom checks whether a volume with the given accessible
+// topology satisfies the accessibility requirements. A volume topology
+// matches a required topology when all segments that are present in both
+// have the same value.
+func volumeAccessibleFrom(volumeTopology []*csi.Topology, requirements *csi.TopologyRequirement) bool {
+	required := requirements.GetRequisite()
+	if len(required) == 0 {
+		required = requirements.GetPreferred()
+	}
+	if len(volumeTopology) == 0 || len(required) == 0 {
+		return true
+	}
+	for _, volumeSegments := range volumeTopology {
+		for _, requiredSegments := range required {
+			match := true
+			for key, value := range volumeSegments.GetSegments() {
+				if requiredValue, ok := requiredSegments.GetSegments()[key]; ok && requiredValue != value {
+					match = false
+					break
+				}
+			}
+			if match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (p *csiProvisioner) supportsTopology() bool {
 	return SupportsTopology(p.pluginCapabilities)
 }
@@ -968,6 +1392,7 @@ func removePrefixedParameters(param map[string]string) (map[string]string, error
 			case prefixedFsTypeKey:
 			case prefixedProvisionerSecretNameKey:
 			case prefixedProvisionerSecretNamespaceKey:
+			case prefixedProvisionerSecretProviderKey:
 			case prefixedControllerPublishSecretNameKey:
 			case prefixedControllerPublishSecretNamespaceKey:
 			case prefixedNodeStageSecretNameKey:
@@ -980,6 +1405,18 @@ func removePrefixedParameters(param map[string]string) (map[string]string, error
 			case prefixedDefaultSecretNamespaceKey:
 			case prefixedNodeExpandSecretNameKey:
 			case prefixedNodeExpandSecretNamespaceKey:
+			case prefixedAllowVolumeImportKey:
+			case prefixedResolveParameterTemplatesKey:
+			case prefixedAutoEnlargeRestoreSizeKey:
+			case prefixedTrashRetentionKey:
+			case prefixedPVCLabelAllowlistKey:
+			case prefixedPVCAnnotationAllowlistKey:
+			case prefixedVolumeNameTemplateKey:
+			case prefixedMaxConcurrentCreatesKey:
+			case prefixedMaxConcurrentDeletesKey:
+			case prefixedCreateTimeoutKey:
+			case prefixedDeleteTimeoutKey:
+			case prefixedGetCapacityTimeoutKey:
 			default:
 				return map[string]string{}, fmt.Errorf("found unknown parameter key \"%s\" with reserved namespace %s", k, csiParameterPrefix)
 			}
@@ -996,99 +1433,112 @@ func removePrefixedParameters(param map[string]string) (map[string]string, error
 // currently we provide Snapshot and PVC, the default case allows the provisioner to still create a volume
 // so that an external controller can act upon it.   Additional DataSource types can be added here with
 // an appropriate implementation function
-func (p *csiProvisioner) getVolumeContentSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, error) {
+//
+// It also returns the size of the source, zero if unknown. A requested
+// capacity smaller than that is an error, unless autoEnlarge is set.
+func (p *csiProvisioner) getVolumeContentSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference, autoEnlarge bool) (*csi.VolumeContentSource, int64, error) {
 	switch dataSource.Kind {
 	case snapshotKind:
-		return p.getSnapshotSource(ctx, claim, sc, dataSource)
+		return p.getSnapshotSource(ctx, claim, sc, dataSource, autoEnlarge)
 	case pvcKind:
-		return p.getPVCSource(ctx, claim, sc, dataSource)
+		return p.getPVCSource(ctx, claim, sc, dataSource, autoEnlarge)
 	default:
 		// For now we shouldn't pass other things to this function, but treat it as a noop and extend as needed
-		return nil, nil
+		return nil, 0, nil
 	}
 }
 
 // getPVCSource verifies DataSource.Kind of type PersistentVolumeClaim, making sure that the requested PVC is available/ready
-// returns the VolumeContentSource for the requested PVC
-func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, error) {
+// returns the VolumeContentSource and the size for the requested PVC
+func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference, autoEnlarge bool) (_ *csi.VolumeContentSource, _ int64, err error) {
+	ctx, span := tracing.Start(ctx, "getPVCSource",
+		attribute.String("source.namespace", dataSource.Namespace),
+		attribute.String("source.name", dataSource.Name))
+	defer func() {
+		tracing.End(span, err)
+	}()
 
 	sourcePVC, err := p.claimLister.PersistentVolumeClaims(dataSource.Namespace).Get(dataSource.Name)
 	if err != nil {
-		return nil, fmt.Errorf("error getting PVC %s (namespace %q) from api server: %v", dataSource.Name, claim.Namespace, err)
+		return nil, 0, fmt.Errorf("error getting PVC %s (namespace %q) from api server: %v", dataSource.Name, claim.Namespace, err)
 	}
 	if string(sourcePVC.Status.Phase) != "Bound" {
-		return nil, fmt.Errorf("the PVC DataSource %s must have a status of Bound.  Got %v", dataSource.Name, sourcePVC.Status)
+		return nil, 0, fmt.Errorf("the PVC DataSource %s must have a status of Bound.  Got %v", dataSource.Name, sourcePVC.Status)
 	}
 	if sourcePVC.ObjectMeta.DeletionTimestamp != nil {
-		return nil, fmt.Errorf("the PVC DataSource %s is currently being deleted", dataSource.Name)
+		return nil, 0, fmt.Errorf("the PVC DataSource %s is currently being deleted", dataSource.Name)
 	}
 
 	if sourcePVC.Spec.StorageClassName == nil {
-		return nil, fmt.Errorf("the source PVC (%s) storageclass cannot be empty", sourcePVC.Name)
+		return nil, 0, fmt.Errorf("the source PVC (%s) storageclass cannot be empty", sourcePVC.Name)
 	}
 
 	if claim.Spec.StorageClassName == nil {
-		return nil, fmt.Errorf("the requested PVC (%s) storageclass cannot be empty", claim.Name)
+		return nil, 0, fmt.Errorf("the requested PVC (%s) storageclass cannot be empty", claim.Name)
 	}
 
 	capacity := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	requestedSize := capacity.Value()
 	srcCapacity := sourcePVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	srcPVCSize := srcCapacity.Value()
-	if requestedSize < srcPVCSize {
-		return nil, fmt.Errorf("error, new PVC request must be greater than or equal in size to the specified PVC data source, requested %v but source is %v", requestedSize, srcPVCSize)
+	if requestedSize < srcPVCSize && !autoEnlarge {
+		return nil, 0, fmt.Errorf("error, new PVC request must be greater than or equal in size to the specified PVC data source, requested %v but source is %v", requestedSize, srcPVCSize)
 	}
 
 	if sourcePVC.Spec.VolumeName == "" {
-		return nil, fmt.Errorf("volume name is empty in source PVC %s", sourcePVC.Name)
+		return nil, 0, fmt.Errorf("volume name is empty in source PVC %s", sourcePVC.Name)
 	}
 
 	sourcePV, err := p.client.CoreV1().PersistentVolumes().Get(ctx, sourcePVC.Spec.VolumeName, metav1.GetOptions{})
 	if err != nil {
 		klog.Warningf("error getting volume %s for PVC %s/%s: %s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, err)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, 0, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.CSI == nil {
 		klog.Warningf("error getting volume source from %s for PVC %s/%s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, 0, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.CSI.Driver != sc.Provisioner {
 		klog.Warningf("the source volume %s for PVC %s/%s is handled by a different CSI driver than requested by StorageClass %s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, *claim.Spec.StorageClassName)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, 0, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.ClaimRef == nil {
 		klog.Warningf("the source volume %s for PVC %s/%s is not bound", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, 0, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.ClaimRef.UID != sourcePVC.UID || sourcePV.Spec.ClaimRef.Namespace != sourcePVC.Namespace || sourcePV.Spec.ClaimRef.Name != sourcePVC.Name {
 		klog.Warningf("the source volume %s for PVC %s/%s is bound to a different PVC than requested", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, 0, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Status.Phase != v1.VolumeBound {
 		klog.Warningf("the source volume %s for PVC %s/%s status is \"%s\", should instead be \"%s\"", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, sourcePV.Status.Phase, v1.VolumeBound)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, 0, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if claim.Spec.VolumeMode == nil || *claim.Spec.VolumeMode == v1.PersistentVolumeFilesystem {
 		if sourcePV.Spec.VolumeMode != nil && *sourcePV.Spec.VolumeMode != v1.PersistentVolumeFilesystem {
-			return nil, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Block, but new PVC requested Filesystem")
+			return nil, 0, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Block, but new PVC requested Filesystem")
 		}
 	}
 
 	if claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock {
 		if sourcePV.Spec.VolumeMode == nil || *sourcePV.Spec.VolumeMode != v1.PersistentVolumeBlock {
-			return nil, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Filesystem, but new PVC requested Block")
+			return nil, 0, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Filesystem, but new PVC requested Block")
 		}
 	}
 
+	sourceVolumeID, err := p.volumeHandleToId(sourcePV.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot clone PV %s: %v", sourcePV.Name, err)
+	}
 	volumeSource := csi.VolumeContentSource_Volume{
 		Volume: &csi.VolumeContentSource_VolumeSource{
-			VolumeId: sourcePV.Spec.CSI.VolumeHandle,
+			VolumeId: sourceVolumeID,
 		},
 	}
 	klog.V(5).Infof("VolumeContentSource_Volume %+v", volumeSource)
@@ -1096,50 +1546,56 @@ func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentV
 	volumeContentSource := &csi.VolumeContentSource{
 		Type: &volumeSource,
 	}
-	return volumeContentSource, nil
+	return volumeContentSource, srcPVCSize, nil
 }
 
 // getSnapshotSource verifies DataSource.Kind of type VolumeSnapshot, making sure that the requested Snapshot is available/ready
-// returns the VolumeContentSource for the requested snapshot
-func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, error) {
+// returns the VolumeContentSource and the restore size for the requested snapshot
+func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference, autoEnlarge bool) (_ *csi.VolumeContentSource, _ int64, err error) {
+	ctx, span := tracing.Start(ctx, "getSnapshotSource",
+		attribute.String("source.namespace", dataSource.Namespace),
+		attribute.String("source.name", dataSource.Name))
+	defer func() {
+		tracing.End(span, err)
+	}()
 	snapshotObj, err := p.snapshotClient.SnapshotV1().VolumeSnapshots(dataSource.Namespace).Get(ctx, dataSource.Name, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("error getting snapshot %s from api server: %v", dataSource.Name, err)
+		return nil, 0, fmt.Errorf("error getting snapshot %s from api server: %v", dataSource.Name, err)
 	}
 
 	if snapshotObj.ObjectMeta.DeletionTimestamp != nil {
-		return nil, fmt.Errorf("snapshot %s is currently being deleted", dataSource.Name)
+		return nil, 0, fmt.Errorf("snapshot %s is currently being deleted", dataSource.Name)
 	}
 	klog.V(5).Infof("VolumeSnapshot %+v", snapshotObj)
 
 	if snapshotObj.Status == nil || snapshotObj.Status.BoundVolumeSnapshotContentName == nil {
-		return nil, fmt.Errorf(snapshotNotBound, dataSource.Name)
+		return nil, 0, fmt.Errorf(snapshotNotBound, dataSource.Name)
 	}
 
 	snapContentObj, err := p.snapshotClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, *snapshotObj.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
 	if err != nil {
 		klog.Warningf("error getting snapshotcontent %s for snapshot %s/%s from api server: %s", *snapshotObj.Status.BoundVolumeSnapshotContentName, snapshotObj.Namespace, snapshotObj.Name, err)
-		return nil, fmt.Errorf(snapshotNotBound, dataSource.Name)
+		return nil, 0, fmt.Errorf(snapshotNotBound, dataSource.Name)
 	}
 
 	if snapContentObj.Spec.VolumeSnapshotRef.UID != snapshotObj.UID || snapContentObj.Spec.VolumeSnapshotRef.Namespace != snapshotObj.Namespace || snapContentObj.Spec.VolumeSnapshotRef.Name != snapshotObj.Name {
 		klog.Warningf("snapshotcontent %s for snapshot %s/%s is bound to a different snapshot", *snapshotObj.Status.BoundVolumeSnapshotContentName, snapshotObj.Namespace, snapshotObj.Name)
-		return nil, fmt.Errorf(snapshotNotBound, dataSource.Name)
+		return nil, 0, fmt.Errorf(snapshotNotBound, dataSource.Name)
 	}
 
 	if snapContentObj.Spec.Driver != sc.Provisioner {
 		klog.Warningf("snapshotcontent %s for snapshot %s/%s is handled by a different CSI driver than requested by StorageClass %s", *snapshotObj.Status.BoundVolumeSnapshotContentName, snapshotObj.Namespace, snapshotObj.Name, sc.Name)
-		return nil, fmt.Errorf(snapshotNotBound, dataSource.Name)
+		return nil, 0, fmt.Errorf(snapshotNotBound, dataSource.Name)
 	}
 
 	if snapshotObj.Status.ReadyToUse == nil || *snapshotObj.Status.ReadyToUse == false {
-		return nil, fmt.Errorf("snapshot %s is not Ready", dataSource.Name)
+		return nil, 0, fmt.Errorf("snapshot %s is not Ready", dataSource.Name)
 	}
 
 	klog.V(5).Infof("VolumeSnapshotContent %+v", snapContentObj)
 
 	if snapContentObj.Status == nil || snapContentObj.Status.SnapshotHandle == nil {
-		return nil, fmt.Errorf("snapshot handle %s is not available", dataSource.Name)
+		return nil, 0, fmt.Errorf("snapshot handle %s is not available", dataSource.Name)
 	}
 
 	snapshotSource := csi.VolumeContentSource_Snapshot{
@@ -1152,14 +1608,14 @@ func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.Persis
 	if snapshotObj.Status.RestoreSize != nil {
 		capacity, exists := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 		if !exists {
-			return nil, fmt.Errorf("error getting capacity for PVC %s when creating snapshot %s", claim.Name, snapshotObj.Name)
+			return nil, 0, fmt.Errorf("error getting capacity for PVC %s when creating snapshot %s", claim.Name, snapshotObj.Name)
 		}
 		volSizeBytes := capacity.Value()
 		klog.V(5).Infof("Requested volume size is %d and snapshot size is %d for the source snapshot %s", int64(volSizeBytes), int64(snapshotObj.Status.RestoreSize.Value()), snapshotObj.Name)
 		// When restoring volume from a snapshot, the volume size should
 		// be equal to or larger than its snapshot size.
-		if int64(volSizeBytes) < int64(snapshotObj.Status.RestoreSize.Value()) {
-			return nil, fmt.Errorf("requested volume size %d is less than the size %d for the source snapshot %s", int64(volSizeBytes), int64(snapshotObj.Status.RestoreSize.Value()), snapshotObj.Name)
+		if int64(volSizeBytes) < int64(snapshotObj.Status.RestoreSize.Value()) && !autoEnlarge {
+			return nil, 0, fmt.Errorf("requested volume size %d is less than the size %d for the source snapshot %s", int64(volSizeBytes), int64(snapshotObj.Status.RestoreSize.Value()), snapshotObj.Name)
 		}
 		if int64(volSizeBytes) > int64(snapshotObj.Status.RestoreSize.Value()) {
 			klog.Warningf("requested volume size %d is greater than the size %d for the source snapshot %s. Volume plugin needs to handle volume expansion.", int64(volSizeBytes), int64(snapshotObj.Status.RestoreSize.Value()), snapshotObj.Name)
@@ -1172,16 +1628,16 @@ func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.Persis
 			// Verify if this volume is allowed to alter its mode.
 			allowVolumeModeChange, ok := snapContentObj.Annotations[annAllowVolumeModeChange]
 			if !ok {
-				return nil, fmt.Errorf("requested volume %s/%s modifies the mode of the source volume but does not have permission to do so. "+
+				return nil, 0, fmt.Errorf("requested volume %s/%s modifies the mode of the source volume but does not have permission to do so. "+
 					"%s annotation is not present on snapshotcontent %s", claim.Namespace, claim.Name, annAllowVolumeModeChange, snapContentObj.Name)
 			}
 			allowVolumeModeChangeBool, err := strconv.ParseBool(allowVolumeModeChange)
 			if err != nil {
-				return nil, fmt.Errorf("requested volume %s/%s modifies the mode of the source volume but does not have permission to do so. "+
+				return nil, 0, fmt.Errorf("requested volume %s/%s modifies the mode of the source volume but does not have permission to do so. "+
 					"failed to convert %s annotation value to boolean with error: %v", claim.Namespace, claim.Name, annAllowVolumeModeChange, err)
 			}
 			if !allowVolumeModeChangeBool {
-				return nil, fmt.Errorf("requested volume %s/%s modifies the mode of the source volume but does not have permission to do so. "+
+				return nil, 0, fmt.Errorf("requested volume %s/%s modifies the mode of the source volume but does not have permission to do so. "+
 					"%s is set to false on snapshotcontent %s", claim.Namespace, claim.Name, annAllowVolumeModeChange, snapContentObj.Name)
 			}
 		}
@@ -1191,7 +1647,11 @@ func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.Persis
 		Type: &snapshotSource,
 	}
 
-	return volumeContentSource, nil
+	var restoreSize int64
+	if snapshotObj.Status.RestoreSize != nil {
+		restoreSize = snapshotObj.Status.RestoreSize.Value()
+	}
+	return volumeContentSource, restoreSize, nil
 }
 
 func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
@@ -1199,19 +1659,54 @@ func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 		return fmt.Errorf("invalid CSI PV")
 	}
 
-	var err error
-	var migratedVolume bool
-	if p.translator.IsPVMigratable(volume) {
-		// we end up here only if CSI migration is enabled in-tree (both overall
-		// and for the specific plugin that is migratable) causing in-tree PV
-		// controller to yield deletion of PVs with in-tree source to external provisioner
-		// based on AnnDynamicallyProvisioned annotation.
-		migratedVolume = true
-		volume, err = p.translator.TranslateInTreePVToCSI(volume)
-		if err != nil {
-			return err
+	if p.namespaceFairness != nil {
+		namespace := pvNamespace(volume)
+		if p.namespaceFairness.shouldDefer(deletionOperation, namespace, volume.Name, volume) {
+			return &controller.IgnoredError{
+				Reason: fmt.Sprintf("namespace %q already uses its share of workers, PV gets deleted when it is its turn", namespace),
+			}
 		}
+		defer p.namespaceFairness.admit(deletionOperation, namespace, volume.Name)()
+	}
+
+	retention, err := p.trashRetention(volume)
+	if err != nil {
+		return err
+	}
+	volume, migratedVolume, err := p.translateVolume(volume)
+	if err != nil {
+		return err
+	}
+	if retention > 0 {
+		return p.trash.add(ctx, volume, migratedVolume, retention)
 	}
+	return p.deleteVolume(ctx, volume, migratedVolume)
+}
+
+// translateVolume translates the PV of an in-tree volume to CSI. It returns
+// true if the PV was translated.
+func (p *csiProvisioner) translateVolume(volume *v1.PersistentVolume) (*v1.PersistentVolume, bool, error) {
+	if !p.translator.IsPVMigratable(volume) {
+		return volume, false, nil
+	}
+	// we end up here only if CSI migration is enabled in-tree (both overall
+	// and for the specific plugin that is migratable) causing in-tree PV
+	// controller to yield deletion of PVs with in-tree source to external provisioner
+	// based on AnnDynamicallyProvisioned annotation.
+	translated, err := p.translator.TranslateInTreePVToCSI(volume)
+	if err != nil {
+		return nil, false, err
+	}
+	return translated, true, nil
+}
+
+// deleteVolume deletes the volume of a PV with a CSI source. migratedVolume
+// is true if the PV was translated from an in-tree volume.
+func (p *csiProvisioner) deleteVolume(ctx context.Context, volume *v1.PersistentVolume, migratedVolume bool) (err error) {
+	ctx, span := tracing.Start(ctx, "Delete", attribute.String("pv.name", volume.Name))
+	defer func() {
+		tracing.End(span, err)
+	}()
 
 	if volume.Spec.CSI == nil {
 		return fmt.Errorf("invalid CSI PV")
@@ -1232,7 +1727,12 @@ func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 		}
 	}
 
-	volumeId := p.volumeHandleToId(volume.Spec.CSI.VolumeHandle)
+	// Volumes of other clusters sharing the same storage backend
+	// must not be deleted.
+	volumeId, err := p.volumeHandleToId(volume.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return err
+	}
 
 	rc := &requiredCapabilities{}
 	if err := p.checkDriverCapabilities(rc); err != nil {
@@ -1247,15 +1747,42 @@ func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 	if err != nil {
 		return err
 	}
-	deleteCtx := markAsMigrated(ctx, migratedVolume)
-	deleteCtx, cancel := context.WithTimeout(deleteCtx, p.timeout)
-	defer cancel()
 
-	if err := p.canDeleteVolume(volume); err != nil {
+	storageClassName := util.GetPersistentVolumeClass(volume)
+	limits, err := p.storageClassLimits(storageClassName)
+	if err != nil {
+		return err
+	}
+
+	_, checkSpan := tracing.Start(ctx, "canDeleteVolume")
+	err = p.canDeleteVolume(volume)
+	tracing.End(checkSpan, err)
+	if err != nil {
+		return err
+	}
+
+	release, err := p.operationLimiter.tryAcquire(deleteOperation, storageClassName, volume.Name, limits.maxConcurrentDeletes)
+	if err != nil {
 		return err
 	}
+	defer release()
+
+	if p.deletionCircuitBreaker != nil {
+		if err := p.deletionCircuitBreaker.admit(ctx, volume); err != nil {
+			return err
+		}
+	}
 
+	// The timeout only covers the DeleteVolume call, not the time
+	// spent before it was admitted.
+	deleteCtx := markAsMigrated(ctx, migratedVolume)
+	deleteCtx, cancel := context.WithTimeout(deleteCtx, limitOrDefault(limits.deleteTimeout, p.timeout))
+	defer cancel()
+	deleteCtx, deleteSpan := tracing.StartGRPC(deleteCtx, "DeleteVolume", attribute.String("volume.id", volumeId))
+	start := time.Now()
 	_, err = p.csiClient.DeleteVolume(deleteCtx, &req)
+	auditDeleteVolume(p.auditLogger, auditReasonDelete, claimRefKey(volume), volume.Name, &req, start, err)
+	tracing.End(deleteSpan, err)
 
 	return err
 }
@@ -1269,7 +1796,7 @@ func (p *csiProvisioner) handleSecretsForDeletion(ctx context.Context, volume *v
 			provisionerSecretRef := &v1.SecretReference{}
 			provisionerSecretRef.Name = annDeletionSecretName
 			provisionerSecretRef.Namespace = annDeletionSecretNamespace
-			credentials, err := getCredentials(ctx, p.client, provisionerSecretRef)
+			credentials, err := p.getCredentials(ctx, volume.Annotations[annDeletionProvisionerSecretProvider], provisionerSecretRef)
 			if err != nil {
 				// Continue with deletion, as the secret may have already been deleted.
 				klog.Errorf("failed to get credentials for volume %s: %s", volume.Name, err.Error())
@@ -1315,7 +1842,7 @@ func (p *csiProvisioner) getSecretsFromSC(ctx context.Context, volume *v1.Persis
 				return fmt.Errorf("failed to get secretreference for volume %s: %v", volume.Name, err)
 			}
 
-			credentials, err := getCredentials(ctx, p.client, provisionerSecretRef)
+			credentials, err := p.getCredentials(ctx, storageClass.Parameters[prefixedProvisionerSecretProviderKey], provisionerSecretRef)
 			if err != nil {
 				// Continue with deletion, as the secret may have already been deleted.
 				klog.Errorf("Failed to get credentials for volume %s: %s", volume.Name, err.Error())
@@ -1329,24 +1856,68 @@ func (p *csiProvisioner) getSecretsFromSC(ctx context.Context, volume *v1.Persis
 }
 
 func (p *csiProvisioner) canDeleteVolume(volume *v1.PersistentVolume) error {
-	if p.vaLister == nil {
+	if p.vaIndexer == nil {
 		// Nothing to check.
 		return nil
 	}
 
 	// Verify if volume is attached to a node before proceeding with deletion
-	vaList, err := p.vaLister.List(labels.Everything())
+	objs, err := p.vaIndexer.ByIndex(VolumeAttachmentPVIndex, volume.Name)
 	if err != nil {
-		return fmt.Errorf("failed to list volumeattachments: %v", err)
+		return fmt.Errorf("failed to look up volumeattachments: %v", err)
+	}
+	if len(objs) == 0 {
+		return nil
 	}
 
-	for _, va := range vaList {
-		if va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == volume.Name {
-			return fmt.Errorf("persistentvolume %s is still attached to node %s", volume.Name, va.Spec.NodeName)
+	nodes := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		if va, ok := obj.(*storagev1.VolumeAttachment); ok {
+			nodes = append(nodes, va.Spec.NodeName)
 		}
 	}
+	sort.Strings(nodes)
+	return fmt.Errorf("persistentvolume %s is still attached to node(s) %s", volume.Name, strings.Join(nodes, ", "))
+}
 
-	return nil
+// VolumeAttachmentPVIndexFunc returns an index function which indexes
+// VolumeAttachments of the given attacher by the name of their PV.
+// VolumeAttachments of other attachers and for inline volumes are not
+// indexed.
+func VolumeAttachmentPVIndexFunc(attacher string) cache.IndexFunc {
+	return func(obj interface{}) ([]string, error) {
+		va, ok := obj.(*storagev1.VolumeAttachment)
+		if !ok {
+			return nil, fmt.Errorf("expected VolumeAttachment, got %T", obj)
+		}
+		if va.Spec.Attacher != attacher || va.Spec.Source.PersistentVolumeName == nil {
+			return nil, nil
+		}
+		return []string{*va.Spec.Source.PersistentVolumeName}, nil
+	}
+}
+
+// VolumeAttachmentTransform returns a transform function for the
+// VolumeAttachment informer which only keeps the name of VolumeAttachments
+// of other attachers. There is no field selector for the attacher, so
+// those still get watched, but they no longer take up memory in the cache.
+func VolumeAttachmentTransform(attacher string) cache.TransformFunc {
+	return func(obj interface{}) (interface{}, error) {
+		va, ok := obj.(*storagev1.VolumeAttachment)
+		if !ok || va.Spec.Attacher == attacher {
+			return obj, nil
+		}
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            va.Name,
+				UID:             va.UID,
+				ResourceVersion: va.ResourceVersion,
+			},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: va.Spec.Attacher,
+			},
+		}, nil
+	}
 }
 
 func (p *csiProvisioner) SupportsBlock(ctx context.Context) bool {
@@ -1389,19 +1960,20 @@ func (p *csiProvisioner) ShouldProvision(ctx context.Context, claim *v1.Persiste
 			claim.Namespace, claim.Name, err)
 	}
 
+	// PVCs which have to wait for PVCs with a higher priority or for
+	// other namespaces are skipped without an event, they get put into
+	// the work queue again when it is their turn.
+	if p.provisioningPriority != nil && p.provisioningPriority.shouldDefer(claim) {
+		return false
+	}
+	if p.namespaceFairness != nil && p.namespaceFairness.shouldDefer(provisionOperation, claim.Namespace, string(claim.UID), claim) {
+		return false
+	}
+
 	// Start provisioning.
 	return true
 }
 
-// TODO use a unique volume handle from and to Id
-func (p *csiProvisioner) volumeIdToHandle(id string) string {
-	return id
-}
-
-func (p *csiProvisioner) volumeHandleToId(handle string) string {
-	return handle
-}
-
 // checkNode optionally checks whether the PVC is assigned to the current node.
 // If the PVC uses immediate binding, it will try to take the PVC for provisioning
 // on the current node. Returns true if provisioning can proceed, an error
@@ -1790,6 +2362,61 @@ func getSecretReference(secretParams secretParamsMap, storageClassParams map[str
 	return ref, nil
 }
 
+// resolveParameterTemplates resolves templates in the values of storage class
+// parameters if the storage class enables it. Parameters with the
+// csi.storage.k8s.io/ prefix are returned unchanged.
+//
+// supported tokens:
+// - ${pv.name}
+// - ${pvc.namespace}
+// - ${pvc.name}
+// - ${pvc.annotations['ANNOTATION_KEY']} (e.g. ${pvc.annotations['example.com/cost-center']})
+// - ${pvc.labels['LABEL_KEY']} (e.g. ${pvc.labels['tier']})
+//
+// Tokens which cannot be resolved, for example because the PVC does not
+// have the annotation, are an error.
+func resolveParameterTemplates(storageClassParams map[string]string, pvName string, pvc *v1.PersistentVolumeClaim) (map[string]string, error) {
+	enabled, ok := storageClassParams[prefixedResolveParameterTemplatesKey]
+	if !ok {
+		return storageClassParams, nil
+	}
+	resolve, err := strconv.ParseBool(enabled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s parameter: %v", prefixedResolveParameterTemplatesKey, err)
+	}
+	if !resolve {
+		return storageClassParams, nil
+	}
+
+	// Note that everything except the PVC namespace is under the
+	// control of the PVC user.
+	templateParams := map[string]string{
+		tokenPVNameKey:       pvName,
+		tokenPVCNameKey:      pvc.Name,
+		tokenPVCNameSpaceKey: pvc.Namespace,
+	}
+	for k, v := range pvc.Annotations {
+		templateParams["pvc.annotations['"+k+"']"] = v
+	}
+	for k, v := range pvc.Labels {
+		templateParams["pvc.labels['"+k+"']"] = v
+	}
+
+	resolved := make(map[string]string, len(storageClassParams))
+	for k, v := range storageClassParams {
+		if strings.HasPrefix(k, csiParameterPrefix) {
+			resolved[k] = v
+			continue
+		}
+		value, err := resolveTemplate(v, templateParams)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving value %q of parameter %q: %v", v, k, err)
+		}
+		resolved[k] = value
+	}
+	return resolved, nil
+}
+
 func resolveTemplate(template string, params map[string]string) (string, error) {
 	missingParams := sets.NewString()
 	resolved := os.Expand(template, func(k string) string {
@@ -1805,21 +2432,25 @@ func resolveTemplate(template string, params map[string]string) (string, error)
 	return resolved, nil
 }
 
-func getCredentials(ctx context.Context, k8s kubernetes.Interface, ref *v1.SecretReference) (map[string]string, error) {
+// getCredentials gets the credentials for the reference from the
+// credential provider with the name, the secret provider if empty.
+func (p *csiProvisioner) getCredentials(ctx context.Context, providerName string, ref *v1.SecretReference) (_ map[string]string, err error) {
 	if ref == nil {
 		return nil, nil
 	}
+	ctx, span := tracing.Start(ctx, "getCredentials",
+		attribute.String("secret.provider", providerName),
+		attribute.String("secret.namespace", ref.Namespace),
+		attribute.String("secret.name", ref.Name))
+	defer func() {
+		tracing.End(span, err)
+	}()
 
-	secret, err := k8s.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	provider, err := p.credentialProvider(providerName)
 	if err != nil {
-		return nil, fmt.Errorf("error getting secret %s in namespace %s: %v", ref.Name, ref.Namespace, err)
-	}
-
-	credentials := map[string]string{}
-	for key, value := range secret.Data {
-		credentials[key] = string(value)
+		return nil, err
 	}
-	return credentials, nil
+	return provider.GetCredentials(ctx, ref)
 }
 
 func bytesToQuantity(bytes int64) resource.Quantity {
@@ -1875,17 +2506,26 @@ func checkError(err error, mayReschedule bool) controller.ProvisioningState {
 	return controller.ProvisioningFinished
 }
 
-func cleanupVolume(ctx context.Context, p *csiProvisioner, delReq *csi.DeleteVolumeRequest, provisionerCredentials map[string]string) error {
+func cleanupVolume(ctx context.Context, p *csiProvisioner, claim *v1.PersistentVolumeClaim, storageClass, pvName string, delReq *csi.DeleteVolumeRequest, provisionerCredentials map[string]string) error {
 	var err error
 	delReq.Secrets = provisionerCredentials
 	deleteCtx, cancel := context.WithTimeout(ctx, p.timeout)
 	defer cancel()
 	for i := 0; i < deleteVolumeRetryCount; i++ {
-		_, err = p.csiClient.DeleteVolume(deleteCtx, delReq)
+		attemptCtx, span := tracing.StartGRPC(deleteCtx, "DeleteVolume", attribute.String("volume.id", delReq.VolumeId))
+		start := time.Now()
+		_, err = p.csiClient.DeleteVolume(attemptCtx, delReq)
+		auditDeleteVolume(p.auditLogger, auditReasonCleanup, claim.Namespace+"/"+claim.Name, pvName, delReq, start, err)
+		tracing.End(span, err)
 		if err == nil {
 			break
 		}
 	}
+	if err != nil && p.orphanRecord != nil {
+		if recordErr := p.orphanRecord.add(ctx, delReq.VolumeId, p.identity, pvName, storageClass, claim); recordErr != nil {
+			klog.Warningf("Volume %s of PV %s is orphaned: %v", delReq.VolumeId, pvName, recordErr)
+		}
+	}
 	return err
 }
 
@@ -36,13 +36,16 @@ import (
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
 	csitrans "k8s.io/csi-translation-lib"
 	"k8s.io/klog/v2"
@@ -232,6 +235,19 @@ func TestStripPrefixedCSIParams(t *testing.T) {
 				prefixedDefaultSecretNamespaceKey:           "csiBar",
 				prefixedNodeExpandSecretNameKey:             "csiBar",
 				prefixedNodeExpandSecretNamespaceKey:        "csiBar",
+				prefixedAllowVolumeImportKey:                "csiBar",
+				prefixedResolveParameterTemplatesKey:        "csiBar",
+				prefixedPVCLabelAllowlistKey:                "csiBar",
+				prefixedPVCAnnotationAllowlistKey:           "csiBar",
+				prefixedVolumeNameTemplateKey:               "csiBar",
+				prefixedMaxConcurrentCreatesKey:             "csiBar",
+				prefixedMaxConcurrentDeletesKey:             "csiBar",
+				prefixedCreateTimeoutKey:                    "csiBar",
+				prefixedDeleteTimeoutKey:                    "csiBar",
+				prefixedGetCapacityTimeoutKey:               "csiBar",
+				prefixedProvisionerSecretProviderKey:        "csiBar",
+				prefixedAutoEnlargeRestoreSizeKey:           "csiBar",
+				prefixedTrashRetentionKey:                   "csiBar",
 			},
 			expectedParams: map[string]string{},
 		},
@@ -496,6 +512,16 @@ func provisionWithTopologyCapabilities() (rpc.PluginCapabilitySet, rpc.Controlle
 		}
 }
 
+func provisionWithGetVolumeCapabilities() (rpc.PluginCapabilitySet, rpc.ControllerCapabilitySet) {
+	return rpc.PluginCapabilitySet{
+			csi.PluginCapability_Service_CONTROLLER_SERVICE:               true,
+			csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS: true,
+		}, rpc.ControllerCapabilitySet{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: true,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME:           true,
+		}
+}
+
 func provisionFromPVCCapabilities() (rpc.PluginCapabilitySet, rpc.ControllerCapabilitySet) {
 	return rpc.PluginCapabilitySet{
 			csi.PluginCapability_Service_CONTROLLER_SERVICE: true,
@@ -2790,6 +2816,74 @@ func TestProvisionFromSnapshot(t *testing.T) {
 			snapshotStatusReady:  true,
 			expectErr:            true,
 		},
+		"enlarge vol size less than snapshot size": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					Parameters:  map[string]string{prefixedAutoEnlargeRestoreSizeKey: "true"},
+					Provisioner: "test-driver",
+				},
+				PVName: "test-name",
+				PVC: &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:         "testid",
+						Annotations: driverNameAnnotation,
+					},
+					Spec: v1.PersistentVolumeClaimSpec{
+						StorageClassName: &snapClassName,
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceName(v1.ResourceStorage): resource.MustParse(strconv.FormatInt(100, 10)),
+							},
+						},
+						AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+						DataSource: &v1.TypedLocalObjectReference{
+							Name:     snapName,
+							Kind:     "VolumeSnapshot",
+							APIGroup: &apiGrp,
+						},
+					},
+				},
+			},
+			snapshotStatusReady: true,
+			expectedPVSpec: &pvSpec{
+				Name: "test-testi",
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+			},
+			expectCSICall: true,
+		},
+		"fail invalid auto-enlarge parameter": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					Parameters:  map[string]string{prefixedAutoEnlargeRestoreSizeKey: "maybe"},
+					Provisioner: "test-driver",
+				},
+				PVName: "test-name",
+				PVC: &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:         "testid",
+						Annotations: driverNameAnnotation,
+					},
+					Spec: v1.PersistentVolumeClaimSpec{
+						StorageClassName: &snapClassName,
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceName(v1.ResourceStorage): resource.MustParse(strconv.FormatInt(100, 10)),
+							},
+						},
+						AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+						DataSource: &v1.TypedLocalObjectReference{
+							Name:     snapName,
+							Kind:     "VolumeSnapshot",
+							APIGroup: &apiGrp,
+						},
+					},
+				},
+			},
+			snapshotStatusReady: true,
+			expectErr:           true,
+		},
 		"fail empty snapshot name": {
 			volOpts: controller.ProvisionOptions{
 				StorageClass: &storagev1.StorageClass{
@@ -4707,6 +4801,7 @@ type deleteTestcase struct {
 	mockDelete                bool
 	expectedProvisionerSecret *expectedSecret
 	deploymentNode            string // fake distributed provisioning with this node as host
+	volumeHandleClusterID     string
 	expectErr                 bool
 }
 
@@ -4804,6 +4899,7 @@ func TestDelete(t *testing.T) {
 					Name: "va",
 				},
 				Spec: storagev1.VolumeAttachmentSpec{
+					Attacher: driverName,
 					Source: storagev1.VolumeAttachmentSource{
 						PersistentVolumeName: &pvName,
 					},
@@ -4845,6 +4941,7 @@ func TestDelete(t *testing.T) {
 					Name: "va",
 				},
 				Spec: storagev1.VolumeAttachmentSpec{
+					Attacher: driverName,
 					Source: storagev1.VolumeAttachmentSource{
 						PersistentVolumeName: &pvName,
 					},
@@ -4887,6 +4984,7 @@ func TestDelete(t *testing.T) {
 					DeletionTimestamp: &deletionTimestamp,
 				},
 				Spec: storagev1.VolumeAttachmentSpec{
+					Attacher: driverName,
 					Source: storagev1.VolumeAttachmentSource{
 						PersistentVolumeName: &pvName,
 					},
@@ -4948,6 +5046,46 @@ func TestDelete(t *testing.T) {
 					Name: "va",
 				},
 				Spec: storagev1.VolumeAttachmentSpec{
+					Attacher: driverName,
+					Source: storagev1.VolumeAttachmentSource{
+						PersistentVolumeName: &pvName,
+					},
+					NodeName: "node",
+				},
+				Status: storagev1.VolumeAttachmentStatus{
+					Attached: true,
+				},
+			},
+			expectErr:  false,
+			mockDelete: true,
+		},
+		"simple - valid case with volumeattachment of other attacher": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: pvName,
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			storageClass: &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "sc-name",
+				},
+				Parameters: map[string]string{
+					prefixedProvisionerSecretNameKey: "static-${pv.name}-${pvc.namespace}-${pvc.name}",
+				},
+			},
+			volumeAttachment: &storagev1.VolumeAttachment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "va",
+				},
+				Spec: storagev1.VolumeAttachmentSpec{
+					Attacher: "other-driver",
 					Source: storagev1.VolumeAttachmentSource{
 						PersistentVolumeName: &pvName,
 					},
@@ -5276,6 +5414,69 @@ func TestDelete(t *testing.T) {
 			expectErr:  false,
 			mockDelete: true,
 		},
+		"encoded volume handle of this cluster": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pv",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "k8s-cluster:cluster-a:vol-id-1",
+						},
+					},
+				},
+			},
+			volumeHandleClusterID: "cluster-a",
+			mockDelete:            true,
+		},
+		"unencoded volume handle with cluster ID": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pv",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			volumeHandleClusterID: "cluster-a",
+			mockDelete:            true,
+		},
+		"fail - encoded volume handle of other cluster": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pv",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "k8s-cluster:cluster-b:vol-id-1",
+						},
+					},
+				},
+			},
+			volumeHandleClusterID: "cluster-a",
+			expectErr:             true,
+		},
+		"fail - encoded volume handle without cluster ID": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pv",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "k8s-cluster:cluster-b:vol-id-1",
+						},
+					},
+				},
+			},
+			expectErr: true,
+		},
 	}
 
 	for k, tc := range tt {
@@ -5362,7 +5563,7 @@ func runDeleteTest(t *testing.T, k string, tc deleteTestcase) {
 	pluginCaps, controllerCaps := provisionCapabilities()
 	scLister, _, _, _, vaLister, _ := listers(clientSet)
 	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
-		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, vaLister, nil, false, defaultfsType, nodeDeployment, true, false)
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, vaLister, nil, false, defaultfsType, nodeDeployment, true, false, WithVolumeHandleClusterID(tc.volumeHandleClusterID))
 
 	err = csiProvisioner.Delete(context.Background(), tc.persistentVolume)
 	if tc.expectErr && err == nil {
@@ -5373,6 +5574,13 @@ func runDeleteTest(t *testing.T, k string, tc deleteTestcase) {
 	}
 }
 
+// withAutoEnlargeRestoreSize enables auto-enlarge-restore-size in the
+// storage class of the options.
+func withAutoEnlargeRestoreSize(options controller.ProvisionOptions) controller.ProvisionOptions {
+	options.StorageClass.Parameters[prefixedAutoEnlargeRestoreSizeKey] = "true"
+	return options
+}
+
 // generatePVCForProvisionFromPVC returns a ProvisionOptions with the requested settings
 func generatePVCForProvisionFromPVC(srcNamespace, srcName, scName string, requestedBytes int64, volumeMode string) controller.ProvisionOptions {
 	deletePolicy := v1.PersistentVolumeReclaimDelete
@@ -5563,6 +5771,17 @@ func TestProvisionFromPVC(t *testing.T) {
 			restoredVolSizeBig: true,
 			expectErr:          true,
 		},
+		"provision with pvc data source destination too large with auto-enlarge": {
+			clonePVName:      pvName,
+			volOpts:          withAutoEnlargeRestoreSize(generatePVCForProvisionFromPVC(srcNamespace, srcName, fakeSc1, requestedBytes-1, "")),
+			expectFinalizers: true,
+			expectedPVSpec: &pvSpec{
+				Name: pvName,
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+			},
+		},
 		"provision with pvc data source not found": {
 			clonePVName: pvName,
 			volOpts:     generatePVCForProvisionFromPVC(srcNamespace, "source-not-found", fakeSc1, requestedBytes, ""),
@@ -6830,3 +7049,473 @@ func createFakeCSIPV(volumeHandle string) *v1.PersistentVolume {
 		},
 	}
 }
+
+func TestProvisionImport(t *testing.T) {
+	const requestBytes = 100
+	const volumeID = "existing-volume"
+	deletePolicy := v1.PersistentVolumeReclaimDelete
+	retainPolicy := v1.PersistentVolumeReclaimRetain
+	importSC := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fakeSCName,
+		},
+		Parameters: map[string]string{
+			prefixedAllowVolumeImportKey: "true",
+		},
+		ReclaimPolicy: &retainPolicy,
+	}
+	importClaim := createFakeNamedPVC(requestBytes, "fake-pvc", map[string]string{annImportVolumeID: volumeID})
+	importedVolume := &csi.Volume{
+		VolumeId:      volumeID,
+		CapacityBytes: 2 * requestBytes,
+		VolumeContext: map[string]string{"key": "value"},
+	}
+	existingPV := createFakeCSIPV(volumeID)
+	existingPV.Name = "existing-pv"
+	existingPV.Spec.CSI.Driver = driverName
+
+	testcases := map[string]struct {
+		sc                *storagev1.StorageClass
+		claim             *v1.PersistentVolumeClaim
+		withoutGetVolume  bool
+		pvs               []*v1.PersistentVolume
+		getVolumeResponse *csi.ControllerGetVolumeResponse
+		getVolumeError    error
+		expectCreate      bool
+		expectErr         bool
+		expectCapacity    int64
+	}{
+		"normal provisioning without annotation": {
+			sc:             importSC,
+			claim:          createFakePVC(requestBytes),
+			expectCreate:   true,
+			expectCapacity: requestBytes,
+		},
+		"import": {
+			sc:                importSC,
+			claim:             importClaim,
+			getVolumeResponse: &csi.ControllerGetVolumeResponse{Volume: importedVolume},
+			expectCapacity:    2 * requestBytes,
+		},
+		"import without GET_VOLUME": {
+			sc:               importSC,
+			claim:            importClaim,
+			withoutGetVolume: true,
+			expectCapacity:   requestBytes,
+		},
+		"import not allowed": {
+			sc: &storagev1.StorageClass{
+				ObjectMeta:    metav1.ObjectMeta{Name: fakeSCName},
+				ReclaimPolicy: &deletePolicy,
+			},
+			claim:     importClaim,
+			expectErr: true,
+		},
+		"import disabled": {
+			sc: &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: fakeSCName},
+				Parameters: map[string]string{prefixedAllowVolumeImportKey: "false"},
+			},
+			claim:     importClaim,
+			expectErr: true,
+		},
+		"volume already in use": {
+			sc:        importSC,
+			claim:     importClaim,
+			pvs:       []*v1.PersistentVolume{existingPV},
+			expectErr: true,
+		},
+		"volume not found": {
+			sc:             importSC,
+			claim:          importClaim,
+			getVolumeError: status.Error(codes.NotFound, "no such volume"),
+			expectErr:      true,
+		},
+		"volume too small": {
+			sc:    importSC,
+			claim: importClaim,
+			getVolumeResponse: &csi.ControllerGetVolumeResponse{Volume: &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: requestBytes / 2,
+			}},
+			expectErr: true,
+		},
+		"volume abnormal": {
+			sc:    importSC,
+			claim: importClaim,
+			getVolumeResponse: &csi.ControllerGetVolumeResponse{
+				Volume: importedVolume,
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "broken"},
+				},
+			},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			clientSet := fakeclientset.NewSimpleClientset()
+			informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+			pvInformer := informerFactory.Core().V1().PersistentVolumes()
+			for _, pv := range tc.pvs {
+				pvInformer.Informer().GetStore().Add(pv)
+			}
+
+			pluginCaps, controllerCaps := provisionCapabilities()
+			if !tc.withoutGetVolume {
+				controllerCaps[csi.ControllerServiceCapability_RPC_GET_VOLUME] = true
+			}
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithPVLister(pvInformer.Lister()))
+
+			if tc.expectCreate {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+					Volume: &csi.Volume{VolumeId: "new-volume", CapacityBytes: requestBytes},
+				}, nil).Times(1)
+			}
+			if tc.getVolumeResponse != nil || tc.getVolumeError != nil {
+				controllerServer.EXPECT().ControllerGetVolume(gomock.Any(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID}).
+					Return(tc.getVolumeResponse, tc.getVolumeError).Times(1)
+			}
+
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: tc.sc,
+				PVC:          tc.claim,
+			})
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.expectCreate {
+				if pv.Spec.CSI.VolumeHandle != "new-volume" {
+					t.Errorf("expected new volume, got %q", pv.Spec.CSI.VolumeHandle)
+				}
+				return
+			}
+			if pv.Spec.CSI.VolumeHandle != volumeID {
+				t.Errorf("expected volume handle %q, got %q", volumeID, pv.Spec.CSI.VolumeHandle)
+			}
+			capacity := pv.Spec.Capacity[v1.ResourceStorage]
+			if capacity.Value() != tc.expectCapacity {
+				t.Errorf("expected capacity %d, got %s", tc.expectCapacity, capacity.String())
+			}
+			if pv.Spec.PersistentVolumeReclaimPolicy != *tc.sc.ReclaimPolicy {
+				t.Errorf("expected reclaim policy %s, got %s", *tc.sc.ReclaimPolicy, pv.Spec.PersistentVolumeReclaimPolicy)
+			}
+			if tc.getVolumeResponse != nil {
+				for k, v := range tc.getVolumeResponse.Volume.VolumeContext {
+					if pv.Spec.CSI.VolumeAttributes[k] != v {
+						t.Errorf("expected volume attribute %s=%s, got %q", k, v, pv.Spec.CSI.VolumeAttributes[k])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestVolumeAccessibleFrom(t *testing.T) {
+	zone1 := &csi.Topology{Segments: map[string]string{"zone": "zone1"}}
+	zone2 := &csi.Topology{Segments: map[string]string{"zone": "zone2"}}
+	zone1Rack1 := &csi.Topology{Segments: map[string]string{"zone": "zone1", "rack": "rack1"}}
+
+	testcases := map[string]struct {
+		volumeTopology []*csi.Topology
+		requirements   *csi.TopologyRequirement
+		expected       bool
+	}{
+		"no requirements": {
+			volumeTopology: []*csi.Topology{zone1},
+			expected:       true,
+		},
+		"no volume topology": {
+			requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{zone1}},
+			expected:     true,
+		},
+		"requisite matches": {
+			volumeTopology: []*csi.Topology{zone1},
+			requirements:   &csi.TopologyRequirement{Requisite: []*csi.Topology{zone2, zone1}},
+			expected:       true,
+		},
+		"requisite does not match": {
+			volumeTopology: []*csi.Topology{zone1},
+			requirements:   &csi.TopologyRequirement{Requisite: []*csi.Topology{zone2}},
+		},
+		"preferred does not match": {
+			volumeTopology: []*csi.Topology{zone2},
+			requirements:   &csi.TopologyRequirement{Preferred: []*csi.Topology{zone1}},
+		},
+		"additional segments": {
+			volumeTopology: []*csi.Topology{zone1},
+			requirements:   &csi.TopologyRequirement{Requisite: []*csi.Topology{zone1Rack1}},
+			expected:       true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if actual := volumeAccessibleFrom(tc.volumeTopology, tc.requirements); actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestResolveParameterTemplates(t *testing.T) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "name",
+			Namespace:   "ns",
+			Annotations: map[string]string{"team/cost-center": "1234"},
+			Labels:      map[string]string{"tier": "gold"},
+		},
+	}
+
+	testcases := map[string]struct {
+		params         map[string]string
+		expectedParams map[string]string
+		expectErr      bool
+	}{
+		"not enabled": {
+			params:         map[string]string{"tag": "${pvc.name}"},
+			expectedParams: map[string]string{"tag": "${pvc.name}"},
+		},
+		"disabled": {
+			params:         map[string]string{prefixedResolveParameterTemplatesKey: "false", "tag": "${pvc.name}"},
+			expectedParams: map[string]string{prefixedResolveParameterTemplatesKey: "false", "tag": "${pvc.name}"},
+		},
+		"invalid opt-in": {
+			params:    map[string]string{prefixedResolveParameterTemplatesKey: "maybe"},
+			expectErr: true,
+		},
+		"all tokens": {
+			params: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				"pv":                                 "${pv.name}",
+				"pvc":                                "${pvc.namespace}/${pvc.name}",
+				"costCenter":                         "cc-${pvc.annotations['team/cost-center']}",
+				"pool":                               "pool-${pvc.labels['tier']}",
+				"plain":                              "value",
+			},
+			expectedParams: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				"pv":                                 "pvname",
+				"pvc":                                "ns/name",
+				"costCenter":                         "cc-1234",
+				"pool":                               "pool-gold",
+				"plain":                              "value",
+			},
+		},
+		"prefixed parameters are not resolved": {
+			params: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				prefixedProvisionerSecretNameKey:     "${pvc.name}",
+			},
+			expectedParams: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				prefixedProvisionerSecretNameKey:     "${pvc.name}",
+			},
+		},
+		"missing annotation": {
+			params: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				"costCenter":                         "${pvc.annotations['other']}",
+			},
+			expectErr: true,
+		},
+		"missing label": {
+			params: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				"pool":                               "${pvc.labels['other']}",
+			},
+			expectErr: true,
+		},
+		"unknown token": {
+			params: map[string]string{
+				prefixedResolveParameterTemplatesKey: "true",
+				"node":                               "${node.name}",
+			},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			params, err := resolveParameterTemplates(tc.params, "pvname", pvc)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(params, tc.expectedParams) {
+				t.Errorf("expected parameters %v, got %v", tc.expectedParams, params)
+			}
+		})
+	}
+}
+
+func TestProvisionWithParameterTemplates(t *testing.T) {
+	const requestBytes = 100
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+	sc := &storagev1.StorageClass{
+		Parameters: map[string]string{
+			prefixedResolveParameterTemplatesKey: "true",
+			"costCenter":                         "${pvc.annotations['team/cost-center']}",
+		},
+	}
+
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+			expectedParams := map[string]string{"costCenter": "1234"}
+			if !reflect.DeepEqual(req.Parameters, expectedParams) {
+				t.Errorf("expected parameters %v, got %v", expectedParams, req.Parameters)
+			}
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{VolumeId: "test-volume-id", CapacityBytes: requestBytes},
+			}, nil
+		}).Times(1)
+
+	claim := createFakeNamedPVC(requestBytes, "fake-pvc", map[string]string{"team/cost-center": "1234"})
+	if _, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: sc,
+		PVC:          claim,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Without the annotation, provisioning fails before calling the driver.
+	_, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: sc,
+		PVC:          createFakePVC(requestBytes),
+	})
+	if err == nil {
+		t.Fatal("expected error for missing annotation, got none")
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected state %s, got %s", controller.ProvisioningFinished, state)
+	}
+}
+
+func volumeAttachmentIndexer(t testing.TB, vas ...*storagev1.VolumeAttachment) cache.Indexer {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{VolumeAttachmentPVIndex: VolumeAttachmentPVIndexFunc(driverName)})
+	for _, va := range vas {
+		if err := indexer.Add(va); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return indexer
+}
+
+func fakeVolumeAttachment(name, attacher, pvName, nodeName string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: attacher,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			NodeName: nodeName,
+		},
+	}
+}
+
+func TestCanDeleteVolume(t *testing.T) {
+	p := &csiProvisioner{
+		vaIndexer: volumeAttachmentIndexer(t,
+			fakeVolumeAttachment("va-1", driverName, "pv", "node-b"),
+			fakeVolumeAttachment("va-2", driverName, "pv", "node-a"),
+			fakeVolumeAttachment("va-3", driverName, "other-pv", "node-c"),
+			fakeVolumeAttachment("va-4", "other-driver", "pv", "node-d"),
+		),
+	}
+
+	err := p.canDeleteVolume(&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}})
+	expected := "persistentvolume pv is still attached to node(s) node-a, node-b"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+	if err := p.canDeleteVolume(&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "unattached-pv"}}); err != nil {
+		t.Errorf("unexpected error for unattached PV: %v", err)
+	}
+}
+
+func TestVolumeAttachmentTransform(t *testing.T) {
+	transform := VolumeAttachmentTransform(driverName)
+	own := fakeVolumeAttachment("va-1", driverName, "pv", "node")
+	if obj, err := transform(own); err != nil || obj != own {
+		t.Errorf("expected VolumeAttachment of own driver to be unchanged, got %v, %v", obj, err)
+	}
+	obj, err := transform(fakeVolumeAttachment("va-2", "other-driver", "pv", "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	va := obj.(*storagev1.VolumeAttachment)
+	if va.Name != "va-2" || va.Spec.Source.PersistentVolumeName != nil || va.Spec.NodeName != "" {
+		t.Errorf("expected stripped VolumeAttachment of other driver, got %+v", va)
+	}
+}
+
+// BenchmarkCanDeleteVolume compares the lookup through the
+// VolumeAttachmentPVIndex with listing all VolumeAttachments.
+func BenchmarkCanDeleteVolume(b *testing.B) {
+	for _, numAttachments := range []int{100, 1000, 10000} {
+		vas := make([]*storagev1.VolumeAttachment, 0, numAttachments)
+		for i := 0; i < numAttachments; i++ {
+			vas = append(vas, fakeVolumeAttachment(fmt.Sprintf("va-%d", i), driverName, fmt.Sprintf("pv-%d", i), "node"))
+		}
+		indexer := volumeAttachmentIndexer(b, vas...)
+		pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "unattached-pv"}}
+
+		b.Run(fmt.Sprintf("%d/index", numAttachments), func(b *testing.B) {
+			p := &csiProvisioner{vaIndexer: indexer}
+			for i := 0; i < b.N; i++ {
+				if err := p.canDeleteVolume(pv); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/list", numAttachments), func(b *testing.B) {
+			lister := storagelistersv1.NewVolumeAttachmentLister(indexer)
+			for i := 0; i < b.N; i++ {
+				vaList, err := lister.List(labels.Everything())
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, va := range vaList {
+					if va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == pv.Name {
+						b.Fatal("unexpected attachment")
+					}
+				}
+			}
+		})
+	}
+}
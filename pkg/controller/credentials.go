@@ -0,0 +1,203 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// CredentialProviderSecret reads credentials from Kubernetes
+	// secrets. It is the default.
+	CredentialProviderSecret = "secret"
+	// CredentialProviderFile reads credentials from files in a
+	// directory.
+	CredentialProviderFile = "file"
+	// CredentialProviderHTTP asks a credential broker over HTTP.
+	CredentialProviderHTTP = "http"
+
+	// Selects the credential provider for the provisioner secret.
+	prefixedProvisionerSecretProviderKey = csiParameterPrefix + "provisioner-secret-provider"
+
+	// Annotation on PVs with the credential provider for the deletion
+	// secret, unless it is CredentialProviderSecret.
+	annDeletionProvisionerSecretProvider = "volume.kubernetes.io/provisioner-deletion-secret-provider"
+)
+
+// CredentialProvider returns the credentials for CSI calls. The reference
+// comes from the provisioner secret parameters of a storage class or
+// from the deletion secret annotations of a PV. How it gets mapped to
+// credentials depends on the provider.
+type CredentialProvider interface {
+	GetCredentials(ctx context.Context, ref *v1.SecretReference) (map[string]string, error)
+}
+
+// secretCredentialProvider reads Kubernetes secrets, from the secret
+// cache if there is one.
+type secretCredentialProvider struct {
+	client      kubernetes.Interface
+	secretCache *SecretCache
+}
+
+var _ CredentialProvider = &secretCredentialProvider{}
+
+func (s *secretCredentialProvider) GetCredentials(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	var secret *v1.Secret
+	var err error
+	if s.secretCache != nil {
+		secret, err = s.secretCache.Get(ctx, ref.Namespace, ref.Name)
+	} else {
+		secret, err = s.client.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret %s in namespace %s: %v", ref.Name, ref.Namespace, err)
+	}
+
+	credentials := map[string]string{}
+	for key, value := range secret.Data {
+		credentials[key] = string(value)
+	}
+	return credentials, nil
+}
+
+// FileCredentialProvider reads credentials from <dir>/<namespace>/<name>,
+// with one file per key, like the files of a secret volume or of the
+// Secrets Store CSI driver. Hidden files are ignored.
+type FileCredentialProvider struct {
+	dir string
+}
+
+var _ CredentialProvider = &FileCredentialProvider{}
+
+// NewFileCredentialProvider creates a provider for the directory.
+func NewFileCredentialProvider(dir string) *FileCredentialProvider {
+	return &FileCredentialProvider{dir: dir}
+}
+
+func (f *FileCredentialProvider) GetCredentials(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	// The names become part of the path and thus must not contain
+	// separators or "..".
+	if errs := validation.IsDNS1123Label(ref.Namespace); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid credentials namespace %q: %s", ref.Namespace, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(ref.Name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid credentials name %q: %s", ref.Name, strings.Join(errs, ", "))
+	}
+	dir := filepath.Join(f.dir, ref.Namespace, ref.Name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials %s in namespace %s: %v", ref.Name, ref.Namespace, err)
+	}
+	credentials := map[string]string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		// Stat follows the symlinks of secret volumes.
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading credentials %s in namespace %s: %v", ref.Name, ref.Namespace, err)
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading credentials %s in namespace %s: %v", ref.Name, ref.Namespace, err)
+		}
+		credentials[entry.Name()] = string(value)
+	}
+	return credentials, nil
+}
+
+// HTTPCredentialProvider asks a credential broker, usually one that runs
+// next to the external-provisioner. It sends a GET request with the
+// namespace and name as query parameters and expects a JSON object with
+// string values in response.
+type HTTPCredentialProvider struct {
+	url    string
+	client *http.Client
+}
+
+var _ CredentialProvider = &HTTPCredentialProvider{}
+
+// NewHTTPCredentialProvider creates a provider for the broker URL. Each
+// request must complete within the timeout.
+func NewHTTPCredentialProvider(brokerURL string, timeout time.Duration) *HTTPCredentialProvider {
+	return &HTTPCredentialProvider{
+		url:    brokerURL,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (h *HTTPCredentialProvider) GetCredentials(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	requestURL, err := url.Parse(h.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential broker URL: %v", err)
+	}
+	query := requestURL.Query()
+	query.Set("namespace", ref.Namespace)
+	query.Set("name", ref.Name)
+	requestURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting credentials %s in namespace %s: %v", ref.Name, ref.Namespace, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error getting credentials %s in namespace %s: %v", ref.Name, ref.Namespace, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("error getting credentials %s in namespace %s: credential broker returned %s", ref.Name, ref.Namespace, resp.Status)
+	}
+	credentials := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&credentials); err != nil {
+		return nil, fmt.Errorf("error getting credentials %s in namespace %s: invalid response of credential broker: %v", ref.Name, ref.Namespace, err)
+	}
+	return credentials, nil
+}
+
+// credentialProvider returns the provider with the name, the secret
+// provider for an empty name.
+func (p *csiProvisioner) credentialProvider(name string) (CredentialProvider, error) {
+	if name == "" {
+		name = CredentialProviderSecret
+	}
+	provider, ok := p.credentialProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("credential provider %q is not configured", name)
+	}
+	return provider, nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestFileCredentialProvider(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	// Same layout as a secret volume: the keys are symlinks into a
+	// hidden directory.
+	dir := filepath.Join(tmpdir, "kube-system", "admin")
+	data := filepath.Join(dir, "..data")
+	if err := os.MkdirAll(data, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"username": "admin", "password": "secret"} {
+		if err := os.WriteFile(filepath.Join(data, key), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join("..data", key), filepath.Join(dir, key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewFileCredentialProvider(tmpdir)
+	testcases := map[string]struct {
+		ref         v1.SecretReference
+		expectErr   bool
+		credentials map[string]string
+	}{
+		"found": {
+			ref:         v1.SecretReference{Namespace: "kube-system", Name: "admin"},
+			credentials: map[string]string{"username": "admin", "password": "secret"},
+		},
+		"missing": {
+			ref:       v1.SecretReference{Namespace: "kube-system", Name: "missing"},
+			expectErr: true,
+		},
+		"parent directory": {
+			ref:       v1.SecretReference{Namespace: "..", Name: "admin"},
+			expectErr: true,
+		},
+		"separator": {
+			ref:       v1.SecretReference{Namespace: "kube-system", Name: "admin/..data"},
+			expectErr: true,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			credentials, err := provider.GetCredentials(context.Background(), &tc.ref)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got credentials %v", credentials)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(credentials, tc.credentials) {
+				t.Errorf("expected credentials %v, got %v", tc.credentials, credentials)
+			}
+		})
+	}
+}
+
+func TestHTTPCredentialProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("token") != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if query.Get("namespace") != "kube-system" || query.Get("name") != "admin" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"password": "secret"})
+	}))
+	defer server.Close()
+
+	provider := NewHTTPCredentialProvider(server.URL+"?token=abc", 5*time.Second)
+	credentials, err := provider.GetCredentials(context.Background(), &v1.SecretReference{Namespace: "kube-system", Name: "admin"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]string{"password": "secret"}; !reflect.DeepEqual(credentials, expected) {
+		t.Errorf("expected credentials %v, got %v", expected, credentials)
+	}
+	if _, err := provider.GetCredentials(context.Background(), &v1.SecretReference{Namespace: "kube-system", Name: "missing"}); err == nil {
+		t.Error("expected error for missing credentials")
+	}
+}
+
+type fakeCredentialProvider map[string]string
+
+func (f fakeCredentialProvider) GetCredentials(ctx context.Context, ref *v1.SecretReference) (map[string]string, error) {
+	return map[string]string{"key": f[ref.Namespace+"/"+ref.Name]}, nil
+}
+
+func TestProvisionWithCredentialProvider(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	providers := map[string]CredentialProvider{
+		"vault": fakeCredentialProvider{"storage/admin": "from-vault"},
+	}
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithCredentialProviders(providers))
+
+	sc := func(provider string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{Name: "gold"},
+			Parameters: map[string]string{
+				prefixedProvisionerSecretNameKey:      "admin",
+				prefixedProvisionerSecretNamespaceKey: "storage",
+				prefixedProvisionerSecretProviderKey:  provider,
+			},
+		}
+	}
+
+	_, state, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: sc("unknown"),
+		PVC:          createFakePVC(100),
+	})
+	if err == nil || state != controller.ProvisioningFinished {
+		t.Fatalf("expected final error for unknown provider, got %v with state %v", err, state)
+	}
+
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+			if expected := map[string]string{"key": "from-vault"}; !reflect.DeepEqual(req.Secrets, expected) {
+				t.Errorf("expected CreateVolume secrets %v, got %v", expected, req.Secrets)
+			}
+			if _, ok := req.Parameters[prefixedProvisionerSecretProviderKey]; ok {
+				t.Errorf("provider parameter was passed to the driver: %v", req.Parameters)
+			}
+			return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "volume-1", CapacityBytes: 100}}, nil
+		}).Times(1)
+	pv, _, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: sc("vault"),
+		PVC:          createFakePVC(100),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if provider := pv.Annotations[annDeletionProvisionerSecretProvider]; provider != "vault" {
+		t.Errorf("expected provider annotation %q on PV, got %q", "vault", provider)
+	}
+
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+			if expected := map[string]string{"key": "from-vault"}; !reflect.DeepEqual(req.Secrets, expected) {
+				t.Errorf("expected DeleteVolume secrets %v, got %v", expected, req.Secrets)
+			}
+			return &csi.DeleteVolumeResponse{}, nil
+		}).Times(1)
+	if err := provisioner.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("unexpected deletion error: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// Explanation describes what provisioning a PVC would do. It is the
+// result of running the same checks and preparations as Provision
+// without creating a volume.
+type Explanation struct {
+	// Steps are the names of the steps that were started, in order.
+	Steps []string
+	// Err is the error of the last step, nil if all steps succeeded.
+	Err error
+	// Request is the CreateVolumeRequest that would be sent to the
+	// driver. Only set when all steps succeeded.
+	Request *csi.CreateVolumeRequest
+}
+
+// FailedStep returns the name of the step that failed, or an
+// empty string if provisioning would proceed.
+func (e *Explanation) FailedStep() string {
+	if e.Err == nil || len(e.Steps) == 0 {
+		return ""
+	}
+	return e.Steps[len(e.Steps)-1]
+}
+
+// Print writes the explanation in a human-readable form. Secrets in
+// the request are redacted.
+func (e *Explanation) Print(w io.Writer) {
+	failedStep := e.FailedStep()
+	for i, step := range e.Steps {
+		result := "ok"
+		if i == len(e.Steps)-1 && failedStep != "" {
+			result = "FAILED"
+		}
+		fmt.Fprintf(w, "%-45s %s\n", step, result)
+	}
+	if e.Err != nil {
+		var ignored *controller.IgnoredError
+		if errors.As(e.Err, &ignored) {
+			fmt.Fprintf(w, "\nThe PVC would be ignored: %v\n", e.Err)
+		} else {
+			fmt.Fprintf(w, "\nProvisioning would fail in step %q: %v\n", failedStep, e.Err)
+		}
+		return
+	}
+	fmt.Fprintf(w, "\nCreateVolumeRequest:\n%s\n", protosanitizer.StripSecrets(e.Request))
+}
+
+type explainRecorderKey struct{}
+
+// explainRecorder collects the steps of prepareProvision when running
+// on behalf of Explain. Its presence also turns prepareProvision into
+// a dry run which does not modify any object.
+type explainRecorder struct {
+	steps []string
+}
+
+func withExplainRecorder(ctx context.Context, recorder *explainRecorder) context.Context {
+	return context.WithValue(ctx, explainRecorderKey{}, recorder)
+}
+
+// explainStep records the start of a step when the context comes from
+// Explain. The step also becomes an event of the current trace span.
+func explainStep(ctx context.Context, step string) {
+	trace.SpanFromContext(ctx).AddEvent(step)
+	if recorder, ok := ctx.Value(explainRecorderKey{}).(*explainRecorder); ok {
+		recorder.steps = append(recorder.steps, step)
+	}
+}
+
+// isDryRun returns true if objects must not be modified.
+func isDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(explainRecorderKey{}).(*explainRecorder)
+	return ok
+}
+
+// Explain explains what would happen if the PVC was provisioned by the
+// given provisioner, which must have been created by NewCSIProvisioner.
+// Nothing gets created or modified. The error is only set when the
+// explanation itself could not be produced.
+func Explain(ctx context.Context, provisioner controller.Provisioner, namespace, name string) (*Explanation, error) {
+	p, ok := provisioner.(*csiProvisioner)
+	if !ok {
+		return nil, fmt.Errorf("unsupported provisioner %T", provisioner)
+	}
+	recorder := &explainRecorder{}
+	ctx = withExplainRecorder(ctx, recorder)
+	explanation := &Explanation{}
+	explanation.Request, explanation.Err = p.explain(ctx, namespace, name)
+	explanation.Steps = recorder.steps
+	return explanation, nil
+}
+
+// explain looks up the objects that the provision controller would pass to
+// Provision and then runs prepareProvision.
+func (p *csiProvisioner) explain(ctx context.Context, namespace, name string) (*csi.CreateVolumeRequest, error) {
+	explainStep(ctx, "get PVC")
+	claim, err := p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if claim.Spec.VolumeName != "" {
+		return nil, &controller.IgnoredError{Reason: fmt.Sprintf("PVC is already bound to PV %s", claim.Spec.VolumeName)}
+	}
+
+	explainStep(ctx, "check provisioner name")
+	// ShouldProvision is not used because it may try to become the
+	// owner of the PVC.
+	provisioner, ok := claim.Annotations[annStorageProvisioner]
+	if !ok {
+		provisioner = claim.Annotations[annBetaStorageProvisioner]
+	}
+	if provisioner != p.driverName && claim.Annotations[annMigratedTo] != p.driverName {
+		return nil, &controller.IgnoredError{Reason: fmt.Sprintf("PVC is for provisioner %q, not for driver %s", provisioner, p.driverName)}
+	}
+
+	explainStep(ctx, "get storage class")
+	scName := ""
+	if claim.Spec.StorageClassName != nil {
+		scName = *claim.Spec.StorageClassName
+	}
+	if scName == "" {
+		return nil, errors.New("PVC has no storage class")
+	}
+	sc, err := p.client.StorageV1().StorageClasses().Get(ctx, scName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var selectedNode *v1.Node
+	if nodeName := claim.Annotations[annSelectedNode]; nodeName != "" {
+		explainStep(ctx, "get selected node")
+		selectedNode, err = p.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+	} else if sc.VolumeBindingMode != nil && *sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer {
+		return nil, &controller.IgnoredError{Reason: "PVC is waiting for a pod to get scheduled before a node is selected"}
+	}
+
+	result, _, err := p.prepareProvision(ctx, claim, sc, selectedNode)
+	if err != nil {
+		return nil, err
+	}
+	if p.quotaChecker != nil {
+		explainStep(ctx, "check quota")
+		if err := p.quotaChecker.checkOnly(result.pvName, sc.Name, claim.Namespace, result.req.CapacityRange.RequiredBytes); err != nil {
+			return nil, err
+		}
+	}
+	return result.req, nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestExplain(t *testing.T) {
+	const requestBytes = 100
+	waitForFirstConsumer := storagev1.VolumeBindingWaitForFirstConsumer
+	sc := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: fakeSCName},
+		Provisioner: driverName,
+		Parameters: map[string]string{
+			"foo":                                 "bar",
+			prefixedProvisionerSecretNameKey:      "provisioner-secret",
+			prefixedProvisionerSecretNamespaceKey: "${pvc.namespace}",
+		},
+	}
+	badSC := sc.DeepCopy()
+	badSC.Parameters[csiParameterPrefix+"unknown"] = "x"
+	lateBindingSC := sc.DeepCopy()
+	lateBindingSC.VolumeBindingMode = &waitForFirstConsumer
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "provisioner-secret", Namespace: "fake-ns"},
+		Data:       map[string][]byte{"password": []byte("secret-value")},
+	}
+
+	boundClaim := createFakePVC(requestBytes)
+	boundClaim.Spec.VolumeName = "some-pv"
+	otherProvisionerClaim := createFakePVC(requestBytes)
+	otherProvisionerClaim.Annotations[annBetaStorageProvisioner] = "other-driver"
+
+	sourceClaim := fakeClaim("source", "fake-ns", "source-uid", requestBytes, "source-pv", v1.ClaimBound, &fakeSCName, "")
+	sourcePV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "source-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: "source-volume"},
+			},
+			ClaimRef: &v1.ObjectReference{Name: "source", Namespace: "fake-ns", UID: "source-uid"},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+	}
+	cloneClaim := createFakePVC(requestBytes)
+	cloneClaim.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "source"}
+	missingSourceClaim := createFakePVC(requestBytes)
+	missingSourceClaim.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "missing"}
+
+	testcases := map[string]struct {
+		objects       []runtime.Object
+		claims        []*v1.PersistentVolumeClaim
+		expectIgnored bool
+		expectFailed  string
+		expectSource  bool
+	}{
+		"success": {
+			objects: []runtime.Object{createFakePVC(requestBytes), sc, secret},
+		},
+		"unknown parameter": {
+			objects:      []runtime.Object{createFakePVC(requestBytes), badSC, secret},
+			expectFailed: "strip prefixed parameters",
+		},
+		"missing secret": {
+			objects:      []runtime.Object{createFakePVC(requestBytes), sc},
+			expectFailed: "resolve provisioner secret",
+		},
+		"missing storage class": {
+			objects:      []runtime.Object{createFakePVC(requestBytes)},
+			expectFailed: "get storage class",
+		},
+		"missing PVC": {
+			expectFailed: "get PVC",
+		},
+		"bound PVC": {
+			objects:       []runtime.Object{boundClaim, sc, secret},
+			expectIgnored: true,
+		},
+		"other provisioner": {
+			objects:       []runtime.Object{otherProvisionerClaim, sc, secret},
+			expectIgnored: true,
+		},
+		"waiting for first consumer": {
+			objects:       []runtime.Object{createFakePVC(requestBytes), lateBindingSC, secret},
+			expectIgnored: true,
+		},
+		"clone": {
+			objects:      []runtime.Object{cloneClaim, sc, secret, sourceClaim, sourcePV},
+			claims:       []*v1.PersistentVolumeClaim{sourceClaim},
+			expectSource: true,
+		},
+		"missing clone source": {
+			objects:      []runtime.Object{missingSourceClaim, sc, secret},
+			expectFailed: "validate PersistentVolumeClaim data source",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			clientSet := fakeclientset.NewSimpleClientset(tc.objects...)
+			informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+			claimInformer := informerFactory.Core().V1().PersistentVolumeClaims()
+			for _, claim := range tc.claims {
+				claimInformer.Informer().GetStore().Add(claim)
+			}
+			pluginCaps, controllerCaps := provisionFromPVCCapabilities()
+			provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, claimInformer.Lister(), nil, nil, false, defaultfsType, nil, true, false)
+
+			explanation, err := Explain(context.Background(), provisioner, "fake-ns", "fake-pvc")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var ignored *controller.IgnoredError
+			if tc.expectIgnored != errors.As(explanation.Err, &ignored) {
+				t.Fatalf("expected ignored %v, got error %v", tc.expectIgnored, explanation.Err)
+			}
+			if tc.expectIgnored {
+				return
+			}
+			if explanation.FailedStep() != tc.expectFailed {
+				t.Fatalf("expected failed step %q, got %q with error %v", tc.expectFailed, explanation.FailedStep(), explanation.Err)
+			}
+
+			var out bytes.Buffer
+			explanation.Print(&out)
+			if tc.expectFailed != "" {
+				if explanation.Request != nil {
+					t.Errorf("expected no request, got %v", explanation.Request)
+				}
+				if !strings.Contains(out.String(), tc.expectFailed) {
+					t.Errorf("expected failed step in output, got:\n%s", out.String())
+				}
+				return
+			}
+
+			if explanation.Request.Parameters["foo"] != "bar" {
+				t.Errorf("expected parameters with foo=bar, got %v", explanation.Request.Parameters)
+			}
+			if explanation.Request.Secrets["password"] != "secret-value" {
+				t.Errorf("expected secrets in request, got %v", explanation.Request.Secrets)
+			}
+			if strings.Contains(out.String(), "secret-value") {
+				t.Errorf("secret not redacted in output:\n%s", out.String())
+			}
+			if tc.expectSource != (explanation.Request.GetVolumeContentSource() != nil) {
+				t.Errorf("expected volume content source %v, got %v", tc.expectSource, explanation.Request.GetVolumeContentSource())
+			}
+			if tc.expectSource {
+				if volume := explanation.Request.GetVolumeContentSource().GetVolume(); volume.GetVolumeId() != "source-volume" {
+					t.Errorf("expected source volume, got %v", volume)
+				}
+			}
+			for _, action := range clientSet.Actions() {
+				if action.GetVerb() != "get" && action.GetVerb() != "list" && action.GetVerb() != "watch" {
+					t.Errorf("unexpected %s %s", action.GetVerb(), action.GetResource().Resource)
+				}
+			}
+		})
+	}
+}
+
+func TestExplainUnsupportedProvisioner(t *testing.T) {
+	var provisioner controller.Provisioner
+	if _, err := Explain(context.Background(), provisioner, "ns", "name"); err == nil {
+		t.Error("expected error for unsupported provisioner")
+	}
+}
@@ -0,0 +1,473 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	provisionOperation = "provision"
+	deletionOperation  = "delete"
+
+	// A PVC or PV which was put into the work queue again but did not
+	// reach a worker within this time no longer holds a worker of its
+	// namespace.
+	dispatchExpiry = time.Minute
+)
+
+var (
+	// NamespacePendingOperations is the number of PVCs waiting for
+	// provisioning and PVs waiting for deletion in each namespace.
+	NamespacePendingOperations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "controller",
+			Name:      "namespace_pending_operations",
+			Help:      "Number of PVCs waiting for provisioning and PVs waiting for deletion, when fair queuing is enabled. Broken down by namespace and operation.",
+		},
+		[]string{"namespace", "operation"},
+	)
+
+	// NamespaceWaitDurationSeconds measures how long operations got
+	// deferred in favor of other namespaces.
+	NamespaceWaitDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: "controller",
+			Name:      "namespace_wait_duration_seconds",
+			Help:      "Time that provisioning and deletion got deferred in favor of other namespaces. Broken down by namespace and operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+		},
+		[]string{"namespace", "operation"},
+	)
+)
+
+// ParseNamespaceWeights parses a comma-separated list of
+// <namespace>=<weight> pairs.
+func ParseNamespaceWeights(value string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		namespace, weightString, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <namespace>=<weight>, got %q", item)
+		}
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+		weight, err := strconv.Atoi(weightString)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("weight of namespace %s must be a positive integer, got %q", namespace, weightString)
+		}
+		weights[namespace] = weight
+	}
+	return weights, nil
+}
+
+// NamespaceFairness shares the worker threads between namespaces.
+//
+// While several namespaces have PVCs waiting for provisioning, each of
+// them may only use its share of the worker threads, proportional to its
+// weight. A PVC that gets picked by a worker while its namespace already
+// uses its share is skipped without an event and appended to the queue of
+// its namespace. Whenever a worker becomes free, the queues of the
+// namespaces which have not used up their share are served by weighted
+// round robin and their PVCs are put into the work queue again. Deletion
+// of PVs is handled the same way, with separate queues and the namespace
+// of the PVC that the PV was bound to.
+type NamespaceFairness struct {
+	driverName string
+	scLister   storagelistersv1.StorageClassLister
+	workers    int
+	weights    map[string]int
+	now        func() time.Time
+
+	mutex  sync.Mutex
+	queues map[string]*fairQueue
+}
+
+// fairQueue contains the state of one operation.
+type fairQueue struct {
+	operation string
+	informer  *RequeueInformer
+
+	// pending contains the namespace of each PVC or PV which waits for
+	// the operation, by PVC UID or PV name.
+	pending map[string]string
+	// pendingCounts counts the pending PVCs or PVs by namespace.
+	pendingCounts map[string]int
+	// running counts the active operations by namespace.
+	running map[string]int
+	// waiting contains the time of the first deferral by key.
+	waiting map[string]time.Time
+	// parked contains the skipped PVCs or PVs by key, with one FIFO queue
+	// of keys per namespace.
+	parked     map[string]interface{}
+	namespaces map[string][]string
+	// dispatched contains the PVCs or PVs which were put into the work
+	// queue again and did not reach a worker yet, by key.
+	dispatched map[string]dispatchedWork
+	// credits are the current weights of the smooth weighted round
+	// robin, by namespace.
+	credits map[string]int
+}
+
+type dispatchedWork struct {
+	namespace string
+	since     time.Time
+}
+
+// NewNamespaceFairness creates the fair sharing of the given number of
+// worker threads. Namespaces without a weight have a weight of one. The
+// informers must be the ones that are passed to the provision controller.
+func NewNamespaceFairness(
+	driverName string,
+	claims *RequeueInformer,
+	pvs *RequeueInformer,
+	scLister storagelistersv1.StorageClassLister,
+	workers int,
+	weights map[string]int,
+) *NamespaceFairness {
+	f := &NamespaceFairness{
+		driverName: driverName,
+		scLister:   scLister,
+		workers:    workers,
+		weights:    weights,
+		now:        time.Now,
+		queues: map[string]*fairQueue{
+			provisionOperation: newFairQueue(provisionOperation, claims),
+			deletionOperation:  newFairQueue(deletionOperation, pvs),
+		},
+	}
+	// Not added to the RequeueInformers themselves, requeued PVCs and
+	// PVs have not changed.
+	claims.SharedIndexInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    f.updateClaim,
+		UpdateFunc: func(oldObj, newObj interface{}) { f.updateClaim(newObj) },
+		DeleteFunc: f.deleteClaim,
+	})
+	pvs.SharedIndexInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    f.updateVolume,
+		UpdateFunc: func(oldObj, newObj interface{}) { f.updateVolume(newObj) },
+		DeleteFunc: f.deleteVolume,
+	})
+	return f
+}
+
+func newFairQueue(operation string, informer *RequeueInformer) *fairQueue {
+	return &fairQueue{
+		operation:     operation,
+		informer:      informer,
+		pending:       map[string]string{},
+		pendingCounts: map[string]int{},
+		running:       map[string]int{},
+		waiting:       map[string]time.Time{},
+		parked:        map[string]interface{}{},
+		namespaces:    map[string][]string{},
+		dispatched:    map[string]dispatchedWork{},
+		credits:       map[string]int{},
+	}
+}
+
+func (f *NamespaceFairness) weight(namespace string) int {
+	if weight, ok := f.weights[namespace]; ok {
+		return weight
+	}
+	return 1
+}
+
+// isPendingVolume returns true for released PVs of the driver which get
+// deleted.
+func isPendingVolume(pv *v1.PersistentVolume, driverName string) bool {
+	return pv.Status.Phase == v1.VolumeReleased &&
+		pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete &&
+		pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName
+}
+
+func (f *NamespaceFairness) updateClaim(obj interface{}) {
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	f.update(provisionOperation, string(claim.UID), claim.Namespace, claim, isPendingClaim(claim, f.driverName, f.scLister))
+}
+
+func (f *NamespaceFairness) deleteClaim(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	if claim, ok := obj.(*v1.PersistentVolumeClaim); ok {
+		f.update(provisionOperation, string(claim.UID), claim.Namespace, claim, false)
+	}
+}
+
+func (f *NamespaceFairness) updateVolume(obj interface{}) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return
+	}
+	f.update(deletionOperation, pv.Name, pvNamespace(pv), pv, isPendingVolume(pv, f.driverName))
+}
+
+func (f *NamespaceFairness) deleteVolume(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	if pv, ok := obj.(*v1.PersistentVolume); ok {
+		f.update(deletionOperation, pv.Name, pvNamespace(pv), pv, false)
+	}
+}
+
+// update records whether the PVC or PV waits for the operation.
+func (f *NamespaceFairness) update(operation, key, namespace string, obj interface{}, pending bool) {
+	f.mutex.Lock()
+	q := f.queues[operation]
+	if oldNamespace, ok := q.pending[key]; ok && (!pending || oldNamespace != namespace) {
+		delete(q.pending, key)
+		q.setPendingCount(oldNamespace, q.pendingCounts[oldNamespace]-1)
+	}
+	if pending {
+		if _, ok := q.pending[key]; !ok {
+			q.pending[key] = namespace
+			q.setPendingCount(namespace, q.pendingCounts[namespace]+1)
+		}
+		if _, ok := q.parked[key]; ok {
+			q.parked[key] = obj
+		}
+	} else {
+		// Keys in the queue of the namespace are skipped once they
+		// are no longer parked.
+		delete(q.parked, key)
+		delete(q.waiting, key)
+		delete(q.dispatched, key)
+	}
+	f.mutex.Unlock()
+	f.dispatch(operation)
+}
+
+func (q *fairQueue) setPendingCount(namespace string, count int) {
+	if count <= 0 {
+		delete(q.pendingCounts, namespace)
+		NamespacePendingOperations.DeleteLabelValues(namespace, q.operation)
+		return
+	}
+	q.pendingCounts[namespace] = count
+	NamespacePendingOperations.WithLabelValues(namespace, q.operation).Set(float64(count))
+}
+
+// shares returns a function which computes how many worker threads a
+// namespace may use for the operation. The caller must hold the mutex.
+func (f *NamespaceFairness) shares(q *fairQueue) func(namespace string) int {
+	namespaces := map[string]bool{}
+	totalWeight := 0
+	for _, counts := range []map[string]int{q.pendingCounts, q.running} {
+		for namespace := range counts {
+			if !namespaces[namespace] {
+				namespaces[namespace] = true
+				totalWeight += f.weight(namespace)
+			}
+		}
+	}
+	return func(namespace string) int {
+		total := totalWeight
+		if !namespaces[namespace] {
+			total += f.weight(namespace)
+		}
+		share := f.workers * f.weight(namespace) / total
+		if share < 1 {
+			share = 1
+		}
+		return share
+	}
+}
+
+// usage counts by namespace how many worker threads are used or will be
+// used for requeued work. The caller must hold the mutex.
+func (q *fairQueue) usage() map[string]int {
+	used := make(map[string]int, len(q.running))
+	for namespace, count := range q.running {
+		used[namespace] = count
+	}
+	for _, work := range q.dispatched {
+		used[work.namespace]++
+	}
+	return used
+}
+
+// shouldDefer checks whether the namespace has used up its share of the
+// worker threads or other work of the namespace is queued already. If so,
+// the PVC or PV is appended to the queue of the namespace and gets put
+// into the work queue again when it is its turn. The key identifies the
+// PVC or PV.
+func (f *NamespaceFairness) shouldDefer(operation, namespace, key string, obj interface{}) bool {
+	f.mutex.Lock()
+	q := f.queues[operation]
+	_, requeued := q.dispatched[key]
+	delete(q.dispatched, key)
+	if requeued || !q.skipStale(namespace) {
+		if share := f.shares(q)(namespace); q.usage()[namespace] < share {
+			delete(q.parked, key)
+			f.mutex.Unlock()
+			return false
+		}
+	}
+
+	if _, ok := q.waiting[key]; !ok {
+		q.waiting[key] = f.now()
+	}
+	if _, ok := q.parked[key]; !ok {
+		q.namespaces[namespace] = append(q.namespaces[namespace], key)
+	}
+	q.parked[key] = obj
+	f.mutex.Unlock()
+	klog.V(4).Infof("Deferring %s of %s in favor of other namespaces or earlier work of namespace %q", operation, key, namespace)
+
+	// Queued because of earlier work of the namespace, which may get
+	// dispatched right away.
+	f.dispatch(operation)
+	return true
+}
+
+// admit starts an operation for a namespace. The key identifies the PVC
+// or PV. The returned function must be called once the operation is done.
+func (f *NamespaceFairness) admit(operation, namespace, key string) func() {
+	f.mutex.Lock()
+	q := f.queues[operation]
+	var waited time.Duration
+	if since, ok := q.waiting[key]; ok {
+		waited = f.now().Sub(since)
+		delete(q.waiting, key)
+	}
+	NamespaceWaitDurationSeconds.WithLabelValues(namespace, operation).Observe(waited.Seconds())
+	q.running[namespace]++
+	f.mutex.Unlock()
+
+	return func() {
+		f.mutex.Lock()
+		q.running[namespace]--
+		if q.running[namespace] <= 0 {
+			delete(q.running, namespace)
+		}
+		f.mutex.Unlock()
+		f.dispatch(operation)
+	}
+}
+
+// dispatch puts parked PVCs or PVs into the work queue again while
+// workers are free. Namespaces which have not used up their share get
+// served by smooth weighted round robin.
+func (f *NamespaceFairness) dispatch(operation string) {
+	f.mutex.Lock()
+	q := f.queues[operation]
+	now := f.now()
+	free := f.workers
+	for _, count := range q.running {
+		free -= count
+	}
+	for key, work := range q.dispatched {
+		if now.Sub(work.since) > dispatchExpiry {
+			delete(q.dispatched, key)
+			continue
+		}
+		free--
+	}
+
+	share := f.shares(q)
+	used := q.usage()
+	var ready []interface{}
+	for ; free > 0; free-- {
+		var eligible []string
+		for namespace := range q.namespaces {
+			if q.skipStale(namespace) && used[namespace] < share(namespace) {
+				eligible = append(eligible, namespace)
+			}
+		}
+		if len(eligible) == 0 {
+			break
+		}
+		sort.Strings(eligible)
+		totalWeight := 0
+		next := ""
+		for _, namespace := range eligible {
+			q.credits[namespace] += f.weight(namespace)
+			totalWeight += f.weight(namespace)
+			if next == "" || q.credits[namespace] > q.credits[next] {
+				next = namespace
+			}
+		}
+		q.credits[next] -= totalWeight
+
+		key := q.namespaces[next][0]
+		q.namespaces[next] = q.namespaces[next][1:]
+		ready = append(ready, q.parked[key])
+		delete(q.parked, key)
+		q.dispatched[key] = dispatchedWork{namespace: next, since: now}
+		used[next]++
+	}
+	for namespace := range q.credits {
+		if len(q.namespaces[namespace]) == 0 {
+			delete(q.credits, namespace)
+		}
+	}
+	f.mutex.Unlock()
+
+	for _, obj := range ready {
+		q.informer.requeue(obj)
+	}
+}
+
+// skipStale removes keys from the front of the queue of the namespace
+// which are no longer parked. It returns false if the queue is empty
+// afterwards. The caller must hold the mutex.
+func (q *fairQueue) skipStale(namespace string) bool {
+	keys := q.namespaces[namespace]
+	for len(keys) > 0 {
+		if _, ok := q.parked[keys[0]]; ok {
+			break
+		}
+		keys = keys[1:]
+	}
+	if len(keys) == 0 {
+		delete(q.namespaces, namespace)
+		return false
+	}
+	q.namespaces[namespace] = keys
+	return true
+}
+
+// pvNamespace returns the namespace of the PVC that the PV is or was
+// bound to.
+func pvNamespace(pv *v1.PersistentVolume) string {
+	if pv.Spec.ClaimRef == nil {
+		return ""
+	}
+	return pv.Spec.ClaimRef.Namespace
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestParseNamespaceWeights(t *testing.T) {
+	testcases := map[string]struct {
+		value           string
+		expectedWeights map[string]int
+		expectErr       bool
+	}{
+		"empty": {
+			expectedWeights: map[string]int{},
+		},
+		"weights": {
+			value:           "prod=3, staging=2,",
+			expectedWeights: map[string]int{"prod": 3, "staging": 2},
+		},
+		"missing weight": {
+			value:     "prod",
+			expectErr: true,
+		},
+		"zero weight": {
+			value:     "prod=0",
+			expectErr: true,
+		},
+		"invalid namespace": {
+			value:     "Prod=1",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			weights, err := ParseNamespaceWeights(tc.value)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got weights %v", weights)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(weights, tc.expectedWeights) {
+				t.Errorf("expected weights %v, got %v", tc.expectedWeights, weights)
+			}
+		})
+	}
+}
+
+func fairnessClaim(namespace string, i int) *v1.PersistentVolumeClaim {
+	claim := createFakeNamedPVC(100, fmt.Sprintf("claim-%d", i), nil)
+	claim.Namespace = namespace
+	claim.UID = types.UID(fmt.Sprintf("uid-%s-%d", namespace, i))
+	return claim
+}
+
+// newTestNamespaceFairness returns the fair sharing with the PVCs and PVs.
+func newTestNamespaceFairness(claims []*v1.PersistentVolumeClaim, pvs []*v1.PersistentVolume, workers int, weights map[string]int) *NamespaceFairness {
+	informerFactory := informers.NewSharedInformerFactory(fakeclientset.NewSimpleClientset(), 0)
+	claimInformer := NewRequeueInformer(informerFactory.Core().V1().PersistentVolumeClaims().Informer())
+	pvInformer := NewRequeueInformer(informerFactory.Core().V1().PersistentVolumes().Informer())
+	scInformer := informerFactory.Storage().V1().StorageClasses()
+	scInformer.Informer().GetStore().Add(&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: fakeSCName}})
+	f := NewNamespaceFairness(driverName, claimInformer, pvInformer, scInformer.Lister(), workers, weights)
+	for _, claim := range claims {
+		f.updateClaim(claim)
+	}
+	for _, pv := range pvs {
+		f.updateVolume(pv)
+	}
+	return f
+}
+
+func TestNamespaceFairnessProvisioning(t *testing.T) {
+	var claims []*v1.PersistentVolumeClaim
+	for i := 0; i < 100; i++ {
+		claims = append(claims, fairnessClaim("tenant-a", i))
+	}
+	claims = append(claims, fairnessClaim("tenant-b", 0), fairnessClaim("tenant-c", 0))
+	f := newTestNamespaceFairness(claims, nil, 10, map[string]int{"tenant-a": 2})
+	requeued := recordRequeued(f.queues[provisionOperation].informer)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	queue := f.queues[provisionOperation]
+
+	// tenant-a has a weight of 2 out of 4 and thus gets 5 workers.
+	var releases []func()
+	for i := 0; i < 5; i++ {
+		if f.shouldDefer(provisionOperation, "tenant-a", string(claims[i].UID), claims[i]) {
+			t.Fatalf("unexpected deferral of PVC %d", i)
+		}
+		releases = append(releases, f.admit(provisionOperation, "tenant-a", string(claims[i].UID)))
+	}
+	for i := 5; i < 7; i++ {
+		if !f.shouldDefer(provisionOperation, "tenant-a", string(claims[i].UID), claims[i]) {
+			t.Fatalf("expected PVC %d of tenant-a to be deferred", i)
+		}
+	}
+	if len(*requeued) != 0 {
+		t.Errorf("expected no requeued PVCs, got %v", *requeued)
+	}
+
+	// Other namespaces are not affected.
+	if f.shouldDefer(provisionOperation, "tenant-b", string(claims[100].UID), claims[100]) {
+		t.Fatal("unexpected deferral of tenant-b")
+	}
+	f.admit(provisionOperation, "tenant-b", string(claims[100].UID))()
+
+	// Deletion is shared separately.
+	if f.shouldDefer(deletionOperation, "tenant-a", "pv-tenant-a-0", nil) {
+		t.Fatal("unexpected deferral of deletion")
+	}
+	f.admit(deletionOperation, "tenant-a", "pv-tenant-a-0")()
+
+	// A free worker of tenant-a goes to its first deferred PVC.
+	now = now.Add(time.Minute)
+	releases[0]()
+	if expected := []string{"tenant-a/claim-5"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Fatalf("expected requeued PVCs %v, got %v", expected, *requeued)
+	}
+	// A new PVC of tenant-a has to wait for the queued ones.
+	if !f.shouldDefer(provisionOperation, "tenant-a", string(claims[7].UID), claims[7]) {
+		t.Fatal("expected new PVC of tenant-a to be queued behind the deferred ones")
+	}
+	if f.shouldDefer(provisionOperation, "tenant-a", string(claims[5].UID), claims[5]) {
+		t.Fatal("expected requeued PVC to be provisioned")
+	}
+	f.admit(provisionOperation, "tenant-a", string(claims[5].UID))()
+	if _, ok := queue.waiting[string(claims[5].UID)]; ok {
+		t.Error("expected requeued PVC to be no longer waiting")
+	}
+	if expected := []string{"tenant-a/claim-5", "tenant-a/claim-6"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Fatalf("expected requeued PVCs %v, got %v", expected, *requeued)
+	}
+
+	// Deleted PVCs are forgotten.
+	f.deleteClaim(claims[7])
+	if _, ok := queue.parked[string(claims[7].UID)]; ok {
+		t.Error("expected deleted PVC to be forgotten")
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+	if len(queue.running) != 0 {
+		t.Errorf("expected no running operations, got %v", queue.running)
+	}
+}
+
+func TestNamespaceFairnessRoundRobin(t *testing.T) {
+	var claims []*v1.PersistentVolumeClaim
+	for _, namespace := range []string{"tenant-a", "tenant-b"} {
+		for i := 0; i < 10; i++ {
+			claims = append(claims, fairnessClaim(namespace, i))
+		}
+	}
+	f := newTestNamespaceFairness(claims, nil, 8, map[string]int{"tenant-a": 3})
+	requeued := recordRequeued(f.queues[provisionOperation].informer)
+	queue := f.queues[provisionOperation]
+
+	// tenant-a gets 6 and tenant-b 2 workers, all of them are busy.
+	queue.running["tenant-a"] = 6
+	queue.running["tenant-b"] = 2
+	for _, claim := range claims {
+		if !f.shouldDefer(provisionOperation, claim.Namespace, string(claim.UID), claim) {
+			t.Fatalf("expected PVC %s/%s to be deferred", claim.Namespace, claim.Name)
+		}
+	}
+
+	// Once all workers are free, they are handed out interleaved by
+	// weight.
+	queue.running = map[string]int{}
+	f.dispatch(provisionOperation)
+	var namespaces []string
+	for _, key := range *requeued {
+		namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+		namespaces = append(namespaces, namespace)
+	}
+	expected := []string{"tenant-a", "tenant-a", "tenant-b", "tenant-a", "tenant-a", "tenant-a", "tenant-b", "tenant-a"}
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("expected requeued PVCs from namespaces %v, got %v", expected, namespaces)
+	}
+}
+
+func TestNamespaceFairnessSingleNamespace(t *testing.T) {
+	var claims []*v1.PersistentVolumeClaim
+	for i := 0; i < 20; i++ {
+		claims = append(claims, fairnessClaim("tenant-a", i))
+	}
+	f := newTestNamespaceFairness(claims, nil, 10, nil)
+
+	// Without other namespaces, all workers may be used.
+	for i := 0; i < 10; i++ {
+		if f.shouldDefer(provisionOperation, "tenant-a", string(claims[i].UID), claims[i]) {
+			t.Fatalf("unexpected deferral of PVC %d", i)
+		}
+		f.admit(provisionOperation, "tenant-a", string(claims[i].UID))
+	}
+}
+
+func TestNamespaceFairnessDeletion(t *testing.T) {
+	pvs := []*v1.PersistentVolume{
+		newTestPV("pv-a-0", "tenant-a", "", ""),
+		newTestPV("pv-a-1", "tenant-a", "", ""),
+		newTestPV("pv-a-2", "tenant-a", "", ""),
+		newTestPV("pv-b-0", "tenant-b", "", ""),
+		newTestPV("pv-c-0", "tenant-c", "", ""),
+	}
+	for _, pv := range pvs {
+		pv.Status.Phase = v1.VolumeReleased
+	}
+	pvs[4].Status.Phase = v1.VolumeBound
+	f := newTestNamespaceFairness(nil, pvs, 2, nil)
+	requeued := recordRequeued(f.queues[deletionOperation].informer)
+	queue := f.queues[deletionOperation]
+
+	if f.shouldDefer(deletionOperation, "tenant-a", pvs[0].Name, pvs[0]) {
+		t.Fatal("unexpected deferral")
+	}
+	release := f.admit(deletionOperation, "tenant-a", pvs[0].Name)
+	if !f.shouldDefer(deletionOperation, "tenant-a", pvs[1].Name, pvs[1]) {
+		t.Fatal("expected tenant-a to be deferred while tenant-b has released PVs")
+	}
+	if count := queue.pendingCounts["tenant-a"]; count != 3 {
+		t.Errorf("expected 3 pending deletions for tenant-a, got %d", count)
+	}
+	if _, ok := queue.pendingCounts["tenant-c"]; ok {
+		t.Error("expected bound PVs not to be pending")
+	}
+
+	deleted := pvs[0].DeepCopy()
+	deleted.Status.Phase = v1.VolumeFailed
+	f.updateVolume(deleted)
+	release()
+	if expected := []string{pvs[1].Name}; !reflect.DeepEqual(*requeued, expected) {
+		t.Errorf("expected requeued PVs %v, got %v", expected, *requeued)
+	}
+	if count := queue.pendingCounts["tenant-a"]; count != 2 {
+		t.Errorf("expected 2 pending deletions for tenant-a, got %d", count)
+	}
+
+	// Only Delete waits for the turn of the namespace, volumes from the
+	// trash get deleted directly.
+	defer f.admit(deletionOperation, "tenant-a", pvs[1].Name)()
+	p := &csiProvisioner{namespaceFairness: f}
+	var ignored *controller.IgnoredError
+	if err := p.Delete(context.Background(), pvs[2]); !errors.As(err, &ignored) {
+		t.Errorf("expected Delete to be deferred, got %v", err)
+	}
+	if err := p.deleteVolume(context.Background(), pvs[2], false); errors.As(err, &ignored) {
+		t.Errorf("expected deleteVolume not to be deferred, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// PVCs with the same value for this annotation in the same namespace get
+// restored together from the snapshots of one volume group snapshot.
+const annGroupRestore = "provisioner.storage.kubernetes.io/group-restore"
+
+// groupRestoreCheckExpiry is how long a successful check of a group restore
+// is reused for the other PVCs of the group.
+const groupRestoreCheckExpiry = time.Minute
+
+// groupRestoreMember is a PVC of a group restore together with the ID of
+// the snapshot that it gets restored from.
+type groupRestoreMember struct {
+	claim      *v1.PersistentVolumeClaim
+	snapshotID string
+}
+
+// groupRestoreChecks remembers the group restores which passed
+// checkGroupRestore, so that the other PVCs of a group restore do not check
+// the whole group again. The zero value is ready to use.
+type groupRestoreChecks struct {
+	mutex sync.Mutex
+	// checked contains the PVCs of a group restore at the time of a
+	// successful check, by <namespace>/<group restore>.
+	checked map[string]groupRestoreCheck
+}
+
+type groupRestoreCheck struct {
+	claims sets.Set[types.UID]
+	time   time.Time
+}
+
+// passed returns true if the group restore with exactly these PVCs was
+// checked recently.
+func (c *groupRestoreChecks) passed(key string, claims sets.Set[types.UID], now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, check := range c.checked {
+		if now.Sub(check.time) > groupRestoreCheckExpiry {
+			delete(c.checked, k)
+		}
+	}
+	check, ok := c.checked[key]
+	return ok && check.claims.Equal(claims)
+}
+
+func (c *groupRestoreChecks) add(key string, claims sets.Set[types.UID], now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.checked == nil {
+		c.checked = map[string]groupRestoreCheck{}
+	}
+	c.checked[key] = groupRestoreCheck{claims: claims, time: now}
+}
+
+// checkGroupRestore checks the group restore that the PVC belongs to. All
+// PVCs of the group restore must be restored from snapshots of the same
+// volume group snapshot, there must be a PVC for each snapshot of the
+// group and the group snapshot must be ready to use. Because each PVC of
+// the group restore gets checked this way before its volume gets created,
+// no volume is created before all of them can be created.
+//
+// The group gets checked once for all of its PVCs. Once some PVC of the
+// group is bound, the group was complete and only the snapshot of the PVC
+// itself gets checked, because snapshots of restored PVCs may be deleted.
+func (p *csiProvisioner) checkGroupRestore(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) error {
+	groupRestore := claim.Annotations[annGroupRestore]
+	if !p.groupControllerCapabilities[csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT] ||
+		!p.controllerCapabilities[csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS] {
+		return fmt.Errorf("group restore %q: driver %s does not support volume group snapshots and listing snapshots", groupRestore, p.driverName)
+	}
+	if p.claimLister == nil {
+		return fmt.Errorf("group restore %q: not supported without a PVC lister", groupRestore)
+	}
+
+	claims, err := p.claimLister.PersistentVolumeClaims(claim.Namespace).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("group restore %q: failed to list PVCs: %v", groupRestore, err)
+	}
+	var others []*v1.PersistentVolumeClaim
+	uids := sets.New(claim.UID)
+	bound := false
+	for _, c := range claims {
+		if c.Annotations[annGroupRestore] != groupRestore || c.UID == claim.UID {
+			continue
+		}
+		others = append(others, c)
+		uids.Insert(c.UID)
+		if c.Spec.VolumeName != "" {
+			bound = true
+		}
+	}
+	// The PVC itself might not be in the lister yet.
+	member, err := p.groupRestoreMember(ctx, claim, sc)
+	if err != nil {
+		return fmt.Errorf("group restore %q: %v", groupRestore, err)
+	}
+	if bound {
+		klog.V(4).Infof("group restore %q: some PVCs are restored already, only checked the snapshot of PVC %s", groupRestore, claim.Name)
+		return nil
+	}
+	key := claim.Namespace + "/" + groupRestore
+	if p.groupRestoreChecks.passed(key, uids, time.Now()) {
+		return nil
+	}
+
+	members := []groupRestoreMember{*member}
+	for _, c := range others {
+		member, err := p.groupRestoreMember(ctx, c, sc)
+		if err != nil {
+			return fmt.Errorf("group restore %q: %v", groupRestore, err)
+		}
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].claim.Name < members[j].claim.Name })
+
+	groupSnapshotID := ""
+	snapshotIDs := make([]string, 0, len(members))
+	for _, member := range members {
+		snapshot, err := p.getCSISnapshot(ctx, member.snapshotID)
+		if err != nil {
+			return fmt.Errorf("group restore %q: PVC %s: %v", groupRestore, member.claim.Name, err)
+		}
+		switch {
+		case snapshot.GroupSnapshotId == "":
+			return fmt.Errorf("group restore %q: snapshot %s of PVC %s does not belong to a volume group snapshot", groupRestore, member.snapshotID, member.claim.Name)
+		case groupSnapshotID == "":
+			groupSnapshotID = snapshot.GroupSnapshotId
+		case groupSnapshotID != snapshot.GroupSnapshotId:
+			return fmt.Errorf("group restore %q: snapshot %s of PVC %s belongs to volume group snapshot %s, not to %s", groupRestore, member.snapshotID, member.claim.Name, snapshot.GroupSnapshotId, groupSnapshotID)
+		}
+		snapshotIDs = append(snapshotIDs, member.snapshotID)
+	}
+
+	groupCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	rsp, err := p.groupControllerClient.GetVolumeGroupSnapshot(groupCtx, &csi.GetVolumeGroupSnapshotRequest{
+		GroupSnapshotId: groupSnapshotID,
+		SnapshotIds:     snapshotIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("group restore %q: failed to get volume group snapshot %s: %v", groupRestore, groupSnapshotID, err)
+	}
+	groupSnapshot := rsp.GetGroupSnapshot()
+	if !groupSnapshot.GetReadyToUse() {
+		return fmt.Errorf("group restore %q: volume group snapshot %s is not ready", groupRestore, groupSnapshotID)
+	}
+	restored := map[string]bool{}
+	for _, id := range snapshotIDs {
+		restored[id] = true
+	}
+	for _, snapshot := range groupSnapshot.GetSnapshots() {
+		if !restored[snapshot.GetSnapshotId()] {
+			return fmt.Errorf("group restore %q: no PVC for snapshot %s of volume group snapshot %s", groupRestore, snapshot.GetSnapshotId(), groupSnapshotID)
+		}
+	}
+	klog.V(4).Infof("group restore %q: all %d snapshots of volume group snapshot %s are ready", groupRestore, len(snapshotIDs), groupSnapshotID)
+	p.groupRestoreChecks.add(key, uids, time.Now())
+	return nil
+}
+
+// groupRestoreMember returns the snapshot that a PVC of a group restore
+// gets restored from.
+func (p *csiProvisioner) groupRestoreMember(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) (*groupRestoreMember, error) {
+	if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != sc.Name {
+		return nil, fmt.Errorf("PVC %s does not use storage class %s", claim.Name, sc.Name)
+	}
+	dataSource, err := p.dataSource(ctx, claim)
+	if err != nil {
+		return nil, fmt.Errorf("PVC %s: %v", claim.Name, err)
+	}
+	if dataSource == nil || dataSource.Kind != snapshotKind || dataSource.APIVersion != snapshotAPIGroup {
+		return nil, fmt.Errorf("PVC %s does not have a VolumeSnapshot as data source", claim.Name)
+	}
+	snapshotObj, err := p.snapshotClient.SnapshotV1().VolumeSnapshots(dataSource.Namespace).Get(ctx, dataSource.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("PVC %s: error getting snapshot %s: %v", claim.Name, dataSource.Name, err)
+	}
+	if snapshotObj.Status == nil || snapshotObj.Status.ReadyToUse == nil || !*snapshotObj.Status.ReadyToUse || snapshotObj.Status.BoundVolumeSnapshotContentName == nil {
+		return nil, fmt.Errorf("PVC %s: snapshot %s is not ready", claim.Name, dataSource.Name)
+	}
+	snapContentObj, err := p.snapshotClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, *snapshotObj.Status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("PVC %s: error getting snapshot content for snapshot %s: %v", claim.Name, dataSource.Name, err)
+	}
+	if snapContentObj.Spec.VolumeSnapshotRef.UID != snapshotObj.UID || snapContentObj.Spec.Driver != p.driverName ||
+		snapContentObj.Status == nil || snapContentObj.Status.SnapshotHandle == nil {
+		return nil, fmt.Errorf("PVC %s: "+snapshotNotBound, claim.Name, dataSource.Name)
+	}
+	return &groupRestoreMember{
+		claim:      claim,
+		snapshotID: *snapContentObj.Status.SnapshotHandle,
+	}, nil
+}
+
+// getCSISnapshot looks up a snapshot with ListSnapshots.
+func (p *csiProvisioner) getCSISnapshot(ctx context.Context, snapshotID string) (*csi.Snapshot, error) {
+	listCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	rsp, err := p.csiClient.ListSnapshots(listCtx, &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshot %s: %v", snapshotID, err)
+	}
+	for _, entry := range rsp.GetEntries() {
+		if entry.GetSnapshot().GetSnapshotId() == snapshotID {
+			return entry.GetSnapshot(), nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found", snapshotID)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-snapshotter/client/v6/clientset/versioned/fake"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeSnapshotLister implements ListSnapshots for a fixed set of snapshots.
+type fakeSnapshotLister struct {
+	csi.ControllerClient
+	snapshots []*csi.Snapshot
+}
+
+func (f *fakeSnapshotLister) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest, opts ...grpc.CallOption) (*csi.ListSnapshotsResponse, error) {
+	rsp := &csi.ListSnapshotsResponse{}
+	for _, snapshot := range f.snapshots {
+		if req.SnapshotId == snapshot.SnapshotId {
+			rsp.Entries = append(rsp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+		}
+	}
+	return rsp, nil
+}
+
+// fakeGroupController implements GetVolumeGroupSnapshot for a single group snapshot.
+type fakeGroupController struct {
+	csi.GroupControllerClient
+	groupSnapshot *csi.VolumeGroupSnapshot
+	calls         int
+}
+
+func (f *fakeGroupController) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest, opts ...grpc.CallOption) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	f.calls++
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: f.groupSnapshot}, nil
+}
+
+func groupRestoreClaim(name, snapshotName string) *v1.PersistentVolumeClaim {
+	claim := createFakeNamedPVC(100, name, map[string]string{annGroupRestore: "db"})
+	claim.UID = types.UID("uid-" + name)
+	if snapshotName != "" {
+		apiGroup := snapshotAPIGroup
+		claim.Spec.DataSource = &v1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: snapshotKind, Name: snapshotName}
+	}
+	return claim
+}
+
+// boundGroupRestoreClaim returns a PVC of a group restore which got
+// restored already.
+func boundGroupRestoreClaim(name, snapshotName string) *v1.PersistentVolumeClaim {
+	claim := groupRestoreClaim(name, snapshotName)
+	claim.Spec.VolumeName = "pv-" + name
+	return claim
+}
+
+func groupRestoreSnapshot(name, handle string, ready bool) []runtime.Object {
+	snapshot := newSnapshot(name, "fake-ns", "snapclass", "content-"+name, "snapuid-"+name, "claim", ready, nil, nil, nil)
+	content := newContent("content-"+name, "fake-ns", "snapclass", handle, "", "", "snapuid-"+name, name, nil, nil)
+	content.Spec.Driver = driverName
+	return []runtime.Object{snapshot, content}
+}
+
+func TestCheckGroupRestore(t *testing.T) {
+	groupCaps := rpc.GroupControllerCapabilitySet{csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT: true}
+	controllerCaps := rpc.ControllerCapabilitySet{csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS: true}
+	csiSnapshots := []*csi.Snapshot{
+		{SnapshotId: "handle-0", GroupSnapshotId: "group-1", ReadyToUse: true},
+		{SnapshotId: "handle-1", GroupSnapshotId: "group-1", ReadyToUse: true},
+		{SnapshotId: "handle-2", GroupSnapshotId: "group-2", ReadyToUse: true},
+		{SnapshotId: "handle-3", ReadyToUse: true},
+	}
+	readyGroup := &csi.VolumeGroupSnapshot{GroupSnapshotId: "group-1", Snapshots: csiSnapshots[0:2], ReadyToUse: true}
+	var snapshotObjects []runtime.Object
+	for i := 0; i < 4; i++ {
+		snapshotObjects = append(snapshotObjects, groupRestoreSnapshot(fmt.Sprintf("snap-%d", i), fmt.Sprintf("handle-%d", i), true)...)
+	}
+	snapshotObjects = append(snapshotObjects, groupRestoreSnapshot("snap-not-ready", "handle-1", false)...)
+
+	// The PVCs which are not bound yet get checked in order, until the
+	// first error.
+	testcases := map[string]struct {
+		claims           []*v1.PersistentVolumeClaim
+		groupCaps        rpc.GroupControllerCapabilitySet
+		groupSnapshot    *csi.VolumeGroupSnapshot
+		expectErr        bool
+		expectGroupCalls int
+	}{
+		"ready": {
+			claims:           []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), groupRestoreClaim("data-1", "snap-1")},
+			groupCaps:        groupCaps,
+			groupSnapshot:    readyGroup,
+			expectGroupCalls: 1,
+		},
+		"partly restored with deleted snapshot": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), boundGroupRestoreClaim("data-1", "snap-deleted")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+		},
+		"partly restored without own snapshot": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-deleted"), boundGroupRestoreClaim("data-1", "snap-1")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+		"no group controller": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), groupRestoreClaim("data-1", "snap-1")},
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+		"group snapshot not ready": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), groupRestoreClaim("data-1", "snap-1")},
+			groupCaps:     groupCaps,
+			groupSnapshot: &csi.VolumeGroupSnapshot{GroupSnapshotId: "group-1", Snapshots: csiSnapshots[0:2]},
+			expectErr:     true,
+		},
+		"volume snapshot not ready": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), groupRestoreClaim("data-1", "snap-not-ready")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+		"missing PVC for group member": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+		"different groups": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), groupRestoreClaim("data-2", "snap-2")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+		"snapshot without group": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-3", "snap-3")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+		"PVC without snapshot": {
+			claims:        []*v1.PersistentVolumeClaim{groupRestoreClaim("data-0", "snap-0"), groupRestoreClaim("data-1", "snap-1"), groupRestoreClaim("data-x", "")},
+			groupCaps:     groupCaps,
+			groupSnapshot: readyGroup,
+			expectErr:     true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			informerFactory := informers.NewSharedInformerFactory(fakeclientset.NewSimpleClientset(), 0)
+			claimInformer := informerFactory.Core().V1().PersistentVolumeClaims()
+			for _, claim := range tc.claims {
+				claimInformer.Informer().GetStore().Add(claim)
+			}
+			groupController := &fakeGroupController{groupSnapshot: tc.groupSnapshot}
+			p := &csiProvisioner{
+				driverName:                  driverName,
+				timeout:                     time.Second,
+				csiClient:                   &fakeSnapshotLister{snapshots: csiSnapshots},
+				groupControllerClient:       groupController,
+				controllerCapabilities:      controllerCaps,
+				groupControllerCapabilities: tc.groupCaps,
+				claimLister:                 claimInformer.Lister(),
+				snapshotClient:              fake.NewSimpleClientset(snapshotObjects...),
+			}
+			sc := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: fakeSCName}}
+			var err error
+			for _, claim := range tc.claims {
+				if claim.Spec.VolumeName != "" {
+					continue
+				}
+				if err = p.checkGroupRestore(context.Background(), claim, sc); err != nil {
+					break
+				}
+			}
+			if tc.expectErr && err == nil {
+				t.Error("expected error, got none")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.expectErr && groupController.calls != tc.expectGroupCalls {
+				t.Errorf("expected %d GetVolumeGroupSnapshot calls, got %d", tc.expectGroupCalls, groupController.calls)
+			}
+		})
+	}
+}
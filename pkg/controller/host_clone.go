@@ -0,0 +1,439 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+//
+// A host-assisted clone copies the data of a PVC data source with a Job
+// instead of letting the CSI driver clone the volume. It gets used when the
+// driver does not support CLONE_VOLUME or when the source volume belongs
+// to some other driver.
+//
+// The new volume gets created empty. It is then made available to the copy
+// Job through a temporary PV and PVC in the namespace of the source PVC.
+// The temporary PV has the Retain reclaim policy, so removing it after the
+// copy leaves the volume intact. Provisioning only returns the PV for the
+// target PVC once the Job has succeeded, so the target PVC stays pending
+// during the copy and the source PVC stays protected by the
+// cloning-protection finalizer.
+//
+// The temporary objects cannot be owned by the target PVC because the PV
+// is not namespaced and the PVC and Job may be in some other namespace.
+// Instead, they are labeled with the UID of the target PVC and annotated
+// with its namespace and name. When the target PVC gets deleted during
+// the copy, a periodic sweep removes the Job and the temporary PVC and
+// hands the temporary PV over to the normal deletion, which deletes the
+// new volume once the temporary PVC is gone.
+//
+// A Job in the namespace of the source PVC can read all data of the source
+// PVC and needs to run as root for cp -a to preserve file ownership.
+// Copying from a PVC in some other namespace therefore must be allowed
+// explicitly.
+//
+
+const (
+	// Label on the temporary PV, PVC and copy Job of a host-assisted
+	// clone, with the UID of the target PVC as value.
+	labelHostAssistedClone = "provisioner.storage.kubernetes.io/host-assisted-clone"
+	// Annotation on the temporary PV, PVC and copy Job of a host-assisted
+	// clone with the namespace and name of the target PVC.
+	annHostAssistedCloneTarget = "provisioner.storage.kubernetes.io/host-assisted-clone-target"
+
+	// annDynamicallyProvisioned marks PVs which the provision controller
+	// deletes.
+	annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
+
+	// hostAssistedCloneSweepInterval is how often the leftovers of
+	// host-assisted clones whose target PVC got deleted are removed.
+	hostAssistedCloneSweepInterval = 5 * time.Minute
+
+	hostCloneSourceVolume = "source"
+	hostCloneTargetVolume = "target"
+)
+
+// HostAssistedClone enables copying the data of PVC data sources with a
+// Job when the CSI driver cannot clone them.
+type HostAssistedClone struct {
+	// Image is the container image of the copy Job. It must provide
+	// sh, cp and dd.
+	Image string
+	// AllowCrossNamespace enables copying PVC data sources in some other
+	// namespace than the target PVC.
+	AllowCrossNamespace bool
+
+	// sweep removes the leftovers of copies whose target PVC got deleted.
+	// It gets set by NewCSIProvisioner.
+	sweep func(ctx context.Context) error
+}
+
+// Run removes the leftovers of copies whose target PVC got deleted until
+// the context is done.
+func (h *HostAssistedClone) Run(ctx context.Context) {
+	klog.Info("Starting host-assisted clone sweep")
+	defer utilruntime.HandleCrash()
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := h.sweep(ctx); err != nil {
+			klog.Warningf("Host-assisted clone: removing leftovers of deleted PVCs failed: %v", err)
+		}
+	}, hostAssistedCloneSweepInterval)
+	klog.Info("Shutting down host-assisted clone sweep")
+}
+
+// needsHostAssistedClone determines whether a PVC data source must be
+// copied by a Job. Problems with the source are left to getPVCSource
+// and checkHostAssistedCloneSource.
+func (p *csiProvisioner) needsHostAssistedClone(ctx context.Context, sc string, dataSource *v1.ObjectReference) bool {
+	if !p.controllerCapabilities[csi.ControllerServiceCapability_RPC_CLONE_VOLUME] {
+		return true
+	}
+	sourcePVC, err := p.claimLister.PersistentVolumeClaims(dataSource.Namespace).Get(dataSource.Name)
+	if err != nil || sourcePVC.Spec.VolumeName == "" {
+		return false
+	}
+	sourcePV, err := p.client.CoreV1().PersistentVolumes().Get(ctx, sourcePVC.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	return sourcePV.Spec.CSI == nil || sourcePV.Spec.CSI.Driver != sc
+}
+
+// checkHostAssistedCloneSource verifies that the PVC data source can be
+// copied into the claim and returns its size.
+func (p *csiProvisioner) checkHostAssistedCloneSource(claim *v1.PersistentVolumeClaim, dataSource *v1.ObjectReference, autoEnlarge bool) (int64, error) {
+	sourcePVC, err := p.claimLister.PersistentVolumeClaims(dataSource.Namespace).Get(dataSource.Name)
+	if err != nil {
+		return 0, fmt.Errorf("error getting PVC %s (namespace %q) from api server: %v", dataSource.Name, dataSource.Namespace, err)
+	}
+	if dataSource.Namespace != claim.Namespace && !p.hostAssistedClone.AllowCrossNamespace {
+		return 0, fmt.Errorf("copying the PVC DataSource %s from namespace %q is not allowed, the driver cannot clone it", dataSource.Name, dataSource.Namespace)
+	}
+	if sourcePVC.Status.Phase != v1.ClaimBound {
+		return 0, fmt.Errorf("the PVC DataSource %s must have a status of Bound.  Got %v", dataSource.Name, sourcePVC.Status)
+	}
+	if sourcePVC.DeletionTimestamp != nil {
+		return 0, fmt.Errorf("the PVC DataSource %s is currently being deleted", dataSource.Name)
+	}
+	if isBlockMode(sourcePVC.Spec.VolumeMode) != isBlockMode(claim.Spec.VolumeMode) {
+		return 0, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning")
+	}
+
+	capacity := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	srcCapacity := sourcePVC.Spec.Resources.Requests[v1.ResourceStorage]
+	if capacity.Value() < srcCapacity.Value() && !autoEnlarge {
+		return 0, fmt.Errorf("error, new PVC request must be greater than or equal in size to the specified PVC data source, requested %v but source is %v", capacity.Value(), srcCapacity.Value())
+	}
+	return srcCapacity.Value(), nil
+}
+
+// copyHostAssistedClone copies the data of the source PVC into the volume
+// of the PV. It returns the PV once the copy is complete and an error
+// while it is still in progress.
+func (p *csiProvisioner) copyHostAssistedClone(ctx context.Context, claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, source *v1.ObjectReference) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	name := hostAssistedCloneName(claim)
+	labels := map[string]string{labelHostAssistedClone: string(claim.UID)}
+	annotations := map[string]string{annHostAssistedCloneTarget: claim.Namespace + "/" + claim.Name}
+	blockMode := isBlockMode(claim.Spec.VolumeMode)
+
+	tempPV := pv.DeepCopy()
+	tempPV.Name = name
+	tempPV.Labels = labels
+	for key, value := range annotations {
+		metav1.SetMetaDataAnnotation(&tempPV.ObjectMeta, key, value)
+	}
+	tempPV.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	tempPV.Spec.StorageClassName = ""
+	tempPV.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  source.Namespace,
+		Name:       name,
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Create(ctx, tempPV, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("error creating PV %s for copying data: %v", name, err)
+	}
+
+	storageClassName := ""
+	tempPVC := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   source.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      pv.Spec.AccessModes,
+			VolumeMode:       claim.Spec.VolumeMode,
+			StorageClassName: &storageClassName,
+			VolumeName:       name,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: pv.Spec.Capacity[v1.ResourceStorage],
+				},
+			},
+		},
+	}
+	if _, err := p.client.CoreV1().PersistentVolumeClaims(source.Namespace).Create(ctx, tempPVC, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("error creating PVC %s/%s for copying data: %v", source.Namespace, name, err)
+	}
+
+	job, err := p.client.BatchV1().Jobs(source.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		job = p.hostAssistedClone.copyJob(name, source.Namespace, source.Name, labels, annotations, blockMode)
+		if _, err := p.client.BatchV1().Jobs(source.Namespace).Create(ctx, job, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return nil, controller.ProvisioningInBackground, fmt.Errorf("error creating Job %s/%s for copying data: %v", source.Namespace, name, err)
+		}
+		p.eventRecorder.Eventf(claim, v1.EventTypeNormal, "HostAssistedClone", "Copying data from PVC %s/%s with Job %s/%s", source.Namespace, source.Name, source.Namespace, name)
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("copying data from PVC %s/%s with Job %s/%s", source.Namespace, source.Name, source.Namespace, name)
+	}
+	if err != nil {
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("error getting Job %s/%s for copying data: %v", source.Namespace, name, err)
+	}
+
+	switch {
+	case job.Status.Succeeded > 0:
+		klog.V(2).Infof("Copied data from PVC %s/%s for PVC %s", source.Namespace, source.Name, klog.KObj(claim))
+		if err := p.cleanupHostAssistedClone(ctx, name, source.Namespace); err != nil {
+			return nil, controller.ProvisioningInBackground, err
+		}
+		return pv, controller.ProvisioningFinished, nil
+	case jobFailed(job):
+		// The Job gets created again by the next attempt.
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "HostAssistedCloneFailed", "Job %s/%s failed to copy data from PVC %s/%s, retrying", source.Namespace, name, source.Namespace, source.Name)
+		if err := deleteIgnoringNotFound(p.client.BatchV1().Jobs(source.Namespace).Delete(ctx, name, backgroundDeletion())); err != nil {
+			return nil, controller.ProvisioningInBackground, fmt.Errorf("error deleting failed Job %s/%s: %v", source.Namespace, name, err)
+		}
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("Job %s/%s failed to copy data from PVC %s/%s", source.Namespace, name, source.Namespace, source.Name)
+	default:
+		return nil, controller.ProvisioningInBackground, fmt.Errorf("waiting for Job %s/%s to copy data from PVC %s/%s", source.Namespace, name, source.Namespace, source.Name)
+	}
+}
+
+// cleanupHostAssistedClone removes the copy Job and the temporary PVC and
+// PV. The volume itself is kept because the PV has the Retain reclaim
+// policy.
+func (p *csiProvisioner) cleanupHostAssistedClone(ctx context.Context, name, namespace string) error {
+	if err := deleteIgnoringNotFound(p.client.BatchV1().Jobs(namespace).Delete(ctx, name, backgroundDeletion())); err != nil {
+		return fmt.Errorf("error deleting Job %s/%s after copying data: %v", namespace, name, err)
+	}
+	if err := deleteIgnoringNotFound(p.client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{})); err != nil {
+		return fmt.Errorf("error deleting PVC %s/%s after copying data: %v", namespace, name, err)
+	}
+	if err := deleteIgnoringNotFound(p.client.CoreV1().PersistentVolumes().Delete(ctx, name, metav1.DeleteOptions{})); err != nil {
+		return fmt.Errorf("error deleting PV %s after copying data: %v", name, err)
+	}
+	return nil
+}
+
+// sweepHostAssistedClones removes the copy Jobs and temporary PVCs of
+// host-assisted clones whose target PVC got deleted during the copy. Their
+// temporary PVs get the Delete reclaim policy and are marked as
+// provisioned by the driver, so the new volume gets deleted like any
+// other volume once the temporary PVC is gone.
+func (p *csiProvisioner) sweepHostAssistedClones(ctx context.Context) error {
+	listOptions := metav1.ListOptions{LabelSelector: labelHostAssistedClone}
+	jobs, err := p.client.BatchV1().Jobs(v1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return fmt.Errorf("error listing Jobs of host-assisted clones: %v", err)
+	}
+	pvcs, err := p.client.CoreV1().PersistentVolumeClaims(v1.NamespaceAll).List(ctx, listOptions)
+	if err != nil {
+		return fmt.Errorf("error listing PVCs of host-assisted clones: %v", err)
+	}
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, listOptions)
+	if err != nil {
+		return fmt.Errorf("error listing PVs of host-assisted clones: %v", err)
+	}
+
+	// Whether the target PVC is gone, by its UID.
+	orphaned := map[string]bool{}
+	isOrphaned := func(meta *metav1.ObjectMeta) (bool, error) {
+		uid := meta.Labels[labelHostAssistedClone]
+		if result, ok := orphaned[uid]; ok {
+			return result, nil
+		}
+		namespace, name, err := cache.SplitMetaNamespaceKey(meta.Annotations[annHostAssistedCloneTarget])
+		if err != nil || namespace == "" || name == "" {
+			// Unknown target, leave the object alone.
+			return false, nil
+		}
+		claim, err := p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			orphaned[uid] = true
+		case err != nil:
+			return false, fmt.Errorf("error getting PVC %s/%s: %v", namespace, name, err)
+		default:
+			orphaned[uid] = string(claim.UID) != uid
+		}
+		return orphaned[uid], nil
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		orphan, err := isOrphaned(&job.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		if !orphan {
+			continue
+		}
+		klog.V(2).Infof("Host-assisted clone: deleting Job %s of deleted PVC %s", klog.KObj(job), job.Annotations[annHostAssistedCloneTarget])
+		if err := deleteIgnoringNotFound(p.client.BatchV1().Jobs(job.Namespace).Delete(ctx, job.Name, backgroundDeletion())); err != nil {
+			return fmt.Errorf("error deleting Job %s/%s: %v", job.Namespace, job.Name, err)
+		}
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		orphan, err := isOrphaned(&pvc.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		if !orphan {
+			continue
+		}
+		klog.V(2).Infof("Host-assisted clone: deleting PVC %s of deleted PVC %s", klog.KObj(pvc), pvc.Annotations[annHostAssistedCloneTarget])
+		if err := deleteIgnoringNotFound(p.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{})); err != nil {
+			return fmt.Errorf("error deleting PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+			continue
+		}
+		orphan, err := isOrphaned(&pv.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		if !orphan {
+			continue
+		}
+		klog.V(2).Infof("Host-assisted clone: releasing PV %s of deleted PVC %s for deletion", pv.Name, pv.Annotations[annHostAssistedCloneTarget])
+		pv = pv.DeepCopy()
+		pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDynamicallyProvisioned, p.driverName)
+		if _, err := p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error updating PV %s: %v", pv.Name, err)
+		}
+	}
+	return nil
+}
+
+// copyJob returns a Job which copies the content of the source PVC into
+// the target PVC.
+func (h *HostAssistedClone) copyJob(name, namespace, sourcePVC string, labels, annotations map[string]string, blockMode bool) *batchv1.Job {
+	var backoffLimit int32 = 3
+	container := v1.Container{
+		Name:  "copy",
+		Image: h.Image,
+	}
+	if blockMode {
+		container.Command = []string{"sh", "-c", "dd if=/dev/source of=/dev/target bs=1M && sync"}
+		container.VolumeDevices = []v1.VolumeDevice{
+			{Name: hostCloneSourceVolume, DevicePath: "/dev/source"},
+			{Name: hostCloneTargetVolume, DevicePath: "/dev/target"},
+		}
+	} else {
+		container.Command = []string{"sh", "-c", "cp -a /source/. /target/ && sync"}
+		container.VolumeMounts = []v1.VolumeMount{
+			{Name: hostCloneSourceVolume, MountPath: "/source", ReadOnly: true},
+			{Name: hostCloneTargetVolume, MountPath: "/target"},
+		}
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: v1.PodSpec{
+					RestartPolicy: v1.RestartPolicyNever,
+					Containers:    []v1.Container{container},
+					Volumes: []v1.Volume{
+						{
+							Name: hostCloneSourceVolume,
+							VolumeSource: v1.VolumeSource{
+								PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: sourcePVC, ReadOnly: true},
+							},
+						},
+						{
+							Name: hostCloneTargetVolume,
+							VolumeSource: v1.VolumeSource{
+								PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// hostAssistedCloneName returns the name of the temporary PV, PVC and
+// copy Job for the target PVC.
+func hostAssistedCloneName(claim *v1.PersistentVolumeClaim) string {
+	return "host-clone-" + string(claim.UID)
+}
+
+func jobFailed(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func isBlockMode(mode *v1.PersistentVolumeMode) bool {
+	return mode != nil && *mode == v1.PersistentVolumeBlock
+}
+
+func backgroundDeletion() metav1.DeleteOptions {
+	propagation := metav1.DeletePropagationBackground
+	return metav1.DeleteOptions{PropagationPolicy: &propagation}
+}
+
+func deleteIgnoringNotFound(err error) error {
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestHostAssistedClone(t *testing.T) {
+	const requestBytes = 100
+	testcases := map[string]struct {
+		cloneCapability bool
+		sourceDriver    string
+		jobFails        bool
+		expectNative    bool
+	}{
+		"driver without clone capability": {
+			sourceDriver: driverName,
+		},
+		"source of other driver": {
+			cloneCapability: true,
+			sourceDriver:    "other-driver",
+		},
+		"copy fails": {
+			sourceDriver: driverName,
+			jobFails:     true,
+		},
+		"native clone": {
+			cloneCapability: true,
+			sourceDriver:    driverName,
+			expectNative:    true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			sourceClaim := fakeClaim("source", "fake-ns", "source-uid", requestBytes, "source-pv", v1.ClaimBound, &fakeSCName, "")
+			sourcePV := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "source-pv"},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{Driver: tc.sourceDriver, VolumeHandle: "source-volume"},
+					},
+					ClaimRef: &v1.ObjectReference{Namespace: "fake-ns", Name: "source", UID: "source-uid"},
+				},
+				Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+			}
+			clientSet := fakeclientset.NewSimpleClientset(sourceClaim, sourcePV)
+			_, _, _, claimLister, _, stopChan := listers(clientSet)
+			defer close(stopChan)
+
+			pluginCaps, controllerCaps := provisionCapabilities()
+			if tc.cloneCapability {
+				controllerCaps = rpc.ControllerCapabilitySet{
+					csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: true,
+					csi.ControllerServiceCapability_RPC_CLONE_VOLUME:         true,
+				}
+			}
+			provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, claimLister, nil, nil, false, defaultfsType, nil, true, false, WithHostAssistedClone(&HostAssistedClone{Image: "busybox"}))
+
+			claim := createFakePVC(requestBytes)
+			claim.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "source"}
+			options := controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Provisioner: driverName, Parameters: map[string]string{}},
+				PVC:          claim,
+			}
+			name := hostAssistedCloneName(claim)
+
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					if tc.expectNative != (req.VolumeContentSource != nil) {
+						t.Errorf("unexpected volume content source %v", req.VolumeContentSource)
+					}
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{VolumeId: "new-volume", CapacityBytes: requestBytes, ContentSource: req.VolumeContentSource},
+					}, nil
+				}).AnyTimes()
+
+			pv, state, err := provisioner.Provision(context.Background(), options)
+			if tc.expectNative {
+				if err != nil || pv == nil {
+					t.Fatalf("expected native clone, got error %v", err)
+				}
+				if _, err := clientSet.BatchV1().Jobs("fake-ns").Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected no copy Job, got error %v", err)
+				}
+				return
+			}
+			if err == nil || state != controller.ProvisioningInBackground {
+				t.Fatalf("expected provisioning to wait for the copy, got PV %v, state %v, error %v", pv, state, err)
+			}
+			source, err := clientSet.CoreV1().PersistentVolumeClaims("fake-ns").Get(context.Background(), "source", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !checkFinalizer(source, pvcCloneFinalizer) {
+				t.Error("source PVC does not have the cloning protection finalizer")
+			}
+			tempPV, err := clientSet.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("temporary PV: %v", err)
+			}
+			if tempPV.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain || tempPV.Spec.CSI.VolumeHandle != "new-volume" ||
+				tempPV.Spec.ClaimRef.Namespace != "fake-ns" || tempPV.Spec.ClaimRef.Name != name ||
+				tempPV.Annotations[annHostAssistedCloneTarget] != claim.Namespace+"/"+claim.Name {
+				t.Errorf("unexpected temporary PV %+v", tempPV.Spec)
+			}
+			if _, err := clientSet.CoreV1().PersistentVolumeClaims("fake-ns").Get(context.Background(), name, metav1.GetOptions{}); err != nil {
+				t.Fatalf("temporary PVC: %v", err)
+			}
+			job, err := clientSet.BatchV1().Jobs("fake-ns").Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("copy Job: %v", err)
+			}
+			volumes := job.Spec.Template.Spec.Volumes
+			if len(volumes) != 2 || volumes[0].PersistentVolumeClaim.ClaimName != "source" || volumes[1].PersistentVolumeClaim.ClaimName != name {
+				t.Errorf("unexpected volumes of copy Job: %+v", volumes)
+			}
+
+			// Still copying.
+			if pv, _, err := provisioner.Provision(context.Background(), options); err == nil {
+				t.Fatalf("expected provisioning to wait for the copy, got PV %v", pv)
+			}
+
+			if tc.jobFails {
+				job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: v1.ConditionTrue}}
+			} else {
+				job.Status.Succeeded = 1
+			}
+			if _, err := clientSet.BatchV1().Jobs("fake-ns").UpdateStatus(context.Background(), job, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			pv, state, err = provisioner.Provision(context.Background(), options)
+			if tc.jobFails {
+				if err == nil || state != controller.ProvisioningInBackground {
+					t.Fatalf("expected provisioning to retry the copy, got PV %v, state %v, error %v", pv, state, err)
+				}
+				if _, err := clientSet.BatchV1().Jobs("fake-ns").Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected failed Job to be deleted, got error %v", err)
+				}
+				return
+			}
+			if err != nil || state != controller.ProvisioningFinished {
+				t.Fatalf("expected PV after copy, got state %v, error %v", state, err)
+			}
+			if pv.Spec.CSI.VolumeHandle != "new-volume" || pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain {
+				t.Errorf("unexpected PV %+v", pv.Spec)
+			}
+			if _, err := clientSet.BatchV1().Jobs("fake-ns").Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("expected copy Job to be deleted, got error %v", err)
+			}
+			if _, err := clientSet.CoreV1().PersistentVolumeClaims("fake-ns").Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("expected temporary PVC to be deleted, got error %v", err)
+			}
+			if _, err := clientSet.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("expected temporary PV to be deleted, got error %v", err)
+			}
+		})
+	}
+}
+
+func TestHostAssistedCloneSweep(t *testing.T) {
+	meta := func(namespace, uid, target string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:        "host-clone-" + uid,
+			Namespace:   namespace,
+			Labels:      map[string]string{labelHostAssistedClone: uid},
+			Annotations: map[string]string{annHostAssistedCloneTarget: target},
+		}
+	}
+	objects := []runtime.Object{
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "copying", Namespace: "fake-ns", UID: "copying-uid"}},
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "recreated", Namespace: "fake-ns", UID: "new-uid"}},
+	}
+	for _, uid := range []string{"copying-uid", "deleted-uid", "recreated-uid"} {
+		target := "fake-ns/" + strings.TrimSuffix(uid, "-uid")
+		objects = append(objects,
+			&batchv1.Job{ObjectMeta: meta("source-ns", uid, target)},
+			&v1.PersistentVolumeClaim{ObjectMeta: meta("source-ns", uid, target)},
+			&v1.PersistentVolume{
+				ObjectMeta: meta("", uid, target),
+				Spec:       v1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain},
+			})
+	}
+	clientSet := fakeclientset.NewSimpleClientset(objects...)
+	p := &csiProvisioner{client: clientSet, driverName: driverName}
+	if err := p.sweepHostAssistedClones(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for uid, orphaned := range map[string]bool{"copying-uid": false, "deleted-uid": true, "recreated-uid": true} {
+		name := "host-clone-" + uid
+		if _, err := clientSet.BatchV1().Jobs("source-ns").Get(context.Background(), name, metav1.GetOptions{}); apierrors.IsNotFound(err) != orphaned {
+			t.Errorf("%s: expected Job to be deleted %v, got error %v", uid, orphaned, err)
+		}
+		if _, err := clientSet.CoreV1().PersistentVolumeClaims("source-ns").Get(context.Background(), name, metav1.GetOptions{}); apierrors.IsNotFound(err) != orphaned {
+			t.Errorf("%s: expected PVC to be deleted %v, got error %v", uid, orphaned, err)
+		}
+		pv, err := clientSet.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: PV: %v", uid, err)
+		}
+		released := pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete && pv.Annotations[annDynamicallyProvisioned] == driverName
+		if released != orphaned {
+			t.Errorf("%s: expected PV to be released for deletion %v, got %+v", uid, orphaned, pv)
+		}
+	}
+}
+
+func TestHostAssistedCloneCrossNamespace(t *testing.T) {
+	sourceClaim := fakeClaim("source", "source-ns", "source-uid", 100, "source-pv", v1.ClaimBound, &fakeSCName, "")
+	clientSet := fakeclientset.NewSimpleClientset(sourceClaim)
+	_, _, _, claimLister, _, stopChan := listers(clientSet)
+	defer close(stopChan)
+
+	claim := createFakePVC(100)
+	dataSource := &v1.ObjectReference{Kind: pvcKind, Namespace: "source-ns", Name: "source"}
+	for _, allow := range []bool{false, true} {
+		p := &csiProvisioner{claimLister: claimLister, hostAssistedClone: &HostAssistedClone{AllowCrossNamespace: allow}}
+		if _, err := p.checkHostAssistedCloneSource(claim, dataSource, false); (err == nil) != allow {
+			t.Errorf("AllowCrossNamespace %v: unexpected error %v", allow, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+const (
+	prefixedMaxConcurrentCreatesKey = csiParameterPrefix + "max-concurrent-creates"
+	prefixedMaxConcurrentDeletesKey = csiParameterPrefix + "max-concurrent-deletes"
+	prefixedCreateTimeoutKey        = csiParameterPrefix + "create-timeout"
+	prefixedDeleteTimeoutKey        = csiParameterPrefix + "delete-timeout"
+	// Used by the capacity controller, see pkg/capacity.
+	prefixedGetCapacityTimeoutKey = csiParameterPrefix + "get-capacity-timeout"
+
+	createOperation = "CreateVolume"
+	deleteOperation = "DeleteVolume"
+
+	// Operations which have been waiting longer than this are
+	// assumed to be abandoned, for example because the PVC was deleted.
+	operationWaitExpiry = 24 * time.Hour
+)
+
+// OperationWaitDurationSeconds measures how long CreateVolume and
+// DeleteVolume calls were delayed by the concurrency limit of their
+// storage class.
+var OperationWaitDurationSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Subsystem: "controller",
+		Name:      "storageclass_operation_wait_duration_seconds",
+		Help:      "Time that CreateVolume and DeleteVolume calls waited for the concurrency limit of their storage class. Broken down by storage class name and operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+	},
+	[]string{"class", "operation"},
+)
+
+// storageClassLimits are the limits that a storage class sets for its
+// volumes through prefixed parameters. Zero values mean that the global
+// settings apply.
+type storageClassLimits struct {
+	maxConcurrentCreates int
+	maxConcurrentDeletes int
+	createTimeout        time.Duration
+	deleteTimeout        time.Duration
+}
+
+// parseStorageClassLimits parses the limits in the storage class parameters.
+func parseStorageClassLimits(params map[string]string) (*storageClassLimits, error) {
+	limits := &storageClassLimits{}
+	for key, value := range params {
+		var err error
+		switch key {
+		case prefixedMaxConcurrentCreatesKey:
+			limits.maxConcurrentCreates, err = parseConcurrencyLimit(value)
+		case prefixedMaxConcurrentDeletesKey:
+			limits.maxConcurrentDeletes, err = parseConcurrencyLimit(value)
+		case prefixedCreateTimeoutKey:
+			limits.createTimeout, err = parseOperationTimeout(value)
+		case prefixedDeleteTimeoutKey:
+			limits.deleteTimeout, err = parseOperationTimeout(value)
+		case prefixedGetCapacityTimeoutKey:
+			_, err = parseOperationTimeout(value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for storage class parameter %s: %v", key, err)
+		}
+	}
+	return limits, nil
+}
+
+func parseConcurrencyLimit(value string) (int, error) {
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, fmt.Errorf("must be positive, got %d", limit)
+	}
+	return limit, nil
+}
+
+func parseOperationTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("must be positive, got %s", value)
+	}
+	return timeout, nil
+}
+
+// limitOrDefault returns the limit if set, otherwise the default.
+func limitOrDefault(limit, def time.Duration) time.Duration {
+	if limit > 0 {
+		return limit
+	}
+	return def
+}
+
+// operationLimiter limits the number of concurrent operations per storage
+// class. It never blocks: when the limit is reached, the caller gets an
+// error and must retry later, so that volumes of other storage classes
+// are not held up by a slow one.
+type operationLimiter struct {
+	now func() time.Time
+
+	mutex sync.Mutex
+	// running counts the active operations, by operation and storage class.
+	running map[string]int
+	// waiting contains the time of the first rejected attempt, by
+	// operation and PV name.
+	waiting map[string]time.Time
+}
+
+func newOperationLimiter() *operationLimiter {
+	return &operationLimiter{
+		now:     time.Now,
+		running: map[string]int{},
+		waiting: map[string]time.Time{},
+	}
+}
+
+// tryAcquire starts an operation for the PV if the storage class allows
+// another one. The returned function must be called once the operation
+// is done. A limit of zero is unlimited.
+func (l *operationLimiter) tryAcquire(operation, storageClass, pvName string, limit int) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	runningKey := operation + "/" + storageClass
+	waitingKey := operation + "/" + pvName
+	if l.running[runningKey] >= limit {
+		if _, ok := l.waiting[waitingKey]; !ok {
+			l.waiting[waitingKey] = now
+		}
+		for key, since := range l.waiting {
+			if now.Sub(since) > operationWaitExpiry {
+				delete(l.waiting, key)
+			}
+		}
+		return nil, fmt.Errorf("storage class %s allows at most %d concurrent %s calls, waiting for one of them to finish", storageClass, limit, operation)
+	}
+
+	var waited time.Duration
+	if since, ok := l.waiting[waitingKey]; ok {
+		waited = now.Sub(since)
+		delete(l.waiting, waitingKey)
+	}
+	OperationWaitDurationSeconds.WithLabelValues(storageClass, operation).Observe(waited.Seconds())
+	l.running[runningKey]++
+	klog.V(5).Infof("%s for PV %s started, %d of at most %d running for storage class %s", operation, pvName, l.running[runningKey], limit, storageClass)
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.running[runningKey]--
+		if l.running[runningKey] <= 0 {
+			delete(l.running, runningKey)
+		}
+	}, nil
+}
+
+// storageClassLimits returns the limits of the storage class with the
+// given name. The storage class is optional because volumes may outlive
+// it, in which case only the global settings apply.
+func (p *csiProvisioner) storageClassLimits(storageClassName string) (*storageClassLimits, error) {
+	if storageClassName == "" || p.scLister == nil {
+		return &storageClassLimits{}, nil
+	}
+	sc, err := p.scLister.Get(storageClassName)
+	if err != nil {
+		klog.V(5).Infof("storage class %s not available, using default limits: %v", storageClassName, err)
+		return &storageClassLimits{}, nil
+	}
+	return parseStorageClassLimits(sc.Parameters)
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestParseStorageClassLimits(t *testing.T) {
+	testcases := map[string]struct {
+		params         map[string]string
+		expectedLimits *storageClassLimits
+		expectErr      bool
+	}{
+		"none": {
+			params:         map[string]string{"foo": "bar"},
+			expectedLimits: &storageClassLimits{},
+		},
+		"all": {
+			params: map[string]string{
+				prefixedMaxConcurrentCreatesKey: "2",
+				prefixedMaxConcurrentDeletesKey: "5",
+				prefixedCreateTimeoutKey:        "10m",
+				prefixedDeleteTimeoutKey:        "90s",
+				prefixedGetCapacityTimeoutKey:   "1m",
+			},
+			expectedLimits: &storageClassLimits{
+				maxConcurrentCreates: 2,
+				maxConcurrentDeletes: 5,
+				createTimeout:        10 * time.Minute,
+				deleteTimeout:        90 * time.Second,
+			},
+		},
+		"invalid limit": {
+			params:    map[string]string{prefixedMaxConcurrentCreatesKey: "two"},
+			expectErr: true,
+		},
+		"zero limit": {
+			params:    map[string]string{prefixedMaxConcurrentDeletesKey: "0"},
+			expectErr: true,
+		},
+		"invalid timeout": {
+			params:    map[string]string{prefixedCreateTimeoutKey: "10"},
+			expectErr: true,
+		},
+		"negative timeout": {
+			params:    map[string]string{prefixedDeleteTimeoutKey: "-1s"},
+			expectErr: true,
+		},
+		"invalid capacity timeout": {
+			params:    map[string]string{prefixedGetCapacityTimeoutKey: "soon"},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			limits, err := parseStorageClassLimits(tc.params)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got limits %+v", limits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(limits, tc.expectedLimits) {
+				t.Errorf("expected limits %+v, got %+v", tc.expectedLimits, limits)
+			}
+		})
+	}
+}
+
+func TestOperationLimiter(t *testing.T) {
+	now := time.Now()
+	l := newOperationLimiter()
+	l.now = func() time.Time { return now }
+
+	release1, err := l.tryAcquire(createOperation, "archive", "pv-1", 2)
+	if err != nil {
+		t.Fatalf("unexpected error for pv-1: %v", err)
+	}
+	release2, err := l.tryAcquire(createOperation, "archive", "pv-2", 2)
+	if err != nil {
+		t.Fatalf("unexpected error for pv-2: %v", err)
+	}
+	if _, err := l.tryAcquire(createOperation, "archive", "pv-3", 2); err == nil {
+		t.Fatal("expected pv-3 to be rejected")
+	}
+
+	// Other storage classes and operations are not affected.
+	releaseOther, err := l.tryAcquire(createOperation, "fast", "pv-4", 1)
+	if err != nil {
+		t.Fatalf("unexpected error for other storage class: %v", err)
+	}
+	releaseOther()
+	releaseDelete, err := l.tryAcquire(deleteOperation, "archive", "pv-5", 1)
+	if err != nil {
+		t.Fatalf("unexpected error for other operation: %v", err)
+	}
+	releaseDelete()
+	if _, err := l.tryAcquire(createOperation, "archive", "pv-6", 0); err != nil {
+		t.Fatalf("unexpected error without limit: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	release1()
+	if _, ok := l.waiting[createOperation+"/pv-3"]; !ok {
+		t.Fatal("expected pv-3 to be waiting")
+	}
+	release3, err := l.tryAcquire(createOperation, "archive", "pv-3", 2)
+	if err != nil {
+		t.Fatalf("unexpected error for pv-3 after release: %v", err)
+	}
+	if len(l.waiting) != 0 {
+		t.Errorf("expected no waiting operations, got %v", l.waiting)
+	}
+	release2()
+	release3()
+	if len(l.running) != 0 {
+		t.Errorf("expected no running operations, got %v", l.running)
+	}
+}
+
+func TestOperationLimiterExpiry(t *testing.T) {
+	now := time.Now()
+	l := newOperationLimiter()
+	l.now = func() time.Time { return now }
+
+	release, err := l.tryAcquire(deleteOperation, "archive", "pv-1", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+	if _, err := l.tryAcquire(deleteOperation, "archive", "pv-2", 1); err == nil {
+		t.Fatal("expected pv-2 to be rejected")
+	}
+	now = now.Add(operationWaitExpiry + time.Second)
+	if _, err := l.tryAcquire(deleteOperation, "archive", "pv-3", 1); err == nil {
+		t.Fatal("expected pv-3 to be rejected")
+	}
+	if _, ok := l.waiting[deleteOperation+"/pv-2"]; ok {
+		t.Error("expected abandoned pv-2 to be forgotten")
+	}
+	if _, ok := l.waiting[deleteOperation+"/pv-3"]; !ok {
+		t.Error("expected pv-3 to be waiting")
+	}
+}
+
+func TestProvisionWithStorageClassLimits(t *testing.T) {
+	const requestBytes = 100
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+	sc := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "archive"},
+		Parameters: map[string]string{
+			prefixedMaxConcurrentCreatesKey: "1",
+			prefixedCreateTimeoutKey:        "10m",
+		},
+	}
+
+	// Occupy the only slot of the storage class.
+	release, err := provisioner.(*csiProvisioner).operationLimiter.tryAcquire(createOperation, sc.Name, "other-pv", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Times(0)
+	_, state, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: sc,
+		PVC:          createFakePVC(requestBytes),
+	})
+	if err == nil {
+		t.Fatal("expected concurrency limit error")
+	}
+	if state != controller.ProvisioningNoChange {
+		t.Errorf("expected state %s, got %s", controller.ProvisioningNoChange, state)
+	}
+
+	release()
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok || time.Until(deadline) < 5*time.Minute {
+				t.Errorf("expected storage class timeout, got deadline %v", deadline)
+			}
+			if _, ok := req.Parameters[prefixedCreateTimeoutKey]; ok {
+				t.Error("expected prefixed parameters to be stripped")
+			}
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{VolumeId: "test-volume-id", CapacityBytes: requestBytes},
+			}, nil
+		}).Times(1)
+	if _, _, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: sc,
+		PVC:          createFakePVC(requestBytes),
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
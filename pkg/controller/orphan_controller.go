@@ -0,0 +1,420 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-provisioner/pkg/audit"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics"
+	"k8s.io/klog/v2"
+)
+
+//
+// The orphaned volume controller finds volumes on the storage backend which
+// are not referenced by any PersistentVolume. Such volumes are left behind
+// when the cleanup after a failed provisioning attempt fails, or when a PV
+// object gets removed without deleting the volume.
+//
+// The controller periodically pages through ListVolumes and compares the result
+// with the volume handles of all PVs for the driver. Volumes of PVs which were
+// provisioned by some other instance or created manually also count as known,
+// so only volumes without any PV are reported. Each orphan is reported once
+// through an event for the CSIDriver object and continuously through metrics.
+//
+// Optionally, orphans get deleted once they have been seen as orphaned for
+// longer than a grace period. Only orphans in the OrphanRecord get deleted,
+// because only those provably were created by this external-provisioner.
+// Other volumes without PV may belong to some other cluster on a shared
+// backend, may wait for being imported or may have been retained on
+// purpose, so they only get reported. The provisioner secret for deleting
+// an orphan gets resolved from the StorageClass recorded with it. Orphans
+// without a recorded StorageClass, or whose StorageClass or secret cannot
+// be read, are not deleted because a driver which needs the secret would
+// fail or might even misbehave without it. Deletions go through the
+// deletion circuit breaker, if there is one.
+//
+// Volumes in the trash count as known because their PV was recorded there.
+//
+
+// OrphanedVolumeController detects and optionally deletes volumes which
+// exist in the storage backend without a corresponding PersistentVolume.
+// It implements metrics.StableCollector and thus can be registered in
+// a registry.
+type OrphanedVolumeController struct {
+	metrics.BaseStableCollector
+
+	csiClient     csi.ControllerClient
+	driverName    string
+	pvInformer    coreinformers.PersistentVolumeInformer
+	pvLister      corelisters.PersistentVolumeLister
+	translator    ProvisionerCSITranslator
+	checkInterval time.Duration
+	deleteAfter   time.Duration
+	timeout       time.Duration
+	auditLogger   *audit.Logger
+	trash         *Trash
+	record        *OrphanRecord
+	breaker       *DeletionCircuitBreaker
+	now           func() time.Time
+
+	// eventRecorder and deletionSecrets get set by NewCSIProvisioner.
+	// deletionSecrets returns the secrets for deleting a recorded orphan.
+	eventRecorder   record.EventRecorder
+	deletionSecrets func(ctx context.Context, entry orphanRecordEntry) (map[string]string, error)
+
+	// orphans maps the ID of each currently orphaned volume to the
+	// time when it was first found to be orphaned.
+	orphans        map[string]time.Time
+	deletedOrphans int64
+	orphansLock    sync.Mutex
+}
+
+var (
+	orphanedVolumesDesc = metrics.NewDesc(
+		"orphaned_volumes",
+		"Number of volumes reported by ListVolumes for which no PersistentVolume exists.",
+		nil, nil,
+		metrics.ALPHA,
+		"",
+	)
+	orphanedVolumesDeletedDesc = metrics.NewDesc(
+		"orphaned_volumes_deleted_total",
+		"Number of orphaned volumes that were deleted after their grace period expired.",
+		nil, nil,
+		metrics.ALPHA,
+		"",
+	)
+)
+
+var _ metrics.StableCollector = &OrphanedVolumeController{}
+
+// NewOrphanedVolumeController creates a new controller for orphaned volumes.
+// It returns nil if the driver does not support LIST_VOLUMES. A deleteAfter
+// of zero or no orphanRecord disables deletion, orphans then only get reported.
+// auditLogger is optional and records the deletion of orphans. trash and
+// breaker are optional. The controller must be passed to NewCSIProvisioner
+// with WithOrphanedVolumeController before it runs.
+func NewOrphanedVolumeController(
+	csiClient csi.ControllerClient,
+	driverName string,
+	pvInformer coreinformers.PersistentVolumeInformer,
+	translator ProvisionerCSITranslator,
+	controllerCapabilities rpc.ControllerCapabilitySet,
+	checkInterval time.Duration,
+	deleteAfter time.Duration,
+	timeout time.Duration,
+	auditLogger *audit.Logger,
+	trash *Trash,
+	orphanRecord *OrphanRecord,
+	breaker *DeletionCircuitBreaker,
+) *OrphanedVolumeController {
+	if !controllerCapabilities[csi.ControllerServiceCapability_RPC_LIST_VOLUMES] {
+		return nil
+	}
+
+	return &OrphanedVolumeController{
+		csiClient:     csiClient,
+		driverName:    driverName,
+		pvInformer:    pvInformer,
+		pvLister:      pvInformer.Lister(),
+		translator:    translator,
+		checkInterval: checkInterval,
+		deleteAfter:   deleteAfter,
+		timeout:       timeout,
+		auditLogger:   auditLogger,
+		trash:         trash,
+		record:        orphanRecord,
+		breaker:       breaker,
+		now:           time.Now,
+		orphans:       map[string]time.Time{},
+	}
+}
+
+// Run is the main OrphanedVolumeController handler.
+func (c *OrphanedVolumeController) Run(ctx context.Context) {
+	klog.Info("Starting OrphanedVolume controller")
+	defer utilruntime.HandleCrash()
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.pvInformer.Informer().HasSynced) {
+		klog.Error("OrphanedVolume controller: failed to sync PersistentVolume informer")
+		return
+	}
+
+	klog.Infof("Started OrphanedVolume controller")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := c.sync(ctx); err != nil {
+			klog.Warningf("OrphanedVolume controller: checking for orphaned volumes failed: %v", err)
+		}
+	}, c.checkInterval)
+	klog.Info("Shutting down OrphanedVolume controller")
+}
+
+// sync compares the volumes in the storage backend against the PVs and
+// deletes orphans whose grace period has expired.
+func (c *OrphanedVolumeController) sync(ctx context.Context) error {
+	// Listing volumes first ensures that PVs which get created while we
+	// page through the volumes are seen below.
+	volumes, err := c.listVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	known, err := c.knownVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	recorded, err := c.recordedVolumes(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := c.now()
+	listed := sets.NewString()
+	orphans := map[string]time.Time{}
+	var expired []*csi.ListVolumesResponse_Entry
+
+	c.orphansLock.Lock()
+	for _, entry := range volumes {
+		volumeID := entry.GetVolume().GetVolumeId()
+		listed.Insert(volumeID)
+		if volumeID == "" || known.Has(volumeID) {
+			continue
+		}
+		_, owned := recorded[volumeID]
+		firstSeen, ok := c.orphans[volumeID]
+		if !ok {
+			firstSeen = now
+			klog.Warningf("OrphanedVolume controller: volume %s has no PersistentVolume", volumeID)
+			c.eventRecorder.Eventf(c.driverRef(), v1.EventTypeWarning, "OrphanedVolume", "Volume %s exists in the storage backend but has no PersistentVolume", volumeID)
+			if c.deleteAfter > 0 && !owned {
+				klog.Infof("OrphanedVolume controller: volume %s will not be deleted, it was not recorded as created by this external-provisioner", volumeID)
+			}
+		}
+		orphans[volumeID] = firstSeen
+		if owned && c.deleteAfter > 0 && now.Sub(firstSeen) >= c.deleteAfter {
+			expired = append(expired, entry)
+		}
+	}
+	c.orphans = orphans
+	c.orphansLock.Unlock()
+
+	// Recorded volumes which got a PV or which are gone do not need to
+	// be remembered anymore.
+	var forget []string
+	for volumeID := range recorded {
+		if known.Has(volumeID) || !listed.Has(volumeID) {
+			forget = append(forget, volumeID)
+		}
+	}
+	if err := c.record.remove(ctx, forget...); err != nil {
+		return err
+	}
+
+	for _, entry := range expired {
+		c.deleteOrphan(ctx, entry, recorded[entry.GetVolume().GetVolumeId()])
+	}
+	return nil
+}
+
+// recordedVolumes returns the volumes which provably were created by this
+// external-provisioner, none without a record or while deletion is
+// disabled.
+func (c *OrphanedVolumeController) recordedVolumes(ctx context.Context) (map[string]orphanRecordEntry, error) {
+	if c.record == nil || c.deleteAfter <= 0 {
+		return nil, nil
+	}
+	return c.record.volumes(ctx)
+}
+
+// deleteOrphan removes an orphaned volume unless it is still published
+// somewhere, a PV has shown up for it in the meantime or its secrets
+// cannot be resolved.
+func (c *OrphanedVolumeController) deleteOrphan(ctx context.Context, entry *csi.ListVolumesResponse_Entry, recorded orphanRecordEntry) {
+	volumeID := entry.GetVolume().GetVolumeId()
+	if nodes := entry.GetStatus().GetPublishedNodeIds(); len(nodes) > 0 {
+		klog.Warningf("OrphanedVolume controller: not deleting volume %s, it is still published on nodes %v", volumeID, nodes)
+		return
+	}
+	known, err := c.knownVolumes(ctx)
+	if err != nil {
+		klog.Warningf("OrphanedVolume controller: not deleting volume %s: %v", volumeID, err)
+		return
+	}
+	if known.Has(volumeID) {
+		return
+	}
+	secrets, err := c.deletionSecrets(ctx, recorded)
+	if err != nil {
+		klog.Warningf("OrphanedVolume controller: not deleting volume %s: %v", volumeID, err)
+		return
+	}
+	if c.breaker != nil {
+		if err := c.breaker.admitOrphan(ctx, volumeID, entry.GetVolume().GetCapacityBytes()); err != nil {
+			klog.Warningf("OrphanedVolume controller: not deleting volume %s: %v", volumeID, err)
+			return
+		}
+	}
+
+	deleteCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req := &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: secrets}
+	start := time.Now()
+	_, err = c.csiClient.DeleteVolume(deleteCtx, req)
+	auditDeleteVolume(c.auditLogger, auditReasonOrphan, recorded.ClaimNamespace+"/"+recorded.ClaimName, recorded.PVName, req, start, err)
+	if err != nil {
+		klog.Warningf("OrphanedVolume controller: deleting volume %s failed: %v", volumeID, err)
+		c.eventRecorder.Eventf(c.driverRef(), v1.EventTypeWarning, "OrphanedVolumeDeletionFailed", "Deleting orphaned volume %s failed: %v", volumeID, err)
+		return
+	}
+
+	klog.Infof("OrphanedVolume controller: deleted orphaned volume %s", volumeID)
+	c.eventRecorder.Eventf(c.driverRef(), v1.EventTypeNormal, "OrphanedVolumeDeleted", "Deleted orphaned volume %s after %v", volumeID, c.deleteAfter)
+	if err := c.record.remove(ctx, volumeID); err != nil {
+		// Gets retried by the next sync, which no longer lists the volume.
+		klog.Warningf("OrphanedVolume controller: %v", err)
+	}
+	c.orphansLock.Lock()
+	defer c.orphansLock.Unlock()
+	delete(c.orphans, volumeID)
+	c.deletedOrphans++
+}
+
+// orphanDeletionSecrets resolves the provisioner secret for deleting a
+// recorded orphan from the StorageClass that it was provisioned with.
+// Unlike for PVs, a StorageClass or secret which cannot be read is an
+// error, the orphan then does not get deleted.
+func (p *csiProvisioner) orphanDeletionSecrets(ctx context.Context, entry orphanRecordEntry) (map[string]string, error) {
+	if entry.StorageClass == "" {
+		return nil, fmt.Errorf("no StorageClass was recorded for it")
+	}
+	storageClass, err := p.scLister.Get(entry.StorageClass)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get StorageClass %s: %v", entry.StorageClass, err)
+	}
+	if p.supportsMigrationFromInTreePluginName != "" && storageClass.Provisioner == p.supportsMigrationFromInTreePluginName {
+		storageClass, err = p.translator.TranslateInTreeStorageClassToCSI(p.supportsMigrationFromInTreePluginName, storageClass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	secretRef, err := getSecretReference(provisionerSecretParams, storageClass.Parameters, entry.PVName, &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      entry.ClaimName,
+			Namespace: entry.ClaimNamespace,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret reference from StorageClass %s: %v", entry.StorageClass, err)
+	}
+	return p.getCredentials(ctx, storageClass.Parameters[prefixedProvisionerSecretProviderKey], secretRef)
+}
+
+// listVolumes pages through all volumes reported by the driver.
+func (c *OrphanedVolumeController) listVolumes(ctx context.Context) ([]*csi.ListVolumesResponse_Entry, error) {
+	var entries []*csi.ListVolumesResponse_Entry
+	token := ""
+	for {
+		listCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		rsp, err := c.csiClient.ListVolumes(listCtx, &csi.ListVolumesRequest{StartingToken: token})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("ListVolumes: %v", err)
+		}
+		entries = append(entries, rsp.GetEntries()...)
+		token = rsp.GetNextToken()
+		if token == "" {
+			return entries, nil
+		}
+	}
+}
+
+// knownVolumes returns the IDs of all volumes of the driver which are referenced by a PV,
+// including the PVs in the trash.
+func (c *OrphanedVolumeController) knownVolumes(ctx context.Context) (sets.String, error) {
+	pvs, err := c.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list persistentvolumes: %v", err)
+	}
+	if c.trash != nil {
+		trashed, err := c.trash.volumes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pvs = append(pvs, trashed...)
+	}
+	known := sets.NewString()
+	for _, pv := range pvs {
+		if c.translator != nil && c.translator.IsPVMigratable(pv) {
+			translated, err := c.translator.TranslateInTreePVToCSI(pv)
+			if err != nil {
+				return nil, fmt.Errorf("failed to translate persistentvolume %s: %v", pv.Name, err)
+			}
+			pv = translated
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != c.driverName {
+			continue
+		}
+		_, id := decodeVolumeHandle(pv.Spec.CSI.VolumeHandle)
+		known.Insert(id)
+	}
+	return known, nil
+}
+
+// driverRef returns the object that events about orphaned volumes are recorded for.
+func (c *OrphanedVolumeController) driverRef() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "CSIDriver",
+		APIVersion: "storage.k8s.io/v1",
+		Name:       c.driverName,
+	}
+}
+
+// DescribeWithStability implements the metrics.StableCollector interface.
+func (c *OrphanedVolumeController) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- orphanedVolumesDesc
+	ch <- orphanedVolumesDeletedDesc
+}
+
+// CollectWithStability implements the metrics.StableCollector interface.
+func (c *OrphanedVolumeController) CollectWithStability(ch chan<- metrics.Metric) {
+	c.orphansLock.Lock()
+	defer c.orphansLock.Unlock()
+
+	ch <- metrics.NewLazyConstMetric(orphanedVolumesDesc,
+		metrics.GaugeValue,
+		float64(len(c.orphans)),
+	)
+	ch <- metrics.NewLazyConstMetric(orphanedVolumesDeletedDesc,
+		metrics.CounterValue,
+		float64(c.deletedOrphans),
+	)
+}
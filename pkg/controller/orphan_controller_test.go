@@ -0,0 +1,362 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func listVolumesEntries(ids ...string) []*csi.ListVolumesResponse_Entry {
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, id := range ids {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{VolumeId: id},
+		})
+	}
+	return entries
+}
+
+func TestOrphanedVolumeController(t *testing.T) {
+	otherDriverPV := newTestPV("volume-other-driver", "", "", "")
+	otherDriverPV.Spec.CSI.Driver = "other-driver"
+
+	testcases := map[string]struct {
+		pvs            []*v1.PersistentVolume
+		trashed        []*v1.PersistentVolume
+		pages          [][]*csi.ListVolumesResponse_Entry
+		recorded       map[string]string // volume ID to StorageClass
+		maxDeletes     int
+		deleteAfter    time.Duration
+		elapsed        time.Duration
+		expectOrphans  []string
+		expectDeleted  []string
+		expectSecrets  map[string]string
+		expectRecorded []string
+	}{
+		"no orphans": {
+			pvs:   []*v1.PersistentVolume{newTestPV("volume-1", "", "", "")},
+			pages: [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+		},
+		"orphan is reported": {
+			pvs:           []*v1.PersistentVolume{newTestPV("volume-1", "", "", "")},
+			pages:         [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1", "volume-2")},
+			expectOrphans: []string{"volume-2"},
+		},
+		"orphans are found across pages": {
+			pages: [][]*csi.ListVolumesResponse_Entry{
+				listVolumesEntries("volume-1"),
+				listVolumesEntries("volume-2"),
+			},
+			expectOrphans: []string{"volume-1", "volume-2"},
+		},
+		"PV of other driver does not count": {
+			pvs:           []*v1.PersistentVolume{otherDriverPV},
+			pages:         [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-other-driver")},
+			expectOrphans: []string{"volume-other-driver"},
+		},
+		"orphan is not deleted within grace period": {
+			pages:         [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			deleteAfter:   time.Hour,
+			elapsed:       time.Minute,
+			expectOrphans: []string{"volume-1"},
+		},
+		"orphan is deleted after grace period": {
+			pages:         [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			recorded:      map[string]string{"volume-1": "sc-1"},
+			deleteAfter:   time.Hour,
+			elapsed:       2 * time.Hour,
+			expectDeleted: []string{"volume-1"},
+		},
+		"unrecorded orphan is not deleted": {
+			pages:          [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1", "volume-2")},
+			recorded:       map[string]string{"volume-2": "sc-1"},
+			deleteAfter:    time.Hour,
+			elapsed:        2 * time.Hour,
+			expectOrphans:  []string{"volume-1"},
+			expectDeleted:  []string{"volume-2"},
+			expectRecorded: []string{},
+		},
+		"recorded volume with PV or without volume is forgotten": {
+			pvs:            []*v1.PersistentVolume{newTestPV("volume-1", "", "", "")},
+			pages:          [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1", "volume-3")},
+			recorded:       map[string]string{"volume-1": "sc-1", "volume-2": "sc-1", "volume-3": "sc-1"},
+			deleteAfter:    time.Hour,
+			elapsed:        time.Minute,
+			expectOrphans:  []string{"volume-3"},
+			expectRecorded: []string{"volume-3"},
+		},
+		"deletion circuit breaker stops deletion": {
+			pages:          [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1", "volume-2")},
+			recorded:       map[string]string{"volume-1": "sc-1", "volume-2": "sc-1"},
+			maxDeletes:     1,
+			deleteAfter:    time.Hour,
+			elapsed:        2 * time.Hour,
+			expectOrphans:  []string{"volume-2"},
+			expectDeleted:  []string{"volume-1"},
+			expectRecorded: []string{"volume-2"},
+		},
+		"published orphan is not deleted": {
+			pages: [][]*csi.ListVolumesResponse_Entry{{
+				{
+					Volume: &csi.Volume{VolumeId: "volume-1"},
+					Status: &csi.ListVolumesResponse_VolumeStatus{PublishedNodeIds: []string{"node-1"}},
+				},
+			}},
+			recorded:      map[string]string{"volume-1": "sc-1"},
+			deleteAfter:   time.Hour,
+			elapsed:       2 * time.Hour,
+			expectOrphans: []string{"volume-1"},
+		},
+		"volume in trash is not deleted": {
+			trashed:     []*v1.PersistentVolume{newTestPV("volume-1", "", "", "")},
+			recorded:    map[string]string{"volume-1": "sc-1"},
+			pages:       [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			deleteAfter: time.Hour,
+			elapsed:     2 * time.Hour,
+		},
+		"orphan is deleted with secret of its storage class": {
+			pages:         [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			recorded:      map[string]string{"volume-1": "sc-secret"},
+			deleteAfter:   time.Hour,
+			elapsed:       2 * time.Hour,
+			expectDeleted: []string{"volume-1"},
+			expectSecrets: map[string]string{"key": "value"},
+		},
+		"orphan without storage class is not deleted": {
+			pages:          [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			recorded:       map[string]string{"volume-1": ""},
+			deleteAfter:    time.Hour,
+			elapsed:        2 * time.Hour,
+			expectOrphans:  []string{"volume-1"},
+			expectRecorded: []string{"volume-1"},
+		},
+		"orphan with missing storage class is not deleted": {
+			pages:          [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			recorded:       map[string]string{"volume-1": "sc-missing"},
+			deleteAfter:    time.Hour,
+			elapsed:        2 * time.Hour,
+			expectOrphans:  []string{"volume-1"},
+			expectRecorded: []string{"volume-1"},
+		},
+		"orphan with missing secret is not deleted": {
+			pages:          [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-2")},
+			recorded:       map[string]string{"volume-2": "sc-secret"},
+			deleteAfter:    time.Hour,
+			elapsed:        2 * time.Hour,
+			expectOrphans:  []string{"volume-2"},
+			expectRecorded: []string{"volume-2"},
+		},
+		"orphan is not deleted without grace period": {
+			pages:         [][]*csi.ListVolumesResponse_Entry{listVolumesEntries("volume-1")},
+			recorded:      map[string]string{"volume-1": "sc-1"},
+			elapsed:       100 * time.Hour,
+			expectOrphans: []string{"volume-1"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			// Each sync pages through all volumes. There are two syncs, the
+			// second one after the simulated elapsed time.
+			for sync := 0; sync < 2; sync++ {
+				for i, page := range tc.pages {
+					token := ""
+					if i > 0 {
+						token = string(rune('a' + i - 1))
+					}
+					nextToken := ""
+					if i < len(tc.pages)-1 {
+						nextToken = string(rune('a' + i))
+					}
+					controllerServer.EXPECT().ListVolumes(gomock.Any(), &csi.ListVolumesRequest{StartingToken: token}).
+						Return(&csi.ListVolumesResponse{Entries: page, NextToken: nextToken}, nil).Times(1)
+				}
+			}
+			for _, volumeID := range tc.expectDeleted {
+				controllerServer.EXPECT().DeleteVolume(gomock.Any(), &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: tc.expectSecrets}).
+					Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+			}
+
+			clientSet := fakeclientset.NewSimpleClientset(
+				&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "sc-1"}, Provisioner: driverName},
+				&storagev1.StorageClass{
+					ObjectMeta:  metav1.ObjectMeta{Name: "sc-secret"},
+					Provisioner: driverName,
+					Parameters: map[string]string{
+						prefixedProvisionerSecretNameKey:      "secret-${pvc.name}",
+						prefixedProvisionerSecretNamespaceKey: "${pvc.namespace}",
+					},
+				},
+				&v1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "secret-claim-volume-1", Namespace: "default"},
+					Data:       map[string][]byte{"key": []byte("value")},
+				},
+			)
+			scLister, _, _, _, _, stopChan := listers(clientSet)
+			defer close(stopChan)
+			informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+			pvInformer := informerFactory.Core().V1().PersistentVolumes()
+			for _, pv := range tc.pvs {
+				pvInformer.Informer().GetStore().Add(pv)
+			}
+
+			trash := NewTrash(clientSet, "kube-system", "trash", pvInformer, time.Minute)
+			orphanRecord := NewOrphanRecord(clientSet, "kube-system", "orphans")
+			var breaker *DeletionCircuitBreaker
+			if tc.maxDeletes > 0 {
+				breaker = NewDeletionCircuitBreaker(clientSet, driverName, tc.maxDeletes, 0, time.Hour)
+			}
+			c := NewOrphanedVolumeController(csi.NewControllerClient(csiConn.conn), driverName, pvInformer, csitrans.New(),
+				rpc.ControllerCapabilitySet{csi.ControllerServiceCapability_RPC_LIST_VOLUMES: true},
+				time.Minute, tc.deleteAfter, timeout, nil, trash, orphanRecord, breaker)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				WithTrash(trash), WithDeletionCircuitBreaker(breaker), WithOrphanedVolumeController(c))
+
+			ctx := context.Background()
+			for _, pv := range tc.trashed {
+				if err := trash.add(ctx, pv, false, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for volumeID, storageClass := range tc.recorded {
+				claim := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "claim-" + volumeID}}
+				if err := orphanRecord.add(ctx, volumeID, "identity", "pv-"+volumeID, storageClass, claim); err != nil {
+					t.Fatal(err)
+				}
+			}
+			now := time.Now()
+			c.now = func() time.Time { return now }
+
+			if err := c.sync(ctx); err != nil {
+				t.Fatalf("unexpected error in first sync: %v", err)
+			}
+			now = now.Add(tc.elapsed)
+			if err := c.sync(ctx); err != nil {
+				t.Fatalf("unexpected error in second sync: %v", err)
+			}
+
+			orphans := sets.NewString()
+			for volumeID := range c.orphans {
+				orphans.Insert(volumeID)
+			}
+			if !orphans.Equal(sets.NewString(tc.expectOrphans...)) {
+				t.Errorf("expected orphans %v, got %v", tc.expectOrphans, orphans.List())
+			}
+			if c.deletedOrphans != int64(len(tc.expectDeleted)) {
+				t.Errorf("expected %d deleted orphans, got %d", len(tc.expectDeleted), c.deletedOrphans)
+			}
+			if tc.expectRecorded != nil {
+				volumes, err := orphanRecord.volumes(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				recorded := sets.NewString()
+				for volumeID := range volumes {
+					recorded.Insert(volumeID)
+				}
+				if !recorded.Equal(sets.NewString(tc.expectRecorded...)) {
+					t.Errorf("expected recorded volumes %v, got %v", tc.expectRecorded, recorded.List())
+				}
+			}
+		})
+	}
+}
+
+func TestOrphanedVolumeControllerCapabilities(t *testing.T) {
+	clientSet := fakeclientset.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+	c := NewOrphanedVolumeController(nil, driverName, informerFactory.Core().V1().PersistentVolumes(), nil,
+		rpc.ControllerCapabilitySet{}, time.Minute, 0, timeout, nil, nil, nil, nil)
+	if c != nil {
+		t.Error("expected no controller without LIST_VOLUMES capability")
+	}
+}
+
+func TestOrphanRecordOnFailedCleanup(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	orphanRecord := NewOrphanRecord(clientSet, "kube-system", "orphans")
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test",
+		5, csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		WithOrphanRecord(orphanRecord))
+
+	deletePolicy := v1.PersistentVolumeReclaimDelete
+	opts := controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: "test-class"},
+			ReclaimPolicy: &deletePolicy,
+			Parameters:    map[string]string{},
+		},
+		PVName: "test-name",
+		PVC:    createFakePVC(100),
+	}
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{CapacityBytes: 99, VolumeId: "test-volume-id"},
+	}, nil).Times(1)
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(nil, errors.New("backend unavailable")).Times(deleteVolumeRetryCount)
+
+	if _, _, err := csiProvisioner.Provision(context.Background(), opts); err == nil {
+		t.Fatal("expected error")
+	}
+	volumes, err := orphanRecord.volumes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := volumes["test-volume-id"]
+	if !ok || entry.Identity != "test-provisioner" {
+		t.Fatalf("expected test-volume-id to be recorded for test-provisioner, got %+v", volumes)
+	}
+	if entry.StorageClass != "test-class" || entry.ClaimNamespace != opts.PVC.Namespace || entry.ClaimName != opts.PVC.Name {
+		t.Errorf("expected storage class and claim to be recorded, got %+v", entry)
+	}
+}
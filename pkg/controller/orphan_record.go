@@ -0,0 +1,172 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// orphanRecordKey is the key in the ConfigMap of an OrphanRecord under
+// which the volumes are stored as JSON.
+const orphanRecordKey = "volumes"
+
+// orphanRecordEntry describes a volume in the OrphanRecord.
+type orphanRecordEntry struct {
+	// Identity is the csiProvisionerIdentity of the instance which
+	// created the volume.
+	Identity string `json:"identity"`
+	// PVName is the name that the PV of the volume would have had.
+	PVName string `json:"pvName"`
+	// StorageClass is the name of the StorageClass that the volume was
+	// provisioned with. Its provisioner secret gets used for deleting
+	// the volume.
+	StorageClass string `json:"storageClass,omitempty"`
+	// ClaimNamespace and ClaimName identify the PVC that the volume was
+	// provisioned for. They resolve the templates of the secret.
+	ClaimNamespace string `json:"claimNamespace,omitempty"`
+	ClaimName      string `json:"claimName,omitempty"`
+	// Recorded is when deleting the volume failed.
+	Recorded metav1.Time `json:"recorded"`
+}
+
+// OrphanRecord persists the IDs of volumes which were created by this
+// external-provisioner but could not be deleted again after provisioning
+// failed. Only volumes in this record provably belong to it: any other
+// volume without a PV might belong to some other cluster, might wait for
+// being imported or might have been retained on purpose.
+type OrphanRecord struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	now       func() time.Time
+}
+
+// NewOrphanRecord creates a record which is stored in the ConfigMap with
+// the given namespace and name. The ConfigMap gets created when needed.
+func NewOrphanRecord(client kubernetes.Interface, namespace, name string) *OrphanRecord {
+	return &OrphanRecord{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		now:       time.Now,
+	}
+}
+
+// add records a volume which was created by the given identity for the
+// claim with the storage class.
+func (r *OrphanRecord) add(ctx context.Context, volumeID, identity, pvName, storageClass string, claim *v1.PersistentVolumeClaim) error {
+	entry := orphanRecordEntry{
+		Identity:       identity,
+		PVName:         pvName,
+		StorageClass:   storageClass,
+		ClaimNamespace: claim.Namespace,
+		ClaimName:      claim.Name,
+		Recorded:       metav1.NewTime(r.now().Truncate(time.Second)),
+	}
+	if err := r.update(ctx, func(volumes map[string]orphanRecordEntry) {
+		if _, ok := volumes[volumeID]; !ok {
+			volumes[volumeID] = entry
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to record orphaned volume %s in ConfigMap %s/%s: %v", volumeID, r.namespace, r.name, err)
+	}
+	return nil
+}
+
+// remove forgets the volumes.
+func (r *OrphanRecord) remove(ctx context.Context, volumeIDs ...string) error {
+	if len(volumeIDs) == 0 {
+		return nil
+	}
+	if err := r.update(ctx, func(volumes map[string]orphanRecordEntry) {
+		for _, volumeID := range volumeIDs {
+			delete(volumes, volumeID)
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to remove volumes from ConfigMap %s/%s: %v", r.namespace, r.name, err)
+	}
+	return nil
+}
+
+// volumes returns the recorded volumes by volume ID.
+func (r *OrphanRecord) volumes(ctx context.Context) (map[string]orphanRecordEntry, error) {
+	configMap, err := r.client.CoreV1().ConfigMaps(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]orphanRecordEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap %s/%s: %v", r.namespace, r.name, err)
+	}
+	return decodeOrphanRecord(configMap)
+}
+
+// update applies the change to the recorded volumes. The ConfigMap gets
+// created if it does not exist yet.
+func (r *OrphanRecord) update(ctx context.Context, change func(volumes map[string]orphanRecordEntry)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := r.client.CoreV1().ConfigMaps(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+		create := apierrors.IsNotFound(err)
+		if create {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: r.namespace, Name: r.name},
+			}
+		} else if err != nil {
+			return err
+		}
+		volumes, err := decodeOrphanRecord(configMap)
+		if err != nil {
+			return err
+		}
+		change(volumes)
+		value, err := json.Marshal(volumes)
+		if err != nil {
+			return err
+		}
+		configMap.Data = map[string]string{orphanRecordKey: string(value)}
+		if create {
+			_, err = r.client.CoreV1().ConfigMaps(r.namespace).Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Treated like a conflict, retry with the existing ConfigMap.
+				return apierrors.NewConflict(v1.Resource("configmaps"), r.name, err)
+			}
+			return err
+		}
+		_, err = r.client.CoreV1().ConfigMaps(r.namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func decodeOrphanRecord(configMap *v1.ConfigMap) (map[string]orphanRecordEntry, error) {
+	volumes := map[string]orphanRecordEntry{}
+	value, ok := configMap.Data[orphanRecordKey]
+	if !ok {
+		return volumes, nil
+	}
+	if err := json.Unmarshal([]byte(value), &volumes); err != nil {
+		return nil, fmt.Errorf("invalid %s in ConfigMap %s/%s: %v", orphanRecordKey, configMap.Namespace, configMap.Name, err)
+	}
+	return volumes, nil
+}
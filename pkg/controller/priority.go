@@ -0,0 +1,380 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/types"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// PodClaimIndex is the name of the pod informer index which is
+	// created by PodClaimIndexFunc.
+	PodClaimIndex = "claim"
+)
+
+// PodClaimIndexFunc indexes pods by the <namespace>/<name> of the PVCs
+// that they use, including the PVCs of generic ephemeral volumes.
+func PodClaimIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("expected pod, got %T", obj)
+	}
+	var keys []string
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			keys = append(keys, pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName)
+		case volume.Ephemeral != nil:
+			keys = append(keys, pod.Namespace+"/"+pod.Name+"-"+volume.Name)
+		}
+	}
+	return keys, nil
+}
+
+// pendingClaim is a PVC that waits for provisioning.
+type pendingClaim struct {
+	claim    *v1.PersistentVolumeClaim
+	priority int32
+}
+
+// ProvisioningPriority orders provisioning by the priority of the pods
+// which use the PVCs. The priority of a PVC is the highest priority of
+// the pods that use it, zero if there are none.
+//
+// A PVC which gets picked by a worker while some other PVC with a higher
+// priority waits for provisioning is skipped without an event and parked.
+// Parked PVCs are put back into the work queue, highest priority first,
+// as soon as no PVC with a higher priority waits anymore. A PVC whose last
+// provisioning attempt failed does not count as waiting until it gets
+// provisioned again, so PVCs in the exponential backoff do not hold up
+// others. To avoid starvation, a PVC is put back and provisioned regardless
+// of its priority once it was parked for longer than the maximum delay.
+type ProvisioningPriority struct {
+	driverName string
+	claims     *RequeueInformer
+	scLister   storagelistersv1.StorageClassLister
+	podIndexer cache.Indexer
+	maxDelay   time.Duration
+	now        func() time.Time
+	afterFunc  func(time.Duration, func()) *time.Timer
+
+	mutex sync.Mutex
+	// pending contains the PVCs which wait for provisioning and are not
+	// being provisioned right now.
+	pending map[types.UID]pendingClaim
+	// inFlight contains PVCs which are being provisioned right now.
+	inFlight map[types.UID]bool
+	// failed contains PVCs whose last provisioning attempt failed.
+	failed map[types.UID]bool
+	// deferred contains the time when a PVC got deferred first.
+	deferred map[types.UID]time.Time
+	// parked contains the deferred PVCs which are not in the work queue.
+	parked map[types.UID]*v1.PersistentVolumeClaim
+}
+
+// NewProvisioningPriority creates the priority ordering. The claims
+// informer must be the one that is passed to the provision controller.
+// The pod informer must have the PodClaimIndex.
+func NewProvisioningPriority(
+	driverName string,
+	claims *RequeueInformer,
+	scLister storagelistersv1.StorageClassLister,
+	podInformer cache.SharedIndexInformer,
+	maxDelay time.Duration,
+) *ProvisioningPriority {
+	pp := &ProvisioningPriority{
+		driverName: driverName,
+		claims:     claims,
+		scLister:   scLister,
+		podIndexer: podInformer.GetIndexer(),
+		maxDelay:   maxDelay,
+		now:        time.Now,
+		afterFunc:  time.AfterFunc,
+		pending:    map[types.UID]pendingClaim{},
+		inFlight:   map[types.UID]bool{},
+		failed:     map[types.UID]bool{},
+		deferred:   map[types.UID]time.Time{},
+		parked:     map[types.UID]*v1.PersistentVolumeClaim{},
+	}
+	// Not added to the RequeueInformer itself, requeued PVCs have not
+	// changed.
+	claims.SharedIndexInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    pp.updateClaim,
+		UpdateFunc: func(oldObj, newObj interface{}) { pp.updateClaim(newObj) },
+		DeleteFunc: pp.deleteClaim,
+	})
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: pp.updatePod,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Volumes cannot change, the new pod has the same PVCs.
+			pp.updatePod(newObj)
+		},
+		DeleteFunc: pp.updatePod,
+	})
+	return pp
+}
+
+// claimPriority returns the highest priority of the pods that use the
+// PVC and have not terminated yet.
+func (pp *ProvisioningPriority) claimPriority(claim *v1.PersistentVolumeClaim) int32 {
+	objs, err := pp.podIndexer.ByIndex(PodClaimIndex, claim.Namespace+"/"+claim.Name)
+	if err != nil {
+		klog.Warningf("failed to look up pods of PVC %s/%s: %v", claim.Namespace, claim.Name, err)
+		return 0
+	}
+	var priority int32
+	for _, obj := range objs {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.Spec.Priority == nil ||
+			pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if *pod.Spec.Priority > priority {
+			priority = *pod.Spec.Priority
+		}
+	}
+	return priority
+}
+
+// isPendingClaim returns true for PVCs of the driver which can be
+// provisioned.
+func isPendingClaim(claim *v1.PersistentVolumeClaim, driverName string, scLister storagelistersv1.StorageClassLister) bool {
+	if claim.Spec.VolumeName != "" || claim.DeletionTimestamp != nil {
+		return false
+	}
+	provisioner, ok := claim.Annotations[annStorageProvisioner]
+	if !ok {
+		provisioner = claim.Annotations[annBetaStorageProvisioner]
+	}
+	if provisioner != driverName && claim.Annotations[annMigratedTo] != driverName {
+		return false
+	}
+	if claim.Annotations[annSelectedNode] == "" && claim.Spec.StorageClassName != nil {
+		// With late binding, nothing happens before a node got selected.
+		sc, err := scLister.Get(*claim.Spec.StorageClassName)
+		if err != nil {
+			return false
+		}
+		if sc.VolumeBindingMode != nil && *sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer {
+			return false
+		}
+	}
+	return true
+}
+
+func (pp *ProvisioningPriority) updateClaim(obj interface{}) {
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	pending := isPendingClaim(claim, pp.driverName, pp.scLister)
+	var priority int32
+	if pending {
+		priority = pp.claimPriority(claim)
+	}
+
+	pp.mutex.Lock()
+	if pending {
+		pp.pending[claim.UID] = pendingClaim{claim: claim, priority: priority}
+		if _, ok := pp.parked[claim.UID]; ok {
+			pp.parked[claim.UID] = claim
+		}
+	} else {
+		pp.forget(claim.UID)
+	}
+	pp.mutex.Unlock()
+	pp.dispatch()
+}
+
+func (pp *ProvisioningPriority) deleteClaim(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	pp.mutex.Lock()
+	pp.forget(claim.UID)
+	pp.mutex.Unlock()
+	pp.dispatch()
+}
+
+// updatePod determines the priority of the pending PVCs of the pod again.
+func (pp *ProvisioningPriority) updatePod(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	keys, err := PodClaimIndexFunc(obj)
+	if err != nil {
+		return
+	}
+	changed := false
+	for _, key := range keys {
+		obj, exists, err := pp.claims.GetIndexer().GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		claim, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		priority := pp.claimPriority(claim)
+		pp.mutex.Lock()
+		if pending, ok := pp.pending[claim.UID]; ok && pending.priority != priority {
+			pending.priority = priority
+			pp.pending[claim.UID] = pending
+			changed = true
+		}
+		pp.mutex.Unlock()
+	}
+	if changed {
+		pp.dispatch()
+	}
+}
+
+// forget removes a PVC which is no longer pending, for example because it
+// got bound or deleted. The caller must hold the mutex.
+func (pp *ProvisioningPriority) forget(uid types.UID) {
+	delete(pp.pending, uid)
+	delete(pp.failed, uid)
+	delete(pp.deferred, uid)
+	delete(pp.parked, uid)
+}
+
+// highestWaiting returns the highest priority of the PVCs which wait for
+// provisioning, are not being provisioned right now and did not fail in
+// their last attempt. PVCs with a lower priority must wait. The caller must
+// hold the mutex.
+func (pp *ProvisioningPriority) highestWaiting() (highest int32, ok bool) {
+	for uid, pending := range pp.pending {
+		if pp.inFlight[uid] || pp.failed[uid] {
+			continue
+		}
+		if !ok || pending.priority > highest {
+			highest = pending.priority
+			ok = true
+		}
+	}
+	return highest, ok
+}
+
+// shouldDefer checks whether provisioning of the PVC must wait for other
+// PVCs with a higher priority. If so, the PVC is parked and gets put into
+// the work queue again once it is its turn.
+func (pp *ProvisioningPriority) shouldDefer(claim *v1.PersistentVolumeClaim) bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	pending, ok := pp.pending[claim.UID]
+	if !ok {
+		// The event handler has not seen the PVC yet.
+		if !isPendingClaim(claim, pp.driverName, pp.scLister) {
+			return false
+		}
+		pending = pendingClaim{claim: claim, priority: pp.claimPriority(claim)}
+	}
+	if highest, ok := pp.highestWaiting(); !ok || highest <= pending.priority {
+		delete(pp.parked, claim.UID)
+		return false
+	}
+	now := pp.now()
+	since, ok := pp.deferred[claim.UID]
+	if !ok {
+		since = now
+		pp.deferred[claim.UID] = now
+		uid := claim.UID
+		pp.afterFunc(pp.maxDelay, func() { pp.expire(uid) })
+	}
+	if now.Sub(since) >= pp.maxDelay {
+		klog.V(3).Infof("PVC %s/%s got deferred for longer than %v, provisioning it despite its low pod priority %d", claim.Namespace, claim.Name, pp.maxDelay, pending.priority)
+		delete(pp.parked, claim.UID)
+		return false
+	}
+	klog.V(4).Infof("Provisioning of PVC %s/%s with pod priority %d deferred in favor of PVCs with a higher pod priority", claim.Namespace, claim.Name, pending.priority)
+	pp.parked[claim.UID] = claim
+	return true
+}
+
+// expire puts a PVC into the work queue again once it reached the maximum
+// delay.
+func (pp *ProvisioningPriority) expire(uid types.UID) {
+	pp.mutex.Lock()
+	claim, ok := pp.parked[uid]
+	delete(pp.parked, uid)
+	pp.mutex.Unlock()
+	if ok {
+		pp.claims.requeue(claim)
+	}
+}
+
+// admit marks the PVC as being provisioned. The returned function must be
+// called once provisioning is done, with failed set if it returned an
+// error.
+func (pp *ProvisioningPriority) admit(claim *v1.PersistentVolumeClaim) func(failed bool) {
+	pp.mutex.Lock()
+	delete(pp.deferred, claim.UID)
+	delete(pp.parked, claim.UID)
+	delete(pp.failed, claim.UID)
+	pp.inFlight[claim.UID] = true
+	pp.mutex.Unlock()
+	pp.dispatch()
+
+	return func(failed bool) {
+		pp.mutex.Lock()
+		delete(pp.inFlight, claim.UID)
+		if _, ok := pp.pending[claim.UID]; ok && failed {
+			pp.failed[claim.UID] = true
+		}
+		pp.mutex.Unlock()
+		pp.dispatch()
+	}
+}
+
+// dispatch puts the parked PVCs which no longer need to wait into the work
+// queue, highest priority first.
+func (pp *ProvisioningPriority) dispatch() {
+	pp.mutex.Lock()
+	highest, waiting := pp.highestWaiting()
+	var ready []pendingClaim
+	for uid, claim := range pp.parked {
+		pending, ok := pp.pending[uid]
+		if !ok {
+			pending = pendingClaim{claim: claim}
+		}
+		if !waiting || highest <= pending.priority {
+			ready = append(ready, pendingClaim{claim: claim, priority: pending.priority})
+			delete(pp.parked, uid)
+		}
+	}
+	pp.mutex.Unlock()
+
+	sort.SliceStable(ready, func(i, j int) bool { return ready[i].priority > ready[j].priority })
+	for _, pending := range ready {
+		pp.claims.requeue(pending.claim)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func priorityPod(name string, priority int32, phase v1.PodPhase, claimNames ...string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "fake-ns"},
+		Spec:       v1.PodSpec{Priority: &priority},
+		Status:     v1.PodStatus{Phase: phase},
+	}
+	for _, claimName := range claimNames {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: "volume-" + claimName,
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+			},
+		})
+	}
+	return pod
+}
+
+func priorityClaim(name, storageClass string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	claim := createFakeNamedPVC(100, name, annotations)
+	claim.UID = types.UID("uid-" + name)
+	claim.Spec.StorageClassName = &storageClass
+	return claim
+}
+
+func TestPodClaimIndexFunc(t *testing.T) {
+	pod := priorityPod("pod", 0, v1.PodRunning, "data")
+	pod.Spec.Volumes = append(pod.Spec.Volumes,
+		v1.Volume{Name: "scratch", VolumeSource: v1.VolumeSource{Ephemeral: &v1.EphemeralVolumeSource{}}},
+		v1.Volume{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{}}},
+	)
+	keys, err := PodClaimIndexFunc(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"fake-ns/data", "fake-ns/pod-scratch"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestProvisioningPriority(t *testing.T) {
+	lateBinding := storagev1.VolumeBindingWaitForFirstConsumer
+	storageClasses := []*storagev1.StorageClass{
+		{ObjectMeta: metav1.ObjectMeta{Name: "immediate"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "late"}, VolumeBindingMode: &lateBinding},
+	}
+	pods := []*v1.Pod{
+		priorityPod("critical", 1000, v1.PodPending, "critical-data"),
+		priorityPod("batch", 10, v1.PodPending, "batch-data", "shared-data"),
+		priorityPod("web", 100, v1.PodPending, "shared-data"),
+		priorityPod("done", 5000, v1.PodSucceeded, "batch-data"),
+		priorityPod("late", 2000, v1.PodPending, "late-data"),
+	}
+
+	testcases := map[string]struct {
+		claims           []*v1.PersistentVolumeClaim
+		inFlight         []string
+		claim            string
+		expectedPriority int32
+		expectDeferred   bool
+	}{
+		"no other claims": {
+			claims:           []*v1.PersistentVolumeClaim{priorityClaim("batch-data", "immediate", nil)},
+			claim:            "batch-data",
+			expectedPriority: 10,
+		},
+		"higher priority pending": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("batch-data", "immediate", nil),
+				priorityClaim("critical-data", "immediate", nil),
+			},
+			claim:            "batch-data",
+			expectedPriority: 10,
+			expectDeferred:   true,
+		},
+		"lower priority pending": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("batch-data", "immediate", nil),
+				priorityClaim("critical-data", "immediate", nil),
+			},
+			claim:            "critical-data",
+			expectedPriority: 1000,
+		},
+		"highest pod priority counts": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("shared-data", "immediate", nil),
+				priorityClaim("unused-data", "immediate", nil),
+			},
+			claim:            "unused-data",
+			expectedPriority: 0,
+			expectDeferred:   true,
+		},
+		"higher priority in flight": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("batch-data", "immediate", nil),
+				priorityClaim("critical-data", "immediate", nil),
+			},
+			inFlight:         []string{"critical-data"},
+			claim:            "batch-data",
+			expectedPriority: 10,
+		},
+		"higher priority waiting for node": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("batch-data", "immediate", nil),
+				priorityClaim("late-data", "late", nil),
+			},
+			claim:            "batch-data",
+			expectedPriority: 10,
+		},
+		"higher priority with selected node": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("batch-data", "immediate", nil),
+				priorityClaim("late-data", "late", map[string]string{annSelectedNode: "node-1"}),
+			},
+			claim:            "batch-data",
+			expectedPriority: 10,
+			expectDeferred:   true,
+		},
+		"higher priority of other driver": {
+			claims: []*v1.PersistentVolumeClaim{
+				priorityClaim("batch-data", "immediate", nil),
+				priorityClaim("critical-data", "immediate", map[string]string{annStorageProvisioner: "other-driver"}),
+			},
+			claim:            "batch-data",
+			expectedPriority: 10,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pp := newTestProvisioningPriority(tc.claims, storageClasses, pods, time.Minute)
+			for _, name := range tc.inFlight {
+				pp.inFlight[types.UID("uid-"+name)] = true
+			}
+			var claim *v1.PersistentVolumeClaim
+			for _, c := range tc.claims {
+				if c.Name == tc.claim {
+					claim = c
+				}
+			}
+			if priority := pp.claimPriority(claim); priority != tc.expectedPriority {
+				t.Errorf("expected priority %d, got %d", tc.expectedPriority, priority)
+			}
+			if deferred := pp.shouldDefer(claim); deferred != tc.expectDeferred {
+				t.Fatalf("expected deferred %v, got %v", tc.expectDeferred, deferred)
+			}
+			if _, parked := pp.parked[claim.UID]; parked != tc.expectDeferred {
+				t.Errorf("expected parked %v, got %v", tc.expectDeferred, parked)
+			}
+			if tc.expectDeferred {
+				return
+			}
+			release := pp.admit(claim)
+			if !pp.inFlight[claim.UID] {
+				t.Error("expected PVC to be in flight")
+			}
+			release(false)
+			if pp.inFlight[claim.UID] {
+				t.Error("expected PVC to be done")
+			}
+		})
+	}
+}
+
+func TestProvisioningPriorityDispatch(t *testing.T) {
+	claims := []*v1.PersistentVolumeClaim{
+		priorityClaim("batch-data", "immediate", nil),
+		priorityClaim("web-data", "immediate", nil),
+		priorityClaim("critical-data", "immediate", nil),
+	}
+	pods := []*v1.Pod{
+		priorityPod("critical", 1000, v1.PodPending, "critical-data"),
+		priorityPod("web", 100, v1.PodPending, "web-data"),
+	}
+	storageClasses := []*storagev1.StorageClass{{ObjectMeta: metav1.ObjectMeta{Name: "immediate"}}}
+	pp := newTestProvisioningPriority(claims, storageClasses, pods, time.Minute)
+	requeued := recordRequeued(pp.claims)
+
+	for _, claim := range claims[:2] {
+		if !pp.shouldDefer(claim) {
+			t.Fatalf("expected PVC %s to be deferred", claim.Name)
+		}
+	}
+	release := pp.admit(claims[2])
+	if expected := []string{"fake-ns/web-data"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Fatalf("expected requeued PVCs %v once the critical PVC is in flight, got %v", expected, *requeued)
+	}
+	if !pp.shouldDefer(claims[0]) {
+		t.Fatal("expected batch PVC to wait for the web PVC")
+	}
+	pp.admit(claims[1])(false)
+	if expected := []string{"fake-ns/web-data", "fake-ns/batch-data"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Fatalf("expected requeued PVCs %v once the web PVC is done, got %v", expected, *requeued)
+	}
+	release(false)
+
+	// A PVC which is no longer pending does not get requeued.
+	if !pp.shouldDefer(claims[1]) {
+		t.Fatal("expected web PVC to wait for the critical PVC")
+	}
+	bound := claims[1].DeepCopy()
+	bound.Spec.VolumeName = "pv"
+	pp.updateClaim(bound)
+	if _, ok := pp.parked[bound.UID]; ok {
+		t.Error("expected bound PVC to be forgotten")
+	}
+}
+
+func TestProvisioningPriorityFailure(t *testing.T) {
+	claims := []*v1.PersistentVolumeClaim{
+		priorityClaim("batch-data", "immediate", nil),
+		priorityClaim("critical-data", "immediate", nil),
+	}
+	pods := []*v1.Pod{
+		priorityPod("critical", 1000, v1.PodPending, "critical-data"),
+	}
+	storageClasses := []*storagev1.StorageClass{{ObjectMeta: metav1.ObjectMeta{Name: "immediate"}}}
+	pp := newTestProvisioningPriority(claims, storageClasses, pods, time.Minute)
+	requeued := recordRequeued(pp.claims)
+
+	if !pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC to be deferred")
+	}
+	// The critical PVC waits for its next attempt after a failure, which
+	// must not hold up the batch PVC.
+	pp.admit(claims[1])(true)
+	if expected := []string{"fake-ns/batch-data"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Fatalf("expected requeued PVCs %v once the critical PVC failed, got %v", expected, *requeued)
+	}
+	if pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC not to wait for a failed PVC")
+	}
+
+	// A successful attempt makes the critical PVC count again until it
+	// is bound.
+	pp.admit(claims[1])(false)
+	if !pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC to be deferred again")
+	}
+}
+
+func TestProvisioningPriorityPodUpdate(t *testing.T) {
+	claims := []*v1.PersistentVolumeClaim{
+		priorityClaim("batch-data", "immediate", nil),
+		priorityClaim("critical-data", "immediate", nil),
+	}
+	critical := priorityPod("critical", 1000, v1.PodPending, "critical-data")
+	storageClasses := []*storagev1.StorageClass{{ObjectMeta: metav1.ObjectMeta{Name: "immediate"}}}
+	pp := newTestProvisioningPriority(claims, storageClasses, []*v1.Pod{critical}, time.Minute)
+	requeued := recordRequeued(pp.claims)
+
+	if !pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC to be deferred")
+	}
+	critical = critical.DeepCopy()
+	critical.Status.Phase = v1.PodFailed
+	pp.podIndexer.Update(critical)
+	pp.updatePod(critical)
+	if expected := []string{"fake-ns/batch-data"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Errorf("expected requeued PVCs %v once the critical pod failed, got %v", expected, *requeued)
+	}
+}
+
+func TestProvisioningPriorityMaxDelay(t *testing.T) {
+	claims := []*v1.PersistentVolumeClaim{
+		priorityClaim("batch-data", "immediate", nil),
+		priorityClaim("critical-data", "immediate", nil),
+	}
+	pods := []*v1.Pod{
+		priorityPod("critical", 1000, v1.PodPending, "critical-data"),
+	}
+	storageClasses := []*storagev1.StorageClass{{ObjectMeta: metav1.ObjectMeta{Name: "immediate"}}}
+	pp := newTestProvisioningPriority(claims, storageClasses, pods, time.Minute)
+	requeued := recordRequeued(pp.claims)
+	now := time.Now()
+	pp.now = func() time.Time { return now }
+	var expire func()
+	pp.afterFunc = func(delay time.Duration, f func()) *time.Timer {
+		if delay != time.Minute {
+			t.Errorf("expected timer for maximum delay, got %v", delay)
+		}
+		expire = f
+		return nil
+	}
+
+	if !pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC to be deferred")
+	}
+	now = now.Add(30 * time.Second)
+	if !pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC to be deferred before the maximum delay")
+	}
+	now = now.Add(31 * time.Second)
+	expire()
+	if expected := []string{"fake-ns/batch-data"}; !reflect.DeepEqual(*requeued, expected) {
+		t.Fatalf("expected requeued PVCs %v after the maximum delay, got %v", expected, *requeued)
+	}
+	if pp.shouldDefer(claims[0]) {
+		t.Fatal("expected PVC to be provisioned after the maximum delay")
+	}
+	pp.admit(claims[0])(false)
+	if _, ok := pp.deferred[claims[0].UID]; ok {
+		t.Error("expected PVC to be no longer deferred")
+	}
+}
+
+// newTestProvisioningPriority returns the priority ordering with the PVCs,
+// storage classes and pods.
+func newTestProvisioningPriority(claims []*v1.PersistentVolumeClaim, storageClasses []*storagev1.StorageClass, pods []*v1.Pod, maxDelay time.Duration) *ProvisioningPriority {
+	informerFactory := informers.NewSharedInformerFactory(fakeclientset.NewSimpleClientset(), 0)
+	claimInformer := informerFactory.Core().V1().PersistentVolumeClaims()
+	for _, claim := range claims {
+		claimInformer.Informer().GetStore().Add(claim)
+	}
+	scInformer := informerFactory.Storage().V1().StorageClasses()
+	for _, sc := range storageClasses {
+		scInformer.Informer().GetStore().Add(sc)
+	}
+	podInformer := informerFactory.Core().V1().Pods().Informer()
+	podInformer.AddIndexers(cache.Indexers{PodClaimIndex: PodClaimIndexFunc})
+	for _, pod := range pods {
+		podInformer.GetStore().Add(pod)
+	}
+	pp := NewProvisioningPriority(driverName, NewRequeueInformer(claimInformer.Informer()), scInformer.Lister(), podInformer, maxDelay)
+	pp.afterFunc = func(time.Duration, func()) *time.Timer { return nil }
+	for _, claim := range claims {
+		pp.updateClaim(claim)
+	}
+	return pp
+}
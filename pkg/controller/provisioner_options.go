@@ -0,0 +1,194 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-provisioner/pkg/audit"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ProvisionerOption configures an optional component of the provisioner
+// created by NewCSIProvisioner.
+type ProvisionerOption func(p *csiProvisioner)
+
+// WithVolumeHandleClusterID embeds the cluster ID in the volume handles
+// of new PVs.
+func WithVolumeHandleClusterID(clusterID string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.volumeHandleClusterID = clusterID
+	}
+}
+
+// WithVolumeNameTemplate replaces the PV name as name of the volume in
+// CreateVolume. maxLength limits the length of the resolved name, zero
+// means no limit.
+func WithVolumeNameTemplate(template string, maxLength int) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.volumeNameTemplate = template
+		p.volumeNameMaxLength = maxLength
+	}
+}
+
+// WithGroupControllerCapabilities enables restoring volume group
+// snapshots when the driver has the respective capabilities.
+func WithGroupControllerCapabilities(capabilities rpc.GroupControllerCapabilitySet) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.groupControllerCapabilities = capabilities
+	}
+}
+
+// WithPVLister is needed for importing existing volumes.
+func WithPVLister(pvLister corelisters.PersistentVolumeLister) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.pvLister = pvLister
+	}
+}
+
+// WithPVIndexer is needed for detecting volume name collisions with
+// existing PVs. The indexer must have the PVVolumeNameIndex.
+func WithPVIndexer(pvIndexer cache.Indexer) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.pvIndexer = pvIndexer
+	}
+}
+
+// WithPVCMetadataAllowlist selects PVC labels and annotations for
+// CreateVolume.
+func WithPVCMetadataAllowlist(allowlist *PVCMetadataAllowlist) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		if allowlist != nil {
+			p.pvcMetadataAllowlist = *allowlist
+		}
+	}
+}
+
+// WithQuotaChecker enforces quotas before creating volumes.
+func WithQuotaChecker(quotaChecker *QuotaChecker) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.quotaChecker = quotaChecker
+	}
+}
+
+// WithProvisioningPriority defers PVCs while PVCs of pods with a higher
+// priority are pending.
+func WithProvisioningPriority(priority *ProvisioningPriority) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.provisioningPriority = priority
+	}
+}
+
+// WithNamespaceFairness shares the worker threads between namespaces.
+func WithNamespaceFairness(fairness *NamespaceFairness) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.namespaceFairness = fairness
+	}
+}
+
+// WithAuditLogger records CreateVolume and DeleteVolume calls.
+func WithAuditLogger(auditLogger *audit.Logger) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.auditLogger = auditLogger
+	}
+}
+
+// WithSecretCache avoids reading secrets from the API server.
+func WithSecretCache(secretCache *SecretCache) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.secretCache = secretCache
+	}
+}
+
+// WithCredentialProviders adds providers besides CredentialProviderSecret,
+// by name.
+func WithCredentialProviders(providers map[string]CredentialProvider) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		for name, provider := range providers {
+			if name != CredentialProviderSecret {
+				p.credentialProviders[name] = provider
+			}
+		}
+	}
+}
+
+// WithHostAssistedClone enables copying PVC data sources which the
+// driver cannot clone.
+func WithHostAssistedClone(hostAssistedClone *HostAssistedClone) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.hostAssistedClone = hostAssistedClone
+	}
+}
+
+// WithTrash keeps the volumes of deleted PVs for the retention of their
+// storage class.
+func WithTrash(trash *Trash) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.trash = trash
+	}
+}
+
+// WithDeletionCircuitBreaker pauses deletions when too many volumes get
+// deleted.
+func WithDeletionCircuitBreaker(breaker *DeletionCircuitBreaker) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.deletionCircuitBreaker = breaker
+	}
+}
+
+// WithCapacityRanking orders the preferred topology of volumes with
+// immediate binding by the published storage capacity.
+func WithCapacityRanking(ranking *CapacityRanking) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.capacityRanking = ranking
+	}
+}
+
+// WithTopologySpreading orders the preferred topology of volumes with
+// immediate binding by the existing volumes of related PVCs. It takes
+// precedence over WithCapacityRanking.
+func WithTopologySpreading(spreading *TopologySpreading) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.topologySpreading = spreading
+	}
+}
+
+// WithOrphanRecord records volumes which cannot be deleted again after
+// provisioning failed, so that the orphaned volume controller may delete
+// them later.
+func WithOrphanRecord(record *OrphanRecord) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.orphanRecord = record
+	}
+}
+
+// WithOrphanedVolumeController lets the orphaned volume controller delete
+// orphans with the provisioner secret of their StorageClass and record
+// events with the provisioner's event recorder.
+func WithOrphanedVolumeController(c *OrphanedVolumeController) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.orphanedVolumeController = c
+	}
+}
+
+// WithCloneAttempts records the provisioning attempts of clones for the
+// CloningProtectionController.
+func WithCloneAttempts(attempts *CloneAttempts) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.cloneAttempts = attempts
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Keys of PVC labels and annotations get appended to these prefixes
+	// in the CreateVolume parameters.
+	pvcLabelKeyPrefix      = csiParameterPrefix + "pvc/label/"
+	pvcAnnotationKeyPrefix = csiParameterPrefix + "pvc/annotation/"
+
+	// Storage class parameters which override the allowlists from the
+	// command line for the storage class.
+	prefixedPVCLabelAllowlistKey      = csiParameterPrefix + "pvc-label-allowlist"
+	prefixedPVCAnnotationAllowlistKey = csiParameterPrefix + "pvc-annotation-allowlist"
+
+	// maxParameterLength is the maximum length in bytes of a key or value
+	// that the CSI spec recommends for strings.
+	maxParameterLength = 128
+
+	// maxParametersSize is the maximum total size in bytes of all keys and
+	// values of the parameters that the CSI spec recommends for maps.
+	maxParametersSize = 4096
+)
+
+// pvcMetadataExcludedAnnotations are set by Kubernetes components and never
+// get passed to CreateVolume, even when an allowlist matches them.
+var pvcMetadataExcludedAnnotations = map[string]bool{
+	"kubectl.kubernetes.io/last-applied-configuration": true,
+	"pv.kubernetes.io/bind-completed":                  true,
+	"pv.kubernetes.io/bound-by-controller":             true,
+	annStorageProvisioner:                              true,
+	annBetaStorageProvisioner:                          true,
+	annSelectedNode:                                    true,
+	annMigratedTo:                                      true,
+}
+
+// PVCMetadataAllowlist selects the PVC labels and annotations which get
+// passed to CreateVolume. Each entry is either a key or a key prefix
+// followed by "*". A single "*" matches all keys.
+type PVCMetadataAllowlist struct {
+	Labels      []string
+	Annotations []string
+}
+
+// ParseAllowlist splits a comma-separated list of key patterns.
+func ParseAllowlist(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// allowlistMatches returns true if the key matches one of the patterns.
+func allowlistMatches(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// addPVCMetadata copies the allowlisted labels and annotations of the PVC
+// into the parameters. The storage class may override the allowlists.
+// Entries which exceed the CSI size limits are skipped with a warning
+// event for the PVC. Keys get added in sorted order, labels first, until
+// the parameters would exceed the total size limit.
+func (p *csiProvisioner) addPVCMetadata(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, parameters map[string]string) {
+	labelPatterns := p.pvcMetadataAllowlist.Labels
+	if value, ok := sc.Parameters[prefixedPVCLabelAllowlistKey]; ok {
+		labelPatterns = ParseAllowlist(value)
+	}
+	annotationPatterns := p.pvcMetadataAllowlist.Annotations
+	if value, ok := sc.Parameters[prefixedPVCAnnotationAllowlistKey]; ok {
+		annotationPatterns = ParseAllowlist(value)
+	}
+
+	size := 0
+	for key, value := range parameters {
+		size += len(key) + len(value)
+	}
+	var tooLong, tooMany []string
+	copyMetadata := func(kind, keyPrefix string, metadata map[string]string, patterns []string, excluded map[string]bool) {
+		if len(patterns) == 0 {
+			return
+		}
+		keys := make([]string, 0, len(metadata))
+		for key := range metadata {
+			if !excluded[key] && allowlistMatches(key, patterns) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := metadata[key]
+			parameterKey := keyPrefix + key
+			switch {
+			case len(parameterKey) > maxParameterLength || len(value) > maxParameterLength:
+				tooLong = append(tooLong, fmt.Sprintf("%s %q", kind, key))
+			case size+len(parameterKey)+len(value) > maxParametersSize:
+				tooMany = append(tooMany, fmt.Sprintf("%s %q", kind, key))
+			default:
+				parameters[parameterKey] = value
+				size += len(parameterKey) + len(value)
+			}
+		}
+	}
+	copyMetadata("label", pvcLabelKeyPrefix, claim.Labels, labelPatterns, nil)
+	copyMetadata("annotation", pvcAnnotationKeyPrefix, claim.Annotations, annotationPatterns, pvcMetadataExcludedAnnotations)
+
+	if len(tooLong) > 0 {
+		klog.V(2).Infof("PVC %s/%s: not passing %s to CreateVolume, key or value too long", claim.Namespace, claim.Name, strings.Join(tooLong, ", "))
+		if !isDryRun(ctx) {
+			p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "PVCMetadataSkipped",
+				"Not passing %s to the CSI driver because the parameter key or value is longer than %d bytes", strings.Join(tooLong, ", "), maxParameterLength)
+		}
+	}
+	if len(tooMany) > 0 {
+		klog.V(2).Infof("PVC %s/%s: not passing %s to CreateVolume, parameters too large", claim.Namespace, claim.Name, strings.Join(tooMany, ", "))
+		if !isDryRun(ctx) {
+			p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "PVCMetadataSkipped",
+				"Not passing %s to the CSI driver because the parameters would be larger than %d bytes", strings.Join(tooMany, ", "), maxParametersSize)
+		}
+	}
+}
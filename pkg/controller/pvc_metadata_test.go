@@ -0,0 +1,175 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	testcases := map[string]struct {
+		value    string
+		expected []string
+	}{
+		"empty": {},
+		"single": {
+			value:    "tier",
+			expected: []string{"tier"},
+		},
+		"multiple with spaces": {
+			value:    " tier, billing.example.com/* ,,",
+			expected: []string{"tier", "billing.example.com/*"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if actual := ParseAllowlist(tc.value); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAddPVCMetadata(t *testing.T) {
+	longValue := strings.Repeat("a", maxParameterLength+1)
+	longKey := "example.com/" + strings.Repeat("k", maxParameterLength-len(pvcLabelKeyPrefix)-len("example.com/")+1)
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pvc",
+			Namespace: "ns",
+			Labels: map[string]string{
+				"tier":                      "gold",
+				"billing.example.com/owner": "team-a",
+				"billing.example.com/long":  longValue,
+				"other":                     "x",
+				longKey:                     "y",
+			},
+			Annotations: map[string]string{
+				"billing.example.com/cost-center": "1234",
+				"other":                           "x",
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				annSelectedNode: "node-1",
+			},
+		},
+	}
+
+	// Leaves room for the "other" label, but not also for "tier".
+	largeParams := map[string]string{
+		"large": strings.Repeat("v", maxParametersSize-len("large")-len(pvcLabelKeyPrefix+"other")-len("x")),
+	}
+
+	testcases := map[string]struct {
+		allowlist      PVCMetadataAllowlist
+		scParameters   map[string]string
+		params         map[string]string
+		expectedParams map[string]string
+		expectEvent    bool
+	}{
+		"nothing allowed": {
+			expectedParams: map[string]string{},
+		},
+		"exact keys": {
+			allowlist: PVCMetadataAllowlist{
+				Labels:      []string{"tier"},
+				Annotations: []string{"billing.example.com/cost-center"},
+			},
+			expectedParams: map[string]string{
+				pvcLabelKeyPrefix + "tier":                                 "gold",
+				pvcAnnotationKeyPrefix + "billing.example.com/cost-center": "1234",
+			},
+		},
+		"prefix skips long entries": {
+			allowlist: PVCMetadataAllowlist{
+				Labels: []string{"billing.example.com/*"},
+			},
+			expectedParams: map[string]string{
+				pvcLabelKeyPrefix + "billing.example.com/owner": "team-a",
+			},
+			expectEvent: true,
+		},
+		"long key": {
+			allowlist: PVCMetadataAllowlist{
+				Labels: []string{"example.com/*"},
+			},
+			expectedParams: map[string]string{},
+			expectEvent:    true,
+		},
+		"system annotations": {
+			allowlist: PVCMetadataAllowlist{
+				Annotations: []string{"*"},
+			},
+			expectedParams: map[string]string{
+				pvcAnnotationKeyPrefix + "billing.example.com/cost-center": "1234",
+				pvcAnnotationKeyPrefix + "other":                           "x",
+			},
+		},
+		"total size": {
+			allowlist: PVCMetadataAllowlist{
+				Labels: []string{"tier", "other"},
+			},
+			params: largeParams,
+			expectedParams: map[string]string{
+				"large":                     largeParams["large"],
+				pvcLabelKeyPrefix + "other": "x",
+			},
+			expectEvent: true,
+		},
+		"storage class overrides flags": {
+			allowlist: PVCMetadataAllowlist{
+				Labels:      []string{"tier"},
+				Annotations: []string{"*"},
+			},
+			scParameters: map[string]string{
+				prefixedPVCLabelAllowlistKey:      "other",
+				prefixedPVCAnnotationAllowlistKey: "",
+			},
+			expectedParams: map[string]string{
+				pvcLabelKeyPrefix + "other": "x",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			p := &csiProvisioner{
+				pvcMetadataAllowlist: tc.allowlist,
+				eventRecorder:        recorder,
+			}
+			params := map[string]string{}
+			for key, value := range tc.params {
+				params[key] = value
+			}
+			p.addPVCMetadata(context.Background(), claim, &storagev1.StorageClass{Parameters: tc.scParameters}, params)
+			if !reflect.DeepEqual(params, tc.expectedParams) {
+				t.Errorf("expected parameters %v, got %v", tc.expectedParams, params)
+			}
+			if tc.expectEvent != (len(recorder.Events) > 0) {
+				t.Errorf("expected event %v, got %d events", tc.expectEvent, len(recorder.Events))
+			}
+		})
+	}
+}
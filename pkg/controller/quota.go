@@ -0,0 +1,315 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	"sigs.k8s.io/yaml"
+)
+
+// quotaReservationTimeout is how long a reservation is kept after Provision
+// returned without the PV showing up. Reservations get renewed each time
+// provisioning is retried and do not expire while Provision runs.
+const quotaReservationTimeout = 10 * time.Minute
+
+// QuotaLimits limits the number of volumes and their total capacity.
+// Unset fields are unlimited.
+type QuotaLimits struct {
+	MaxVolumes  *int64             `json:"maxVolumes,omitempty"`
+	MaxCapacity *resource.Quantity `json:"maxCapacity,omitempty"`
+}
+
+// QuotaPolicy contains the limits for a storage class. The embedded limits
+// apply to all PVs of the storage class, PerNamespace applies to the PVs
+// of each namespace separately.
+type QuotaPolicy struct {
+	QuotaLimits
+	PerNamespace *QuotaLimits `json:"perNamespace,omitempty"`
+}
+
+// quotaVolume is what a PV or a volume which is being provisioned counts
+// against the quota.
+type quotaVolume struct {
+	storageClass string
+	namespace    string
+	bytes        int64
+}
+
+// quotaReservation is the capacity of a volume which is being provisioned
+// and for which no PV exists yet.
+type quotaReservation struct {
+	quotaVolume
+	// inFlight is true while Provision runs for the volume. Only
+	// reservations of volumes whose Provision call returned expire.
+	inFlight bool
+	expires  time.Time
+}
+
+// quotaUsage is the number and the total capacity of volumes.
+type quotaUsage struct {
+	volumes int64
+	bytes   int64
+}
+
+func (u quotaUsage) add(bytes, count int64) quotaUsage {
+	return quotaUsage{volumes: u.volumes + count, bytes: u.bytes + count*bytes}
+}
+
+// quotaNamespaceKey identifies the volumes of a storage class in a
+// namespace.
+type quotaNamespaceKey struct {
+	storageClass string
+	namespace    string
+}
+
+// QuotaChecker enforces the quota policies of a ConfigMap. The data of
+// the ConfigMap maps storage class names to a QuotaPolicy in YAML.
+//
+// Usage is counted from the events of the PV informer plus the reservations
+// of volumes that are being provisioned, so concurrent Provision calls cannot
+// exceed the limits together.
+type QuotaChecker struct {
+	configMapLister corelisters.ConfigMapLister
+	namespace       string
+	name            string
+	now             func() time.Time
+
+	mutex          sync.Mutex
+	reservations   map[string]*quotaReservation // by PV name
+	usage          map[string]quotaUsage        // by storage class
+	namespaceUsage map[quotaNamespaceKey]quotaUsage
+}
+
+// NewQuotaChecker creates a checker for the quota policies in the
+// ConfigMap with the given namespace and name.
+func NewQuotaChecker(configMapLister corelisters.ConfigMapLister, namespace, name string, pvInformer coreinformers.PersistentVolumeInformer) *QuotaChecker {
+	q := &QuotaChecker{
+		configMapLister: configMapLister,
+		namespace:       namespace,
+		name:            name,
+		now:             time.Now,
+		reservations:    map[string]*quotaReservation{},
+		usage:           map[string]quotaUsage{},
+		namespaceUsage:  map[quotaNamespaceKey]quotaUsage{},
+	}
+	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    q.addVolume,
+		UpdateFunc: q.updateVolume,
+		DeleteFunc: q.deleteVolume,
+	})
+	return q
+}
+
+func quotaVolumeOf(obj interface{}) (string, quotaVolume, bool) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return "", quotaVolume{}, false
+	}
+	volume := quotaVolume{storageClass: pv.Spec.StorageClassName}
+	if pv.Spec.ClaimRef != nil {
+		volume.namespace = pv.Spec.ClaimRef.Namespace
+	}
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	volume.bytes = capacity.Value()
+	return pv.Name, volume, true
+}
+
+// count adds the volume to the usage, or removes it for a negative count.
+// The caller must hold the mutex.
+func (q *QuotaChecker) count(volume quotaVolume, count int64) {
+	usage := q.usage[volume.storageClass].add(volume.bytes, count)
+	if usage.volumes == 0 {
+		delete(q.usage, volume.storageClass)
+	} else {
+		q.usage[volume.storageClass] = usage
+	}
+	key := quotaNamespaceKey{storageClass: volume.storageClass, namespace: volume.namespace}
+	usage = q.namespaceUsage[key].add(volume.bytes, count)
+	if usage.volumes == 0 {
+		delete(q.namespaceUsage, key)
+	} else {
+		q.namespaceUsage[key] = usage
+	}
+}
+
+func (q *QuotaChecker) addVolume(obj interface{}) {
+	name, volume, ok := quotaVolumeOf(obj)
+	if !ok {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.count(volume, 1)
+	// The PV is counted instead of the reservation from now on.
+	delete(q.reservations, name)
+}
+
+func (q *QuotaChecker) updateVolume(oldObj, newObj interface{}) {
+	_, oldVolume, ok := quotaVolumeOf(oldObj)
+	if !ok {
+		return
+	}
+	_, volume, ok := quotaVolumeOf(newObj)
+	if !ok {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.count(oldVolume, -1)
+	q.count(volume, 1)
+}
+
+func (q *QuotaChecker) deleteVolume(obj interface{}) {
+	_, volume, ok := quotaVolumeOf(obj)
+	if !ok {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.count(volume, -1)
+}
+
+// policy returns the quota policy of the storage class, nil if there is none.
+func (q *QuotaChecker) policy(storageClass string) (*QuotaPolicy, error) {
+	configMap, err := q.configMapLister.ConfigMaps(q.namespace).Get(q.name)
+	if apierrors.IsNotFound(err) {
+		klog.V(5).Infof("quota ConfigMap %s/%s not found, no quotas are enforced", q.namespace, q.name)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota ConfigMap %s/%s: %v", q.namespace, q.name, err)
+	}
+	data, ok := configMap.Data[storageClass]
+	if !ok {
+		return nil, nil
+	}
+	policy := &QuotaPolicy{}
+	if err := yaml.UnmarshalStrict([]byte(data), policy); err != nil {
+		return nil, fmt.Errorf("invalid quota policy for storage class %s in ConfigMap %s/%s: %v", storageClass, q.namespace, q.name, err)
+	}
+	return policy, nil
+}
+
+// check returns an error if a new volume of the given size would exceed
+// the quota of the storage class. The reservation for pvName, if there is
+// one, is not counted. The result is false if the storage class has no
+// quota. The caller must hold the mutex.
+func (q *QuotaChecker) check(pvName, storageClass, namespace string, bytes int64) (bool, error) {
+	policy, err := q.policy(storageClass)
+	if err != nil || policy == nil {
+		return false, err
+	}
+
+	usage := q.usage[storageClass]
+	namespaceUsage := q.namespaceUsage[quotaNamespaceKey{storageClass: storageClass, namespace: namespace}]
+	now := q.now()
+	for name, reservation := range q.reservations {
+		if !reservation.inFlight && now.After(reservation.expires) {
+			// Provisioning was abandoned.
+			delete(q.reservations, name)
+			continue
+		}
+		if name != pvName && reservation.storageClass == storageClass {
+			usage = usage.add(reservation.bytes, 1)
+			if reservation.namespace == namespace {
+				namespaceUsage = namespaceUsage.add(reservation.bytes, 1)
+			}
+		}
+	}
+
+	exceeded := func(limits *QuotaLimits, scope string, usage quotaUsage) error {
+		if limits.MaxVolumes != nil && usage.volumes+1 > *limits.MaxVolumes {
+			return fmt.Errorf("quota of storage class %s exceeded: %s already has %d of at most %d volumes", storageClass, scope, usage.volumes, *limits.MaxVolumes)
+		}
+		if limits.MaxCapacity != nil && usage.bytes+bytes > limits.MaxCapacity.Value() {
+			return fmt.Errorf("quota of storage class %s exceeded: %s already uses %s of at most %s, %s requested",
+				storageClass, scope, resource.NewQuantity(usage.bytes, resource.BinarySI), limits.MaxCapacity, resource.NewQuantity(bytes, resource.BinarySI))
+		}
+		return nil
+	}
+	if err := exceeded(&policy.QuotaLimits, "the cluster", usage); err != nil {
+		return true, err
+	}
+	if policy.PerNamespace != nil {
+		if err := exceeded(policy.PerNamespace, fmt.Sprintf("namespace %s", namespace), namespaceUsage); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// checkOnly is like reserve without reserving anything.
+func (q *QuotaChecker) checkOnly(pvName, storageClass, namespace string, bytes int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, err := q.check(pvName, storageClass, namespace, bytes)
+	return err
+}
+
+// reserve checks the quota and, if the volume fits, reserves its capacity
+// until finish gets called.
+func (q *QuotaChecker) reserve(pvName, storageClass, namespace string, bytes int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	limited, err := q.check(pvName, storageClass, namespace, bytes)
+	if err != nil || !limited {
+		return err
+	}
+	q.reservations[pvName] = &quotaReservation{
+		quotaVolume: quotaVolume{
+			storageClass: storageClass,
+			namespace:    namespace,
+			bytes:        bytes,
+		},
+		inFlight: true,
+	}
+	return nil
+}
+
+// finish updates the reservation after Provision returned. A volume that
+// was provisioned stays reserved until its PV shows up in the informer. A
+// volume that may still get created in the background stays reserved until
+// the next attempt. Both expire after quotaReservationTimeout. In all other
+// cases the reservation is released.
+func (q *QuotaChecker) finish(pvName string, provisioned bool, state controller.ProvisioningState) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	reservation, ok := q.reservations[pvName]
+	if !ok {
+		return
+	}
+	if provisioned || state == controller.ProvisioningInBackground {
+		reservation.inFlight = false
+		reservation.expires = q.now().Add(quotaReservationTimeout)
+		return
+	}
+	delete(q.reservations, pvName)
+}
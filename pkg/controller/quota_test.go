@@ -0,0 +1,266 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	quotaNamespace = "kube-system"
+	quotaName      = "provisioner-quota"
+)
+
+// newTestQuotaChecker creates a checker for a ConfigMap with the given
+// data, nil for no ConfigMap.
+func newTestQuotaChecker(data map[string]string, pvs ...*v1.PersistentVolume) *QuotaChecker {
+	informerFactory := informers.NewSharedInformerFactory(fakeclientset.NewSimpleClientset(), 0)
+	configMapInformer := informerFactory.Core().V1().ConfigMaps()
+	if data != nil {
+		configMapInformer.Informer().GetStore().Add(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: quotaNamespace, Name: quotaName},
+			Data:       data,
+		})
+	}
+	q := NewQuotaChecker(configMapInformer.Lister(), quotaNamespace, quotaName, informerFactory.Core().V1().PersistentVolumes())
+	for _, pv := range pvs {
+		q.addVolume(pv)
+	}
+	return q
+}
+
+func TestQuotaCheck(t *testing.T) {
+	pvs := []*v1.PersistentVolume{
+		newTestPV("pv-1", "ns-a", "gold", "10Gi"),
+		newTestPV("pv-2", "ns-b", "gold", "10Gi"),
+		newTestPV("pv-3", "ns-a", "silver", "100Gi"),
+	}
+	testcases := map[string]struct {
+		data         map[string]string
+		storageClass string
+		namespace    string
+		bytes        int64
+		expectErr    string
+	}{
+		"no ConfigMap": {
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        100 << 30,
+		},
+		"no policy for storage class": {
+			data:         map[string]string{"silver": "maxVolumes: 1"},
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        100 << 30,
+		},
+		"within limits": {
+			data:         map[string]string{"gold": "maxVolumes: 3\nmaxCapacity: 30Gi"},
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        10 << 30,
+		},
+		"too many volumes": {
+			data:         map[string]string{"gold": "maxVolumes: 2"},
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        1,
+			expectErr:    "the cluster already has 2 of at most 2 volumes",
+		},
+		"too much capacity": {
+			data:         map[string]string{"gold": "maxCapacity: 30Gi"},
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        11 << 30,
+			expectErr:    "the cluster already uses 20Gi of at most 30Gi, 11Gi requested",
+		},
+		"within namespace limits": {
+			data:         map[string]string{"gold": "perNamespace:\n  maxVolumes: 1"},
+			storageClass: "gold",
+			namespace:    "ns-c",
+			bytes:        1,
+		},
+		"too many volumes in namespace": {
+			data:         map[string]string{"gold": "perNamespace:\n  maxVolumes: 1"},
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        1,
+			expectErr:    "namespace ns-a already has 1 of at most 1 volumes",
+		},
+		"too much capacity in namespace": {
+			data:         map[string]string{"gold": "maxCapacity: 1Ti\nperNamespace:\n  maxCapacity: 15Gi"},
+			storageClass: "gold",
+			namespace:    "ns-b",
+			bytes:        10 << 30,
+			expectErr:    "namespace ns-b already uses 10Gi of at most 15Gi",
+		},
+		"invalid policy": {
+			data:         map[string]string{"gold": "maxVolume: 1"},
+			storageClass: "gold",
+			namespace:    "ns-a",
+			bytes:        1,
+			expectErr:    "invalid quota policy for storage class gold",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			q := newTestQuotaChecker(tc.data, pvs...)
+			err := q.reserve("pv-new", tc.storageClass, tc.namespace, tc.bytes)
+			switch {
+			case tc.expectErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.expectErr != "" && err == nil:
+				t.Errorf("expected error containing %q, got none", tc.expectErr)
+			case tc.expectErr != "" && !strings.Contains(err.Error(), tc.expectErr):
+				t.Errorf("expected error containing %q, got: %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestQuotaReservations(t *testing.T) {
+	now := time.Now()
+	q := newTestQuotaChecker(map[string]string{"gold": "maxVolumes: 2"})
+	q.now = func() time.Time { return now }
+
+	if err := q.reserve("pv-1", "gold", "ns-a", 1); err != nil {
+		t.Fatalf("unexpected error for first volume: %v", err)
+	}
+	// Retrying the same volume must not count its own reservation.
+	if err := q.reserve("pv-1", "gold", "ns-a", 1); err != nil {
+		t.Fatalf("unexpected error when retrying first volume: %v", err)
+	}
+	if err := q.reserve("pv-2", "gold", "ns-a", 1); err != nil {
+		t.Fatalf("unexpected error for second volume: %v", err)
+	}
+	if err := q.reserve("pv-3", "gold", "ns-a", 1); err == nil {
+		t.Fatal("expected reservations to block third volume")
+	}
+	if err := q.checkOnly("pv-3", "gold", "ns-a", 1); err == nil {
+		t.Fatal("expected check of third volume to fail")
+	}
+
+	// Failed provisioning releases the reservation, a volume which
+	// continues in the background keeps it.
+	q.finish("pv-1", false, controller.ProvisioningInBackground)
+	if err := q.reserve("pv-3", "gold", "ns-a", 1); err == nil {
+		t.Fatal("expected background provisioning to keep its reservation")
+	}
+	q.finish("pv-1", false, controller.ProvisioningFinished)
+	if err := q.reserve("pv-3", "gold", "ns-a", 1); err != nil {
+		t.Fatalf("expected released reservation to make room, got: %v", err)
+	}
+
+	// Reservations only expire once Provision returned.
+	now = now.Add(quotaReservationTimeout + time.Second)
+	if err := q.reserve("pv-4", "gold", "ns-a", 1); err == nil {
+		t.Fatal("expected reservations of running operations not to expire")
+	}
+	q.finish("pv-2", true, controller.ProvisioningFinished)
+	q.finish("pv-3", false, controller.ProvisioningInBackground)
+	now = now.Add(quotaReservationTimeout + time.Second)
+	if err := q.reserve("pv-4", "gold", "ns-a", 1); err != nil {
+		t.Fatalf("expected expired reservations to be dropped, got: %v", err)
+	}
+	if len(q.reservations) != 1 {
+		t.Errorf("expected one reservation, got %d", len(q.reservations))
+	}
+}
+
+func TestQuotaReservationReplacedByPV(t *testing.T) {
+	q := newTestQuotaChecker(map[string]string{"gold": "maxVolumes: 2\nmaxCapacity: 4Gi"})
+
+	if err := q.reserve("pv-1", "gold", "ns-a", 1<<30); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q.finish("pv-1", true, controller.ProvisioningFinished)
+	pv := newTestPV("pv-1", "ns-a", "gold", "1Gi")
+	q.addVolume(pv)
+
+	// The PV must be counted exactly once.
+	if err := q.reserve("pv-2", "gold", "ns-a", 1<<30); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := q.reservations["pv-1"]; ok {
+		t.Error("expected reservation to be dropped once the PV exists")
+	}
+	if err := q.reserve("pv-3", "gold", "ns-a", 1<<30); err == nil {
+		t.Error("expected quota to be exceeded")
+	}
+	q.finish("pv-2", false, controller.ProvisioningFinished)
+
+	// Usage follows updates and deletions of the PV.
+	resized := newTestPV("pv-1", "ns-a", "gold", "4Gi")
+	q.updateVolume(pv, resized)
+	if err := q.checkOnly("pv-3", "gold", "ns-a", 1<<30); err == nil || !strings.Contains(err.Error(), "already uses 4Gi") {
+		t.Errorf("expected capacity quota to be exceeded after resize, got %v", err)
+	}
+	q.deleteVolume(cache.DeletedFinalStateUnknown{Key: resized.Name, Obj: resized})
+	if err := q.checkOnly("pv-3", "gold", "ns-a", 1<<30); err != nil {
+		t.Errorf("unexpected error after PV deletion: %v", err)
+	}
+	if len(q.usage) != 0 || len(q.namespaceUsage) != 0 {
+		t.Errorf("expected no usage after PV deletion, got %v and %v", q.usage, q.namespaceUsage)
+	}
+}
+
+func TestProvisionQuotaExceeded(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	const scName = "gold"
+	q := newTestQuotaChecker(map[string]string{scName: "maxVolumes: 1"}, newTestPV("pv-1", "fake-ns", scName, "1Gi"))
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithQuotaChecker(q))
+
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Times(0)
+
+	claim := createFakePVC(100)
+	claim.Spec.StorageClassName = &[]string{scName}[0]
+	pv, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: scName}},
+		PVC:          claim,
+	})
+	if err == nil {
+		t.Fatalf("expected quota error, got PV %v", pv)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected state %s, got %s", controller.ProvisioningFinished, state)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// RequeueInformer wraps the PVC or PV informer which is passed to the
+// provision controller and remembers the event handlers of the provision
+// controller. The work queue of the provision controller is not
+// accessible, but through its event handlers PVCs and PVs which were
+// skipped because it was not their turn yet can be put into it again.
+type RequeueInformer struct {
+	cache.SharedIndexInformer
+
+	mutex    sync.Mutex
+	handlers []cache.ResourceEventHandler
+}
+
+var _ cache.SharedIndexInformer = &RequeueInformer{}
+
+// NewRequeueInformer wraps the informer.
+func NewRequeueInformer(informer cache.SharedIndexInformer) *RequeueInformer {
+	return &RequeueInformer{SharedIndexInformer: informer}
+}
+
+func (i *RequeueInformer) AddEventHandler(handler cache.ResourceEventHandler) (cache.ResourceEventHandlerRegistration, error) {
+	i.remember(handler)
+	return i.SharedIndexInformer.AddEventHandler(handler)
+}
+
+func (i *RequeueInformer) AddEventHandlerWithResyncPeriod(handler cache.ResourceEventHandler, resyncPeriod time.Duration) (cache.ResourceEventHandlerRegistration, error) {
+	i.remember(handler)
+	return i.SharedIndexInformer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+}
+
+func (i *RequeueInformer) remember(handler cache.ResourceEventHandler) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.handlers = append(i.handlers, handler)
+}
+
+// requeue passes the object to the event handlers as if it had been
+// updated. Handlers which only need to observe changes must be added to
+// the wrapped informer, otherwise they get called for requeued objects,
+// too.
+func (i *RequeueInformer) requeue(obj interface{}) {
+	i.mutex.Lock()
+	handlers := i.handlers
+	i.mutex.Unlock()
+	for _, handler := range handlers {
+		handler.OnUpdate(obj, obj)
+	}
+}
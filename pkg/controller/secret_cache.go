@@ -0,0 +1,432 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	storageinformersv1 "k8s.io/client-go/informers/storage/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	secretCacheHit  = "hit"
+	secretCacheMiss = "miss"
+)
+
+// SecretCacheRequestsTotal counts the lookups of secrets in the cache.
+// The hit ratio is the rate of hits divided by the rate of all lookups.
+var SecretCacheRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "controller",
+		Name:      "secret_cache_requests_total",
+		Help:      "Number of secret lookups for provisioning and deletion, by result: hit if the secret was found in the cache, miss if it had to be read from the API server.",
+	},
+	[]string{"result"},
+)
+
+// secretWatch identifies the secrets that one informer watches: a single
+// secret or, with an empty name, all secrets of a namespace.
+type secretWatch struct {
+	namespace string
+	name      string
+}
+
+// runningSecretWatch is an informer for a secretWatch.
+type runningSecretWatch struct {
+	informer cache.SharedIndexInformer
+	lister   corelisters.SecretLister
+	stop     chan struct{}
+}
+
+// SecretCache caches the secrets that provisioning and deletion need.
+//
+// Only secrets referenced by the provisioner secret parameters of
+// storage classes of the driver and by the deletion secret annotations of
+// PVs get watched, unless they are meant for some other credential
+// provider. A secret with a fixed namespace and name is watched on its
+// own, a secret whose name is a template makes the whole namespace get
+// watched, except for service account tokens. At most maxWatches
+// informers run, the ones for the secrets with the most references.
+// Secrets whose namespace is a template, secrets beyond that limit,
+// secrets which the provisioner may not list and watch and secrets which
+// are not in the cache yet are read from the API server.
+type SecretCache struct {
+	client     kubernetes.Interface
+	driverName string
+	resync     time.Duration
+	maxWatches int
+	// changed gets a value when the referenced secrets have changed.
+	changed chan struct{}
+
+	refsMutex sync.Mutex
+	// storageClassRefs and pvRefs contain the secret that each storage
+	// class and PV references, by object name.
+	storageClassRefs map[string]secretWatch
+	pvRefs           map[string]secretWatch
+	// refs counts the storage classes and PVs which reference a secret.
+	refs map[secretWatch]int
+
+	mutex   sync.RWMutex
+	watches map[secretWatch]*runningSecretWatch
+	// forbidden contains the watches which failed because the provisioner
+	// is not permitted to list and watch the secrets. They are not tried
+	// again while they are referenced.
+	forbidden map[secretWatch]bool
+}
+
+// NewSecretCache creates a cache which gets updated when the storage
+// classes or PVs change. It must be started with Run.
+func NewSecretCache(
+	client kubernetes.Interface,
+	driverName string,
+	scInformer storageinformersv1.StorageClassInformer,
+	pvInformer coreinformers.PersistentVolumeInformer,
+	resync time.Duration,
+	maxWatches int,
+) *SecretCache {
+	c := &SecretCache{
+		client:           client,
+		driverName:       driverName,
+		resync:           resync,
+		maxWatches:       maxWatches,
+		changed:          make(chan struct{}, 1),
+		storageClassRefs: map[string]secretWatch{},
+		pvRefs:           map[string]secretWatch{},
+		refs:             map[secretWatch]int{},
+		watches:          map[secretWatch]*runningSecretWatch{},
+		forbidden:        map[secretWatch]bool{},
+	}
+	scInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.updateStorageClass,
+		UpdateFunc: func(_, obj interface{}) { c.updateStorageClass(obj) },
+		DeleteFunc: c.deleteStorageClass,
+	})
+	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.updatePV,
+		UpdateFunc: func(_, obj interface{}) { c.updatePV(obj) },
+		DeleteFunc: c.deletePV,
+	})
+	return c
+}
+
+func (c *SecretCache) queueUpdate() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run updates the watched secrets until the context is done.
+func (c *SecretCache) Run(ctx context.Context) {
+	klog.Info("Starting secret cache")
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for watch, running := range c.watches {
+			close(running.stop)
+			delete(c.watches, watch)
+		}
+		klog.Info("Shutting down secret cache")
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.changed:
+			c.updateWatches()
+		}
+	}
+}
+
+func (c *SecretCache) updateStorageClass(obj interface{}) {
+	sc, ok := obj.(*storagev1.StorageClass)
+	if !ok {
+		return
+	}
+	watch, ok := c.storageClassWatch(sc)
+	c.setReference(c.storageClassRefs, sc.Name, watch, ok)
+}
+
+func (c *SecretCache) deleteStorageClass(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	if sc, ok := obj.(*storagev1.StorageClass); ok {
+		c.setReference(c.storageClassRefs, sc.Name, secretWatch{}, false)
+	}
+}
+
+func (c *SecretCache) updatePV(obj interface{}) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return
+	}
+	watch, ok := c.pvWatch(pv)
+	c.setReference(c.pvRefs, pv.Name, watch, ok)
+}
+
+func (c *SecretCache) deletePV(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+		obj = unknown.Obj
+	}
+	if pv, ok := obj.(*v1.PersistentVolume); ok {
+		c.setReference(c.pvRefs, pv.Name, secretWatch{}, false)
+	}
+}
+
+// storageClassWatch returns the secrets that need to be watched for the
+// provisioner secret of a storage class.
+func (c *SecretCache) storageClassWatch(sc *storagev1.StorageClass) (secretWatch, bool) {
+	if sc.Provisioner != c.driverName || !isSecretProvider(sc.Parameters[prefixedProvisionerSecretProviderKey]) {
+		return secretWatch{}, false
+	}
+	nameTemplate, namespaceTemplate := provisionerSecretTemplates(sc.Parameters)
+	if namespaceTemplate == "" || isTemplate(namespaceTemplate) {
+		return secretWatch{}, false
+	}
+	if isTemplate(nameTemplate) {
+		return secretWatch{namespace: namespaceTemplate}, true
+	}
+	return secretWatch{namespace: namespaceTemplate, name: nameTemplate}, true
+}
+
+// pvWatch returns the deletion secret of a PV.
+func (c *SecretCache) pvWatch(pv *v1.PersistentVolume) (secretWatch, bool) {
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != c.driverName || !isSecretProvider(pv.Annotations[annDeletionProvisionerSecretProvider]) {
+		return secretWatch{}, false
+	}
+	name, namespace := pv.Annotations[annDeletionProvisionerSecretRefName], pv.Annotations[annDeletionProvisionerSecretRefNamespace]
+	if name == "" || namespace == "" {
+		return secretWatch{}, false
+	}
+	return secretWatch{namespace: namespace, name: name}, true
+}
+
+// setReference records which secret an object references, if any, and
+// triggers an update of the watches when that has changed.
+func (c *SecretCache) setReference(objects map[string]secretWatch, key string, watch secretWatch, ok bool) {
+	c.refsMutex.Lock()
+	defer c.refsMutex.Unlock()
+	old, hadOld := objects[key]
+	if hadOld == ok && old == watch {
+		return
+	}
+	if hadOld {
+		c.refs[old]--
+		if c.refs[old] == 0 {
+			delete(c.refs, old)
+		}
+		delete(objects, key)
+	}
+	if ok {
+		objects[key] = watch
+		c.refs[watch]++
+	}
+	c.queueUpdate()
+}
+
+// desiredWatches determines which secrets need to be watched. The caller
+// must hold the mutex.
+func (c *SecretCache) desiredWatches() map[secretWatch]bool {
+	c.refsMutex.Lock()
+	refs := make(map[secretWatch]int, len(c.refs))
+	for watch, count := range c.refs {
+		refs[watch] = count
+	}
+	c.refsMutex.Unlock()
+
+	// Single secrets in a namespace which gets watched completely
+	// don't need their own informer.
+	for watch, count := range refs {
+		namespace := secretWatch{namespace: watch.namespace}
+		if watch.name != "" && refs[namespace] > 0 {
+			refs[namespace] += count
+			delete(refs, watch)
+		}
+	}
+
+	candidates := make([]secretWatch, 0, len(refs))
+	for watch := range refs {
+		if !c.forbidden[watch] {
+			candidates = append(candidates, watch)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if refs[a] != refs[b] {
+			return refs[a] > refs[b]
+		}
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		return a.name < b.name
+	})
+	if len(candidates) > c.maxWatches {
+		klog.V(4).Infof("Secret cache: %d secrets and namespaces are referenced, only the %d most used ones get watched", len(candidates), c.maxWatches)
+		candidates = candidates[:c.maxWatches]
+	}
+
+	watches := make(map[secretWatch]bool, len(candidates))
+	for _, watch := range candidates {
+		watches[watch] = true
+	}
+	// Forget about permission problems once a watch is not referenced
+	// anymore, it gets tried again when it is needed again.
+	for watch := range c.forbidden {
+		if _, ok := refs[watch]; !ok {
+			delete(c.forbidden, watch)
+		}
+	}
+	return watches
+}
+
+// updateWatches starts and stops informers so that exactly the desired
+// secrets are watched.
+func (c *SecretCache) updateWatches() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	desired := c.desiredWatches()
+	for watch, running := range c.watches {
+		if !desired[watch] {
+			klog.V(4).Infof("Secret cache: stop watching %+v", watch)
+			close(running.stop)
+			delete(c.watches, watch)
+		}
+	}
+	for watch := range desired {
+		if _, ok := c.watches[watch]; ok {
+			continue
+		}
+		klog.V(4).Infof("Secret cache: start watching %+v", watch)
+		var selector fields.Selector
+		if watch.name != "" {
+			selector = fields.OneTermEqualSelector("metadata.name", watch.name)
+		} else {
+			// Service account tokens are never provisioner secrets,
+			// but are often the majority of the secrets of a namespace.
+			selector = fields.OneTermNotEqualSelector("type", string(v1.SecretTypeServiceAccountToken))
+		}
+		factory := informers.NewSharedInformerFactoryWithOptions(c.client, c.resync,
+			informers.WithNamespace(watch.namespace),
+			informers.WithTweakListOptions(func(lo *metav1.ListOptions) {
+				lo.FieldSelector = selector.String()
+			}))
+		secretInformer := factory.Core().V1().Secrets()
+		running := &runningSecretWatch{
+			informer: secretInformer.Informer(),
+			lister:   secretInformer.Lister(),
+			stop:     make(chan struct{}),
+		}
+		watch := watch
+		running.informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			if apierrors.IsForbidden(err) {
+				c.forbid(watch, err)
+				return
+			}
+			cache.DefaultWatchErrorHandler(r, err)
+		})
+		factory.Start(running.stop)
+		c.watches[watch] = running
+	}
+}
+
+// forbid stops trying to watch secrets which the provisioner is not
+// permitted to list and watch.
+func (c *SecretCache) forbid(watch secretWatch, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.forbidden[watch] {
+		return
+	}
+	klog.Warningf("Secret cache: cannot watch %+v, reading the secrets from the API server instead: %v", watch, err)
+	c.forbidden[watch] = true
+	c.queueUpdate()
+}
+
+// lookup returns the secret if it is in the cache.
+func (c *SecretCache) lookup(namespace, name string) *v1.Secret {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, watch := range []secretWatch{{namespace: namespace, name: name}, {namespace: namespace}} {
+		running, ok := c.watches[watch]
+		if !ok || !running.informer.HasSynced() {
+			continue
+		}
+		if secret, err := running.lister.Secrets(namespace).Get(name); err == nil {
+			return secret
+		}
+	}
+	return nil
+}
+
+// Get returns the secret from the cache or, if it is not cached, from the
+// API server. The returned secret must not be modified.
+func (c *SecretCache) Get(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	if secret := c.lookup(namespace, name); secret != nil {
+		SecretCacheRequestsTotal.WithLabelValues(secretCacheHit).Inc()
+		return secret, nil
+	}
+	SecretCacheRequestsTotal.WithLabelValues(secretCacheMiss).Inc()
+	return c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// provisionerSecretTemplates returns the templates of the provisioner
+// secret in the storage class parameters, without validating them.
+func provisionerSecretTemplates(params map[string]string) (nameTemplate, namespaceTemplate string) {
+	for _, secret := range []secretParamsMap{provisionerSecretParams, defaultSecretParams} {
+		for _, key := range []string{secret.secretNameKey, secret.deprecatedSecretNameKey} {
+			if value, ok := params[key]; ok && key != "" {
+				nameTemplate = value
+			}
+		}
+		for _, key := range []string{secret.secretNamespaceKey, secret.deprecatedSecretNamespaceKey} {
+			if value, ok := params[key]; ok && key != "" {
+				namespaceTemplate = value
+			}
+		}
+		if nameTemplate != "" || namespaceTemplate != "" {
+			return nameTemplate, namespaceTemplate
+		}
+	}
+	return "", ""
+}
+
+// isSecretProvider returns true if the credential provider reads
+// Kubernetes secrets.
+func isSecretProvider(name string) bool {
+	return name == "" || name == CredentialProviderSecret
+}
+
+func isTemplate(value string) bool {
+	return strings.Contains(value, "${")
+}
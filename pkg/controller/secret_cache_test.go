@@ -0,0 +1,267 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func secretCacheSC(name, provisioner string, params map[string]string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: provisioner,
+		Parameters:  params,
+	}
+}
+
+// withDeletionSecret sets the annotations of the secret for deleting the
+// volume of the PV.
+func withDeletionSecret(pv *v1.PersistentVolume, namespace, name string) *v1.PersistentVolume {
+	metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefName, name)
+	metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefNamespace, namespace)
+	return pv
+}
+
+func newTestSecretCache(storageClasses []*storagev1.StorageClass, pvs []*v1.PersistentVolume, objects ...runtime.Object) *SecretCache {
+	client := fakeclientset.NewSimpleClientset(objects...)
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	c := NewSecretCache(client, driverName, informerFactory.Storage().V1().StorageClasses(), informerFactory.Core().V1().PersistentVolumes(), 0, 100)
+	for _, sc := range storageClasses {
+		c.updateStorageClass(sc)
+	}
+	for _, pv := range pvs {
+		c.updatePV(pv)
+	}
+	return c
+}
+
+func TestSecretCacheDesiredWatches(t *testing.T) {
+	storageClasses := []*storagev1.StorageClass{
+		secretCacheSC("fixed", driverName, map[string]string{
+			prefixedProvisionerSecretNameKey:      "provisioner",
+			prefixedProvisionerSecretNamespaceKey: "kube-system",
+		}),
+		secretCacheSC("deprecated", driverName, map[string]string{
+			provisionerSecretNameKey:      "legacy",
+			provisionerSecretNamespaceKey: "legacy-ns",
+		}),
+		secretCacheSC("default", driverName, map[string]string{
+			prefixedDefaultSecretNameKey:      "default",
+			prefixedDefaultSecretNamespaceKey: "default-ns",
+		}),
+		secretCacheSC("per-pvc", driverName, map[string]string{
+			prefixedProvisionerSecretNameKey:      "${pvc.name}",
+			prefixedProvisionerSecretNamespaceKey: "tenant-secrets",
+		}),
+		secretCacheSC("per-namespace", driverName, map[string]string{
+			prefixedProvisionerSecretNameKey:      "provisioner",
+			prefixedProvisionerSecretNamespaceKey: "${pvc.namespace}",
+		}),
+		secretCacheSC("other-driver", "other-driver", map[string]string{
+			prefixedProvisionerSecretNameKey:      "other",
+			prefixedProvisionerSecretNamespaceKey: "other",
+		}),
+		secretCacheSC("node-secrets-only", driverName, map[string]string{
+			prefixedNodeStageSecretNameKey:      "node",
+			prefixedNodeStageSecretNamespaceKey: "node",
+		}),
+		secretCacheSC("file-provider", driverName, map[string]string{
+			prefixedProvisionerSecretNameKey:      "from-file",
+			prefixedProvisionerSecretNamespaceKey: "files",
+			prefixedProvisionerSecretProviderKey:  CredentialProviderFile,
+		}),
+	}
+	otherDriverPV := withDeletionSecret(newTestPV("pv-5", "", "", ""), "other", "other")
+	otherDriverPV.Spec.CSI.Driver = "other-driver"
+	filePV := withDeletionSecret(newTestPV("pv-6", "", "", ""), "files", "from-file")
+	metav1.SetMetaDataAnnotation(&filePV.ObjectMeta, annDeletionProvisionerSecretProvider, CredentialProviderFile)
+	pvs := []*v1.PersistentVolume{
+		withDeletionSecret(newTestPV("pv-1", "", "", ""), "kube-system", "provisioner"),
+		withDeletionSecret(newTestPV("pv-2", "", "", ""), "old-secrets", "old"),
+		withDeletionSecret(newTestPV("pv-3", "", "", ""), "tenant-secrets", "claim-1"),
+		newTestPV("pv-4", "", "", ""),
+		otherDriverPV,
+		filePV,
+	}
+	c := newTestSecretCache(storageClasses, pvs)
+
+	expected := map[secretWatch]bool{
+		{namespace: "kube-system", name: "provisioner"}: true,
+		{namespace: "legacy-ns", name: "legacy"}:        true,
+		{namespace: "default-ns", name: "default"}:      true,
+		{namespace: "tenant-secrets"}:                   true,
+		{namespace: "old-secrets", name: "old"}:         true,
+	}
+	if watches := c.desiredWatches(); !reflect.DeepEqual(watches, expected) {
+		t.Errorf("expected watches %v, got %v", expected, watches)
+	}
+
+	// Only the most referenced secrets get watched: tenant-secrets
+	// (per-pvc and pv-3) and kube-system/provisioner (fixed and pv-1).
+	c.maxWatches = 2
+	expected = map[secretWatch]bool{
+		{namespace: "kube-system", name: "provisioner"}: true,
+		{namespace: "tenant-secrets"}:                   true,
+	}
+	if watches := c.desiredWatches(); !reflect.DeepEqual(watches, expected) {
+		t.Errorf("expected watches %v with limit, got %v", expected, watches)
+	}
+
+	// Updates and deletions replace the references of the objects.
+	c.maxWatches = 100
+	c.updatePV(newTestPV("pv-2", "", "", ""))
+	c.deleteStorageClass(cache.DeletedFinalStateUnknown{Key: "per-pvc", Obj: storageClasses[3]})
+	expected = map[secretWatch]bool{
+		{namespace: "kube-system", name: "provisioner"}: true,
+		{namespace: "legacy-ns", name: "legacy"}:        true,
+		{namespace: "default-ns", name: "default"}:      true,
+		{namespace: "tenant-secrets", name: "claim-1"}:  true,
+	}
+	if watches := c.desiredWatches(); !reflect.DeepEqual(watches, expected) {
+		t.Errorf("expected watches %v after changes, got %v", expected, watches)
+	}
+}
+
+func TestSecretCacheGet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := func(namespace, name string) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string][]byte{"password": []byte(name)},
+		}
+	}
+	storageClasses := []*storagev1.StorageClass{
+		secretCacheSC("fixed", driverName, map[string]string{
+			prefixedProvisionerSecretNameKey:      "provisioner",
+			prefixedProvisionerSecretNamespaceKey: "kube-system",
+		}),
+	}
+	c := newTestSecretCache(storageClasses, nil, secret("kube-system", "provisioner"), secret("tenant", "uncached"))
+	c.updateWatches()
+	defer func() {
+		for _, running := range c.watches {
+			close(running.stop)
+		}
+	}()
+	for watch, running := range c.watches {
+		if !cache.WaitForCacheSync(ctx.Done(), running.informer.HasSynced) {
+			t.Fatalf("informer for %+v did not sync", watch)
+		}
+	}
+
+	hits := testutil.ToFloat64(SecretCacheRequestsTotal.WithLabelValues(secretCacheHit))
+	misses := testutil.ToFloat64(SecretCacheRequestsTotal.WithLabelValues(secretCacheMiss))
+	for _, tc := range []struct{ namespace, name string }{{"kube-system", "provisioner"}, {"tenant", "uncached"}} {
+		s, err := c.Get(ctx, tc.namespace, tc.name)
+		if err != nil {
+			t.Fatalf("unexpected error for %s/%s: %v", tc.namespace, tc.name, err)
+		}
+		if string(s.Data["password"]) != tc.name {
+			t.Errorf("expected secret %s/%s, got %+v", tc.namespace, tc.name, s)
+		}
+	}
+	if _, err := c.Get(ctx, "tenant", "missing"); err == nil {
+		t.Error("expected error for missing secret")
+	}
+	if delta := testutil.ToFloat64(SecretCacheRequestsTotal.WithLabelValues(secretCacheHit)) - hits; delta != 1 {
+		t.Errorf("expected 1 hit, got %v", delta)
+	}
+	if delta := testutil.ToFloat64(SecretCacheRequestsTotal.WithLabelValues(secretCacheMiss)) - misses; delta != 2 {
+		t.Errorf("expected 2 misses, got %v", delta)
+	}
+
+	// Watches get stopped once no storage class needs them anymore.
+	c.deleteStorageClass(storageClasses[0])
+	c.updateWatches()
+	if len(c.watches) != 0 {
+		t.Errorf("expected no watches, got %v", c.watches)
+	}
+}
+
+func TestSecretCacheRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newTestSecretCache(nil, []*v1.PersistentVolume{withDeletionSecret(newTestPV("pv-1", "", "", ""), "kube-system", "provisioner")})
+	c.queueUpdate()
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return len(c.watches) == 1, nil
+	})
+	cancel()
+	<-done
+	if err != nil {
+		t.Fatal("expected secret to be watched")
+	}
+	if len(c.watches) != 0 {
+		t.Errorf("expected watches to be stopped, got %v", c.watches)
+	}
+}
+
+func TestSecretCacheForbidden(t *testing.T) {
+	c := newTestSecretCache(nil, []*v1.PersistentVolume{withDeletionSecret(newTestPV("pv-1", "", "", ""), "kube-system", "provisioner")})
+	c.client.(*fakeclientset.Clientset).PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(v1.Resource("secrets"), "", errors.New("no RBAC rule"))
+	})
+	c.updateWatches()
+	defer func() {
+		for _, running := range c.watches {
+			close(running.stop)
+		}
+	}()
+	err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return len(c.forbidden) == 1, nil
+	})
+	if err != nil {
+		t.Fatal("expected watch to be forbidden")
+	}
+
+	// The forbidden watch gets stopped and is tried again once it is
+	// referenced again after not being referenced.
+	c.updateWatches()
+	if len(c.watches) != 0 {
+		t.Errorf("expected no watches, got %v", c.watches)
+	}
+	c.deletePV(withDeletionSecret(newTestPV("pv-1", "", "", ""), "kube-system", "provisioner"))
+	c.updateWatches()
+	if len(c.forbidden) != 0 {
+		t.Errorf("expected forbidden watches to be forgotten, got %v", c.forbidden)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+// CapacityRanking orders the preferred topology segments of volumes with
+// immediate binding by the capacity that is published for their storage
+// class in CSIStorageCapacity objects, largest capacity first.
+type CapacityRanking struct {
+	capacityLister storagelistersv1.CSIStorageCapacityLister
+	// tolerance is the percentage of the largest capacity by which
+	// capacities may differ and still be treated as equal.
+	tolerance int
+}
+
+// NewCapacityRanking creates a ranking which uses the CSIStorageCapacity
+// objects of the driver. Capacities within tolerance percent of each
+// other, measured relative to the largest capacity, rank the same.
+func NewCapacityRanking(capacityLister storagelistersv1.CSIStorageCapacityLister, tolerance int) *CapacityRanking {
+	return &CapacityRanking{
+		capacityLister: capacityLister,
+		tolerance:      tolerance,
+	}
+}
+
+// rankedTopology is a preferred topology segment with the capacity that
+// is available in it.
+type rankedTopology struct {
+	topology *csi.Topology
+	known    bool
+	bytes    int64
+	// bucket groups segments with similar capacity, 0 for those closest
+	// to the largest capacity.
+	bucket int64
+}
+
+// rank sorts the preferred segments in place. The capacity of a segment
+// is the sum of the CSIStorageCapacity objects whose topology is within
+// that segment, without objects for a part of the topology of another
+// such object. Segments are sorted by buckets of tolerance percent of the
+// largest capacity, so that the original order, usually the StatefulSet
+// spreading, decides between segments with similar capacity. Segments
+// without any capacity information come last.
+func (r *CapacityRanking) rank(storageClassName string, preferred []*csi.Topology) error {
+	capacities, err := r.capacityLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list CSIStorageCapacity objects: %v", err)
+	}
+
+	ranked := make([]rankedTopology, 0, len(preferred))
+	var largest int64
+	for _, topology := range preferred {
+		entry := rankedTopology{topology: topology}
+		var within []*storagev1.CSIStorageCapacity
+		for _, capacity := range capacities {
+			if capacity.StorageClassName != storageClassName ||
+				capacity.NodeTopology == nil ||
+				capacity.Capacity == nil ||
+				!topologyTerm(topology.Segments).subset(capacity.NodeTopology.MatchLabels) {
+				continue
+			}
+			within = append(within, capacity)
+		}
+		for _, capacity := range within {
+			if partOfOther(capacity, within) {
+				continue
+			}
+			entry.known = true
+			entry.bytes += capacity.Capacity.Value()
+		}
+		if entry.bytes > largest {
+			largest = entry.bytes
+		}
+		ranked = append(ranked, entry)
+	}
+	for i := range ranked {
+		ranked[i].bucket = largest - ranked[i].bytes
+		if r.tolerance > 0 && largest > 0 {
+			ranked[i].bucket = int64(float64(largest-ranked[i].bytes) / (float64(largest) * float64(r.tolerance) / 100))
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].known != ranked[j].known {
+			return ranked[i].known
+		}
+		return ranked[i].bucket < ranked[j].bucket
+	})
+	for i, entry := range ranked {
+		preferred[i] = entry.topology
+	}
+	klog.V(5).Infof("Preferred topology for storage class %s ranked by capacity: %v", storageClassName, preferred)
+	return nil
+}
+
+// partOfOther returns true if the topology of the capacity is a part of
+// the topology of one of the other capacities, for example a node in a
+// zone. Drivers which publish capacity at several levels of their
+// topology include the capacity of the parts in the capacity of the whole.
+func partOfOther(capacity *storagev1.CSIStorageCapacity, others []*storagev1.CSIStorageCapacity) bool {
+	topology := capacity.NodeTopology.MatchLabels
+	for _, other := range others {
+		otherTopology := other.NodeTopology.MatchLabels
+		if len(otherTopology) < len(topology) && topologyTerm(otherTopology).subset(topology) {
+			return true
+		}
+	}
+	return false
+}
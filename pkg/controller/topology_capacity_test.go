@@ -0,0 +1,154 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCapacityRanking(t *testing.T) {
+	capacity := func(name, storageClassName, zone, rack, quantity string) *storagev1.CSIStorageCapacity {
+		q := resource.MustParse(quantity)
+		segment := map[string]string{"zone": zone}
+		if rack != "" {
+			segment["rack"] = rack
+		}
+		return &storagev1.CSIStorageCapacity{
+			ObjectMeta:       metav1.ObjectMeta{Name: name, Namespace: "default"},
+			StorageClassName: storageClassName,
+			NodeTopology:     &metav1.LabelSelector{MatchLabels: segment},
+			Capacity:         &q,
+		}
+	}
+	zones := func(zones ...string) []*csi.Topology {
+		var topologies []*csi.Topology
+		for _, zone := range zones {
+			topologies = append(topologies, &csi.Topology{Segments: map[string]string{"zone": zone}})
+		}
+		return topologies
+	}
+
+	testcases := map[string]struct {
+		capacities []*storagev1.CSIStorageCapacity
+		tolerance  int
+		preferred  []*csi.Topology
+		expected   []*csi.Topology
+	}{
+		"no capacity": {
+			preferred: zones("b", "c", "a"),
+			expected:  zones("b", "c", "a"),
+		},
+		"largest capacity first": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "sc", "a", "", "10Gi"),
+				capacity("cap-b", "sc", "b", "", "1Gi"),
+				capacity("cap-c", "sc", "c", "", "5Gi"),
+			},
+			preferred: zones("b", "c", "a"),
+			expected:  zones("a", "c", "b"),
+		},
+		"ties keep order": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "sc", "a", "", "5Gi"),
+				capacity("cap-b", "sc", "b", "", "1Gi"),
+				capacity("cap-c", "sc", "c", "", "5Gi"),
+			},
+			preferred: zones("b", "c", "a"),
+			expected:  zones("c", "a", "b"),
+		},
+		"unknown capacity last": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-b", "sc", "b", "", "0"),
+			},
+			preferred: zones("a", "b"),
+			expected:  zones("b", "a"),
+		},
+		"other storage class ignored": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "other-sc", "a", "", "10Gi"),
+				capacity("cap-b", "sc", "b", "", "1Gi"),
+				capacity("cap-c", "sc", "c", "", "5Gi"),
+			},
+			preferred: zones("a", "b", "c"),
+			expected:  zones("c", "b", "a"),
+		},
+		"sum of finer segments": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "sc", "a", "rack1", "3Gi"),
+				capacity("cap-b-1", "sc", "b", "rack1", "2Gi"),
+				capacity("cap-b-2", "sc", "b", "rack2", "2Gi"),
+			},
+			preferred: zones("a", "b"),
+			expected:  zones("b", "a"),
+		},
+		"zone and rack capacity": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "sc", "a", "", "4Gi"),
+				capacity("cap-a-1", "sc", "a", "rack1", "2Gi"),
+				capacity("cap-a-2", "sc", "a", "rack2", "2Gi"),
+				capacity("cap-b", "sc", "b", "", "5Gi"),
+			},
+			preferred: zones("a", "b"),
+			expected:  zones("b", "a"),
+		},
+		"similar capacity keeps order": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "sc", "a", "", "10Gi"),
+				capacity("cap-b", "sc", "b", "", "9.5Gi"),
+				capacity("cap-c", "sc", "c", "", "5Gi"),
+			},
+			tolerance: 10,
+			preferred: zones("c", "b", "a"),
+			expected:  zones("b", "a", "c"),
+		},
+		"buckets relative to largest capacity": {
+			capacities: []*storagev1.CSIStorageCapacity{
+				capacity("cap-a", "sc", "a", "", "10Gi"),
+				capacity("cap-b", "sc", "b", "", "8.5Gi"),
+				capacity("cap-c", "sc", "c", "", "8Gi"),
+				capacity("cap-d", "sc", "d", "", "7.5Gi"),
+			},
+			tolerance: 20,
+			preferred: zones("d", "c", "b", "a"),
+			expected:  zones("b", "a", "d", "c"),
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, capacity := range tc.capacities {
+				indexer.Add(capacity)
+			}
+			ranking := NewCapacityRanking(storagelistersv1.NewCSIStorageCapacityLister(indexer), tc.tolerance)
+			if err := ranking.rank("sc", tc.preferred); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tc.preferred, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, tc.preferred)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Ways of grouping PVCs for TopologySpreading.
+	topologySpreadLabel       = "label"
+	topologySpreadAnnotation  = "annotation"
+	topologySpreadStatefulSet = "statefulset"
+)
+
+// TopologySpreading orders the preferred topology segments of volumes
+// with immediate binding so that the segment with the fewest existing
+// volumes of the same group comes first. PVCs belong to the same group
+// when they are in the same namespace and have the same value for a
+// label, an annotation or the same owning StatefulSet.
+//
+// PVCs which are still being provisioned have no PV yet. The first
+// segment that was chosen for them is reserved in memory and counted
+// like a volume until their PV is bound or they leave the group.
+type TopologySpreading struct {
+	driverName  string
+	groupBy     string
+	key         string
+	claimLister corelisters.PersistentVolumeClaimLister
+	pvLister    corelisters.PersistentVolumeLister
+
+	mutex        sync.Mutex
+	reservations map[types.UID]topologyReservation
+}
+
+// topologyReservation is the segment that was chosen for a PVC of a group.
+type topologyReservation struct {
+	// group is the namespace and the group of the PVC.
+	group   string
+	segment topologyTerm
+}
+
+// NewTopologySpreading creates a spreading for the volumes of the driver.
+// groupBy must be "label:<key>", "annotation:<key>" or "statefulset".
+func NewTopologySpreading(driverName string, groupBy string, claimLister corelisters.PersistentVolumeClaimLister, pvLister corelisters.PersistentVolumeLister) (*TopologySpreading, error) {
+	s := &TopologySpreading{
+		driverName:   driverName,
+		claimLister:  claimLister,
+		pvLister:     pvLister,
+		reservations: map[types.UID]topologyReservation{},
+	}
+	s.groupBy, s.key, _ = strings.Cut(groupBy, ":")
+	switch s.groupBy {
+	case topologySpreadLabel, topologySpreadAnnotation:
+		if s.key == "" {
+			return nil, fmt.Errorf("%s grouping needs a key, for example %s:app", s.groupBy, s.groupBy)
+		}
+	case topologySpreadStatefulSet:
+		if s.key != "" {
+			return nil, fmt.Errorf("%s grouping does not take a key", s.groupBy)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported grouping %q, must be %s:<key>, %s:<key> or %s", groupBy, topologySpreadLabel, topologySpreadAnnotation, topologySpreadStatefulSet)
+	}
+	return s, nil
+}
+
+// group returns the group of the PVC and false if it does not belong to
+// any group.
+func (s *TopologySpreading) group(claim *v1.PersistentVolumeClaim) (string, bool) {
+	switch s.groupBy {
+	case topologySpreadLabel:
+		value, ok := claim.Labels[s.key]
+		return value, ok
+	case topologySpreadAnnotation:
+		value, ok := claim.Annotations[s.key]
+		return value, ok
+	default:
+		owner := metav1.GetControllerOf(claim)
+		if owner == nil || owner.Kind != "StatefulSet" {
+			return "", false
+		}
+		return owner.Name, true
+	}
+}
+
+// rank sorts the preferred segments in place by the number of volumes
+// that other PVCs of the same group have in them. Those get determined
+// through the node affinity of their PVs and through the reservations of
+// PVCs without a bound PV. The original order breaks ties. Unless this is
+// a dry run, the first segment gets reserved for the PVC.
+func (s *TopologySpreading) rank(ctx context.Context, claim *v1.PersistentVolumeClaim, preferred []*csi.Topology) error {
+	group, ok := s.group(claim)
+	if !ok {
+		return nil
+	}
+	selector := labels.Everything()
+	if s.groupBy == topologySpreadLabel {
+		selector = labels.SelectorFromSet(labels.Set{s.key: group})
+	}
+	claims, err := s.claimLister.PersistentVolumeClaims(claim.Namespace).List(selector)
+	if err != nil {
+		return fmt.Errorf("failed to list PVCs for topology spreading: %v", err)
+	}
+
+	// Counting and reserving must not interleave with other PVCs of the
+	// group, otherwise they would all choose the same segment.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	groupKey := claim.Namespace + "/" + group
+	members := map[types.UID]bool{}
+	counts := make(map[*csi.Topology]int, len(preferred))
+	for _, other := range claims {
+		if other.UID == claim.UID {
+			continue
+		}
+		if otherGroup, ok := s.group(other); !ok || otherGroup != group {
+			continue
+		}
+		members[other.UID] = true
+		if other.Spec.VolumeName == "" {
+			continue
+		}
+		pv, err := s.pvLister.Get(other.Spec.VolumeName)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get PV %s for topology spreading: %v", other.Spec.VolumeName, err)
+		}
+		// The PV counts from now on.
+		delete(s.reservations, other.UID)
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != s.driverName || pv.Spec.NodeAffinity == nil {
+			continue
+		}
+		for _, topology := range preferred {
+			accessible, err := VolumeIsAccessible(pv.Spec.NodeAffinity, topology)
+			if err != nil {
+				return fmt.Errorf("failed to check node affinity of PV %s: %v", pv.Name, err)
+			}
+			if accessible {
+				counts[topology]++
+			}
+		}
+	}
+	for uid, reservation := range s.reservations {
+		if reservation.group != groupKey || uid == claim.UID {
+			continue
+		}
+		if !members[uid] {
+			// Deleted or no longer in the group.
+			delete(s.reservations, uid)
+			continue
+		}
+		for _, topology := range preferred {
+			if topologyTerm(topology.Segments).subset(reservation.segment) {
+				counts[topology]++
+			}
+		}
+	}
+	sort.SliceStable(preferred, func(i, j int) bool {
+		return counts[preferred[i]] < counts[preferred[j]]
+	})
+	if len(preferred) > 0 && !isDryRun(ctx) {
+		s.reservations[claim.UID] = topologyReservation{group: groupKey, segment: preferred[0].Segments}
+	}
+	klog.V(5).Infof("Preferred topology for PVC %s/%s spread within group %q: %v", claim.Namespace, claim.Name, group, preferred)
+	return nil
+}
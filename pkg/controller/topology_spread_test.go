@@ -0,0 +1,268 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNewTopologySpreading(t *testing.T) {
+	for groupBy, expectErr := range map[string]bool{
+		"label:app":       false,
+		"annotation:team": false,
+		"statefulset":     false,
+		"label":           true,
+		"annotation:":     true,
+		"statefulset:web": true,
+		"deployment":      true,
+	} {
+		_, err := NewTopologySpreading(driverName, groupBy, nil, nil)
+		if expectErr && err == nil {
+			t.Errorf("%s: expected error", groupBy)
+		} else if !expectErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", groupBy, err)
+		}
+	}
+}
+
+func TestTopologySpreading(t *testing.T) {
+	type volume struct {
+		claim     string
+		namespace string
+		group     string
+		driver    string
+		zones     []string
+	}
+	zones := func(zones ...string) []*csi.Topology {
+		var topologies []*csi.Topology
+		for _, zone := range zones {
+			topologies = append(topologies, &csi.Topology{Segments: map[string]string{"zone": zone}})
+		}
+		return topologies
+	}
+
+	testcases := map[string]struct {
+		groupBy   string
+		group     string
+		volumes   []volume
+		preferred []*csi.Topology
+		expected  []*csi.Topology
+	}{
+		"no group": {
+			groupBy: "label:app",
+			volumes: []volume{
+				{claim: "db-1", group: "db", zones: []string{"a"}},
+			},
+			preferred: zones("a", "b"),
+			expected:  zones("a", "b"),
+		},
+		"least used first": {
+			groupBy: "label:app",
+			group:   "db",
+			volumes: []volume{
+				{claim: "db-1", group: "db", zones: []string{"a"}},
+				{claim: "db-2", group: "db", zones: []string{"a"}},
+				{claim: "db-3", group: "db", zones: []string{"b"}},
+			},
+			preferred: zones("a", "b", "c"),
+			expected:  zones("c", "b", "a"),
+		},
+		"ties keep order": {
+			groupBy: "annotation:team",
+			group:   "db",
+			volumes: []volume{
+				{claim: "db-1", group: "db", zones: []string{"b"}},
+			},
+			preferred: zones("b", "c", "a"),
+			expected:  zones("c", "a", "b"),
+		},
+		"volumes in several zones": {
+			groupBy: "label:app",
+			group:   "db",
+			volumes: []volume{
+				{claim: "db-1", group: "db", zones: []string{"a", "b"}},
+				{claim: "db-2", group: "db", zones: []string{"b"}},
+			},
+			preferred: zones("a", "b", "c"),
+			expected:  zones("c", "a", "b"),
+		},
+		"other groups, namespaces and drivers ignored": {
+			groupBy: "label:app",
+			group:   "db",
+			volumes: []volume{
+				{claim: "web-1", group: "web", zones: []string{"a"}},
+				{claim: "db-1", namespace: "other-ns", group: "db", zones: []string{"a"}},
+				{claim: "db-2", group: "db", driver: "other-driver", zones: []string{"a"}},
+				{claim: "db-3", group: "db", zones: []string{"b"}},
+			},
+			preferred: zones("a", "b"),
+			expected:  zones("a", "b"),
+		},
+		"statefulset": {
+			groupBy: "statefulset",
+			group:   "db",
+			volumes: []volume{
+				{claim: "data-db-0", group: "db", zones: []string{"a"}},
+				{claim: "data-web-0", group: "web", zones: []string{"b"}},
+			},
+			preferred: zones("a", "b"),
+			expected:  zones("b", "a"),
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			spreading, err := NewTopologySpreading(driverName, tc.groupBy, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claimIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			setGroup := func(claim *v1.PersistentVolumeClaim, group string) {
+				if group == "" {
+					return
+				}
+				switch spreading.groupBy {
+				case topologySpreadLabel:
+					claim.Labels = map[string]string{spreading.key: group}
+				case topologySpreadAnnotation:
+					claim.Annotations = map[string]string{spreading.key: group}
+				default:
+					controller := true
+					claim.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: group, Controller: &controller}}
+				}
+			}
+			for _, volume := range tc.volumes {
+				namespace := volume.namespace
+				if namespace == "" {
+					namespace = "default"
+				}
+				driver := volume.driver
+				if driver == "" {
+					driver = driverName
+				}
+				claim := &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: volume.claim, Namespace: namespace, UID: types.UID(volume.claim)},
+					Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-" + volume.claim},
+				}
+				setGroup(claim, volume.group)
+				claimIndexer.Add(claim)
+				pvIndexer.Add(&v1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{Name: "pv-" + volume.claim},
+					Spec: v1.PersistentVolumeSpec{
+						PersistentVolumeSource: v1.PersistentVolumeSource{
+							CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volume.claim},
+						},
+						NodeAffinity: GenerateVolumeNodeAffinity(zones(volume.zones...)),
+					},
+				})
+			}
+			spreading.claimLister = corelisters.NewPersistentVolumeClaimLister(claimIndexer)
+			spreading.pvLister = corelisters.NewPersistentVolumeLister(pvIndexer)
+
+			claim := &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default", UID: "new"},
+			}
+			setGroup(claim, tc.group)
+			if err := spreading.rank(context.Background(), claim, tc.preferred); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tc.preferred, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, tc.preferred)
+			}
+		})
+	}
+}
+
+func TestTopologySpreadingReservations(t *testing.T) {
+	zones := func(zones ...string) []*csi.Topology {
+		var topologies []*csi.Topology
+		for _, zone := range zones {
+			topologies = append(topologies, &csi.Topology{Segments: map[string]string{"zone": zone}})
+		}
+		return topologies
+	}
+	spreading, err := NewTopologySpreading(driverName, "label:app", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	spreading.claimLister = corelisters.NewPersistentVolumeClaimLister(claimIndexer)
+	spreading.pvLister = corelisters.NewPersistentVolumeLister(pvIndexer)
+	claims := map[string]*v1.PersistentVolumeClaim{}
+	for _, name := range []string{"db-1", "db-2", "db-3"} {
+		claims[name] = &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name), Labels: map[string]string{"app": "db"}},
+		}
+		claimIndexer.Add(claims[name])
+	}
+	rank := func(ctx context.Context, name string, expected []*csi.Topology) {
+		t.Helper()
+		preferred := zones("a", "b", "c")
+		if err := spreading.rank(ctx, claims[name], preferred); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if !reflect.DeepEqual(preferred, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, preferred)
+		}
+	}
+
+	// PVCs which get provisioned at the same time are spread, too. A
+	// retry does not count the own reservation and a dry run reserves
+	// nothing.
+	rank(context.Background(), "db-1", zones("a", "b", "c"))
+	rank(context.Background(), "db-2", zones("b", "c", "a"))
+	rank(context.Background(), "db-1", zones("a", "c", "b"))
+	rank(withExplainRecorder(context.Background(), &explainRecorder{}), "db-3", zones("c", "a", "b"))
+	rank(context.Background(), "db-3", zones("c", "a", "b"))
+	if len(spreading.reservations) != 3 {
+		t.Errorf("expected 3 reservations, got %v", spreading.reservations)
+	}
+
+	// Once the PV is bound, it counts instead of the reservation.
+	bound := claims["db-1"].DeepCopy()
+	bound.Spec.VolumeName = "pv-db-1"
+	claimIndexer.Update(bound)
+	pvIndexer.Add(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-db-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: "db-1"},
+			},
+			NodeAffinity: GenerateVolumeNodeAffinity(zones("a")),
+		},
+	})
+	// Reservations of deleted PVCs get dropped.
+	claimIndexer.Delete(claims["db-2"])
+	rank(context.Background(), "db-3", zones("b", "c", "a"))
+	expected := map[types.UID]topologyReservation{
+		"db-3": {group: "default/db", segment: topologyTerm{"zone": "b"}},
+	}
+	if !reflect.DeepEqual(spreading.reservations, expected) {
+		t.Errorf("expected reservations %v, got %v", expected, spreading.reservations)
+	}
+}
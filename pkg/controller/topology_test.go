@@ -30,6 +30,7 @@ import (
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
@@ -1622,7 +1623,7 @@ func listers(kubeClient *fakeclientset.Clientset) (
 	storagelistersv1.CSINodeLister,
 	corelisters.NodeLister,
 	corelisters.PersistentVolumeClaimLister,
-	storagelistersv1.VolumeAttachmentLister,
+	cache.Indexer,
 	chan struct{}) {
 	factory := informers.NewSharedInformerFactory(kubeClient, ResyncPeriodOfCsiNodeInformer)
 	stopChan := make(chan struct{})
@@ -1630,8 +1631,9 @@ func listers(kubeClient *fakeclientset.Clientset) (
 	csiNodeLister := factory.Storage().V1().CSINodes().Lister()
 	nodeLister := factory.Core().V1().Nodes().Lister()
 	claimLister := factory.Core().V1().PersistentVolumeClaims().Lister()
-	vaLister := factory.Storage().V1().VolumeAttachments().Lister()
+	vaInformer := factory.Storage().V1().VolumeAttachments().Informer()
+	vaInformer.AddIndexers(cache.Indexers{VolumeAttachmentPVIndex: VolumeAttachmentPVIndexFunc(driverName)})
 	factory.Start(stopChan)
 	factory.WaitForCacheSync(stopChan)
-	return scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan
+	return scLister, csiNodeLister, nodeLister, claimLister, vaInformer.GetIndexer(), stopChan
 }
@@ -0,0 +1,121 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionTracing(t *testing.T) {
+	const requestBytes = 100
+	exporter := tracetest.NewInMemoryExporter()
+	oldProvider, oldPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+	}()
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+	recorder := record.NewFakeRecorder(10)
+	provisioner.(*csiProvisioner).eventRecorder = recorder
+
+	var traceParent string
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if values := md.Get("traceparent"); len(values) > 0 {
+				traceParent = values[0]
+			}
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{VolumeId: "test-volume-id", CapacityBytes: requestBytes},
+			}, nil
+		}).Times(1)
+	pv, _, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "gold"}},
+		PVC:          createFakePVC(requestBytes),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	root, ok := spans["Provision"]
+	if !ok {
+		t.Fatalf("expected Provision span, got %v", spans)
+	}
+	traceID := root.SpanContext.TraceID().String()
+	for _, name := range []string{"prepareProvision", "csi.CreateVolume", "newPersistentVolume"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("expected %s span to be a child of the Provision span", name)
+		}
+	}
+	if len(spans["prepareProvision"].Events) == 0 {
+		t.Error("expected the steps of prepareProvision as span events")
+	}
+	if !strings.Contains(traceParent, traceID) {
+		t.Errorf("expected trace ID %s to be propagated to the driver, got traceparent %q", traceID, traceParent)
+	}
+
+	if pv.Annotations[annTraceID] != traceID {
+		t.Errorf("expected PV annotation with trace ID %s, got annotations %v", traceID, pv.Annotations)
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("expected no event, got %q", event)
+	default:
+	}
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+//
+// The trash keeps the volumes of deleted PVs for a retention period before
+// DeleteVolume gets called, so that data survives an accidental deletion of
+// PVCs or namespaces for a while. It is enabled per storage class with the
+// csi.storage.k8s.io/trash-retention parameter.
+//
+// Delete records the volume in a ConfigMap instead of deleting it, so the
+// PV object gets removed as usual. The trash periodically deletes the
+// volumes whose retention has expired, using the recorded parts of the PV
+// for deletion secrets and all the other checks of Delete. A volume gets restored by
+// creating a PV with the same volume handle before its retention expires:
+// the entry then gets removed without deleting the volume.
+//
+
+const (
+	// Keeps the volumes of deleted PVs for this duration, for example
+	// "72h", before they get deleted.
+	prefixedTrashRetentionKey = csiParameterPrefix + "trash-retention"
+
+	trashOperationAdded          = "added"
+	trashOperationDeleted        = "deleted"
+	trashOperationRestored       = "restored"
+	trashOperationDeletionFailed = "deletion_failed"
+)
+
+var (
+	// TrashVolumes is the number of volumes in the trash.
+	TrashVolumes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "controller",
+			Name:      "trash_volumes",
+			Help:      "Number of volumes of deleted PVs which are kept in the trash.",
+		},
+	)
+	// TrashOperationsTotal counts the changes of the trash.
+	TrashOperationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "controller",
+			Name:      "trash_operations_total",
+			Help:      "Number of trash operations, by operation: added when a PV got deleted, deleted when the retention expired, restored when a PV was created again for the volume, deletion_failed when DeleteVolume failed.",
+		},
+		[]string{"operation"},
+	)
+)
+
+// trashEntry is the value of the trash ConfigMap for one PV, stored under
+// the PV name. A ConfigMap cannot be larger than 1 MiB, so instead of the
+// whole PV the entry only contains what deleting and restoring the volume
+// needs.
+type trashEntry struct {
+	DeleteAfter  metav1.Time `json:"deleteAfter"`
+	UID          types.UID   `json:"uid"`
+	Driver       string      `json:"driver"`
+	VolumeHandle string      `json:"volumeHandle"`
+	// Migrated is true for an in-tree volume, Driver and VolumeHandle
+	// are then translated to CSI.
+	Migrated         bool               `json:"migrated,omitempty"`
+	Capacity         *resource.Quantity `json:"capacity,omitempty"`
+	StorageClassName string             `json:"storageClassName,omitempty"`
+	ClaimNamespace   string             `json:"claimNamespace,omitempty"`
+	ClaimName        string             `json:"claimName,omitempty"`
+	// SecretAnnotations are the annotations of the PV which reference
+	// its deletion secret.
+	SecretAnnotations map[string]string `json:"secretAnnotations,omitempty"`
+}
+
+// newTrashEntry records the PV, which must have a CSI source.
+func newTrashEntry(volume *v1.PersistentVolume, migrated bool, deleteAfter metav1.Time) *trashEntry {
+	entry := &trashEntry{
+		DeleteAfter:      deleteAfter,
+		UID:              volume.UID,
+		Driver:           volume.Spec.CSI.Driver,
+		VolumeHandle:     volume.Spec.CSI.VolumeHandle,
+		Migrated:         migrated,
+		StorageClassName: volume.Spec.StorageClassName,
+	}
+	if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok {
+		entry.Capacity = &capacity
+	}
+	if volume.Spec.ClaimRef != nil {
+		entry.ClaimNamespace = volume.Spec.ClaimRef.Namespace
+		entry.ClaimName = volume.Spec.ClaimRef.Name
+	}
+	for _, key := range []string{annDeletionProvisionerSecretRefName, annDeletionProvisionerSecretRefNamespace, annDeletionProvisionerSecretProvider} {
+		if value, ok := volume.Annotations[key]; ok {
+			if entry.SecretAnnotations == nil {
+				entry.SecretAnnotations = map[string]string{}
+			}
+			entry.SecretAnnotations[key] = value
+		}
+	}
+	return entry
+}
+
+// persistentVolume returns a PV with the recorded parts of the PV.
+func (e *trashEntry) persistentVolume(name string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			UID:         e.UID,
+			Annotations: e.SecretAnnotations,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: e.Driver, VolumeHandle: e.VolumeHandle},
+			},
+			StorageClassName:              e.StorageClassName,
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		},
+	}
+	if e.Capacity != nil {
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: *e.Capacity}
+	}
+	if e.ClaimName != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: e.ClaimNamespace, Name: e.ClaimName}
+	}
+	return pv
+}
+
+// Trash keeps deleted volumes in a ConfigMap until their retention expires.
+type Trash struct {
+	client     kubernetes.Interface
+	namespace  string
+	name       string
+	pvInformer coreinformers.PersistentVolumeInformer
+	pvLister   corelisters.PersistentVolumeLister
+	interval   time.Duration
+	now        func() time.Time
+
+	// deleteVolume deletes the volume of a PV with a CSI source after the
+	// retention. It and eventRecorder get set by NewCSIProvisioner.
+	deleteVolume  func(ctx context.Context, volume *v1.PersistentVolume, migrated bool) error
+	eventRecorder record.EventRecorder
+}
+
+// NewTrash creates a trash which is stored in the ConfigMap with the given
+// namespace and name. The ConfigMap gets created when needed. Expired
+// volumes get deleted each interval once Run is called.
+func NewTrash(
+	client kubernetes.Interface,
+	namespace, name string,
+	pvInformer coreinformers.PersistentVolumeInformer,
+	interval time.Duration,
+) *Trash {
+	return &Trash{
+		client:     client,
+		namespace:  namespace,
+		name:       name,
+		pvInformer: pvInformer,
+		pvLister:   pvInformer.Lister(),
+		interval:   interval,
+		now:        time.Now,
+	}
+}
+
+// Run deletes expired volumes until the context is done.
+func (t *Trash) Run(ctx context.Context) {
+	klog.Info("Starting trash")
+	defer utilruntime.HandleCrash()
+
+	if !cache.WaitForCacheSync(ctx.Done(), t.pvInformer.Informer().HasSynced) {
+		klog.Error("Trash: failed to sync PersistentVolume informer")
+		return
+	}
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := t.sync(ctx); err != nil {
+			klog.Warningf("Trash: deleting expired volumes failed: %v", err)
+		}
+	}, t.interval)
+	klog.Info("Shutting down trash")
+}
+
+// trashRetention returns how long the volume of a deleted PV is kept in
+// the trash, zero if it gets deleted right away.
+func (p *csiProvisioner) trashRetention(volume *v1.PersistentVolume) (time.Duration, error) {
+	storageClassName := util.GetPersistentVolumeClass(volume)
+	if p.trash == nil || storageClassName == "" {
+		return 0, nil
+	}
+	storageClass, err := p.scLister.Get(storageClassName)
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	value, ok := storageClass.Parameters[prefixedTrashRetentionKey]
+	if !ok {
+		return 0, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid %s parameter %q in storage class %s: must be a non-negative duration", prefixedTrashRetentionKey, value, storageClassName)
+	}
+	return retention, nil
+}
+
+// add records the volume of the PV in the trash. The PV must have a CSI
+// source, migrated is true if it was translated from an in-tree volume.
+// Adding a PV again does not extend its retention.
+func (t *Trash) add(ctx context.Context, volume *v1.PersistentVolume, migrated bool, retention time.Duration) error {
+	if volume.Spec.CSI == nil {
+		return fmt.Errorf("invalid CSI PV")
+	}
+	deleteAfter := metav1.NewTime(t.now().Add(retention).Truncate(time.Second))
+	value, err := json.Marshal(newTrashEntry(volume, migrated, deleteAfter))
+	if err != nil {
+		return err
+	}
+
+	added := false
+	if err := t.update(ctx, func(data map[string]string) {
+		_, exists := data[volume.Name]
+		if !exists {
+			data[volume.Name] = string(value)
+		}
+		added = !exists
+	}); err != nil {
+		return fmt.Errorf("failed to add volume of PV %s to trash ConfigMap %s/%s: %v", volume.Name, t.namespace, t.name, err)
+	}
+	if !added {
+		return nil
+	}
+
+	klog.Infof("Trash: keeping volume of PV %s until %s", volume.Name, deleteAfter.Format(time.RFC3339))
+	t.eventRecorder.Eventf(volume, v1.EventTypeNormal, "VolumeTrashed", "Volume is kept in trash ConfigMap %s/%s until %s", t.namespace, t.name, deleteAfter.Format(time.RFC3339))
+	TrashOperationsTotal.WithLabelValues(trashOperationAdded).Inc()
+	return nil
+}
+
+// update applies the change to the data of the ConfigMap, which gets
+// created if it does not exist yet.
+func (t *Trash) update(ctx context.Context, change func(data map[string]string)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := t.client.CoreV1().ConfigMaps(t.namespace).Get(ctx, t.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: t.namespace, Name: t.name},
+				Data:       map[string]string{},
+			}
+			change(configMap.Data)
+			_, err = t.client.CoreV1().ConfigMaps(t.namespace).Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Treated like a conflict, retry with the existing ConfigMap.
+				return apierrors.NewConflict(v1.Resource("configmaps"), t.name, err)
+			}
+		} else if err == nil {
+			if configMap.Data == nil {
+				configMap.Data = map[string]string{}
+			}
+			change(configMap.Data)
+			_, err = t.client.CoreV1().ConfigMaps(t.namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			TrashVolumes.Set(float64(len(configMap.Data)))
+		}
+		return err
+	})
+}
+
+// entries returns the valid entries of the trash by PV name.
+func (t *Trash) entries(ctx context.Context) (*v1.ConfigMap, map[string]*trashEntry, error) {
+	configMap, err := t.client.CoreV1().ConfigMaps(t.namespace).Get(ctx, t.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get trash ConfigMap %s/%s: %v", t.namespace, t.name, err)
+	}
+	entries := map[string]*trashEntry{}
+	for name, value := range configMap.Data {
+		entry := &trashEntry{}
+		if err := json.Unmarshal([]byte(value), entry); err != nil || entry.Driver == "" || entry.VolumeHandle == "" {
+			klog.Warningf("Trash: ignoring invalid entry %s in ConfigMap %s/%s: %v", name, t.namespace, t.name, err)
+			continue
+		}
+		entries[name] = entry
+	}
+	return configMap, entries, nil
+}
+
+// volumes returns the PVs whose volumes are in the trash.
+func (t *Trash) volumes(ctx context.Context) ([]*v1.PersistentVolume, error) {
+	_, entries, err := t.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pvs []*v1.PersistentVolume
+	for name, entry := range entries {
+		pvs = append(pvs, entry.persistentVolume(name))
+	}
+	return pvs, nil
+}
+
+// sync removes restored volumes from the trash and deletes expired ones.
+func (t *Trash) sync(ctx context.Context) error {
+	configMap, entries, err := t.entries(ctx)
+	if err != nil {
+		return err
+	}
+	if configMap == nil {
+		TrashVolumes.Set(0)
+		return nil
+	}
+	TrashVolumes.Set(float64(len(configMap.Data)))
+
+	inUse, err := t.volumesInUse()
+	if err != nil {
+		return err
+	}
+	now := t.now()
+	var removed []string
+	for name, entry := range entries {
+		if restored(entry, inUse) {
+			klog.Infof("Trash: volume of PV %s was restored", name)
+			t.eventRecorder.Eventf(configMap, v1.EventTypeNormal, "VolumeRestored", "Volume %s of PV %s was restored by a new PersistentVolume", entry.VolumeHandle, name)
+			TrashOperationsTotal.WithLabelValues(trashOperationRestored).Inc()
+			removed = append(removed, name)
+			continue
+		}
+		if now.Before(entry.DeleteAfter.Time) || t.deleteVolume == nil {
+			continue
+		}
+		if err := t.deleteVolume(ctx, entry.persistentVolume(name), entry.Migrated); err != nil {
+			klog.Warningf("Trash: deleting volume of PV %s failed: %v", name, err)
+			t.eventRecorder.Eventf(configMap, v1.EventTypeWarning, "VolumeDeletionFailed", "Deleting volume of PV %s failed: %v", name, err)
+			TrashOperationsTotal.WithLabelValues(trashOperationDeletionFailed).Inc()
+			continue
+		}
+		klog.Infof("Trash: deleted volume of PV %s", name)
+		t.eventRecorder.Eventf(configMap, v1.EventTypeNormal, "VolumeDeleted", "Deleted volume of PV %s, its retention expired at %s", name, entry.DeleteAfter.Format(time.RFC3339))
+		TrashOperationsTotal.WithLabelValues(trashOperationDeleted).Inc()
+		removed = append(removed, name)
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+	return t.update(ctx, func(data map[string]string) {
+		for _, name := range removed {
+			delete(data, name)
+		}
+	})
+}
+
+// trashVolumeKey identifies a CSI volume.
+type trashVolumeKey struct {
+	driver, handle string
+}
+
+// volumesInUse returns the UIDs of the PVs of each CSI volume.
+func (t *Trash) volumesInUse() (map[trashVolumeKey][]types.UID, error) {
+	pvs, err := t.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list persistentvolumes: %v", err)
+	}
+	inUse := map[trashVolumeKey][]types.UID{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil {
+			continue
+		}
+		key := trashVolumeKey{driver: pv.Spec.CSI.Driver, handle: pv.Spec.CSI.VolumeHandle}
+		inUse[key] = append(inUse[key], pv.UID)
+	}
+	return inUse, nil
+}
+
+// restored returns true if some other PV than the trashed one uses its
+// volume.
+func restored(entry *trashEntry, inUse map[trashVolumeKey][]types.UID) bool {
+	for _, uid := range inUse[trashVolumeKey{driver: entry.Driver, handle: entry.VolumeHandle}] {
+		if uid != entry.UID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+func TestTrash(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	storageClass := func(name, retention string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			Provisioner: driverName,
+			Parameters:  map[string]string{prefixedTrashRetentionKey: retention},
+		}
+	}
+	trashedPV := func(name, class string) *v1.PersistentVolume {
+		pv := newTestPV(name, "fake-ns", class, "")
+		pv.UID = types.UID("uid-" + name)
+		return pv
+	}
+
+	clientSet := fakeclientset.NewSimpleClientset(storageClass("trash", "1h"), storageClass("invalid", "forever"))
+	scLister, _, _, _, _, stopChan := listers(clientSet)
+	defer close(stopChan)
+	informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+	pvInformer := informerFactory.Core().V1().PersistentVolumes()
+	trash := NewTrash(clientSet, "kube-system", "trash", pvInformer, time.Minute)
+	now := time.Now()
+	trash.now = func() time.Time { return now }
+
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithTrash(trash))
+
+	ctx := context.Background()
+	if err := provisioner.Delete(ctx, trashedPV("pv-invalid", "invalid")); err == nil {
+		t.Error("expected error for invalid retention")
+	}
+	for _, name := range []string{"pv-1", "pv-2"} {
+		if err := provisioner.Delete(ctx, trashedPV(name, "trash")); err != nil {
+			t.Fatalf("unexpected error trashing %s: %v", name, err)
+		}
+	}
+	if volumes := testutil.ToFloat64(TrashVolumes); volumes != 2 {
+		t.Errorf("expected 2 volumes in trash, got %v", volumes)
+	}
+
+	// Deleting a PV again keeps the original retention.
+	now = now.Add(30 * time.Minute)
+	if err := provisioner.Delete(ctx, trashedPV("pv-1", "trash")); err != nil {
+		t.Fatalf("unexpected error trashing pv-1 again: %v", err)
+	}
+
+	// pv-2 gets restored by a new PV for the same volume.
+	restoredPV := trashedPV("pv-restored", "")
+	restoredPV.Spec.CSI.VolumeHandle = "pv-2"
+	pvInformer.Informer().GetStore().Add(restoredPV)
+
+	// Only pv-1 gets deleted because its original retention has expired.
+	now = now.Add(45 * time.Minute)
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), &csi.DeleteVolumeRequest{VolumeId: "pv-1"}).
+		Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+	if err := trash.sync(ctx); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+
+	configMap, err := clientSet.CoreV1().ConfigMaps("kube-system").Get(ctx, "trash", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMap.Data) != 0 {
+		t.Errorf("expected empty trash, got %v", configMap.Data)
+	}
+	if volumes := testutil.ToFloat64(TrashVolumes); volumes != 0 {
+		t.Errorf("expected no volumes in trash, got %v", volumes)
+	}
+}
+
+func TestTrashRetentionExpiry(t *testing.T) {
+	clientSet := fakeclientset.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+	trash := NewTrash(clientSet, "kube-system", "trash", informerFactory.Core().V1().PersistentVolumes(), time.Minute)
+	trash.eventRecorder = &record.FakeRecorder{}
+	now := time.Now()
+	trash.now = func() time.Time { return now }
+	var deleted []string
+	trash.deleteVolume = func(ctx context.Context, volume *v1.PersistentVolume, migrated bool) error {
+		deleted = append(deleted, volume.Name)
+		return nil
+	}
+
+	ctx := context.Background()
+	pv := newTestPV("volume-1", "fake-ns", "", "")
+	if err := trash.add(ctx, pv, false, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, elapsed := range []time.Duration{59 * time.Minute, time.Minute} {
+		now = now.Add(elapsed)
+		if err := trash.sync(ctx); err != nil {
+			t.Fatalf("unexpected sync error: %v", err)
+		}
+	}
+	if len(deleted) != 1 || deleted[0] != pv.Name {
+		t.Errorf("expected %s to be deleted once after its retention, got %v", pv.Name, deleted)
+	}
+	volumes, err := trash.volumes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 0 {
+		t.Errorf("expected empty trash, got %d volumes", len(volumes))
+	}
+}
+
+func TestTrashEntry(t *testing.T) {
+	pv := newTestPV("volume-1", "default", "trash", "10Gi")
+	pv.UID = "uid-1"
+	pv.Spec.CSI.VolumeAttributes = map[string]string{"large": strings.Repeat("x", 1000)}
+	pv.Annotations = map[string]string{
+		annDeletionProvisionerSecretRefName:      "secret",
+		annDeletionProvisionerSecretRefNamespace: "default",
+		"unrelated":                              "value",
+	}
+	deleteAfter := metav1.NewTime(time.Now().Truncate(time.Second))
+
+	value, err := json.Marshal(newTrashEntry(pv, true, deleteAfter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(value), "large") || strings.Contains(string(value), "unrelated") {
+		t.Errorf("expected only the fields needed for deletion, got %s", value)
+	}
+	entry := &trashEntry{}
+	if err := json.Unmarshal(value, entry); err != nil {
+		t.Fatal(err)
+	}
+	if !entry.Migrated || !entry.DeleteAfter.Equal(&deleteAfter) {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	expected := pv.DeepCopy()
+	expected.Spec.CSI.VolumeAttributes = nil
+	expected.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+	delete(expected.Annotations, "unrelated")
+	if restored := entry.persistentVolume(pv.Name); !equality.Semantic.DeepEqual(restored, expected) {
+		t.Errorf("expected PV %+v, got %+v", expected, restored)
+	}
+}
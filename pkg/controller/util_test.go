@@ -7,6 +7,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 	gatewayv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 )
 
@@ -15,6 +16,44 @@ func ObjectNamePtr(val string) *gatewayv1beta1.ObjectName {
 	return &objectName
 }
 
+// newTestPV returns a PV of the test driver whose volume handle is its
+// name. The claim reference to claim-<name> and the capacity are only set
+// when namespace and capacity are not empty.
+func newTestPV(name, namespace, storageClass, capacity string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: name},
+			},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			StorageClassName:              storageClass,
+		},
+	}
+	if namespace != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: namespace, Name: "claim-" + name}
+	}
+	if capacity != "" {
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)}
+	}
+	return pv
+}
+
+// recordRequeued returns the keys of the PVCs and PVs which get put into
+// the work queues again through the informers.
+func recordRequeued(informers ...*RequeueInformer) *[]string {
+	var keys []string
+	for _, informer := range informers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				key, _ := cache.MetaNamespaceKeyFunc(newObj)
+				keys = append(keys, key)
+			},
+		})
+	}
+	return &keys
+}
+
 // generateReferenceGrant returns a new ReferenceGrant with given attributes
 func generateReferenceGrant(namespace string, referenceGrantFrom []gatewayv1beta1.ReferenceGrantFrom, referenceGrantTo []gatewayv1beta1.ReferenceGrantTo) *gatewayv1beta1.ReferenceGrant {
 	return &gatewayv1beta1.ReferenceGrant{
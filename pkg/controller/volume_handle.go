@@ -0,0 +1,80 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Volume handles which embed a cluster ID have the format
+// k8s-cluster:<cluster ID>:<volume ID>. Handles without this prefix are
+// the plain volume ID, which is also what all PVs provisioned without
+// encoding contain.
+const encodedVolumeHandlePrefix = "k8s-cluster:"
+
+// ValidateClusterID checks that the ID can be embedded in volume handles.
+// An empty ID is valid and disables the encoding.
+func ValidateClusterID(clusterID string) error {
+	if clusterID == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(clusterID); len(errs) > 0 {
+		return fmt.Errorf("invalid cluster ID %q: %s", clusterID, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// encodeVolumeHandle embeds the cluster ID in the volume handle.
+// An empty cluster ID returns the volume ID unchanged.
+func encodeVolumeHandle(clusterID, volumeID string) string {
+	if clusterID == "" {
+		return volumeID
+	}
+	return encodedVolumeHandlePrefix + clusterID + ":" + volumeID
+}
+
+// decodeVolumeHandle splits a volume handle into the cluster ID and the
+// volume ID. The cluster ID is empty for handles without encoding.
+func decodeVolumeHandle(handle string) (clusterID, volumeID string) {
+	rest, ok := strings.CutPrefix(handle, encodedVolumeHandlePrefix)
+	if !ok {
+		return "", handle
+	}
+	clusterID, volumeID, ok = strings.Cut(rest, ":")
+	if !ok {
+		return "", handle
+	}
+	return clusterID, volumeID
+}
+
+// volumeIdToHandle returns the volume handle for a new PV.
+func (p *csiProvisioner) volumeIdToHandle(id string) string {
+	return encodeVolumeHandle(p.volumeHandleClusterID, id)
+}
+
+// volumeHandleToId returns the volume ID for a volume handle. It fails for
+// volumes which were provisioned by some other cluster.
+func (p *csiProvisioner) volumeHandleToId(handle string) (string, error) {
+	clusterID, id := decodeVolumeHandle(handle)
+	if clusterID != "" && clusterID != p.volumeHandleClusterID {
+		return "", fmt.Errorf("volume handle %q belongs to cluster %q, not to this cluster %q", handle, clusterID, p.volumeHandleClusterID)
+	}
+	return id, nil
+}
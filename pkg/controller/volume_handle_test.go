@@ -0,0 +1,164 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	storagev1 "k8s.io/api/storage/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestVolumeHandleEncoding(t *testing.T) {
+	testcases := map[string]struct {
+		clusterID      string
+		volumeID       string
+		expectedHandle string
+	}{
+		"no cluster ID": {
+			volumeID:       "vol-1",
+			expectedHandle: "vol-1",
+		},
+		"cluster ID": {
+			clusterID:      "cluster-a",
+			volumeID:       "vol-1",
+			expectedHandle: "k8s-cluster:cluster-a:vol-1",
+		},
+		"volume ID with separators": {
+			clusterID:      "cluster-a",
+			volumeID:       "pool:vol/1",
+			expectedHandle: "k8s-cluster:cluster-a:pool:vol/1",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			handle := encodeVolumeHandle(tc.clusterID, tc.volumeID)
+			if handle != tc.expectedHandle {
+				t.Errorf("expected handle %q, got %q", tc.expectedHandle, handle)
+			}
+			clusterID, volumeID := decodeVolumeHandle(handle)
+			if clusterID != tc.clusterID || volumeID != tc.volumeID {
+				t.Errorf("expected cluster ID %q and volume ID %q, got %q and %q", tc.clusterID, tc.volumeID, clusterID, volumeID)
+			}
+		})
+	}
+}
+
+func TestVolumeHandleToId(t *testing.T) {
+	testcases := map[string]struct {
+		clusterID  string
+		handle     string
+		expectedID string
+		expectErr  bool
+	}{
+		"unencoded": {
+			clusterID:  "cluster-a",
+			handle:     "vol-1",
+			expectedID: "vol-1",
+		},
+		"own cluster": {
+			clusterID:  "cluster-a",
+			handle:     "k8s-cluster:cluster-a:vol-1",
+			expectedID: "vol-1",
+		},
+		"other cluster": {
+			clusterID: "cluster-a",
+			handle:    "k8s-cluster:cluster-b:vol-1",
+			expectErr: true,
+		},
+		"encoded without cluster ID": {
+			handle:    "k8s-cluster:cluster-b:vol-1",
+			expectErr: true,
+		},
+		"incomplete prefix": {
+			handle:     "k8s-cluster:vol-1",
+			expectedID: "k8s-cluster:vol-1",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			p := &csiProvisioner{volumeHandleClusterID: tc.clusterID}
+			id, err := p.volumeHandleToId(tc.handle)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got volume ID %q", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id != tc.expectedID {
+				t.Errorf("expected volume ID %q, got %q", tc.expectedID, id)
+			}
+		})
+	}
+}
+
+func TestValidateClusterID(t *testing.T) {
+	for clusterID, expectErr := range map[string]bool{
+		"":          false,
+		"cluster-a": false,
+		"Cluster":   true,
+		"a:b":       true,
+	} {
+		if err := ValidateClusterID(clusterID); (err != nil) != expectErr {
+			t.Errorf("cluster ID %q: expected error %v, got %v", clusterID, expectErr, err)
+		}
+	}
+}
+
+func TestProvisionWithVolumeHandleClusterID(t *testing.T) {
+	const requestBytes = 100
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithVolumeHandleClusterID("cluster-a"))
+
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{VolumeId: "test-volume-id", CapacityBytes: requestBytes},
+	}, nil).Times(1)
+
+	pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVC:          createFakePVC(requestBytes),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "k8s-cluster:cluster-a:test-volume-id"; pv.Spec.CSI.VolumeHandle != expected {
+		t.Errorf("expected volume handle %q, got %q", expected, pv.Spec.CSI.VolumeHandle)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	// Storage class parameter which overrides the volume name template
+	// from the command line.
+	prefixedVolumeNameTemplateKey = csiParameterPrefix + "volume-name-template"
+
+	// Annotation on PVs with the name of the volume that was passed to
+	// CreateVolume, if it differs from the PV name.
+	annVolumeName = "provisioner.storage.kubernetes.io/volume-name"
+
+	// PVVolumeNameIndex is the name of the PersistentVolume informer index
+	// which is created by PVVolumeNameIndexFunc.
+	PVVolumeNameIndex = "volumename"
+
+	tokenPVCUIDKey             = "pvc.uid"
+	tokenPVCUIDHashKey         = "pvc.uidhash"
+	tokenStatefulSetOrdinalKey = "statefulset.ordinal"
+)
+
+// statefulSetOrdinal matches the ordinal at the end of the names of PVCs
+// created for a StatefulSet (<volume claim template>-<statefulset>-<ordinal>).
+var statefulSetOrdinal = regexp.MustCompile(`-([0-9]+)$`)
+
+// volumeName returns the name of the volume for CreateVolume. Without a
+// template, it is the same as the PV name.
+//
+// supported tokens:
+// - ${pv.name}
+// - ${pvc.namespace}
+// - ${pvc.name}
+// - ${pvc.uid}
+// - ${pvc.uidhash} (8 hex characters)
+// - ${statefulset.ordinal} (only for PVC names ending in -<number>)
+//
+// Only immutable fields of the PVC are supported, so the name stays the same
+// when CreateVolume gets retried. Names which are longer than the maximum
+// length get truncated and a hash of the full name gets appended.
+func (p *csiProvisioner) volumeName(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, pvName string) (string, error) {
+	template := p.volumeNameTemplate
+	if value, ok := sc.Parameters[prefixedVolumeNameTemplateKey]; ok {
+		template = value
+	}
+	if template == "" {
+		return pvName, nil
+	}
+
+	params := map[string]string{
+		tokenPVNameKey:       pvName,
+		tokenPVCNameKey:      claim.Name,
+		tokenPVCNameSpaceKey: claim.Namespace,
+		tokenPVCUIDKey:       string(claim.UID),
+		tokenPVCUIDHashKey:   nameHash(string(claim.UID)),
+	}
+	if match := statefulSetOrdinal.FindStringSubmatch(claim.Name); match != nil {
+		params[tokenStatefulSetOrdinalKey] = match[1]
+	}
+	name, err := resolveTemplate(template, params)
+	if err != nil {
+		return "", fmt.Errorf("error resolving volume name template %q: %v", template, err)
+	}
+	if name == "" {
+		return "", fmt.Errorf("volume name template %q resolved to an empty name", template)
+	}
+	return truncateVolumeName(name, p.volumeNameMaxLength), nil
+}
+
+// ValidateVolumeNameTemplate checks that a volume name template only
+// contains supported tokens.
+func ValidateVolumeNameTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	p := &csiProvisioner{volumeNameTemplate: template}
+	claim := &v1.PersistentVolumeClaim{}
+	claim.Name = "claim-0"
+	claim.Namespace = "default"
+	claim.UID = "00000000-0000-0000-0000-000000000000"
+	_, err := p.volumeName(claim, &storagev1.StorageClass{}, "pv")
+	return err
+}
+
+// truncateVolumeName shortens names which are longer than maxLength by
+// replacing the end with a hash of the full name. A maxLength <= 0
+// disables the check.
+func truncateVolumeName(name string, maxLength int) string {
+	if maxLength <= 0 || len(name) <= maxLength {
+		return name
+	}
+	hash := nameHash(name)
+	prefixLength := maxLength - len(hash) - 1
+	if prefixLength <= 0 {
+		// No space left for a part of the name.
+		if maxLength < len(hash) {
+			return hash[:maxLength]
+		}
+		return hash
+	}
+	return name[:prefixLength] + "-" + hash
+}
+
+// nameHash calculates the hexadecimal representation (8-chars)
+// of the hash of the passed in string using the FNV-a algorithm.
+func nameHash(s string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(s))
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// PVVolumeNameIndexFunc returns an index function which indexes the PVs
+// of the driver by the name of their volume, see PVVolumeNameIndex.
+func PVVolumeNameIndexFunc(driverName string) cache.IndexFunc {
+	return func(obj interface{}) ([]string, error) {
+		pv, ok := obj.(*v1.PersistentVolume)
+		if !ok {
+			return nil, fmt.Errorf("expected PersistentVolume, got %T", obj)
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			return nil, nil
+		}
+		if name, ok := pv.Annotations[annVolumeName]; ok {
+			return []string{name}, nil
+		}
+		// PVs without the annotation were created with the PV name as
+		// volume name.
+		return []string{pv.Name}, nil
+	}
+}
+
+// volumeNameReservation is a volume name which is used by a provisioning
+// operation whose PV does not exist yet.
+type volumeNameReservation struct {
+	pvName string
+	claim  string // <namespace>/<name>
+	// inFlight is true while Provision runs for the PV.
+	inFlight bool
+}
+
+// volumeNameReservations prevents that two PVCs which get provisioned at
+// the same time resolve to the same volume name. CreateVolume is
+// idempotent, so both would get the same volume. Only names of PVCs whose
+// provisioning is running or continues in the background are held, names of
+// provisioned volumes are protected by their PV.
+type volumeNameReservations struct {
+	mutex sync.Mutex
+	names map[string]*volumeNameReservation // by volume name
+}
+
+// reserveVolumeName returns an error if some other PV or some other PVC
+// which is being provisioned already uses the volume name. Otherwise the
+// name gets reserved for the PVC.
+func (p *csiProvisioner) reserveVolumeName(claim *v1.PersistentVolumeClaim, volumeName, pvName string) error {
+	r := p.volumeNames
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, reservation := range r.names {
+		if !reservation.inFlight && p.reservationObsolete(reservation) {
+			delete(r.names, name)
+		}
+	}
+	if reservation, ok := r.names[volumeName]; ok && reservation.pvName != pvName {
+		return fmt.Errorf("volume name %q is already used by PVC %s, which is being provisioned", volumeName, reservation.claim)
+	}
+	if err := p.checkVolumeNameCollision(volumeName, pvName); err != nil {
+		return err
+	}
+	r.names[volumeName] = &volumeNameReservation{
+		pvName:   pvName,
+		claim:    claim.Namespace + "/" + claim.Name,
+		inFlight: true,
+	}
+	return nil
+}
+
+// finishVolumeName ends the provisioning operation for the PV. The name gets
+// released unless provisioning continues in the background. Once the volume
+// is provisioned, checkVolumeNameCollision finds its PV instead. A name that
+// stays reserved gets released when the PV shows up or the PVC is gone.
+func (p *csiProvisioner) finishVolumeName(volumeName, pvName string, provisioned bool, state controller.ProvisioningState) {
+	r := p.volumeNames
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	reservation, ok := r.names[volumeName]
+	if !ok || reservation.pvName != pvName {
+		return
+	}
+	if !provisioned && state == controller.ProvisioningInBackground {
+		reservation.inFlight = false
+		return
+	}
+	delete(r.names, volumeName)
+}
+
+// reservationObsolete returns true if the PV of the reservation exists,
+// then checkVolumeNameCollision takes over, or if its PVC was deleted. PVCs
+// are only checked when there is a claim lister.
+func (p *csiProvisioner) reservationObsolete(reservation *volumeNameReservation) bool {
+	if p.pvLister != nil {
+		if _, err := p.pvLister.Get(reservation.pvName); err == nil {
+			return true
+		}
+	}
+	if p.claimLister != nil {
+		namespace, name, _ := strings.Cut(reservation.claim, "/")
+		if _, err := p.claimLister.PersistentVolumeClaims(namespace).Get(name); apierrors.IsNotFound(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVolumeNameCollision returns an error if some other PV already uses
+// the volume name. Volumes whose PV was deleted while the volume was retained
+// cannot be detected. It needs the PV indexer.
+func (p *csiProvisioner) checkVolumeNameCollision(volumeName, pvName string) error {
+	if p.pvIndexer == nil {
+		return nil
+	}
+	objs, err := p.pvIndexer.ByIndex(PVVolumeNameIndex, volumeName)
+	if err != nil {
+		return fmt.Errorf("failed to look up persistentvolumes by volume name: %v", err)
+	}
+	for _, obj := range objs {
+		if pv, ok := obj.(*v1.PersistentVolume); ok && pv.Name != pvName {
+			return fmt.Errorf("volume name %q is already used by persistentvolume %s", volumeName, pv.Name)
+		}
+	}
+	return nil
+}
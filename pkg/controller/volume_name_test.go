@@ -0,0 +1,325 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestVolumeName(t *testing.T) {
+	claim := createFakeNamedPVC(100, "data-web-12", nil)
+	uidHash := nameHash(string(claim.UID))
+
+	testcases := map[string]struct {
+		template     string
+		scParameters map[string]string
+		maxLength    int
+		expectedName string
+		expectErr    bool
+	}{
+		"no template": {
+			expectedName: "pvc-1234",
+		},
+		"all tokens": {
+			template:     "${pvc.namespace}-${pvc.name}-${pvc.uid}-${pvc.uidhash}-${statefulset.ordinal}-${pv.name}",
+			expectedName: "fake-ns-data-web-12-testid-" + uidHash + "-12-pvc-1234",
+		},
+		"storage class overrides flag": {
+			template:     "${pvc.name}",
+			scParameters: map[string]string{prefixedVolumeNameTemplateKey: "vol-${pvc.uidhash}"},
+			expectedName: "vol-" + uidHash,
+		},
+		"storage class disables flag": {
+			template:     "${pvc.name}",
+			scParameters: map[string]string{prefixedVolumeNameTemplateKey: ""},
+			expectedName: "pvc-1234",
+		},
+		"truncated": {
+			template:     "${pvc.namespace}-${pvc.name}",
+			maxLength:    12,
+			expectedName: "fak-" + nameHash("fake-ns-data-web-12"),
+		},
+		"unknown token": {
+			template:  "${pvc.annotations['foo']}",
+			expectErr: true,
+		},
+		"empty name": {
+			template:  "${}",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			p := &csiProvisioner{
+				volumeNameTemplate:  tc.template,
+				volumeNameMaxLength: tc.maxLength,
+			}
+			actual, err := p.volumeName(claim, &storagev1.StorageClass{Parameters: tc.scParameters}, "pvc-1234")
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got name %q", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != tc.expectedName {
+				t.Errorf("expected name %q, got %q", tc.expectedName, actual)
+			}
+		})
+	}
+}
+
+func TestVolumeNameStatefulSetOrdinal(t *testing.T) {
+	p := &csiProvisioner{volumeNameTemplate: "db-${statefulset.ordinal}"}
+	if _, err := p.volumeName(createFakeNamedPVC(100, "data", nil), &storagev1.StorageClass{}, "pvc-1234"); err == nil {
+		t.Error("expected error for PVC name without ordinal")
+	}
+}
+
+func TestTruncateVolumeName(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	for _, maxLength := range []int{0, 5, 9, 10, 128} {
+		actual := truncateVolumeName(long, maxLength)
+		if maxLength == 0 {
+			if actual != long {
+				t.Errorf("max length 0: expected name to be unchanged, got %q", actual)
+			}
+			continue
+		}
+		if len(actual) > maxLength {
+			t.Errorf("max length %d: got name %q with length %d", maxLength, actual, len(actual))
+		}
+		if other := truncateVolumeName(long+"b", maxLength); other == actual {
+			t.Errorf("max length %d: different names truncated to the same %q", maxLength, actual)
+		}
+	}
+	if actual := truncateVolumeName("short", 10); actual != "short" {
+		t.Errorf("expected short name to be unchanged, got %q", actual)
+	}
+}
+
+func TestValidateVolumeNameTemplate(t *testing.T) {
+	for template, expectErr := range map[string]bool{
+		"":                                  false,
+		"${pvc.namespace}-${pvc.uidhash}":   false,
+		"${statefulset.ordinal}":            false,
+		"${pvc.labels['app']}":              true,
+		"${pvc.namespace}-${no.such.token}": true,
+	} {
+		if err := ValidateVolumeNameTemplate(template); (err != nil) != expectErr {
+			t.Errorf("template %q: expected error %v, got %v", template, expectErr, err)
+		}
+	}
+}
+
+func TestCheckVolumeNameCollision(t *testing.T) {
+	annotatedPV := newTestPV("volume-1", "", "", "")
+	annotatedPV.Annotations = map[string]string{annVolumeName: "fake-ns-data"}
+	plainPV := newTestPV("volume-2", "", "", "")
+	otherDriverPV := newTestPV("volume-3", "", "", "")
+	otherDriverPV.Annotations = map[string]string{annVolumeName: "other-data"}
+	otherDriverPV.Spec.CSI.Driver = "other-driver"
+
+	testcases := map[string]struct {
+		volumeName string
+		pvName     string
+		expectErr  bool
+	}{
+		"unused": {
+			volumeName: "fake-ns-other",
+			pvName:     "pvc-1234",
+		},
+		"used by annotation": {
+			volumeName: "fake-ns-data",
+			pvName:     "pvc-1234",
+			expectErr:  true,
+		},
+		"used by PV name": {
+			volumeName: plainPV.Name,
+			pvName:     "pvc-1234",
+			expectErr:  true,
+		},
+		"own PV": {
+			volumeName: "fake-ns-data",
+			pvName:     annotatedPV.Name,
+		},
+		"other driver": {
+			volumeName: "other-data",
+			pvName:     "pvc-1234",
+		},
+	}
+
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{PVVolumeNameIndex: PVVolumeNameIndexFunc(driverName)})
+	for _, pv := range []*v1.PersistentVolume{annotatedPV, plainPV, otherDriverPV} {
+		pvIndexer.Add(pv)
+	}
+	p := &csiProvisioner{driverName: driverName, pvIndexer: pvIndexer}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := p.checkVolumeNameCollision(tc.volumeName, tc.pvName)
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestReserveVolumeName(t *testing.T) {
+	claimIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{PVVolumeNameIndex: PVVolumeNameIndexFunc(driverName)})
+	p := &csiProvisioner{
+		driverName:  driverName,
+		claimLister: corelisters.NewPersistentVolumeClaimLister(claimIndexer),
+		pvLister:    corelisters.NewPersistentVolumeLister(pvIndexer),
+		pvIndexer:   pvIndexer,
+		volumeNames: &volumeNameReservations{names: map[string]*volumeNameReservation{}},
+	}
+	claim := func(namespace string) *v1.PersistentVolumeClaim {
+		claim := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: namespace}}
+		claimIndexer.Add(claim)
+		return claim
+	}
+	claimA, claimB := claim("ns-a"), claim("ns-b")
+
+	// Both PVCs resolve to the same name, e.g. with ${pvc.name}.
+	if err := p.reserveVolumeName(claimA, "data", "pvc-a"); err != nil {
+		t.Fatalf("unexpected error for first PVC: %v", err)
+	}
+	if err := p.reserveVolumeName(claimB, "data", "pvc-b"); err == nil {
+		t.Fatal("expected error while first PVC is provisioned")
+	}
+	// Retries of the first PVC are fine.
+	if err := p.reserveVolumeName(claimA, "data", "pvc-a"); err != nil {
+		t.Fatalf("unexpected error for retry: %v", err)
+	}
+
+	// The name stays reserved while provisioning continues in the
+	// background.
+	p.finishVolumeName("data", "pvc-a", false, controller.ProvisioningInBackground)
+	if err := p.reserveVolumeName(claimB, "data", "pvc-b"); err == nil {
+		t.Fatal("expected error while the first PVC is provisioned in the background")
+	}
+
+	// The PV takes over.
+	pv := newTestPV("pvc-a", "", "", "")
+	pv.Annotations = map[string]string{annVolumeName: "data"}
+	pvIndexer.Add(pv)
+	if err := p.reserveVolumeName(claimB, "data", "pvc-b"); err == nil || !strings.Contains(err.Error(), "persistentvolume pvc-a") {
+		t.Fatalf("expected collision with PV, got %v", err)
+	}
+
+	// The name is free again once the first PVC and its PV are gone.
+	pvIndexer.Delete(pv)
+	p.volumeNames.names["data"] = &volumeNameReservation{pvName: "pvc-a", claim: "ns-a/data"}
+	claimIndexer.Delete(claimA)
+	if err := p.reserveVolumeName(claimB, "data", "pvc-b"); err != nil {
+		t.Fatalf("unexpected error after first PVC is gone: %v", err)
+	}
+
+	// Finished operations release the name, the PV protects it after
+	// provisioning.
+	for _, state := range []controller.ProvisioningState{controller.ProvisioningFinished, controller.ProvisioningNoChange} {
+		for _, provisioned := range []bool{true, false} {
+			if err := p.reserveVolumeName(claimB, "data", "pvc-b"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			p.finishVolumeName("data", "pvc-b", provisioned, state)
+			if len(p.volumeNames.names) != 0 {
+				t.Errorf("expected no reservations after provisioned=%v, state %s, got %v", provisioned, state, p.volumeNames.names)
+			}
+		}
+	}
+}
+
+func TestProvisionWithVolumeNameTemplate(t *testing.T) {
+	const requestBytes = 100
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	claim := createFakeNamedPVC(requestBytes, "data", nil)
+	expectedVolumeName := "fake-ns-data-" + nameHash(string(claim.UID))
+	existingPV := newTestPV("volume-1", "", "", "")
+	existingPV.Annotations = map[string]string{annVolumeName: expectedVolumeName}
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{PVVolumeNameIndex: PVVolumeNameIndexFunc(driverName)})
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false, WithVolumeNameTemplate("${pvc.namespace}-${pvc.name}-${pvc.uidhash}", 128), WithPVIndexer(pvIndexer))
+
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+			if req.Name != expectedVolumeName {
+				t.Errorf("expected volume name %q, got %q", expectedVolumeName, req.Name)
+			}
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{VolumeId: "test-volume-id", CapacityBytes: requestBytes},
+			}, nil
+		}).Times(1)
+
+	pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVC:          claim,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pv.Name != "test-testi" {
+		t.Errorf("expected PV name test-testi, got %q", pv.Name)
+	}
+	if pv.Annotations[annVolumeName] != expectedVolumeName {
+		t.Errorf("expected annotation %s=%s, got %v", annVolumeName, expectedVolumeName, pv.Annotations)
+	}
+
+	// Another PV already uses the volume name.
+	pvIndexer.Add(existingPV)
+	_, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVC:          claim,
+	})
+	if err == nil {
+		t.Fatal("expected error for volume name collision, got none")
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected state %s, got %s", controller.ProvisioningFinished, state)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSetupStdout(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(ctx, Options{
+		Exporter:      ExporterStdout,
+		File:          file,
+		SamplingRatio: 1,
+		ServiceName:   "csi-provisioner",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spanCtx, span := Start(ctx, "Provision")
+	traceID := TraceID(spanCtx)
+	if traceID == "" {
+		t.Fatal("expected sampled trace")
+	}
+	grpcCtx, grpcSpan := StartGRPC(metadata.AppendToOutgoingContext(spanCtx, "foo", "bar"), "CreateVolume")
+	md, _ := metadata.FromOutgoingContext(grpcCtx)
+	if values := md.Get("traceparent"); len(values) != 1 || !strings.Contains(values[0], traceID) {
+		t.Errorf("expected traceparent with trace ID %s, got %v", traceID, values)
+	}
+	if values := md.Get("foo"); len(values) != 1 || values[0] != "bar" {
+		t.Errorf("expected existing metadata to be kept, got %v", md)
+	}
+	End(grpcSpan, errors.New("fake error"))
+	End(span, nil)
+
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error during shutdown: %v", err)
+	}
+	output, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{traceID, `"Name":"Provision"`, `"Name":"csi.CreateVolume"`, "fake error", "csi-provisioner"} {
+		if !strings.Contains(string(output), expected) {
+			t.Errorf("expected %q in output:\n%s", expected, output)
+		}
+	}
+}
+
+func TestSetupInvalidExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Options{Exporter: "jaeger"}); err == nil {
+		t.Error("expected error for unknown exporter")
+	}
+}
+
+func TestTraceIDNotSampled(t *testing.T) {
+	if traceID := TraceID(context.Background()); traceID != "" {
+		t.Errorf("expected no trace ID without span, got %s", traceID)
+	}
+}